@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -28,13 +29,23 @@ func TestFiles(t *testing.T) {
 		if err != nil {
 			panic(err)
 		}
-		l := lang.NewLexer(strings.TrimSpace(string(f)))
-		p := lang.NewParser(&l)
-		prog := p.Parse()
-		ev := lang.NewEvaluator(&prog, &l, false)
-		result := cli.Test(&ev, false)
-		if !result {
-			t.Error(fileName)
+
+		// every file runs on both the tree-walker and the vm
+		for _, vm := range []bool{false, true} {
+			c, errs := lang.Compile(strings.TrimSpace(string(f)))
+			if len(errs) > 0 {
+				t.Fatalf("%s: %s on line %d", fileName, errs[0].Msg, errs[0].Line)
+			}
+			ev := c.NewEvaluator(lang.WithOutput(io.Discard))
+			if vm {
+				for _, note := range ev.EnableVM() {
+					t.Logf("%s: %s", fileName, note)
+				}
+			}
+			result := cli.Test(ev)
+			if !result {
+				t.Errorf("%s (vm: %v)", fileName, vm)
+			}
 		}
 	}
 }
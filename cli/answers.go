@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	lang "github.com/alligator/advent-of-code-2021-lang/src"
+)
+
+// answersPath is the file --record writes a program's answers to, day7.aoc's
+// are in day7.answers
+func answersPath(program string) string {
+	return strings.TrimSuffix(program, filepath.Ext(program)) + ".answers"
+}
+
+// answers are the recorded reprs of each part's value, by part
+type answers map[string]string
+
+// The answers file has each part's name and how many lines its repr takes,
+// then the repr: a multi-line string comes back exactly as it was.
+//
+//	part1 1
+//	5934
+//	part2 2
+//	'#.#
+//	.#.'
+func readAnswers(path string) (answers, error) {
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(f), "\n"), "\n")
+	recorded := make(answers)
+	for i := 0; i < len(lines); i++ {
+		if lines[i] == "" || strings.HasPrefix(lines[i], "#") {
+			continue
+		}
+		fields := strings.Fields(lines[i])
+		n := 0
+		if len(fields) == 2 {
+			n, err = strconv.Atoi(fields[1])
+		}
+		if len(fields) != 2 || err != nil || n < 1 || i+n >= len(lines) {
+			return nil, fmt.Errorf("%s:%d: expected a part name and a number of lines", path, i+1)
+		}
+		recorded[fields[0]] = strings.Join(lines[i+1:i+1+n], "\n")
+		i += n
+	}
+	return recorded, nil
+}
+
+func writeAnswers(path string, recorded answers) error {
+	parts := make([]string, 0, len(recorded))
+	for part := range recorded {
+		parts = append(parts, part)
+	}
+	sort.Strings(parts)
+
+	var b strings.Builder
+	b.WriteString("# written by aoc --record, checked by aoc --check-answers\n")
+	for _, part := range parts {
+		repr := recorded[part]
+		fmt.Fprintf(&b, "%s %d\n%s\n", part, strings.Count(repr, "\n")+1, repr)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
+
+// record runs the parts on the real input like run does and saves their
+// answers. Answers already recorded for other parts are kept.
+func record(ev *lang.Evaluator, parts []string, path string) error {
+	recorded, err := readAnswers(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		recorded, err = make(answers), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	readInput(ev, "file")
+	for _, part := range parts {
+		v := evalSection(ev, part)
+		fmt.Printf("%s: %s\n", part, v.Repr())
+		recorded[part] = v.Repr()
+	}
+	if err := writeAnswers(path, recorded); err != nil {
+		return err
+	}
+	fmt.Printf("recorded to %s\n", path)
+	return nil
+}
+
+// checkAnswers runs the parts on the real input and compares their answers
+// to the recorded ones, printing a summary like testParts. Parts without a
+// recorded answer are skipped.
+func checkAnswers(ev *lang.Evaluator, parts []string, path string) (bool, error) {
+	recorded, err := readAnswers(path)
+	if err != nil {
+		return false, err
+	}
+
+	passed, failed, skipped := 0, 0, 0
+	readInput(ev, "file")
+	for _, part := range parts {
+		expected, ok := recorded[part]
+		if !ok {
+			fmt.Printf("- %s skipped, there's no recorded answer\n", part)
+			skipped++
+			continue
+		}
+		actual := evalSection(ev, part).Repr()
+		switch {
+		case actual == expected:
+			fmt.Printf("%s %s\n", green("✓"), part)
+			passed++
+			continue
+		case strings.Contains(expected, "\n") && strings.Contains(actual, "\n"):
+			fmt.Printf("%s %s\n  expected (-) and got (+) differ\n%s", red("✗"), part, indent(diffLines(expected, actual), "  "))
+		default:
+			fmt.Printf("%s %s\n  expected %s\n       got %s\n", red("✗"), part, expected, actual)
+		}
+		failed++
+	}
+
+	summary := fmt.Sprintf("%d passed, %d failed", passed, failed)
+	if skipped > 0 {
+		summary += fmt.Sprintf(", %d skipped", skipped)
+	}
+	fmt.Println(summary)
+	return failed == 0, nil
+}
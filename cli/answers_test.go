@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAnswersRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "day.answers")
+	recorded := answers{
+		"part1": "5934",
+		"part2": "'#.#\n\n.#.\n'",
+		"part3": "[1, 'a\nb', [nil]]",
+	}
+	if err := writeAnswers(path, recorded); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readAnswers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(recorded) {
+		t.Fatalf("expected %d answers, got %d: %q", len(recorded), len(read), read)
+	}
+	for part, repr := range recorded {
+		if read[part] != repr {
+			t.Errorf("%s: expected %q, got %q", part, repr, read[part])
+		}
+	}
+}
+
+func TestBadAnswersFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "day.answers")
+	if err := os.WriteFile(path, []byte("part1 1\n5\npart2 3\n'a\nb'\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := readAnswers(path)
+	if err == nil || !strings.HasSuffix(err.Error(), ":3: expected a part name and a number of lines") {
+		t.Errorf("expected an error on line 3, got %v", err)
+	}
+}
+
+func TestRecordThenCheckAnswers(t *testing.T) {
+	path := writeProgram(t, `file: 'a b'
+part1: {
+  return len(split(input, ' '))
+}
+part2: {
+  return 'x
+' + input
+}`)
+
+	var stderr bytes.Buffer
+	out := captureStdout(t, func() {
+		if code := RunArgs([]string{"--record", path}, &stderr); code != 0 {
+			t.Errorf("expected --record to exit 0, got %d\n%s", code, stderr.String())
+		}
+	})
+	if !strings.Contains(out, "recorded to") {
+		t.Errorf("expected a note about the answers file, got\n%s", out)
+	}
+
+	out = captureStdout(t, func() {
+		if code := RunArgs([]string{"--check-answers", path}, &stderr); code != 0 {
+			t.Errorf("expected the recorded answers to match, got %d\n%s", code, stderr.String())
+		}
+	})
+	if !strings.Contains(out, "2 passed, 0 failed") {
+		t.Errorf("expected both parts to pass, got\n%s", out)
+	}
+
+	// a regression in part2
+	src, _ := os.ReadFile(path)
+	if err := os.WriteFile(path, []byte(strings.Replace(string(src), "'x", "'y", 1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out = captureStdout(t, func() {
+		if code := RunArgs([]string{"--check-answers", path}, &stderr); code != 1 {
+			t.Errorf("expected a mismatch to exit 1, got %d", code)
+		}
+	})
+	if !strings.Contains(out, "1 passed, 1 failed") || !strings.Contains(out, "'y") {
+		t.Errorf("expected part2 to fail with a diff, got\n%s", out)
+	}
+}
@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	lang "github.com/alligator/advent-of-code-2021-lang/src"
+)
+
+// with no iteration count given, sections run until this much time has passed
+const benchTime = time.Second
+
+// bench runs each of parts iters times, or for benchTime if iters is 0, and
+// reports the fastest, mean and slowest runs. setup gives a fresh evaluator
+// with the part's input read for every run, so a part that changes globals can't
+// affect the next one. setup is timed separately.
+func bench(setup func(part string) *lang.Evaluator, parts []string, iters int) {
+	for _, part := range parts {
+		benchSection(setup, part, iters)
+	}
+}
+
+func benchSection(setup func(part string) *lang.Evaluator, name string, iters int) {
+	var runs []time.Duration
+	var setupTime time.Duration
+	start := time.Now()
+	for {
+		if iters > 0 && len(runs) == iters {
+			break
+		}
+		if iters == 0 && len(runs) > 0 && time.Since(start) >= benchTime {
+			break
+		}
+
+		setupStart := time.Now()
+		ev := setup(name)
+		setupTime += time.Since(setupStart)
+
+		runStart := time.Now()
+		if _, err := ev.EvalSection(name); err != nil {
+			panic(err)
+		}
+		runs = append(runs, time.Since(runStart))
+	}
+
+	min, max, total := runs[0], runs[0], time.Duration(0)
+	for _, d := range runs {
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+		total += d
+	}
+	n := time.Duration(len(runs))
+	fmt.Printf("%s %s %d runs, min %s mean %s max %s (setup %s)\n",
+		yellow("bench:"), name, len(runs), formatDuration(min), formatDuration(total/n), formatDuration(max), formatDuration(setupTime/n))
+}
@@ -0,0 +1,48 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	lang "github.com/alligator/advent-of-code-2021-lang/src"
+)
+
+// checkSyntax lexes and parses each file, or every file in a directory or
+// glob, without running anything. It prints nothing unless there are errors,
+// or warnings with --lint.
+func checkSyntax(paths []string, mode lintMode, stderr io.Writer) (exitCode int) {
+	for _, path := range paths {
+		files := []string{path}
+		if manyFiles(path) {
+			var err error
+			files, err = findFiles(path)
+			if err != nil {
+				fmt.Fprintln(stderr, err)
+				exitCode = 1
+				continue
+			}
+		}
+
+		for _, file := range files {
+			f, err := os.ReadFile(file)
+			if err != nil {
+				fmt.Fprintln(stderr, err)
+				exitCode = 1
+				continue
+			}
+			compiled, errs := lang.Compile(strings.TrimSpace(string(f)))
+			if len(errs) > 0 {
+				fmt.Fprintf(stderr, "%s:\n", file)
+				printErrors(stderr, errs)
+				exitCode = 1
+				continue
+			}
+			if !lint(compiled, file, mode, stderr) {
+				exitCode = 1
+			}
+		}
+	}
+	return exitCode
+}
@@ -1,88 +1,419 @@
 package cli
 
 import (
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	lang "github.com/alligator/advent-of-code-2021-lang/src"
 )
 
-func Run() (exitCode int) {
-	dbgLex := flag.Bool("debug-lex", false, "debug lexing")
-	dbgAst := flag.Bool("debug-ast", false, "debug ast parsing")
-	testMode := flag.Bool("t", false, "run tests")
-	benchMode := flag.Bool("b", false, "benchmark")
-	profile := flag.Bool("p", false, "profile")
-	flag.Parse()
-
-	filePath := flag.Arg(0)
-	if filePath == "" {
-		fmt.Fprintln(os.Stderr, "no file given!")
+func Run() int {
+	return RunArgs(os.Args[1:], os.Stderr)
+}
+
+// config is the command line flags
+type config struct {
+	dbgLex     bool
+	dbgAst     astFormat
+	test       bool
+	bench      bool
+	benchIters int
+	profile    bool
+	profileOut string
+	vm         bool
+	quiet      bool
+	timeout    time.Duration
+	only       string // a single section to run, or every part
+	watch      bool
+	trace      bool
+	traceLimit int
+	debug      bool
+	breaks     []int
+	check      bool
+	lint       lintMode
+	noTiming   bool
+	color      colorMode
+	record     bool     // save the answers for --check-answers
+	answers    bool     // compare the answers to the saved ones
+	args       []string // everything after --, the program's args global
+	stdin      *stdinCache
+	ctx        context.Context // cancels the running program, for watch mode
+}
+
+// astFormat is the --debug-ast flag, on its own it means s-expressions
+type astFormat string
+
+func (f *astFormat) String() string   { return string(*f) }
+func (f *astFormat) IsBoolFlag() bool { return true }
+
+func (f *astFormat) Set(s string) error {
+	switch s {
+	case "true", "sexp":
+		*f = "sexp"
+	case "false":
+		*f = ""
+	case "json":
+		*f = "json"
+	default:
+		return fmt.Errorf("expected sexp or json")
+	}
+	return nil
+}
+
+// RunArgs is Run with the command line arguments given, errors and the
+// profile are written to stderr
+func RunArgs(args []string, stderr io.Writer) int {
+	var cfg config
+	// aoc check is --check-syntax
+	if len(args) > 0 && args[0] == "check" {
+		args = append([]string{"--check-syntax"}, args[1:]...)
+	}
+	if len(args) > 0 && args[0] == "new" {
+		return newDay(args[1:], stderr)
+	}
+	if len(args) > 0 && args[0] == "fetch" {
+		return fetch(args[1:], stderr)
+	}
+	flags := flag.NewFlagSet("aoc", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.BoolVar(&cfg.dbgLex, "debug-lex", false, "debug lexing")
+	flags.Var(&cfg.dbgAst, "debug-ast", "print the syntax tree, --debug-ast=json for JSON")
+	flags.BoolVar(&cfg.test, "t", false, "run tests")
+	flags.BoolVar(&cfg.bench, "b", false, "benchmark")
+	flags.IntVar(&cfg.benchIters, "bench-iters", 0, "how many times -b runs each part, by default as many as fit in a second")
+	flags.BoolVar(&cfg.profile, "p", false, "profile, printed to stderr")
+	flags.BoolVar(&cfg.profile, "profile", false, "profile, printed to stderr")
+	flags.StringVar(&cfg.profileOut, "profile-out", "", "write a speedscope profile to this file")
+	flags.BoolVar(&cfg.vm, "vm", false, "run on the bytecode vm")
+	flags.BoolVar(&cfg.quiet, "quiet", false, "discard output from print and println")
+	flags.DurationVar(&cfg.timeout, "timeout", 0, "stop a section that runs for longer than this, e.g. 10s")
+	flags.StringVar(&cfg.only, "section", "", "only run this section")
+	part := flags.Int("part", 0, "only run this part, --part 2 is the same as --section part2")
+	flags.BoolVar(&cfg.trace, "trace", false, "print each statement to stderr as it runs")
+	flags.IntVar(&cfg.traceLimit, "trace-limit", 0, "stop tracing after this many lines, the program carries on")
+	flags.BoolVar(&cfg.debug, "debug", false, "stop before the first statement and read debugger commands from stdin")
+	flags.Func("break", "stop before this line, as N or file:N, and read debugger commands from stdin", func(s string) error {
+		n, err := strconv.Atoi(s[strings.LastIndexByte(s, ':')+1:])
+		if err != nil {
+			return fmt.Errorf("expected a line number")
+		}
+		cfg.breaks = append(cfg.breaks, n)
+		return nil
+	})
+	flags.BoolVar(&cfg.check, "check-syntax", false, "only lex and parse the files, printing any errors")
+	flags.Var(&cfg.lint, "lint", "warn about unused vars and functions, shadowed variables and unreachable code, --lint=strict fails if there are any")
+	flags.Var(&cfg.color, "color", "color the output: auto, always or never. auto colors a terminal unless NO_COLOR is set")
+	flags.BoolVar(&cfg.noTiming, "no-timing", false, "don't print how long each part took, the default when stdout isn't a terminal")
+	flags.BoolVar(&cfg.record, "record", false, "save each part's answer to a .answers file next to the program")
+	flags.BoolVar(&cfg.answers, "check-answers", false, "check each part's answer against the ones saved by --record")
+	flags.BoolVar(&cfg.watch, "w", false, "watch the file and the files it reads, re-running on every change")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	colors = colorAuto
+	if cfg.color != "" {
+		colors = cfg.color
+	}
+
+	if modes := countTrue(cfg.test, cfg.record, cfg.answers); modes > 1 {
+		fmt.Fprintln(stderr, "give one of -t, --record and --check-answers")
+		return 2
+	}
+
+	if cfg.benchIters < 0 {
+		fmt.Fprintf(stderr, "--bench-iters must be 0 or more, got %d\n", cfg.benchIters)
+		return 2
+	}
+
+	if *part != 0 {
+		if cfg.only != "" {
+			fmt.Fprintln(stderr, "give one of --section and --part, not both")
+			return 2
+		}
+		cfg.only = fmt.Sprintf("part%d", *part)
+	}
+
+	files, scriptArgs := splitArgs(flags.Args())
+	cfg.args = scriptArgs
+	cfg.stdin = &stdinCache{}
+	if len(files) == 0 {
+		fmt.Fprintln(stderr, "no file given!")
 		return 1
 	}
+	filePath := files[0]
+
+	if cfg.check {
+		return checkSyntax(files, cfg.lint, stderr)
+	}
+
+	if manyFiles(filePath) {
+		found, err := findFiles(filePath)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		return runFiles(found, cfg)
+	}
+
+	if cfg.watch {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		defer signal.Stop(interrupt)
+		return watch(filePath, cfg, stderr, interrupt)
+	}
+
+	exitCode, _ := runProgram(filePath, cfg, stderr)
+	return exitCode
+}
+
+func countTrue(flags ...bool) int {
+	n := 0
+	for _, f := range flags {
+		if f {
+			n++
+		}
+	}
+	return n
+}
+
+// splitArgs splits the arguments left after the flags at --, the ones after
+// it are for the program. flag.Parse only drops a -- that comes before the
+// file.
+func splitArgs(args []string) (files []string, scriptArgs []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+	return args, nil
+}
+
+// tests see this as the time, so what they print doesn't change from run to
+// run
+var testTime = time.Date(2021, time.December, 1, 0, 0, 0, 0, time.UTC)
+
+// programOptions are the options every evaluator gets, whether it's running,
+// testing or benchmarking the program: the args global holding the
+// arguments after --, stdin, and a clock that's stopped when testing
+func (cfg config) programOptions() []lang.Option {
+	items := make([]lang.Value, len(cfg.args))
+	for i, arg := range cfg.args {
+		items[i] = lang.NewStr(arg)
+	}
+	opts := []lang.Option{lang.WithVar("args", lang.NewArray(items))}
+	if cfg.stdin != nil {
+		opts = append(opts, lang.WithStdin(cfg.stdin.reader()))
+	}
+	if cfg.test {
+		opts = append(opts, lang.WithClock(func() time.Time { return testTime }))
+	}
+	return opts
+}
+
+// stdinCache reads stdin the first time a program calls stdin(). Each
+// evaluator gets its own reader over the same input, so benchmark runs and
+// watch reruns see what the first run saw.
+type stdinCache struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+func (c *stdinCache) reader() io.Reader {
+	var r *bytes.Reader
+	return readerFunc(func(p []byte) (int, error) {
+		c.once.Do(func() { c.data, c.err = io.ReadAll(os.Stdin) })
+		if c.err != nil {
+			return 0, c.err
+		}
+		if r == nil {
+			r = bytes.NewReader(c.data)
+		}
+		return r.Read(p)
+	})
+}
+
+type readerFunc func(p []byte) (int, error)
 
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+// runProgram runs or tests a single file. It also returns the files the
+// program read, for watch mode.
+func runProgram(filePath string, cfg config, stderr io.Writer) (exitCode int, read []string) {
+	start := time.Now()
 	f, err := os.ReadFile(filePath)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return 1
+		fmt.Fprintln(stderr, err)
+		return 1, nil
 	}
 
 	src := strings.TrimSpace(string(f))
-	defer handleErrors(&exitCode)
+	defer handleErrors(stderr, &exitCode)
 
-	defer func() {
-		if r := recover(); r != nil {
-			if e, ok := r.(lang.Error); ok {
-				fmt.Fprintf(os.Stderr, "\n\x1b[91m%s on line %d\x1b[0m\n%s\n", e.Tag.String(), e.Line, e.Msg)
-				exitCode = 1
-				return
-			}
-			panic(r)
+	if cfg.dbgLex {
+		if err := debugLex(src); err != nil {
+			printError(stderr, err.(lang.Error))
+			return 1, nil
 		}
-	}()
+		return 0, nil
+	}
 
-	if *dbgLex {
-		debugLex(src)
-		return 0
+	compiled, errs := lang.Compile(src)
+	if len(errs) > 0 {
+		printErrors(stderr, errs)
+		return 1, nil
+	}
+	if !lint(compiled, filePath, cfg.lint, stderr) {
+		return 1, nil
 	}
 
-	l := lang.NewLexer(src)
-	p := lang.NewParser(&l)
-	prog := p.Parse()
+	if cfg.dbgAst != "" {
+		if err := compiled.PrintAST(os.Stdout, string(cfg.dbgAst)); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1, nil
+		}
+		return 0, nil
+	}
 
-	if *dbgAst {
-		lang.PrettyPrint(&prog)
-		return 0
+	opts := cfg.programOptions()
+	if cfg.profile || cfg.profileOut != "" {
+		opts = append(opts, lang.WithProfiling())
+	}
+	if cfg.quiet {
+		opts = append(opts, lang.WithOutput(io.Discard))
+	}
+	if cfg.timeout > 0 {
+		opts = append(opts, lang.WithTimeout(cfg.timeout))
+	}
+	if cfg.ctx != nil {
+		opts = append(opts, lang.WithContext(cfg.ctx))
+	}
+	if f, ok := stderr.(*os.File); ok && isTerminal(f) && !cfg.quiet {
+		opts = append(opts, lang.WithProgress(stderr))
+	}
+	if cfg.trace {
+		opts = append(opts, lang.WithTrace(stderr, cfg.traceLimit))
+	}
+	if cfg.debug || len(cfg.breaks) > 0 {
+		d := lang.NewDebugger(os.Stdin, stderr)
+		for _, line := range cfg.breaks {
+			d.Break(line)
+		}
+		if len(cfg.breaks) == 0 {
+			d.Step()
+		}
+		opts = append(opts, lang.WithDebugger(d))
+	}
+	ev := compiled.NewEvaluator(opts...)
+	defer func() { read = ev.FilesRead() }()
+	if cfg.vm {
+		for _, note := range ev.EnableVM() {
+			fmt.Fprintf(stderr, "vm: %s\n", note)
+		}
 	}
 
-	ev := lang.NewEvaluator(&prog, &l, *profile)
+	parts := defaultParts(ev)
+	if cfg.only != "" {
+		if !ev.HasSection(cfg.only) {
+			fmt.Fprintf(stderr, "no section named %s, the sections are: %s\n", cfg.only, strings.Join(ev.Sections(), ", "))
+			return 1, nil
+		}
+		parts = []string{cfg.only}
+	}
 
-	if *testMode {
-		if !Test(&ev, *benchMode) {
+	switch {
+	case cfg.test:
+		if !testParts(ev, parts) {
 			exitCode = 1
 		}
-	} else {
-		run(&ev, *benchMode)
+	case cfg.record:
+		if err := record(ev, parts, answersPath(filePath)); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1, nil
+		}
+	case cfg.answers:
+		ok, err := checkAnswers(ev, parts, answersPath(filePath))
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1, nil
+		}
+		if !ok {
+			exitCode = 1
+		}
+	default:
+		// the total includes reading and parsing the program
+		// timings in a file or a pipe would only make the output differ from
+		// run to run
+		timing := !cfg.noTiming && isTerminal(os.Stdout)
+		run(ev, parts, timing)
+		if timing {
+			fmt.Println(dim("total: " + formatDuration(time.Since(start))))
+		}
 	}
 
-	if *profile {
-		ev.PrintProfile()
+	if cfg.bench {
+		// the parts have already run once, their output has been seen
+		bench(func(part string) *lang.Evaluator {
+			opts := append(cfg.programOptions(), lang.WithOutput(io.Discard), lang.WithTimeout(cfg.timeout))
+			ev := compiled.NewEvaluator(opts...)
+			if cfg.vm {
+				ev.EnableVM()
+			}
+			if cfg.test {
+				readInput(ev, testInput(ev, part))
+			} else {
+				readInput(ev, "file")
+			}
+			return ev
+		}, parts, cfg.benchIters)
 	}
 
-	return exitCode
+	if cfg.profile {
+		ev.PrintProfile(stderr)
+	}
+	if cfg.profileOut != "" {
+		if err := writeProfile(ev, cfg.profileOut); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1, nil
+		}
+	}
+
+	return exitCode, nil
 }
 
-func debugLex(src string) {
+func writeProfile(ev *lang.Evaluator, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := ev.WriteProfile(f, "speedscope"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func debugLex(src string) error {
 	l := lang.NewLexer(src)
 	line := 0
 	lines := strings.Split(src, "\n")
 	for {
 		t, err := l.NextToken()
 		if err != nil {
-			panic(err)
+			fmt.Print("\n")
+			return err
 		}
 		tline, _ := l.GetLineAndCol(t)
 		if tline != line {
@@ -104,88 +435,270 @@ func debugLex(src string) {
 		}
 	}
 	fmt.Print("\n")
+	return nil
 }
 
-func Test(ev *lang.Evaluator, benchMode bool) bool {
-	testInput, err := ev.EvalSection("test")
-	if err != nil {
-		panic(err)
-	}
-	testInput.CheckTagOrPanic(lang.ValStr)
-	ev.ReadInput(*testInput.Str)
+func Test(ev *lang.Evaluator) bool {
+	return testParts(ev, defaultParts(ev))
+}
 
-	oneOk := true
-	twoOk := true
-	oneOk = testSection(ev, "test_part1", "part1", benchMode)
+// defaultParts are the sections run when none is picked on the command line
+func defaultParts(ev *lang.Evaluator) []string {
 	if ev.HasSection("part2") {
-		twoOk = testSection(ev, "test_part2", "part2", benchMode)
+		return []string{"part1", "part2"}
 	}
+	return []string{"part1"}
+}
 
-	return oneOk && twoOk
+// testParts checks each part against its test_ section, e.g. part1 against
+// test_part1, and what it prints against its test_output_ section, and prints
+// a summary. Parts without either are skipped. A test_error section means
+// part1 should fail instead, see testError.
+func testParts(ev *lang.Evaluator, parts []string) bool {
+	if !ev.HasSection("test") {
+		fmt.Println("no tests, there's no test section")
+		return true
+	}
+
+	passed, failed, skipped := 0, 0, 0
+	input := ""
+	for _, part := range parts {
+		expected := "test_" + part
+		if part == "part1" && ev.HasSection("test_error") {
+			expected = "test_error"
+		}
+		if !ev.HasSection(expected) && !ev.HasSection("test_output_"+part) {
+			fmt.Printf("- %s skipped, there's no %s section\n", part, expected)
+			skipped++
+			continue
+		}
+		if next := testInput(ev, part); next != input {
+			input = next
+			readInput(ev, input)
+		}
+		var ok bool
+		if expected == "test_error" {
+			ok = testError(ev, part)
+		} else {
+			ok = testSection(ev, part)
+		}
+		if ok {
+			passed++
+		} else {
+			failed++
+		}
+	}
+
+	summary := fmt.Sprintf("%d passed, %d failed", passed, failed)
+	if skipped > 0 {
+		summary += fmt.Sprintf(", %d skipped", skipped)
+	}
+	fmt.Println(summary)
+	return failed == 0
 }
 
-func testSection(ev *lang.Evaluator, expectedSection string, actualSection string, benchMode bool) bool {
-	expected, err := ev.EvalSection(expectedSection)
-	if err != nil {
-		panic(err)
+// testInput is the section holding the test input for part. part2 uses
+// test2 if there is one, everything else uses test.
+func testInput(ev *lang.Evaluator, part string) string {
+	if n := strings.TrimPrefix(part, "part"); n != part && ev.HasSection("test"+n) {
+		return "test" + n
 	}
-	actual := evalSection(ev, actualSection, benchMode)
+	return "test"
+}
 
-	res, err := expected.Compare(actual)
-	if err != nil {
-		panic(err)
+// testSection runs part, checking its value against test_<part> and its
+// output against test_output_<part>, whichever of them there are
+func testSection(ev *lang.Evaluator, actualSection string) (res bool) {
+	// a runtime error (e.g. a failed assert) fails this part, not the whole run
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(lang.Error); ok && e.Tag == lang.RuntimeError {
+				fmt.Printf("%s %s\n  %s on line %d: %s\n%s%s", red("✗"), actualSection, e.Tag.String(), e.Line, e.Msg, indent(e.Excerpt(), "  "), fmtTrace(e, "  "))
+				res = false
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	expectedSection := "test_" + actualSection
+	outputSection := "test_output_" + actualSection
+	hasValue, hasOutput := ev.HasSection(expectedSection), ev.HasSection(outputSection)
+
+	// the expected values are worked out before part runs, so anything they
+	// print isn't counted as part's output
+	var expected, expectedOutput lang.Value
+	if hasValue {
+		expected = evalSection(ev, expectedSection)
+	}
+	var output bytes.Buffer
+	if hasOutput {
+		expectedOutput = evalSection(ev, outputSection)
+		if expectedOutput.Tag != lang.ValStr {
+			panic(lang.E(lang.RuntimeError, fmt.Sprintf("%s section must evaluate to a string, got %v", outputSection, expectedOutput.Tag), 0))
+		}
+		prev := ev.Output()
+		ev.SetOutput(&output)
+		defer ev.SetOutput(prev)
 	}
+	actual := evalSection(ev, actualSection)
 
-	if res {
-		fmt.Printf("\x1b[92m✓\x1b[0m %s\n", actualSection)
-	} else {
-		fmt.Printf("\x1b[91m✗\x1b[0m %s\n  expected %s\n       got %s\n", actualSection, expected.Repr(), actual.Repr())
+	if hasValue {
+		same, err := expected.Compare(actual)
+		if err != nil {
+			panic(err)
+		}
+		if !same {
+			if multiline(expected) && multiline(actual) {
+				fmt.Printf("%s %s\n  expected (-) and got (+) differ\n%s", red("✗"), actualSection, indent(diffLines(expected.Str, actual.Str), "  "))
+			} else {
+				fmt.Printf("%s %s\n  expected %s\n       got %s\n", red("✗"), actualSection, expected.Repr(), actual.Repr())
+			}
+			return false
+		}
+	}
+	if hasOutput && output.String() != expectedOutput.Str {
+		fmt.Printf("%s %s\n  expected (-) and printed (+) output differ\n%s", red("✗"), actualSection, indent(diffLines(expectedOutput.Str, output.String()), "  "))
+		return false
 	}
 
-	return res
+	fmt.Printf("%s %s\n", green("✓"), actualSection)
+	return true
 }
 
-func run(ev *lang.Evaluator, benchMode bool) {
-	f, err := ev.EvalSection("file")
+// testError checks that part fails with the error the test_error section
+// describes: a string the message contains, or an array of that string and
+// the line the error is on.
+func testError(ev *lang.Evaluator, part string) bool {
+	expected, err := ev.EvalSection("test_error")
 	if err != nil {
 		panic(err)
 	}
-	if f.Tag != lang.ValStr {
-		panic("file section must evaluate to a string")
+	msg, line, ok := expectedError(expected)
+	if !ok {
+		panic(lang.E(lang.RuntimeError, fmt.Sprintf("test_error section must be a string or an array of a string and a line, got %s", expected.Repr()), 0))
 	}
-	ev.ReadInput(*f.Str)
-	fmt.Printf("part1: %s\n", evalSection(ev, "part1", benchMode).Repr())
-	if ev.HasSection("part2") {
-		fmt.Printf("part2: %s\n", evalSection(ev, "part2", benchMode).Repr())
+
+	want := fmt.Sprintf("an error containing %q", msg)
+	if line > 0 {
+		want += fmt.Sprintf(" on line %d", line)
+	}
+	_, err = ev.EvalSection(part)
+	e, _ := err.(lang.Error)
+	switch {
+	case err == nil:
+		fmt.Printf("%s %s\n  expected %s\n       got no error\n", red("✗"), part, want)
+	case !strings.Contains(e.Msg, msg) || line > 0 && e.Line != line:
+		fmt.Printf("%s %s\n  expected %s\n       got %s on line %d: %s\n", red("✗"), part, want, e.Tag.String(), e.Line, e.Msg)
+	default:
+		fmt.Printf("%s %s\n", green("✓"), part)
+		return true
 	}
+	return false
 }
 
-func evalSection(ev *lang.Evaluator, name string, benchMode bool) lang.Value {
-	if benchMode {
-		defer timeFunc(name)()
+func expectedError(v lang.Value) (string, int, bool) {
+	if v.Tag == lang.ValStr {
+		return v.Str, 0, true
 	}
-	v, err := ev.EvalSection(name)
+	if v.Tag != lang.ValArray || len(*v.Array) != 2 {
+		return "", 0, false
+	}
+	msg, line := (*v.Array)[0], (*v.Array)[1]
+	if msg.Tag != lang.ValStr || line.Tag != lang.ValNum {
+		return "", 0, false
+	}
+	return msg.Str, line.Num, true
+}
+
+func multiline(v lang.Value) bool {
+	return v.Tag == lang.ValStr && strings.Contains(v.Str, "\n")
+}
+
+// run prints each part's answer, and how long it took if timing is set
+func run(ev *lang.Evaluator, parts []string, timing bool) {
+	readInput(ev, "file")
+	for _, part := range parts {
+		start := time.Now()
+		v := evalSection(ev, part)
+		if timing {
+			fmt.Printf("%s: %s %s\n", part, v.Repr(), dim("("+formatDuration(time.Since(start))+")"))
+		} else {
+			fmt.Printf("%s: %s\n", part, v.Repr())
+		}
+	}
+}
+
+// readInput evaluates the named section, file or test, makes it the
+// program's input and runs the parse section over it
+func readInput(ev *lang.Evaluator, section string) {
+	v, err := ev.EvalSection(section)
 	if err != nil {
 		panic(err)
 	}
-	return v
+	if v.Tag != lang.ValStr {
+		panic(lang.E(lang.RuntimeError, fmt.Sprintf("%s section must evaluate to a string, got %v", section, v.Tag), 0))
+	}
+	ev.ReadInput(v.Str)
+	if err := ev.Parse(); err != nil {
+		panic(err)
+	}
 }
 
-func timeFunc(name string) func() {
-	start := time.Now()
-	return func() {
-		fmt.Printf("\x1b[93mbench:\x1b[0m %s took %0.3fs\n", name, time.Since(start).Seconds())
+func evalSection(ev *lang.Evaluator, name string) lang.Value {
+	v, err := ev.EvalSection(name)
+	if err != nil {
+		panic(err)
 	}
+	return v
 }
 
-func handleErrors(exitCode *int) {
+func handleErrors(stderr io.Writer, exitCode *int) {
 	if r := recover(); r != nil {
 		if e, ok := r.(lang.Error); ok {
-			fmt.Fprintf(os.Stderr, "\n\x1b[91m%s on line %d\x1b[0m\n%s\n", e.Tag.String(), e.Line, e.Msg)
-			code := 1
-			exitCode = &code
+			printError(stderr, e)
+			*exitCode = 1
 			return
 		}
-		panic(r)
+		// anything else is a bug, a goroutine dump isn't much use to anyone
+		// running a solution
+		fmt.Fprintf(stderr, "internal error, please report: %v\n", r)
+		*exitCode = 1
+	}
+}
+
+// at most this many parse errors are printed, after that they're mostly
+// knock-on effects of the earlier ones
+const maxErrors = 20
+
+func printErrors(w io.Writer, errs []lang.Error) {
+	for i, e := range errs {
+		if i == maxErrors {
+			fmt.Fprintf(w, "\n...and %d more\n", len(errs)-maxErrors)
+			break
+		}
+		printError(w, e)
+	}
+}
+
+func printError(w io.Writer, e lang.Error) {
+	banner := fmt.Sprintf("%s on line %d", e.Tag.String(), e.Line)
+	fmt.Fprintf(w, "\n%s\n%s\n%s%s", paint(w, "91", banner), e.Msg, e.Excerpt(), fmtTrace(e, ""))
+}
+
+func indent(s string, prefix string) string {
+	if s == "" {
+		return s
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(s, "\n"), "\n")
+	return prefix + strings.Join(lines, prefix) + "\n"
+}
+
+// fmtTrace lists the calls that led to an error, one per line
+func fmtTrace(e lang.Error, indent string) string {
+	var sb strings.Builder
+	for _, line := range e.Trace {
+		fmt.Fprintf(&sb, "%s  called from line %d\n", indent, line)
 	}
+	return sb.String()
 }
@@ -0,0 +1,597 @@
+package cli
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lang "github.com/alligator/advent-of-code-2021-lang/src"
+)
+
+func newEvaluator(src string) *lang.Evaluator {
+	c, errs := lang.Compile(src)
+	if len(errs) > 0 {
+		panic(errs[0])
+	}
+	return c.NewEvaluator()
+}
+
+func TestFailedAssertFailsPart(t *testing.T) {
+	ev := newEvaluator(`test: ''
+test_part1: 1
+test_part2: 2
+part1: {
+  assert(0, 'nope')
+  return 1
+}
+part2: {
+  return 2
+}`)
+
+	if Test(ev) {
+		t.Fatal("expected the tests to fail")
+	}
+}
+
+func TestProfileFlag(t *testing.T) {
+	path := writeProgram(t, `fn triangle(n) {
+  var total = 0
+  for i in range(0, n) {
+    total = total + i
+  }
+  return total
+}
+test: ''
+test_part1: 499500
+part1: {
+  return triangle(1000)
+}`)
+
+	var stderr bytes.Buffer
+	if code := RunArgs([]string{"-t", "-p", path}, &stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d\n%s", code, stderr.String())
+	}
+	out := stderr.String()
+	if !strings.HasPrefix(out, "profile: ") {
+		t.Errorf("expected a profile header, got\n%s", out)
+	}
+	if !strings.Contains(out, "triangle:1") {
+		t.Errorf("expected the profile to mention triangle, got\n%s", out)
+	}
+}
+
+func TestBenchRunsAreIndependent(t *testing.T) {
+	// part1 fails if it sees a previous run's changes to lines
+	src := `part1: {
+  assert(lines[0] == 'a', 'saw a previous run')
+  lines[0] = 'b'
+  return 1
+}`
+	setups := 0
+	bench(func(part string) *lang.Evaluator {
+		setups++
+		ev := newEvaluator(src)
+		ev.ReadInput("a")
+		return ev
+	}, []string{"part1"}, 3)
+
+	if setups != 3 {
+		t.Errorf("expected 3 setups, got %d", setups)
+	}
+}
+
+// captureStdout returns what f prints to stdout
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- string(b)
+	}()
+	f()
+	w.Close()
+	return <-done
+}
+
+func writeProgram(t *testing.T, src string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "program.aoc")
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const twoParts = `file: 'input'
+part1: {
+  println('running part1')
+  return 1
+}
+part2: {
+  println('running part2')
+  return 2
+}`
+
+func TestNegativeBenchIters(t *testing.T) {
+	path := writeProgram(t, twoParts)
+	var stderr bytes.Buffer
+	if code := RunArgs([]string{"-b", "--bench-iters", "-1", path}, &stderr); code != 2 {
+		t.Errorf("expected exit code 2, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), "--bench-iters must be 0 or more, got -1") {
+		t.Errorf("expected a usage error, got %q", stderr.String())
+	}
+}
+
+func TestRunOnePart(t *testing.T) {
+	path := writeProgram(t, twoParts)
+	var stderr bytes.Buffer
+	var code int
+	out := captureStdout(t, func() {
+		code = RunArgs([]string{"--part", "2", path}, &stderr)
+	})
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d\n%s", code, stderr.String())
+	}
+	if strings.Contains(out, "part1") {
+		t.Errorf("expected part1 not to run, got\n%s", out)
+	}
+	if !strings.Contains(out, "running part2") || !strings.Contains(out, "part2: 2") {
+		t.Errorf("expected part2 to run, got\n%s", out)
+	}
+}
+
+func TestRunUnknownSection(t *testing.T) {
+	path := writeProgram(t, twoParts)
+	var stderr bytes.Buffer
+	if code := RunArgs([]string{"--section", "part3", path}, &stderr); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), "file, part1, part2") {
+		t.Errorf("expected the sections to be listed, got %q", stderr.String())
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	path := writeProgram(t, `test: 'input'
+test_part1: 1
+part1: {
+  println('noisy')
+  return 1
+}`)
+	var stderr bytes.Buffer
+	out := captureStdout(t, func() {
+		if code := RunArgs([]string{"-t", "--quiet", path}, &stderr); code != 0 {
+			t.Errorf("expected exit code 0, got %d\n%s", code, stderr.String())
+		}
+	})
+	if strings.Contains(out, "noisy") {
+		t.Errorf("expected print output to be discarded, got\n%s", out)
+	}
+	if !strings.Contains(out, "part1") {
+		t.Errorf("expected the test results, got\n%s", out)
+	}
+}
+
+func TestTimeoutFlag(t *testing.T) {
+	path := writeProgram(t, `file: ''
+part1: {
+  for {}
+}`)
+	var stderr bytes.Buffer
+	captureStdout(t, func() {
+		if code := RunArgs([]string{"--timeout", "50ms", path}, &stderr); code != 1 {
+			t.Errorf("expected exit code 1, got %d", code)
+		}
+	})
+	if !strings.Contains(stderr.String(), "execution timed out") {
+		t.Errorf("expected a timeout error, got %q", stderr.String())
+	}
+}
+
+func TestHandleErrorsSetsExitCode(t *testing.T) {
+	code := func() (exitCode int) {
+		defer handleErrors(io.Discard, &exitCode)
+		panic(lang.Error{Tag: lang.RuntimeError, Msg: "oops", Line: 1})
+	}()
+	if code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+}
+
+func TestFailingTestsExitCode(t *testing.T) {
+	path := writeProgram(t, `test: ''
+test_part1: 1
+test_part2: 3
+part1: {
+  return 1
+}
+part2: {
+  return 2
+}`)
+	var stderr bytes.Buffer
+	out := captureStdout(t, func() {
+		if code := RunArgs([]string{"-t", path}, &stderr); code != 1 {
+			t.Errorf("expected exit code 1, got %d", code)
+		}
+	})
+	if !strings.Contains(out, "1 passed, 1 failed\n") {
+		t.Errorf("expected a summary, got\n%s", out)
+	}
+}
+
+func TestNoTestSection(t *testing.T) {
+	path := writeProgram(t, twoParts)
+	var stderr bytes.Buffer
+	out := captureStdout(t, func() {
+		if code := RunArgs([]string{"-t", path}, &stderr); code != 0 {
+			t.Errorf("expected exit code 0, got %d\n%s", code, stderr.String())
+		}
+	})
+	if !strings.Contains(out, "no test section") || stderr.Len() > 0 {
+		t.Errorf("expected a note about the missing section, got\n%s%s", out, stderr.String())
+	}
+}
+
+func TestSeparateTestInputs(t *testing.T) {
+	src := `test: 'first'
+test2: 'second'
+test_part1: 'first'
+test_part2: 'second'
+part1: {
+  return lines[0]
+}
+part2: {
+  return input
+}`
+	for _, parts := range [][]string{{"part1", "part2"}, {"part2", "part1"}} {
+		ev := newEvaluator(src)
+		ok := true
+		captureStdout(t, func() { ok = testParts(ev, parts) })
+		if !ok {
+			t.Errorf("expected %v to pass", parts)
+		}
+	}
+}
+
+func TestSingleTestInput(t *testing.T) {
+	ev := newEvaluator(`test: 'shared'
+test_part1: 'shared'
+test_part2: 'shared'
+part1: {
+  return input
+}
+part2: {
+  return lines[0]
+}`)
+	ok := true
+	captureStdout(t, func() { ok = Test(ev) })
+	if !ok {
+		t.Error("expected both parts to see the test input")
+	}
+}
+
+func TestParseRunsOncePerInput(t *testing.T) {
+	src := `test: '1 2'
+test_part1: 3
+test_part2: 2
+parse: {
+  println('parsing ' + input)
+  return nums(input)
+}
+part1: {
+  return parsed[0] + parsed[1]
+}
+part2: {
+  return len(parsed)
+}`
+	for _, test := range []struct {
+		src    string
+		parses []string
+	}{
+		{src, []string{"parsing 1 2"}},
+		// switching to part2's own input parses again
+		{"test2: '5 6'\n" + src, []string{"parsing 1 2", "parsing 5 6"}},
+	} {
+		ok := true
+		// print writes to whatever stdout was when the evaluator was made
+		out := captureStdout(t, func() { ok = Test(newEvaluator(test.src)) })
+		if !ok {
+			t.Errorf("expected the parts to pass\n%s", out)
+		}
+		var parses []string
+		for _, line := range strings.Split(out, "\n") {
+			if strings.HasPrefix(line, "parsing") {
+				parses = append(parses, line)
+			}
+		}
+		if strings.Join(parses, ", ") != strings.Join(test.parses, ", ") {
+			t.Errorf("expected the parse section to print %q, got %q", test.parses, parses)
+		}
+	}
+}
+
+func TestExpectedErrors(t *testing.T) {
+	part1 := `
+part1: {
+  assert(len(input) == 0, 'no input please')
+  return 1
+}`
+	for _, test := range []struct {
+		src  string
+		pass bool
+		out  string
+	}{
+		{"test: 'x'\ntest_error: 'no input'" + part1, true, "1 passed"},
+		{"test: 'x'\ntest_error: ['no input', 4]" + part1, true, "1 passed"},
+		{"test: 'x'\ntest_error: ['no input', 3]" + part1, false, `expected an error containing "no input" on line 3`},
+		{"test: 'x'\ntest_error: 'out of range'" + part1, false, "got runtime error on line 4: assertion failed: no input please"},
+		{"test: ''\ntest_error: 'no input'" + part1, false, "got no error"},
+		{"test: 'x'\ntest_error: 3" + part1, false, "test_error section must be a string or an array of a string and a line, got 3"},
+	} {
+		pass := true
+		raised := ""
+		out := captureStdout(t, func() {
+			defer func() {
+				if r := recover(); r != nil {
+					pass, raised = false, r.(lang.Error).Msg
+				}
+			}()
+			pass = Test(newEvaluator(test.src))
+		})
+		out += raised
+		if pass != test.pass || !strings.Contains(out, test.out) {
+			t.Errorf("%q: expected pass %v and %q, got %v\n%s", test.src, test.pass, test.out, pass, out)
+		}
+	}
+}
+
+func TestOutputTestRestoresOutput(t *testing.T) {
+	src := `test: ''
+test_part1: 1
+test_output_part2: 'grid
+'
+test_output_part3: 'never'
+part1: {
+  println('after')
+  return 1
+}
+part2: {
+  println('grid')
+}
+part3: {
+  println('partial')
+  error('failed')
+}`
+	ok := true
+	out := captureStdout(t, func() {
+		ok = testParts(newEvaluator(src), []string{"part2", "part3", "part1"})
+	})
+	if ok || !strings.Contains(out, "2 passed, 1 failed") {
+		t.Errorf("expected part3 to fail, got\n%s", out)
+	}
+	if strings.Contains(out, "grid") || strings.Contains(out, "partial") {
+		t.Errorf("expected the tested output to be captured, got\n%s", out)
+	}
+	if !strings.Contains(out, "after") {
+		t.Errorf("expected part1 to print normally, got\n%s", out)
+	}
+}
+
+func TestCheckSyntax(t *testing.T) {
+	good := writeProgram(t, "part1: {\n  return nope()\n}")
+	bad := writeProgram(t, "part1: {\n  var x = )\n}")
+
+	var stderr bytes.Buffer
+	out := captureStdout(t, func() {
+		if code := RunArgs([]string{"check", good, "../tests"}, &stderr); code != 0 {
+			t.Errorf("expected exit code 0, got %d", code)
+		}
+	})
+	if out != "" || stderr.Len() != 0 {
+		t.Errorf("expected no output, got %q %q", out, stderr.String())
+	}
+
+	if code := RunArgs([]string{"--check-syntax", good, bad}, &stderr); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), bad+":\n") || !strings.Contains(stderr.String(), "unexpected )") {
+		t.Errorf("expected the parse error, got\n%s", stderr.String())
+	}
+}
+
+func TestLintFlag(t *testing.T) {
+	path := writeProgram(t, `file: 'x'
+part1: {
+  var unused = 1
+  return 2
+}`)
+	var stderr bytes.Buffer
+	out := captureStdout(t, func() {
+		if code := RunArgs([]string{"--lint", path}, &stderr); code != 0 {
+			t.Errorf("expected warnings not to change the exit code, got %d", code)
+		}
+	})
+	if want := path + ":3: var unused is never used\n"; stderr.String() != want {
+		t.Errorf("expected %q, got %q", want, stderr.String())
+	}
+	if !strings.Contains(out, "part1: 2") {
+		t.Errorf("expected the program to run, got\n%s", out)
+	}
+
+	stderr.Reset()
+	out = captureStdout(t, func() {
+		if code := RunArgs([]string{"--lint=strict", path}, &stderr); code != 1 {
+			t.Errorf("expected --lint=strict to exit 1, got %d", code)
+		}
+	})
+	if out != "" || !strings.Contains(stderr.String(), "var unused is never used") {
+		t.Errorf("expected only the warning, got %q %q", out, stderr.String())
+	}
+
+	stderr.Reset()
+	if code := RunArgs([]string{"check", "--lint=strict", "../tests/for.aoc", path}, &stderr); code != 1 {
+		t.Errorf("expected check --lint=strict to exit 1, got %d", code)
+	}
+	if strings.Count(stderr.String(), "\n") != 1 {
+		t.Errorf("expected one warning, got %q", stderr.String())
+	}
+}
+
+func TestDebugLexError(t *testing.T) {
+	path := writeProgram(t, "part1: {\n  return ~\n}")
+	var stderr bytes.Buffer
+	var code int
+	captureStdout(t, func() {
+		code = RunArgs([]string{"--debug-lex", path}, &stderr)
+	})
+	if code != 1 || !strings.Contains(stderr.String(), "unexpected character '~'") {
+		t.Errorf("expected the lex error and exit code 1, got %d\n%s", code, stderr.String())
+	}
+}
+
+func TestScriptArgsAndEnv(t *testing.T) {
+	t.Setenv("AOC_TEST_DIR", "/tmp/inputs")
+	path := writeProgram(t, `file: ''
+part1: {
+  return env('AOC_TEST_DIR')
+}
+part2: {
+  return env('AOC_TEST_UNSET') == nil
+}
+part3: {
+  return num(args[0]) * 2
+}`)
+
+	var stderr bytes.Buffer
+	var code int
+	out := captureStdout(t, func() {
+		code = RunArgs([]string{path, "--", "21", "more"}, &stderr)
+	})
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d\n%s", code, stderr.String())
+	}
+	for _, want := range []string{"part1: '/tmp/inputs'", "part2: 1"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in\n%s", want, out)
+		}
+	}
+
+	out = captureStdout(t, func() {
+		code = RunArgs([]string{"--section", "part3", path, "--", "21"}, &stderr)
+	})
+	if code != 0 || !strings.Contains(out, "part3: 42") {
+		t.Errorf("expected part3: 42, got %d\n%s%s", code, out, stderr.String())
+	}
+}
+
+func TestScriptArgsEmpty(t *testing.T) {
+	path := writeProgram(t, `file: ''
+part1: {
+  return len(args)
+}`)
+	var stderr bytes.Buffer
+	out := captureStdout(t, func() {
+		RunArgs([]string{path}, &stderr)
+	})
+	if !strings.Contains(out, "part1: 0") {
+		t.Errorf("expected no args, got\n%s%s", out, stderr.String())
+	}
+}
+
+// withStdin makes os.Stdin read input for the rest of the test
+func withStdin(t *testing.T, input string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		w.WriteString(input)
+		w.Close()
+	}()
+	old := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = old
+		r.Close()
+	})
+}
+
+const stdinProgram = `test: '1
+2
+3'
+test_part1: 6
+file: stdin()
+part1: {
+  var total = 0
+  for line in lines {
+    total = total + num(line)
+  }
+  return total
+}`
+
+func TestPipedInput(t *testing.T) {
+	withStdin(t, "10\n20\n")
+	path := writeProgram(t, stdinProgram)
+	var stderr bytes.Buffer
+	var code int
+	out := captureStdout(t, func() {
+		code = RunArgs([]string{path}, &stderr)
+	})
+	if code != 0 || !strings.Contains(out, "part1: 30") {
+		t.Errorf("expected part1: 30, got %d\n%s%s", code, out, stderr.String())
+	}
+}
+
+func TestPipedInputNotReadByTests(t *testing.T) {
+	// reading a closed stdin fails, the tests never get that far
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	r.Close()
+	old := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = old }()
+
+	path := writeProgram(t, stdinProgram)
+	var stderr bytes.Buffer
+	var code int
+	out := captureStdout(t, func() {
+		code = RunArgs([]string{"-t", path}, &stderr)
+	})
+	if code != 0 {
+		t.Errorf("expected the tests to pass without reading stdin, got %d\n%s%s", code, out, stderr.String())
+	}
+}
+
+func TestTestsStopTheClock(t *testing.T) {
+	path := writeProgram(t, `test: ''
+test_output_part1: '2021-12-01 00:00:00 0
+'
+part1: {
+  println(now(), clock_ms())
+}`)
+	var stderr bytes.Buffer
+	out := captureStdout(t, func() {
+		if code := RunArgs([]string{"-t", path}, &stderr); code != 0 {
+			t.Errorf("expected exit code 0, got %d\n%s", code, stderr.String())
+		}
+	})
+	if !strings.Contains(out, "1 passed") {
+		t.Errorf("expected the printed time to be the same every run, got\n%s", out)
+	}
+}
@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// colorMode is the --color flag. auto colors output going to a terminal
+// unless NO_COLOR is set, always and never override both.
+type colorMode string
+
+const (
+	colorAuto   colorMode = "auto"
+	colorAlways colorMode = "always"
+	colorNever  colorMode = "never"
+)
+
+func (m *colorMode) String() string { return string(*m) }
+
+func (m *colorMode) Set(s string) error {
+	switch colorMode(s) {
+	case colorAuto, colorAlways, colorNever:
+		*m = colorMode(s)
+		return nil
+	}
+	return fmt.Errorf("expected auto, always or never")
+}
+
+// colors is the --color flag of the current run
+var colors = colorAuto
+
+// isTerminal is false for files and pipes. Tests replace it to pretend
+// they're writing to a terminal.
+var isTerminal = func(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// useColor says whether what's written to w can have escape codes in it.
+// Only files are ever terminals, a buffer is only colored with
+// --color=always.
+func useColor(w io.Writer) bool {
+	switch colors {
+	case colorAlways:
+		return true
+	case colorNever:
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	f, ok := w.(*os.File)
+	return ok && isTerminal(f)
+}
+
+// paint wraps s in the escape codes for an SGR code if w is colored
+func paint(w io.Writer, code string, s string) string {
+	if !useColor(w) {
+		return s
+	}
+	return "\x1b[" + code + "m" + s + "\x1b[0m"
+}
+
+// the colors of everything printed to stdout, all colored output goes
+// through these or paint
+func red(s string) string    { return paint(os.Stdout, "91", s) }
+func green(s string) string  { return paint(os.Stdout, "92", s) }
+func yellow(s string) string { return paint(os.Stdout, "93", s) }
+func dim(s string) string    { return paint(os.Stdout, "2", s) }
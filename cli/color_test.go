@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// forceColor sets the --color mode for the rest of the test
+func forceColor(t *testing.T, mode colorMode) {
+	t.Helper()
+	prev := colors
+	colors = mode
+	t.Cleanup(func() { colors = prev })
+}
+
+// colorTest fails both parts when testing, one with a diff and one with an
+// error, and part2's error stops it when it's run
+const colorTest = `file: ''
+test: ''
+test_part1: 'a
+b'
+test_part2: 1
+part1: {
+  return 'a
+c'
+}
+part2: {
+  return 1 + [1]
+}`
+
+// runColorTest runs colorTest as if stdout and stderr were terminals,
+// returning everything written to them
+func runColorTest(t *testing.T, args ...string) string {
+	t.Helper()
+	terminal := isTerminal
+	isTerminal = func(f *os.File) bool { return true }
+	t.Cleanup(func() { isTerminal = terminal })
+
+	path := writeProgram(t, colorTest)
+	stderr, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+
+	out := captureStdout(t, func() {
+		RunArgs(append(args, "-t", path), stderr)
+		RunArgs(append(args, path), stderr)
+	})
+	if _, err := stderr.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	errOut, err := io.ReadAll(stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out + string(errOut)
+}
+
+func TestColorOnTerminal(t *testing.T) {
+	t.Setenv("NO_COLOR", "")
+	out := runColorTest(t)
+	for _, want := range []string{"\x1b[91m✗", "\x1b[91m-   2   b", "\x1b[91mruntime error on line 11", "\x1b[2m("} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in the output, got %q", want, out)
+		}
+	}
+}
+
+func TestNoColor(t *testing.T) {
+	t.Setenv("NO_COLOR", "1")
+	if out := runColorTest(t); strings.Contains(out, "\x1b") {
+		t.Errorf("expected no escape codes with NO_COLOR, got %q", out)
+	}
+
+	t.Setenv("NO_COLOR", "")
+	if out := runColorTest(t, "--color=never"); strings.Contains(out, "\x1b") {
+		t.Errorf("expected no escape codes with --color=never, got %q", out)
+	}
+}
+
+func TestColorAlways(t *testing.T) {
+	t.Setenv("NO_COLOR", "1")
+	var stderr bytes.Buffer
+	path := writeProgram(t, "part1: {\n  return nope\n}")
+	captureStdout(t, func() { RunArgs([]string{"--color=always", path}, &stderr) })
+	t.Cleanup(func() { colors = colorAuto })
+	if !strings.Contains(stderr.String(), "\x1b[91m") {
+		t.Errorf("expected --color=always to color the error, got %q", stderr.String())
+	}
+}
+
+func TestBadColorFlag(t *testing.T) {
+	var stderr bytes.Buffer
+	if code := RunArgs([]string{"--color=sometimes", "x.aoc"}, &stderr); code != 2 {
+		t.Errorf("expected exit code 2, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), "expected auto, always or never") {
+		t.Errorf("expected the flag's values, got %q", stderr.String())
+	}
+}
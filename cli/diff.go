@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffLines compares two multi-line strings a line at a time. Matching lines
+// are printed as they are, where they differ the expected line is marked with
+// - and the actual line with +. The first difference is highlighted.
+func diffLines(expected, actual string) string {
+	trimmedExpected := strings.TrimRight(expected, "\n")
+	trimmedActual := strings.TrimRight(actual, "\n")
+	if trimmedExpected == trimmedActual {
+		return fmt.Sprintf("only the trailing newlines differ, expected %d and got %d\n",
+			len(expected)-len(trimmedExpected), len(actual)-len(trimmedActual))
+	}
+
+	expectedLines := strings.Split(expected, "\n")
+	actualLines := strings.Split(actual, "\n")
+	n := len(expectedLines)
+	if len(actualLines) > n {
+		n = len(actualLines)
+	}
+
+	var sb strings.Builder
+	first := true
+	for i := 0; i < n; i++ {
+		e, hasExpected := line(expectedLines, i)
+		a, hasActual := line(actualLines, i)
+		if hasExpected && hasActual && e == a {
+			fmt.Fprintf(&sb, "  %3d   %s\n", i+1, e)
+			continue
+		}
+
+		color := func(s string) string { return s }
+		if first {
+			color = red
+			first = false
+		}
+		if hasExpected {
+			sb.WriteString(color(fmt.Sprintf("- %3d   %s", i+1, e)) + "\n")
+		}
+		if hasActual {
+			sb.WriteString(color(fmt.Sprintf("+ %3d   %s", i+1, a)) + "\n")
+		}
+	}
+	return sb.String()
+}
+
+func line(lines []string, i int) (string, bool) {
+	if i >= len(lines) {
+		return "", false
+	}
+	return lines[i], true
+}
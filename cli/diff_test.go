@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	forceColor(t, colorAlways)
+	expected := "#..#\n#..#\n####\n#..#"
+	actual := "#..#\n#..#\n#.##\n#..#\n#..#"
+	diff := diffLines(expected, actual)
+
+	for _, want := range []string{
+		"    1   #..#\n",
+		"- " + "  3   ####",
+		"+ " + "  3   #.##",
+		"+   5   #..#",
+	} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("expected the diff to contain %q, got\n%s", want, diff)
+		}
+	}
+	// line 4 matches, so it isn't marked
+	if strings.Contains(diff, "-   4") || strings.Contains(diff, "+   4") {
+		t.Errorf("expected line 4 to match, got\n%s", diff)
+	}
+	// only the first difference is highlighted
+	if strings.Count(diff, "\x1b[91m") != 2 {
+		t.Errorf("expected the first difference to be highlighted, got %q", diff)
+	}
+}
+
+func TestDiffLinesTrailingNewline(t *testing.T) {
+	diff := diffLines("ab\ncd\n", "ab\ncd")
+	if diff != "only the trailing newlines differ, expected 1 and got 0\n" {
+		t.Errorf("expected the trailing newline to be called out, got %q", diff)
+	}
+}
+
+func TestFailedMultilineTestShowsDiff(t *testing.T) {
+	ev := newEvaluator(`test: ''
+test_part1: 'ab
+cd'
+part1: {
+  return 'ab
+ce'
+}`)
+	out := captureStdout(t, func() {
+		if Test(ev) {
+			t.Error("expected the test to fail")
+		}
+	})
+	if !strings.Contains(out, "- ") || !strings.Contains(out, "  2   cd") || !strings.Contains(out, "  2   ce") {
+		t.Errorf("expected a diff, got\n%s", out)
+	}
+}
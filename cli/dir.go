@@ -0,0 +1,227 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	lang "github.com/alligator/advent-of-code-2021-lang/src"
+)
+
+// manyFiles is true if path names more than one program, a directory or a
+// glob
+func manyFiles(path string) bool {
+	if strings.ContainsAny(path, "*?[") {
+		return true
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// findFiles returns the .aoc files in a directory or matching a glob, sorted
+// by name
+func findFiles(path string) ([]string, error) {
+	pattern := path
+	if !strings.ContainsAny(path, "*?[") {
+		pattern = filepath.Join(path, "*.aoc")
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .aoc files in %s", path)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// partResult is one cell of the summary table
+type partResult struct {
+	text string // ✓ or ✗ when testing, otherwise the answer
+	ok   bool
+	took time.Duration
+}
+
+type fileResult struct {
+	name  string
+	parts map[string]partResult
+	err   string // set if the file couldn't run at all
+}
+
+// runFiles runs or tests every file and prints a table of the results. An
+// error in one file is reported in its row and doesn't stop the others.
+func runFiles(files []string, cfg config) (exitCode int) {
+	columns := []string{"part1", "part2"}
+	if cfg.only != "" {
+		columns = []string{cfg.only}
+	}
+
+	results := make([]fileResult, 0, len(files))
+	for _, file := range files {
+		res := runFile(file, columns, cfg)
+		if res.err != "" {
+			exitCode = 1
+		}
+		for _, part := range res.parts {
+			if !part.ok {
+				exitCode = 1
+			}
+		}
+		results = append(results, res)
+	}
+
+	printTable(os.Stdout, results, columns, cfg.test)
+	return exitCode
+}
+
+func runFile(path string, columns []string, cfg config) (res fileResult) {
+	res = fileResult{name: filepath.Base(path), parts: make(map[string]partResult)}
+	defer func() {
+		if r := recover(); r != nil {
+			res.err = describe(r)
+		}
+	}()
+
+	f, err := os.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	compiled, errs := lang.Compile(strings.TrimSpace(string(f)))
+	if len(errs) > 0 {
+		panic(errs[0])
+	}
+
+	// script output would break up the table
+	opts := append(cfg.programOptions(), lang.WithOutput(io.Discard), lang.WithTimeout(cfg.timeout))
+	ev := compiled.NewEvaluator(opts...)
+	if cfg.vm {
+		ev.EnableVM()
+	}
+
+	if cfg.test && !ev.HasSection("test") {
+		panic("no test section")
+	}
+
+	input := ""
+	for _, part := range columns {
+		if !ev.HasSection(part) || cfg.test && !ev.HasSection("test_"+part) {
+			continue
+		}
+		next := "file"
+		if cfg.test {
+			next = testInput(ev, part)
+		}
+		if next != input {
+			input = next
+			readInput(ev, input)
+		}
+		res.parts[part] = runPart(ev, part, cfg.test)
+	}
+	return res
+}
+
+// runPart runs a part, checking it against its test_ section when testing.
+// An error fails the part rather than the whole file.
+func runPart(ev *lang.Evaluator, part string, test bool) (res partResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			res = partResult{text: "✗ " + describe(r)}
+		}
+	}()
+
+	var expected lang.Value
+	if test {
+		expected = evalSection(ev, "test_"+part)
+	}
+	start := time.Now()
+	actual := evalSection(ev, part)
+	took := time.Since(start)
+
+	if !test {
+		return partResult{text: actual.Repr(), ok: true, took: took}
+	}
+	ok, err := expected.Compare(actual)
+	if err != nil {
+		panic(err)
+	}
+	if !ok {
+		return partResult{text: "✗", took: took}
+	}
+	return partResult{text: "✓", ok: true, took: took}
+}
+
+// describe turns a recovered panic into a short message for the table
+func describe(r interface{}) string {
+	if e, ok := r.(lang.Error); ok {
+		if e.Line > 0 {
+			return fmt.Sprintf("%s on line %d: %s", e.Tag, e.Line, e.Msg)
+		}
+		return fmt.Sprintf("%s: %s", e.Tag, e.Msg)
+	}
+	return fmt.Sprint(r)
+}
+
+// answers longer than this are cut short in the table
+const maxCell = 24
+
+func cell(s string) string {
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if r := []rune(s); len(r) > maxCell {
+		return string(r[:maxCell-1]) + "…"
+	}
+	return s
+}
+
+func printTable(w io.Writer, results []fileResult, columns []string, test bool) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "file")
+	for _, col := range columns {
+		fmt.Fprintf(tw, "\t%s\ttime", col)
+	}
+	fmt.Fprintln(tw)
+
+	totals := make([]time.Duration, len(columns))
+	passed, failed := 0, 0
+	for _, res := range results {
+		fmt.Fprint(tw, res.name)
+		if res.err != "" {
+			fmt.Fprintf(tw, "\t✗ %s\n", cell(res.err))
+			failed++
+			continue
+		}
+		for i, col := range columns {
+			part, ok := res.parts[col]
+			if !ok {
+				fmt.Fprint(tw, "\t-\t")
+				continue
+			}
+			fmt.Fprintf(tw, "\t%s\t%s", cell(part.text), formatDuration(part.took))
+			totals[i] += part.took
+			if part.ok {
+				passed++
+			} else {
+				failed++
+			}
+		}
+		fmt.Fprintln(tw)
+	}
+
+	fmt.Fprint(tw, "total")
+	for i := range columns {
+		fmt.Fprintf(tw, "\t\t%s", formatDuration(totals[i]))
+	}
+	fmt.Fprintln(tw)
+	tw.Flush()
+
+	if test {
+		fmt.Fprintf(w, "%d passed, %d failed\n", passed, failed)
+	} else if failed > 0 {
+		fmt.Fprintf(w, "%d failed\n", failed)
+	}
+}
@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTestDirectory(t *testing.T) {
+	var stderr bytes.Buffer
+	var code int
+	out := captureStdout(t, func() {
+		code = RunArgs([]string{"-t", "../tests"}, &stderr)
+	})
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d\n%s%s", code, out, stderr.String())
+	}
+
+	files, _ := filepath.Glob("../tests/*.aoc")
+	for _, file := range files {
+		if !strings.Contains(out, filepath.Base(file)) {
+			t.Errorf("expected a row for %s, got\n%s", file, out)
+		}
+	}
+	if !strings.Contains(out, "\ntotal ") || !strings.Contains(out, " passed, 0 failed\n") {
+		t.Errorf("expected a totals row and a summary, got\n%s", out)
+	}
+}
+
+func TestDirectoryKeepsGoingAfterFailures(t *testing.T) {
+	dir := t.TempDir()
+	programs := map[string]string{
+		"a_broken.aoc": "part1: {",
+		"b_fails.aoc":  "test: ''\ntest_part1: 1\npart1: {\n  return 2\n}",
+		"c_errors.aoc": "test: ''\ntest_part1: 1\npart1: {\n  return nope\n}",
+		"d_passes.aoc": "test: ''\ntest_part1: 1\npart1: {\n  return 1\n}",
+	}
+	for name, src := range programs {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stderr bytes.Buffer
+	var code int
+	out := captureStdout(t, func() {
+		code = RunArgs([]string{"-t", dir}, &stderr)
+	})
+	if code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	for _, name := range []string{"a_broken.aoc", "b_fails.aoc", "c_errors.aoc", "d_passes.aoc"} {
+		if !strings.Contains(out, name) {
+			t.Errorf("expected a row for %s, got\n%s", name, out)
+		}
+	}
+	if !strings.Contains(out, "1 passed, 3 failed\n") {
+		t.Errorf("expected a summary, got\n%s", out)
+	}
+}
+
+func TestRunGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"day1.aoc", "day2.aoc", "other.aoc"} {
+		src := "file: 'x'\npart1: {\n  return '" + name + "'\n}"
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stderr bytes.Buffer
+	out := captureStdout(t, func() {
+		if code := RunArgs([]string{filepath.Join(dir, "day*.aoc")}, &stderr); code != 0 {
+			t.Errorf("expected exit code 0, got %d\n%s", code, stderr.String())
+		}
+	})
+	if !strings.Contains(out, "'day2.aoc'") || strings.Contains(out, "other.aoc") {
+		t.Errorf("expected only the matching files' answers, got\n%s", out)
+	}
+}
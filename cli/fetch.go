@@ -0,0 +1,131 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// adventofcode.com asks for a user agent that says where requests come from
+const userAgent = "github.com/alligator/advent-of-code-2021-lang"
+
+// httpClient is the part of http.Client fetch uses, tests swap in a fake
+type httpClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// the client and site aoc fetch downloads from
+var (
+	fetchClient  httpClient = http.DefaultClient
+	fetchBaseURL            = "https://adventofcode.com"
+)
+
+// fetch is aoc fetch: it downloads a day's input to input/dayNN.txt, where
+// aoc new's template reads it from. An input that's already there is never
+// downloaded again.
+func fetch(args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet("aoc fetch", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	day := flags.Int("day", 0, "the day to download, from 1 to 25")
+	year := flags.Int("year", 2021, "the year of the puzzle")
+	dir := flags.String("dir", ".", "download into input/ in this directory")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if *day < 1 || *day > 25 || flags.NArg() > 0 {
+		fmt.Fprintln(stderr, "usage: aoc fetch --day N [--year YYYY], the day is from 1 to 25")
+		return 2
+	}
+
+	path := filepath.Join(*dir, "input", fmt.Sprintf("day%02d.txt", *day))
+	if _, err := os.Stat(path); err == nil {
+		fmt.Printf("%s is already there\n", path)
+		return 0
+	}
+
+	session, err := findSession()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	input, err := fetchInput(fetchClient, fetchBaseURL, *year, *day, session)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if err := os.WriteFile(path, []byte(input), 0o644); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Printf("downloaded %s\n", path)
+	return 0
+}
+
+// findSession returns the adventofcode.com session cookie from $AOC_SESSION,
+// or failing that the aoc/session file in the user's config directory
+func findSession() (string, error) {
+	if s := strings.TrimSpace(os.Getenv("AOC_SESSION")); s != "" {
+		return s, nil
+	}
+	config, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("no session cookie, set AOC_SESSION to the session cookie from adventofcode.com")
+	}
+	path := filepath.Join(config, "aoc", "session")
+	f, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("no session cookie, set AOC_SESSION or put the session cookie from adventofcode.com in %s", path)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(f)), nil
+}
+
+func fetchInput(client httpClient, baseURL string, year int, day int, session string) (string, error) {
+	url := fmt.Sprintf("%s/%d/day/%d/input", baseURL, year, day)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.AddCookie(&http.Cookie{Name: "session", Value: session})
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", fmt.Errorf("day %d of %d isn't out yet", day, year)
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusInternalServerError:
+		// adventofcode.com gives a 400 for a missing session and a 500 for
+		// one that's expired or made up
+		return "", fmt.Errorf("adventofcode.com didn't accept the session cookie, it might have expired (%s)", resp.Status)
+	default:
+		return "", fmt.Errorf("couldn't download %s: %s", url, resp.Status)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
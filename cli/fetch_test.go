@@ -0,0 +1,109 @@
+package cli
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeSite answers requests like adventofcode.com would, with status and
+// body, and remembers the last request
+type fakeSite struct {
+	status int
+	body   string
+	req    *http.Request
+	calls  int
+}
+
+func (f *fakeSite) Do(req *http.Request) (*http.Response, error) {
+	f.req = req
+	f.calls++
+	return &http.Response{
+		StatusCode: f.status,
+		Status:     http.StatusText(f.status),
+		Body:       io.NopCloser(strings.NewReader(f.body)),
+	}, nil
+}
+
+func fakeFetch(t *testing.T, site *fakeSite) {
+	t.Helper()
+	client := fetchClient
+	fetchClient = site
+	t.Cleanup(func() { fetchClient = client })
+	t.Setenv("AOC_SESSION", "cookie")
+}
+
+func TestFetch(t *testing.T) {
+	site := &fakeSite{status: http.StatusOK, body: "1\n2\n3\n"}
+	fakeFetch(t, site)
+	dir := t.TempDir()
+
+	for i := 0; i < 2; i++ {
+		var stderr bytes.Buffer
+		captureStdout(t, func() {
+			if code := RunArgs([]string{"fetch", "--dir", dir, "--day", "7"}, &stderr); code != 0 {
+				t.Fatalf("expected exit code 0, got %d\n%s", code, stderr.String())
+			}
+		})
+	}
+
+	if site.calls != 1 {
+		t.Errorf("expected the input to be downloaded once, got %d requests", site.calls)
+	}
+	if url := site.req.URL.String(); url != "https://adventofcode.com/2021/day/7/input" {
+		t.Errorf("expected the 2021 day 7 input, got %s", url)
+	}
+	if c, err := site.req.Cookie("session"); err != nil || c.Value != "cookie" {
+		t.Errorf("expected the session cookie, got %v %v", c, err)
+	}
+	if ua := site.req.Header.Get("User-Agent"); ua != userAgent {
+		t.Errorf("expected the user agent %q, got %q", userAgent, ua)
+	}
+	if input, _ := os.ReadFile(filepath.Join(dir, "input", "day07.txt")); string(input) != site.body {
+		t.Errorf("expected the input to be written, got %q", input)
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	for _, test := range []struct {
+		status int
+		msg    string
+	}{
+		{http.StatusNotFound, "day 7 of 2021 isn't out yet"},
+		{http.StatusBadRequest, "didn't accept the session cookie"},
+		{http.StatusInternalServerError, "didn't accept the session cookie"},
+		{http.StatusTeapot, "couldn't download https://adventofcode.com/2021/day/7/input: I'm a teapot"},
+	} {
+		fakeFetch(t, &fakeSite{status: test.status})
+		dir := t.TempDir()
+		var stderr bytes.Buffer
+		if code := RunArgs([]string{"fetch", "--dir", dir, "--day", "7"}, &stderr); code != 1 {
+			t.Errorf("%d: expected exit code 1, got %d", test.status, code)
+		}
+		if !strings.Contains(stderr.String(), test.msg) {
+			t.Errorf("%d: expected %q, got %q", test.status, test.msg, stderr.String())
+		}
+		if _, err := os.Stat(filepath.Join(dir, "input")); err == nil {
+			t.Errorf("%d: expected nothing to be written", test.status)
+		}
+	}
+}
+
+func TestFetchNeedsSession(t *testing.T) {
+	fakeFetch(t, &fakeSite{status: http.StatusOK})
+	t.Setenv("AOC_SESSION", "")
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	var stderr bytes.Buffer
+	if code := RunArgs([]string{"fetch", "--dir", t.TempDir(), "--day", "1"}, &stderr); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), "no session cookie") {
+		t.Errorf("expected a note about the session, got %q", stderr.String())
+	}
+}
@@ -0,0 +1,48 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+
+	lang "github.com/alligator/advent-of-code-2021-lang/src"
+)
+
+// lintMode is the --lint flag. On its own it prints the warnings and carries
+// on, --lint=strict fails if there are any.
+type lintMode string
+
+const (
+	lintOff    lintMode = ""
+	lintWarn   lintMode = "warn"
+	lintStrict lintMode = "strict"
+)
+
+func (m *lintMode) String() string   { return string(*m) }
+func (m *lintMode) IsBoolFlag() bool { return true }
+
+func (m *lintMode) Set(s string) error {
+	switch s {
+	case "true", "warn":
+		*m = lintWarn
+	case "false":
+		*m = lintOff
+	case "strict":
+		*m = lintStrict
+	default:
+		return fmt.Errorf("expected warn or strict")
+	}
+	return nil
+}
+
+// lint prints a program's warnings to stderr, like file.aoc:12: var x is
+// never used. It returns false if they should stop the program running.
+func lint(compiled *lang.Compiled, path string, mode lintMode, stderr io.Writer) bool {
+	if mode == lintOff {
+		return true
+	}
+	warnings := compiled.Lint()
+	for _, w := range warnings {
+		fmt.Fprintf(stderr, "%s:%d: %s\n", path, w.Line, paint(stderr, "93", w.Msg))
+	}
+	return mode != lintStrict || len(warnings) == 0
+}
@@ -0,0 +1,107 @@
+package cli
+
+import (
+	_ "embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/template"
+)
+
+// the file aoc new starts each day from. {{.Day}} is the day and {{.Input}}
+// the path of its input.
+//
+//go:embed template.aoc
+var dayTemplate string
+
+// newDay is aoc new: it writes dayNN.aoc from the template, and with --input
+// an empty input/dayNN.txt for the puzzle input
+func newDay(args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet("aoc new", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	force := flags.Bool("force", false, "overwrite the day's file if it's already there")
+	input := flags.Bool("input", false, "also create an empty input file")
+	dir := flags.String("dir", ".", "create the files in this directory")
+	templatePath := flags.String("template", "", "use this file as the template rather than the built in one")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	day, err := strconv.Atoi(flags.Arg(0))
+	if flags.NArg() != 1 || err != nil || day < 1 || day > 25 {
+		fmt.Fprintln(stderr, "usage: aoc new [flags] day, the day is from 1 to 25")
+		return 2
+	}
+
+	src := dayTemplate
+	if *templatePath != "" {
+		f, err := os.ReadFile(*templatePath)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		src = string(f)
+	}
+	tmpl, err := template.New("day").Parse(src)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	name := fmt.Sprintf("day%02d", day)
+	inputPath := "input/" + name + ".txt"
+	path := filepath.Join(*dir, name+".aoc")
+	mode := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if *force {
+		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, mode, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		fmt.Fprintf(stderr, "%s already exists, --force overwrites it\n", path)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	err = tmpl.Execute(f, struct{ Day, Input string }{strconv.Itoa(day), inputPath})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Printf("created %s\n", path)
+
+	if *input {
+		// the input is never overwritten, it can't be got back as easily
+		path := filepath.Join(*dir, filepath.FromSlash(inputPath))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, fs.ErrExist) {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		if err := f.Close(); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		fmt.Printf("created %s\n", path)
+	}
+	return 0
+}
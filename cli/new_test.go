@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lang "github.com/alligator/advent-of-code-2021-lang/src"
+)
+
+func TestNewDay(t *testing.T) {
+	dir := t.TempDir()
+	var stderr bytes.Buffer
+	captureStdout(t, func() {
+		if code := RunArgs([]string{"new", "--dir", dir, "--input", "7"}, &stderr); code != 0 {
+			t.Fatalf("expected exit code 0, got %d\n%s", code, stderr.String())
+		}
+	})
+
+	src, err := os.ReadFile(filepath.Join(dir, "day07.aoc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := lang.NewLexer(strings.TrimSpace(string(src)))
+	p := lang.NewParser(&l)
+	if _, errs := p.ParseErr(); len(errs) > 0 {
+		t.Errorf("expected the new day to parse, got %s on line %d", errs[0].Msg, errs[0].Line)
+	}
+	if !strings.Contains(string(src), "read('input/day07.txt')") {
+		t.Errorf("expected the file section to read the input, got\n%s", src)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "input", "day07.txt")); err != nil {
+		t.Errorf("expected an input file: %v", err)
+	}
+}
+
+func TestNewDayOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "day12.aoc")
+	if err := os.WriteFile(path, []byte("solved"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stderr bytes.Buffer
+	captureStdout(t, func() {
+		if code := RunArgs([]string{"new", "--dir", dir, "12"}, &stderr); code != 1 {
+			t.Errorf("expected exit code 1, got %d", code)
+		}
+	})
+	if src, _ := os.ReadFile(path); string(src) != "solved" {
+		t.Fatalf("expected the day to be left alone, got\n%s", src)
+	}
+	if !strings.Contains(stderr.String(), "already exists") {
+		t.Errorf("expected a note about the existing file, got %q", stderr.String())
+	}
+
+	template := filepath.Join(dir, "template.aoc")
+	if err := os.WriteFile(template, []byte("part1: {\n  return {{.Day}}\n}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	captureStdout(t, func() {
+		if code := RunArgs([]string{"new", "--dir", dir, "--force", "--template", template, "12"}, &stderr); code != 0 {
+			t.Errorf("expected exit code 0, got %d\n%s", code, stderr.String())
+		}
+	})
+	if src, _ := os.ReadFile(path); string(src) != "part1: {\n  return 12\n}\n" {
+		t.Errorf("expected --force to overwrite the day from the template, got\n%s", src)
+	}
+}
+
+func TestNewDayUsage(t *testing.T) {
+	for _, args := range [][]string{{"new"}, {"new", "26"}, {"new", "seven"}, {"new", "1", "2"}} {
+		var stderr bytes.Buffer
+		if code := RunArgs(args, &stderr); code != 2 || !strings.Contains(stderr.String(), "usage") {
+			t.Errorf("%v: expected usage and exit code 2, got %d %q", args, code, stderr.String())
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package cli
+
+import "time"
+
+// formatDuration rounds d to a few significant figures for printing:
+// 512µs, 12.3ms, 1.24s
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Millisecond:
+		return d.Round(time.Microsecond).String()
+	case d < time.Second:
+		return d.Round(100 * time.Microsecond).String()
+	}
+	return d.Round(10 * time.Millisecond).String()
+}
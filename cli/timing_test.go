@@ -0,0 +1,27 @@
+package cli
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatDuration(t *testing.T) {
+	for _, test := range []struct {
+		d        time.Duration
+		expected string
+	}{
+		{0, "0s"},
+		{512*time.Microsecond + 400*time.Nanosecond, "512µs"},
+		{999 * time.Microsecond, "999µs"},
+		{time.Millisecond, "1ms"},
+		{12*time.Millisecond + 345*time.Microsecond, "12.3ms"},
+		{340 * time.Millisecond, "340ms"},
+		{999*time.Millisecond + 960*time.Microsecond, "1s"},
+		{1234 * time.Millisecond, "1.23s"},
+		{90 * time.Second, "1m30s"},
+	} {
+		if s := formatDuration(test.d); s != test.expected {
+			t.Errorf("%d: expected %s, got %s", test.d, test.expected, s)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// how often watch mode looks at the files, and how long they have to stay
+// the same before a change counts, editors often write a file more than once
+// per save
+var (
+	pollInterval = 200 * time.Millisecond
+	settleTime   = 100 * time.Millisecond
+)
+
+// watch runs the program, then runs it again every time it or one of the
+// files it read changes, until interrupt receives something. That stops a
+// run that's in progress too. Every run compiles the program from scratch.
+func watch(path string, cfg config, stderr io.Writer, interrupt <-chan os.Signal) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	cfg.ctx = ctx
+
+	for {
+		// clear the screen, if there is one
+		if isTerminal(os.Stdout) {
+			fmt.Print("\x1b[H\x1b[2J")
+		}
+		_, read := runProgram(path, cfg, stderr)
+		if ctx.Err() != nil {
+			return 0
+		}
+		fmt.Printf("\nwatching %s for changes, ctrl-c to stop\n", path)
+
+		files := append([]string{path}, read...)
+		if !waitForChange(files, ctx.Done()) {
+			return 0
+		}
+	}
+}
+
+// fileState is enough to notice a file has been written
+type fileState struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+func statFiles(files []string) []fileState {
+	states := make([]fileState, len(files))
+	for i, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			states[i] = fileState{info.ModTime(), info.Size(), true}
+		}
+	}
+	return states
+}
+
+func sameStates(a, b []fileState) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// waitForChange blocks until one of files changes and then stays the same
+// for settleTime. It returns false if it was interrupted instead.
+func waitForChange(files []string, interrupt <-chan struct{}) bool {
+	before := statFiles(files)
+	for {
+		select {
+		case <-interrupt:
+			return false
+		case <-time.After(pollInterval):
+		}
+
+		now := statFiles(files)
+		if sameStates(before, now) {
+			continue
+		}
+
+		// wait for the writes to stop
+		for {
+			select {
+			case <-interrupt:
+				return false
+			case <-time.After(settleTime):
+			}
+			settled := statFiles(files)
+			if sameStates(now, settled) {
+				return true
+			}
+			now = settled
+		}
+	}
+}
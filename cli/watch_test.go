@@ -0,0 +1,72 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchRerunsOnChange(t *testing.T) {
+	pollInterval, settleTime = 10*time.Millisecond, 10*time.Millisecond
+	defer func() { pollInterval, settleTime = 200*time.Millisecond, 100*time.Millisecond }()
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.txt")
+	if err := os.WriteFile(input, []byte("1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path := writeProgram(t, "test: read('"+input+"')\ntest_part1: '1'\npart1: {\n  return input\n}")
+
+	interrupt := make(chan os.Signal, 1)
+	go func() {
+		// the input the program reads is watched along with the program
+		time.Sleep(200 * time.Millisecond)
+		os.WriteFile(input, []byte("2"), 0o644)
+		time.Sleep(200 * time.Millisecond)
+		os.WriteFile(path, []byte("part1: {"), 0o644)
+		time.Sleep(200 * time.Millisecond)
+		interrupt <- os.Interrupt
+	}()
+
+	var stderr bytes.Buffer
+	var code int
+	out := captureStdout(t, func() {
+		code = watch(path, config{test: true}, &stderr, interrupt)
+	})
+	if code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if !strings.Contains(out, "1 passed, 0 failed") || !strings.Contains(out, "0 passed, 1 failed") {
+		t.Errorf("expected a passing run then a failing one, got\n%s", out)
+	}
+	// a parse error doesn't stop watching
+	if !strings.Contains(stderr.String(), "parse error") || strings.Count(out, "watching") != 3 {
+		t.Errorf("expected a third run with a parse error, got\n%s\n%s", out, stderr.String())
+	}
+}
+
+func TestWatchInterruptStopsARun(t *testing.T) {
+	path := writeProgram(t, "test: ''\ntest_part1: 1\npart1: {\n  for {}\n}")
+
+	interrupt := make(chan os.Signal, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		interrupt <- os.Interrupt
+	}()
+
+	var stderr bytes.Buffer
+	start := time.Now()
+	var code int
+	out := captureStdout(t, func() {
+		code = watch(path, config{test: true}, &stderr, interrupt)
+	})
+	if code != 0 || time.Since(start) > 2*time.Second {
+		t.Errorf("expected the loop to stop and exit 0, got %d after %v", code, time.Since(start))
+	}
+	if strings.Contains(out, "watching") {
+		t.Errorf("expected no more watching after the interrupt, got\n%s", out)
+	}
+}
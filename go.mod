@@ -1,3 +1,3 @@
 module github.com/alligator/advent-of-code-2021-lang
 
-go 1.17
+go 1.18
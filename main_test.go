@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMainOnlyCallsRun keeps the binary a thin wrapper around cli.Run, so
+// everything it does goes through the code the tests use.
+func TestMainOnlyCallsRun(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if file != "main.go" && !strings.HasSuffix(file, "_test.go") {
+			t.Errorf("%s: only main.go belongs in package main, put code in cli", file)
+		}
+	}
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "main.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Decls) != 2 || f.Scope.Lookup("main") == nil {
+		t.Fatalf("main.go should only have its imports and func main")
+	}
+
+	var body bytes.Buffer
+	printer.Fprint(&body, fset, f.Scope.Lookup("main").Decl)
+	expected := "func main() {\n\tos.Exit(cli.Run())\n}"
+	if body.String() != expected {
+		t.Fatalf("expected main.go to be\n%s\nbut got\n%s", expected, body.String())
+	}
+}
@@ -0,0 +1,176 @@
+package lang
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Compiled is a parsed program. Any number of evaluators can be made from it,
+// each with its own globals and input.
+type Compiled struct {
+	prog Program
+	lex  Lexer
+}
+
+// Compile parses src, returning every error found
+func Compile(src string) (*Compiled, []Error) {
+	c := &Compiled{lex: NewLexer(src)}
+	p := NewParser(&c.lex)
+	prog, errs := p.ParseErr()
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	c.prog = prog
+	return c, nil
+}
+
+// Option configures an evaluator made by Compiled.NewEvaluator
+type Option func(*options)
+
+type options struct {
+	output  io.Writer
+	stdin   io.Reader
+	profile bool
+	vars    map[string]Value
+	timeout time.Duration
+	ctx     context.Context
+
+	traceOut   io.Writer
+	traceLimit int
+
+	debugger *Debugger
+
+	clock func() time.Time
+
+	progress io.Writer
+}
+
+// WithOutput sends the output of print and println to w instead of stdout
+func WithOutput(w io.Writer) Option {
+	return func(o *options) { o.output = w }
+}
+
+// WithStdin makes stdin() read from r instead of os.Stdin
+func WithStdin(r io.Reader) Option {
+	return func(o *options) { o.stdin = r }
+}
+
+// WithClock makes clock_ms and now get the time from clock rather than the
+// system clock. The evaluator's start time is the first time it calls it.
+func WithClock(clock func() time.Time) Option {
+	return func(o *options) { o.clock = clock }
+}
+
+// WithProgress draws progress()'s bar on w, which should be a terminal. Without
+// it progress does nothing.
+func WithProgress(w io.Writer) Option {
+	return func(o *options) { o.progress = w }
+}
+
+// WithProfiling records the time spent in each part of the program, for
+// PrintProfile and WriteProfile
+func WithProfiling() Option {
+	return func(o *options) { o.profile = true }
+}
+
+// WithTimeout stops each section with a runtime error if it runs for longer
+// than d
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) { o.timeout = d }
+}
+
+// WithContext stops each section with a runtime error once ctx is done, like
+// EvalSectionContext does for one section. A timeout still applies on top.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) { o.ctx = ctx }
+}
+
+// WithTrace writes each statement to w as it runs, along with the values
+// variables are set to and the arguments of calls. It stops after limit
+// lines, or never if limit is 0. Tracing keeps everything on the
+// tree-walker, EnableVM does nothing.
+func WithTrace(w io.Writer, limit int) Option {
+	return func(o *options) { o.traceOut, o.traceLimit = w, limit }
+}
+
+// WithDebugger runs the program under d. Like tracing it keeps everything on
+// the tree-walker.
+func WithDebugger(d *Debugger) Option {
+	return func(o *options) { o.debugger = d }
+}
+
+// WithVar makes name a global holding v. The program's own functions take
+// precedence over it.
+func WithVar(name string, v Value) Option {
+	return func(o *options) {
+		if o.vars == nil {
+			o.vars = make(map[string]Value)
+		}
+		o.vars[name] = v
+	}
+}
+
+// NewEvaluator returns an evaluator for the program, ready for ReadInput
+// and EvalSection
+func (c *Compiled) NewEvaluator(opts ...Option) *Evaluator {
+	o := options{output: os.Stdout, stdin: os.Stdin}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	ev := newEvaluator(&c.prog, &c.lex, o)
+	return &ev
+}
+
+// NewBareEvaluator returns an evaluator with no program, only the natives,
+// for calling them from Go with CallNative
+func NewBareEvaluator(opts ...Option) *Evaluator {
+	c, _ := Compile("")
+	return c.NewEvaluator(opts...)
+}
+
+// SetOutput sends the output of print and println to w from now on
+func (ev *Evaluator) SetOutput(w io.Writer) {
+	ev.out = w
+}
+
+// Output returns where print and println write to
+func (ev *Evaluator) Output() io.Writer {
+	return ev.out
+}
+
+// RegisterNative adds a builtin function called name, replacing any global
+// already called that. An error returned from fn is raised as a runtime
+// error on the line of the call, like the built in natives' errors.
+func (ev *Evaluator) RegisterNative(name string, fn func(*Evaluator, []Value) (Value, error)) {
+	native := func(ev *Evaluator, args []Value) Value {
+		v, err := fn(ev, args)
+		if err != nil {
+			// EvalSection fills in the line of the call
+			panic(E(RuntimeError, err.Error(), 0))
+		}
+		return v
+	}
+	ev.setGlobal(name, &Value{Tag: ValNativeFn, NativeFn: native})
+}
+
+// CallNative calls the native called name with args, returning the error it
+// raises rather than panicking. The error has no line, there's no call in
+// the program for it to point at. A native that calls a function back, like
+// pmap, has to be given another native rather than a fn from the program.
+func (ev *Evaluator) CallNative(name string, args ...Value) (v Value, err error) {
+	fnVal, present := ev.findGlobal(name)
+	if !present || fnVal.Tag != ValNativeFn {
+		return NilValue, fmt.Errorf("%s isn't a native", name)
+	}
+	env, frames, argStack, native := ev.env, len(ev.frames), len(ev.argStack), ev.native
+	defer func() {
+		if r := recover(); r != nil {
+			ev.env, ev.frames, ev.argStack, ev.native = env, ev.frames[:frames], ev.argStack[:argStack], native
+			v, err = NilValue, asError(r)
+		}
+	}()
+	return fnVal.NativeFn(ev, args), nil
+}
@@ -0,0 +1,309 @@
+package lang
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustCompile(t *testing.T, src string) *Compiled {
+	t.Helper()
+	c, errs := Compile(src)
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	return c
+}
+
+func TestCompileReturnsErrors(t *testing.T) {
+	c, errs := Compile("part1: {\n  var = 1\n}")
+	if c != nil || len(errs) == 0 {
+		t.Fatal("expected a parse error")
+	}
+	if errs[0].Line != 2 {
+		t.Errorf("expected the error on line 2, got %d", errs[0].Line)
+	}
+}
+
+func TestEvalSectionReturnsErrors(t *testing.T) {
+	ev := mustCompile(t, "part1: {\n  assert(0, 'nope')\n}").NewEvaluator()
+
+	_, err := ev.EvalSection("part1")
+	e, ok := err.(Error)
+	if !ok {
+		t.Fatalf("expected an Error, got %v", err)
+	}
+	if e.Tag != RuntimeError || e.Line != 2 {
+		t.Errorf("expected a runtime error on line 2, got %s on line %d", e.Tag, e.Line)
+	}
+
+	// the evaluator is still usable afterwards
+	if _, err := ev.EvalSection("missing"); err == nil {
+		t.Error("expected an error for a missing section")
+	}
+}
+
+func TestEvaluatorOptions(t *testing.T) {
+	c := mustCompile(t, "part1: {\n  println('hello', greeting)\n  return greeting\n}")
+
+	var out bytes.Buffer
+	ev := c.NewEvaluator(WithOutput(&out), WithVar("greeting", Value{Tag: ValStr, Str: "world"}))
+	v, err := ev.EvalSection("part1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Str != "world" {
+		t.Errorf("expected world, got %s", v.Repr())
+	}
+	if out.String() != "hello world\n" {
+		t.Errorf("expected the output to be captured, got %q", out.String())
+	}
+
+	// evaluators from the same program don't share globals
+	other := c.NewEvaluator(WithOutput(&bytes.Buffer{}))
+	if _, err := other.EvalSection("part1"); err == nil {
+		t.Error("expected greeting to be unknown without WithVar")
+	}
+}
+
+func ExampleEvaluator_RegisterNative() {
+	c, _ := Compile(`part1: {
+  return shout('hello') + ' ' + shout('world')
+}`)
+	ev := c.NewEvaluator()
+	ev.RegisterNative("shout", func(ev *Evaluator, args []Value) (Value, error) {
+		if len(args) != 1 {
+			return NilValue, errors.New("shout expects 1 argument")
+		}
+		s, ok := args[0].AsStr()
+		if !ok {
+			return NilValue, fmt.Errorf("shout expects a string, got a %s", args[0].Tag)
+		}
+		return NewStr(strings.ToUpper(s) + "!"), nil
+	})
+
+	v, _ := ev.EvalSection("part1")
+	fmt.Println(v.Str)
+	// Output: HELLO! WORLD!
+}
+
+func TestRegisterNativeError(t *testing.T) {
+	for _, vm := range []bool{false, true} {
+		ev := mustCompile(t, "part1: {\n  var x = 1\n  return fail(x)\n}").NewEvaluator()
+		if vm {
+			ev.EnableVM()
+		}
+		ev.RegisterNative("fail", func(ev *Evaluator, args []Value) (Value, error) {
+			return NilValue, errors.New("failed on purpose")
+		})
+
+		_, err := ev.EvalSection("part1")
+		e, ok := err.(Error)
+		if !ok {
+			t.Fatalf("vm %v: expected an Error, got %v", vm, err)
+		}
+		if e.Tag != RuntimeError || e.Line != 3 || e.Msg != "failed on purpose" {
+			t.Errorf("vm %v: expected a runtime error on line 3, got %s on line %d: %s", vm, e.Tag, e.Line, e.Msg)
+		}
+	}
+}
+
+func TestCallNative(t *testing.T) {
+	var out bytes.Buffer
+	ev := NewBareEvaluator(WithOutput(&out))
+	if _, err := ev.CallNative("println", NewStr("hi"), NewNum(1)); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hi 1\n" {
+		t.Errorf("expected hi 1, got %q", out.String())
+	}
+
+	_, err := ev.CallNative("split", NewNum(1))
+	e, ok := err.(Error)
+	if !ok || e.Tag != RuntimeError || e.Line != 0 {
+		t.Errorf("expected a runtime error without a line, got %#v", err)
+	}
+
+	// natives a program registers can be called too, but not its functions
+	ev = mustCompile(t, "fn double(n) {\n  return n * 2\n}").NewEvaluator()
+	ev.RegisterNative("triple", func(ev *Evaluator, args []Value) (Value, error) {
+		return NewNum(args[0].Num * 3), nil
+	})
+	if v, err := ev.CallNative("triple", NewNum(2)); err != nil || v.Repr() != "6" {
+		t.Errorf("expected 6, got %s, %v", v.Repr(), err)
+	}
+	for _, name := range []string{"double", "missing"} {
+		if _, err := ev.CallNative(name); err == nil || err.Error() != name+" isn't a native" {
+			t.Errorf("expected %s not to be a native, got %v", name, err)
+		}
+	}
+}
+
+func TestValueHelpers(t *testing.T) {
+	arr := NewArray([]Value{NewNum(1), NewStr("two")})
+	items, ok := arr.AsArray()
+	if !ok || len(items) != 2 {
+		t.Fatalf("expected two items, got %s", arr.Repr())
+	}
+	if n, ok := items[0].AsNum(); !ok || n != 1 {
+		t.Errorf("expected 1, got %s", items[0].Repr())
+	}
+	if _, ok := items[1].AsNum(); ok {
+		t.Error("expected a string not to be a number")
+	}
+
+	m := NewMap(map[string]Value{"a": arr})
+	if got, ok := m.AsMap(); !ok || got["a"].Tag != ValArray {
+		t.Errorf("expected a map holding an array, got %s", m.Repr())
+	}
+}
+
+func TestPrintOutput(t *testing.T) {
+	ev := mustCompile(t, `part1: {
+  print('a', 1, nil)
+  print(['b'], 2)
+  println()
+  println('c', 'd')
+}`).NewEvaluator()
+
+	var out bytes.Buffer
+	ev.SetOutput(&out)
+	if _, err := ev.EvalSection("part1"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "a 1 nil['b'] 2\nc d\n"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	src := "part1: {\n  for {}\n}\npart2: {\n  return 2\n}"
+	for _, vm := range []bool{false, true} {
+		ev := mustCompile(t, src).NewEvaluator()
+		if vm {
+			ev.EnableVM()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		_, err := ev.EvalSectionContext(ctx, "part1")
+		cancel()
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("vm %v: took %v to stop", vm, elapsed)
+		}
+		e, ok := err.(Error)
+		if !ok || e.Tag != RuntimeError || e.Msg != "execution timed out" || e.Line != 2 {
+			t.Errorf("vm %v: expected a timeout on line 2, got %v", vm, err)
+		}
+
+		// the next section isn't affected
+		if v, err := ev.EvalSection("part2"); err != nil || v.Num != 2 {
+			t.Errorf("vm %v: expected part2 to return 2, got %v %v", vm, v.Repr(), err)
+		}
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	ev := mustCompile(t, "part1: {\n  for {}\n}").NewEvaluator(WithTimeout(50 * time.Millisecond))
+	_, err := ev.EvalSection("part1")
+	if e, ok := err.(Error); !ok || e.Msg != "execution timed out" {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ev := mustCompile(t, "part1: {\n  for {}\n}").NewEvaluator(WithContext(ctx), WithTimeout(time.Minute))
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := ev.EvalSection("part1")
+	if e, ok := err.(Error); !ok || e.Msg != "execution cancelled" {
+		t.Errorf("expected the section to be cancelled, got %v", err)
+	}
+}
+
+func TestTimeoutIsntCaught(t *testing.T) {
+	src := "part1: {\n  for {\n    try {\n      var x = 1\n    } catch e {\n    }\n  }\n}"
+	ev := mustCompile(t, src).NewEvaluator(WithTimeout(50 * time.Millisecond))
+	_, err := ev.EvalSection("part1")
+	if e, ok := err.(Error); !ok || e.Msg != "execution timed out" {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func TestCRLF(t *testing.T) {
+	src := "test: 'a b\n1 2\n'\npart1: {\n\tvar out = []\n\tfor line in lines {\n\t\tout = push(out, split(line, ' '))\n\t}\n\treturn [out, split(input, '\n'), 'x\ny']\n}"
+	run := func(src string) string {
+		ev := mustCompile(t, src).NewEvaluator()
+		input, err := ev.EvalSection("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev.ReadInput(input.Str)
+		v, err := ev.EvalSection("part1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v.Repr()
+	}
+
+	lf := run(src)
+	crlf := run(strings.ReplaceAll(src, "\n", "\r\n"))
+	if lf != crlf {
+		t.Errorf("expected CRLF to match LF\n%s\ngot\n%s", lf, crlf)
+	}
+
+	ev := mustCompile(t, "part1: {\n  return lines\n}").NewEvaluator()
+	ev.ReadInput("a\r\nb\r\n")
+	v, _ := ev.EvalSection("part1")
+	if v.Repr() != "['a', 'b']" {
+		t.Errorf("expected the \\r to be stripped, got %s", v.Repr())
+	}
+}
+
+func TestWithStdin(t *testing.T) {
+	c := mustCompile(t, `file: stdin()
+part1: {
+  return stdin() + stdin()
+}`)
+	ev := c.NewEvaluator(WithStdin(strings.NewReader("3,4\n")))
+	v, err := ev.EvalSection("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Str != "3,4\n" {
+		t.Errorf("expected stdin, got %s", v.Repr())
+	}
+
+	// the reader is at EOF now, later calls see the same input
+	v, err = ev.EvalSection("part1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Str != "3,4\n3,4\n" {
+		t.Errorf("expected stdin twice, got %s", v.Repr())
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	// each look at the clock moves it on 1.5 seconds
+	at := time.Date(2021, time.December, 7, 9, 30, 0, 0, time.UTC)
+	clock := func() time.Time {
+		now := at
+		at = at.Add(1500 * time.Millisecond)
+		return now
+	}
+	ev := mustCompile(t, `part1: {
+  return [clock_ms(), clock_ms(), now()]
+}`).NewEvaluator(WithClock(clock))
+	v, err := ev.EvalSection("part1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "[1500, 3000, '2021-12-07 09:30:04']"; v.Repr() != expected {
+		t.Errorf("expected %s, got %s", expected, v.Repr())
+	}
+}
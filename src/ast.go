@@ -1,9 +1,5 @@
 package lang
 
-import (
-	"go/ast"
-)
-
 // interfaces
 type (
 	Node interface {
@@ -25,6 +21,7 @@ type (
 //
 type Program struct {
 	Stmts []Stmt // either StmtSection or StmtExpr -> ExprFunc
+	notes []lintNote
 }
 
 func (p *Program) Pos() int      { return 0 }
@@ -42,6 +39,7 @@ type ExprString struct {
 type ExprIdentifier struct {
 	Identifier string
 	token      Token
+	local      local // filled in by the resolver
 }
 
 type ExprNum struct {
@@ -49,6 +47,11 @@ type ExprNum struct {
 	token Token
 }
 
+type ExprFloat struct {
+	Float float64
+	token Token
+}
+
 type ExprNil struct {
 	token Token
 }
@@ -64,7 +67,7 @@ type ExprMap struct {
 }
 
 type ExprMapItem struct {
-	Key   string
+	Key   MapKey
 	Value Expr
 }
 
@@ -83,18 +86,54 @@ type ExprFuncall struct {
 	Identifier      Expr
 	Args            []Expr
 	identifierToken Token
+	Spread          bool // the last argument is an array spread into the rest
 }
 
 type ExprFunc struct {
 	Identifier   string
 	Args         []string
+	Defaults     []Expr // the default for each arg, nil if it doesn't have one
+	Variadic     bool   // the last arg collects the rest of the call's arguments
 	Body         Stmt
 	openingToken Token
+	needsEnv     bool // false if a call can skip creating a scope
+	slot         int  // where the function's name is bound, -1 for globals
+	slots        int  // locals in the function's env
+	names        []string
+}
+
+const anonymousFn = "<anonymous>"
+
+// required is how many args a call has to pass, the ones before the first
+// with a default
+func (fn *ExprFunc) required() int {
+	for i, d := range fn.Defaults {
+		if d != nil {
+			return i
+		}
+	}
+	return fn.fixed()
+}
+
+// fixed is how many args aren't the rest of a variadic function
+func (fn *ExprFunc) fixed() int {
+	if fn.Variadic {
+		return len(fn.Args) - 1
+	}
+	return len(fn.Args)
+}
+
+// ExprMatch is a match used as an expression, its value is the value of the
+// case that matched
+type ExprMatch struct {
+	Match *StmtMatch
+	token Token
 }
 
 func (e *ExprString) Token() *Token     { return &e.token }
 func (e *ExprIdentifier) Token() *Token { return &e.token }
 func (e *ExprNum) Token() *Token        { return &e.token }
+func (e *ExprFloat) Token() *Token      { return &e.token }
 func (e *ExprNil) Token() *Token        { return &e.token }
 func (e *ExprArray) Token() *Token      { return &e.openingToken }
 func (e *ExprMap) Token() *Token        { return &e.openingtoken }
@@ -102,10 +141,12 @@ func (e *ExprBinary) Token() *Token     { return &e.Op }
 func (e *ExprUnary) Token() *Token      { return &e.Op }
 func (e *ExprFuncall) Token() *Token    { return &e.identifierToken }
 func (e *ExprFunc) Token() *Token       { return &e.openingToken }
+func (e *ExprMatch) Token() *Token      { return &e.token }
 
 func (e *ExprString) Name() string     { return "<string>" }
 func (e *ExprIdentifier) Name() string { return e.Identifier }
 func (e *ExprNum) Name() string        { return "<number>" }
+func (e *ExprFloat) Name() string      { return "<float>" }
 func (e *ExprNil) Name() string        { return "nil" }
 func (e *ExprArray) Name() string      { return "<array>" }
 func (e *ExprMap) Name() string        { return "<map>" }
@@ -113,10 +154,12 @@ func (e *ExprBinary) Name() string     { return "" }
 func (e *ExprUnary) Name() string      { return "" }
 func (e *ExprFuncall) Name() string    { return e.Identifier.Name() }
 func (e *ExprFunc) Name() string       { return e.Identifier }
+func (e *ExprMatch) Name() string      { return "" }
 
 func (*ExprString) exprNode()     {}
 func (*ExprIdentifier) exprNode() {}
 func (*ExprNum) exprNode()        {}
+func (*ExprFloat) exprNode()      {}
 func (*ExprNil) exprNode()        {}
 func (*ExprArray) exprNode()      {}
 func (*ExprMap) exprNode()        {}
@@ -124,6 +167,7 @@ func (*ExprBinary) exprNode()     {}
 func (*ExprUnary) exprNode()      {}
 func (*ExprFuncall) exprNode()    {}
 func (*ExprFunc) exprNode()       {}
+func (*ExprMatch) exprNode()      {}
 
 //
 // statements
@@ -135,12 +179,16 @@ type StmtExpr struct {
 type StmtBlock struct {
 	Body         []Stmt
 	openingToken Token
+	slots        int
+	names        []string
+	noEnv        bool // nothing's declared in it, see the resolver
 }
 
 type StmtVar struct {
 	Identifier      string
 	Value           Expr
 	identifierToken Token
+	slot            int
 }
 
 type StmtFor struct {
@@ -149,6 +197,11 @@ type StmtFor struct {
 	Value           Expr
 	body            Stmt
 	openingToken    Token
+	slots           int
+	names           []string
+	identSlot       int
+	indexSlot       int
+	captures        bool // the body makes functions, see runForLoopBody
 }
 
 type StmtIf struct {
@@ -167,8 +220,10 @@ type StmtMatch struct {
 }
 
 type MatchCase struct {
-	Cond Expr
-	Body Stmt
+	Cond  Expr
+	Body  Stmt // a StmtBlock, or a StmtExpr for a case that's one expression
+	slots int
+	names []string
 }
 
 type StmtContinue struct {
@@ -179,6 +234,16 @@ type StmtBreak struct {
 	token Token
 }
 
+type StmtTry struct {
+	Body         Stmt
+	Identifier   string
+	CatchBody    Stmt
+	openingToken Token
+	slots        int
+	names        []string
+	identSlot    int
+}
+
 type StmtSection struct {
 	Label      string
 	Body       Stmt
@@ -194,6 +259,7 @@ func (s *StmtReturn) Token() *Token   { return s.Value.Token() }
 func (s *StmtMatch) Token() *Token    { return s.Value.Token() }
 func (s *StmtContinue) Token() *Token { return &s.token }
 func (s *StmtBreak) Token() *Token    { return &s.token }
+func (s *StmtTry) Token() *Token      { return &s.openingToken }
 func (s *StmtSection) Token() *Token  { return &s.labelToken }
 
 func (s *StmtExpr) Name() string     { return "" }
@@ -205,6 +271,7 @@ func (s *StmtReturn) Name() string   { return "" }
 func (s *StmtMatch) Name() string    { return "" }
 func (s *StmtContinue) Name() string { return "" }
 func (s *StmtBreak) Name() string    { return "" }
+func (s *StmtTry) Name() string      { return "" }
 func (s *StmtSection) Name() string  { return s.Label }
 
 func (*StmtExpr) stmtNode()     {}
@@ -216,8 +283,5 @@ func (*StmtReturn) stmtNode()   {}
 func (*StmtMatch) stmtNode()    {}
 func (*StmtContinue) stmtNode() {}
 func (*StmtBreak) stmtNode()    {}
+func (*StmtTry) stmtNode()      {}
 func (*StmtSection) stmtNode()  {}
-
-func PrettyPrint(prog *Program) {
-	ast.Print(nil, prog)
-}
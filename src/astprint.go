@@ -0,0 +1,259 @@
+package lang
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// astNode is a syntax tree node stripped down for printing, the same tree
+// is printed as s-expressions or JSON
+type astNode struct {
+	Type     string      `json:"type"`
+	Line     int         `json:"line"`
+	Name     string      `json:"name,omitempty"`  // identifiers, labels, operators
+	Value    interface{} `json:"value,omitempty"` // literals
+	Args     []string    `json:"args,omitempty"`  // parameters and loop variables
+	Children []*astNode  `json:"children,omitempty"`
+
+	stmt bool // statements get their line in s-expressions
+}
+
+// PrintAST writes the program's syntax tree to w, as indented s-expressions
+// if format is "sexp" or as JSON if it's "json"
+func (c *Compiled) PrintAST(w io.Writer, format string) error {
+	tree := astTree(&c.lex, &c.prog)
+	switch format {
+	case "sexp":
+		var sb strings.Builder
+		writeSexp(&sb, tree, 0)
+		sb.WriteString("\n")
+		_, err := io.WriteString(w, sb.String())
+		return err
+	case "json":
+		b, err := json.MarshalIndent(tree, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	default:
+		return fmt.Errorf("unknown ast format %q, expected sexp or json", format)
+	}
+}
+
+func astTree(lex *Lexer, node Node) *astNode {
+	if node == nil {
+		return nil
+	}
+	n := &astNode{}
+	if tok := node.Token(); tok != nil {
+		n.Line, _ = lex.GetLineAndCol(*tok)
+	}
+	_, n.stmt = node.(Stmt)
+	add := func(children ...Node) {
+		for _, child := range children {
+			if c := astTree(lex, child); c != nil {
+				n.Children = append(n.Children, c)
+			}
+		}
+	}
+
+	switch node := node.(type) {
+	case *Program:
+		n.Type = "program"
+		for _, stmt := range node.Stmts {
+			add(stmt)
+		}
+	case *ExprString:
+		n.Type, n.Value = "string", node.Str
+	case *ExprIdentifier:
+		n.Type, n.Name = "ident", node.Identifier
+	case *ExprNum:
+		n.Type, n.Value = "num", node.Num
+	case *ExprFloat:
+		n.Type, n.Value = "float", node.Float
+	case *ExprNil:
+		n.Type = "nil"
+	case *ExprArray:
+		n.Type = "array"
+		for _, item := range node.Items {
+			add(item)
+		}
+	case *ExprMap:
+		n.Type = "map"
+		for _, item := range node.Items {
+			n.Children = append(n.Children, &astNode{
+				Type:     "item",
+				Line:     n.Line,
+				Name:     item.Key.String(),
+				Children: []*astNode{astTree(lex, item.Value)},
+			})
+		}
+	case *ExprBinary:
+		n.Type, n.Name = "binary", node.Op.Tag.String()
+		add(node.Lhs, node.Rhs)
+	case *ExprUnary:
+		n.Type, n.Name = "unary", node.Op.Tag.String()
+		add(node.Lhs)
+	case *ExprFuncall:
+		n.Type = "call"
+		if node.Spread {
+			n.Name = "spread"
+		}
+		add(node.Identifier)
+		for _, arg := range node.Args {
+			add(arg)
+		}
+	case *ExprMatch:
+		// the same tree as a match statement, without the statement's line
+		m := astTree(lex, node.Match)
+		m.stmt = false
+		return m
+	case *ExprFunc:
+		n.Type, n.Name, n.Args = "fn", node.Identifier, node.Args
+		if n.Args == nil {
+			n.Args = []string{}
+		}
+		if node.Variadic {
+			n.Args = append([]string{}, n.Args...)
+			n.Args[len(n.Args)-1] += ".."
+		}
+		for i, def := range node.Defaults {
+			if def != nil {
+				n.Children = append(n.Children, &astNode{
+					Type:     "default",
+					Line:     n.Line,
+					Name:     node.Args[i],
+					Children: []*astNode{astTree(lex, def)},
+				})
+			}
+		}
+		add(node.Body)
+	case *StmtExpr:
+		// a function declaration is a statement on its own, anything else
+		// is wrapped to show where it is
+		if fn, ok := node.Expr.(*ExprFunc); ok {
+			return astTree(lex, fn)
+		}
+		n.Type = "expr"
+		add(node.Expr)
+	case *StmtBlock:
+		n.Type = "block"
+		for _, stmt := range node.Body {
+			add(stmt)
+		}
+	case *StmtVar:
+		n.Type, n.Name = "var", node.Identifier
+		add(node.Value)
+	case *StmtFor:
+		n.Type = "for"
+		for _, ident := range []string{node.Identifier, node.IndexIdentifier} {
+			if ident != "" {
+				n.Args = append(n.Args, ident)
+			}
+		}
+		if node.Value != nil {
+			add(node.Value)
+		}
+		add(node.body)
+	case *StmtIf:
+		n.Type = "if"
+		add(node.Condition, node.Body)
+		if node.ElseBody != nil {
+			add(node.ElseBody)
+		}
+	case *StmtReturn:
+		n.Type = "return"
+		add(node.Value)
+	case *StmtMatch:
+		n.Type = "match"
+		add(node.Value)
+		for _, c := range node.Cases {
+			cond := astTree(lex, c.Cond)
+			n.Children = append(n.Children, &astNode{
+				Type:     "case",
+				Line:     cond.Line,
+				Children: []*astNode{cond, astTree(lex, c.Body)},
+				stmt:     true,
+			})
+		}
+	case *StmtContinue:
+		n.Type = "continue"
+	case *StmtBreak:
+		n.Type = "break"
+	case *StmtTry:
+		n.Type = "try"
+		add(node.Body)
+		catch := astTree(lex, node.CatchBody)
+		n.Children = append(n.Children, &astNode{
+			Type:     "catch",
+			Line:     catch.Line,
+			Name:     node.Identifier,
+			Children: []*astNode{catch},
+			stmt:     true,
+		})
+	case *StmtSection:
+		n.Type, n.Name = "section", node.Label
+		add(node.Body)
+	default:
+		panic(fmt.Sprintf("astTree: unknown node %T", node))
+	}
+	return n
+}
+
+// multiline is true for nodes holding a block, they're spread over several
+// lines with their children indented
+func (n *astNode) multiline() bool {
+	if n.Type == "block" || n.Type == "program" {
+		return true
+	}
+	for _, child := range n.Children {
+		if child.multiline() {
+			return true
+		}
+	}
+	return false
+}
+
+func writeSexp(sb *strings.Builder, n *astNode, depth int) {
+	sb.WriteString("(")
+	switch n.Type {
+	case "binary", "unary":
+		sb.WriteString(n.Name)
+	default:
+		sb.WriteString(n.Type)
+	}
+	if n.stmt || n.Type == "fn" {
+		fmt.Fprintf(sb, ":%d", n.Line)
+	}
+
+	switch n.Type {
+	case "binary", "unary":
+	case "string":
+		sb.WriteString(" " + strconv.Quote(n.Value.(string)))
+	default:
+		if n.Name != "" {
+			sb.WriteString(" " + n.Name)
+		}
+		if n.Value != nil {
+			fmt.Fprintf(sb, " %v", n.Value)
+		}
+	}
+	if n.Args != nil {
+		sb.WriteString(" (" + strings.Join(n.Args, " ") + ")")
+	}
+
+	multiline := n.multiline()
+	for _, child := range n.Children {
+		if multiline {
+			sb.WriteString("\n" + strings.Repeat("  ", depth+1))
+		} else {
+			sb.WriteString(" ")
+		}
+		writeSexp(sb, child, depth+1)
+	}
+	sb.WriteString(")")
+}
@@ -0,0 +1,52 @@
+package lang
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestPrintAST compares the printed syntax tree of testdata/ast.aoc against
+// testdata/ast.sexp and testdata/ast.json. Run with -update after changing
+// the format on purpose.
+func TestPrintAST(t *testing.T) {
+	src, err := os.ReadFile(filepath.Join("testdata", "ast.aoc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mustCompile(t, strings.TrimSpace(string(src)))
+
+	for _, format := range []string{"sexp", "json"} {
+		var out bytes.Buffer
+		if err := c.PrintAST(&out, format); err != nil {
+			t.Fatal(err)
+		}
+
+		golden := filepath.Join("testdata", "ast."+format)
+		if *update {
+			if err := os.WriteFile(golden, out.Bytes(), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != string(want) {
+			t.Errorf("%s doesn't match, got\n%s", golden, out.String())
+		}
+	}
+}
+
+func TestPrintASTUnknownFormat(t *testing.T) {
+	c := mustCompile(t, "part1: 1")
+	if err := c.PrintAST(&bytes.Buffer{}, "xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
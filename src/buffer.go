@@ -0,0 +1,35 @@
+package lang
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A buffer builds a string a piece at a time. out = out + line copies all of
+// out every time, so building a big string that way is quadratic. Writing
+// the lines to a buffer and taking the string at the end is linear.
+
+func nativeBuffer(ev *Evaluator, args []Value) Value {
+	checkArgs("buffer", args)
+	return Value{Tag: ValBuffer, ref: &strings.Builder{}}
+}
+
+// nativeBufWrite adds each value to the end of a buffer as print shows it,
+// buf_write(b, x, ',', y) is like out = out + x + ',' + y
+func nativeBufWrite(ev *Evaluator, args []Value) Value {
+	if len(args) < 2 {
+		panic(E(RuntimeError, fmt.Sprintf("buf_write: expected at least 2 arguments, got %d", len(args)), 0))
+	}
+	checkArg("buf_write", args, 0, ValBuffer)
+	for _, v := range args[1:] {
+		args[0].buffer().WriteString(v.String())
+	}
+	return NilValue
+}
+
+// nativeBufString returns everything written to a buffer so far, the buffer
+// can carry on being written to
+func nativeBufString(ev *Evaluator, args []Value) Value {
+	checkArgs("buf_string", args, ValBuffer)
+	return Value{Tag: ValStr, Str: args[0].buffer().String()}
+}
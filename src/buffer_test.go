@@ -0,0 +1,62 @@
+package lang
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBufferErrors(t *testing.T) {
+	src := `part1: {
+  var b = buffer()
+  buf_write(b)
+}
+part2: {
+  buf_write('out', 'line')
+}`
+	expectError(t, src, "part1", RuntimeError, "buf_write: expected at least 2 arguments, got 1", 3)
+	expectError(t, src, "part2", RuntimeError, "buf_write: argument 1 must be a buffer, got string", 6)
+}
+
+func TestCopyBuffer(t *testing.T) {
+	src := `part1: {
+  var b = buffer()
+  buf_write(b, 'a')
+  var c = copy(b)
+  buf_write(c, 'b')
+  return buf_string(b) + buf_string(c)
+}`
+	for _, vm := range []bool{false, true} {
+		v, err := evalSourceOn(t, src, "part1", vm)
+		if err != nil || v.Str != "aab" {
+			t.Errorf("expected the copy to be written to on its own, got %s, %v", v.Repr(), err)
+		}
+	}
+}
+
+// the same lines appended 1000, 10000 and 100000 times, the buffer's time
+// per op goes up tenfold each step and concatenation's a hundredfold
+func BenchmarkBuffer(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		src := fmt.Sprintf(`part1: {
+  var b = buffer()
+  for i in range(0, %d) {
+    buf_write(b, 'line ', i, '
+')
+  }
+  return len(buf_string(b))
+}`, n)
+		b.Run(fmt.Sprintf("buffer/%d", n), func(b *testing.B) { benchSource(b, src) })
+	}
+	// 100000 would take seconds an op
+	for _, n := range []int{1000, 10000} {
+		src := fmt.Sprintf(`part1: {
+  var out = ''
+  for i in range(0, %d) {
+    out = out + 'line ' + i + '
+'
+  }
+  return len(out)
+}`, n)
+		b.Run(fmt.Sprintf("concat/%d", n), func(b *testing.B) { benchSource(b, src) })
+	}
+}
@@ -0,0 +1,506 @@
+package lang
+
+import "fmt"
+
+// The compiler turns top level functions and sections into bytecode for the
+// vm. It handles most of the language but not all of it, anything it can't
+// compile is left to the evaluator, see EnableVM.
+//
+// Locals are resolved by the resolver to a slot in one of a chain of envs.
+// The vm has no envs, each call gets one flat array of locals, so the
+// compiler gives every scope a base in that array and a local ends up at
+// base + slot. Sibling scopes reuse the same space.
+
+type opcode uint8
+
+const (
+	opConst       opcode = iota // push consts[a]
+	opNil                       // push nil
+	opPop                       // discard the top of the stack
+	opLoad                      // push locals[a]
+	opStore                     // locals[a] = the top of the stack, leaving it there
+	opLoadGlobal                // push the global named consts[a]
+	opStoreGlobal               // assign the top of the stack to the global named consts[a]
+	opBinary                    // pop rhs and lhs, push the result of operator a
+	opUnary                     // pop lhs, push the result of operator a
+	opSetKey                    // pop val, key and lhs, set lhs[key] = val and push val
+	opArray                     // pop a values, push an array of them
+	opMap                       // pop a value for each of mapKeys[a], push a map of them
+	opCall                      // call the function below the top a values, from calls[b], spreading the last if c is 1
+	opReturn                    // return the top of the stack from the current frame
+	opJump                      // jump to a
+	opJumpIfFalse               // pop, jump to a if it isn't truthy
+	opIterStart                 // pop a value and start iterating over it
+	opIterNext                  // put the next item in locals[a] and its index in locals[b], or jump to c when done
+	opIterEnd                   // finish the innermost iteration
+	opMatchIndex                // jump to c unless locals[a] is an array with an index b
+	opMatchItem                 // pop, jump to c unless it equals locals[a][b]
+	opMatchBind                 // locals[c] = locals[a][b]
+	opMatchValue                // pop, jump to c unless it equals locals[a]
+	opError                     // raise consts[a] as a runtime error
+	opArgPassed                 // jump to c if the call passed argument a
+)
+
+type instr struct {
+	op      opcode
+	a, b, c int
+}
+
+// chunk is the bytecode for one function or section
+type chunk struct {
+	name    string
+	code    []instr
+	tokens  []Token // where each instruction came from, for errors
+	consts  []Value
+	mapKeys [][]MapKey
+	calls   []*ExprFuncall
+	locals  int
+	names   []string // every local declared, for suggesting names in errors
+}
+
+// unsupported is panicked when the compiler finds something the vm can't
+// run
+type unsupported struct {
+	node   Node
+	reason string
+}
+
+type compileScope struct {
+	base int // where slot 0 of the scope is in the frame's locals
+}
+
+type compileLoop struct {
+	continueTo int
+	breaks     []int
+}
+
+type compiler struct {
+	lex    *Lexer
+	chunk  *chunk
+	scopes []compileScope
+	loops  []compileLoop
+	next   int // the first free local
+}
+
+func compileFn(lex *Lexer, fn *ExprFunc) (*chunk, *unsupported) {
+	return compile(lex, fn.Identifier, func(c *compiler) {
+		if fn.needsEnv {
+			// arguments are the first locals
+			c.pushScope(fn.slots, fn.names)
+		}
+		for i, def := range fn.Defaults {
+			if def == nil {
+				continue
+			}
+			passed := c.emit(def, opArgPassed, i, 0, 0)
+			c.expr(def)
+			c.emit(def, opStore, i, 0, 0)
+			c.emit(def, opPop, 0, 0, 0)
+			c.patch(passed)
+		}
+		c.stmts(fn.Body.(*StmtBlock).Body)
+		c.emit(fn, opNil, 0, 0, 0)
+		c.emit(fn, opReturn, 0, 0, 0)
+	})
+}
+
+func compileSection(lex *Lexer, section *StmtSection) (*chunk, *unsupported) {
+	return compile(lex, section.Label, func(c *compiler) {
+		switch body := section.Body.(type) {
+		case *StmtBlock:
+			if !body.noEnv {
+				c.pushScope(body.slots, body.names)
+			}
+			c.stmtsValue(body)
+		case *StmtExpr:
+			c.expr(body.Expr)
+		default:
+			c.unsupported(body, "a section body of %T", body)
+		}
+		c.emit(section, opReturn, 0, 0, 0)
+	})
+}
+
+func compile(lex *Lexer, name string, body func(c *compiler)) (ch *chunk, unsup *unsupported) {
+	c := compiler{lex: lex, chunk: &chunk{name: name}}
+	defer func() {
+		if r := recover(); r != nil {
+			if u, ok := r.(unsupported); ok {
+				ch = nil
+				unsup = &u
+				return
+			}
+			panic(r)
+		}
+	}()
+	body(&c)
+	return c.chunk, nil
+}
+
+func (c *compiler) unsupported(node Node, format string, args ...interface{}) {
+	panic(unsupported{node, fmt.Sprintf(format, args...)})
+}
+
+// emit adds an instruction, taking its position from node, and returns
+// where it is so jumps can be patched later
+func (c *compiler) emit(node Node, op opcode, a, b, cc int) int {
+	c.chunk.code = append(c.chunk.code, instr{op, a, b, cc})
+	c.chunk.tokens = append(c.chunk.tokens, *node.Token())
+	return len(c.chunk.code) - 1
+}
+
+// patch points the jump at index to the next instruction emitted
+func (c *compiler) patch(index int) {
+	target := len(c.chunk.code)
+	switch c.chunk.code[index].op {
+	case opJump, opJumpIfFalse:
+		c.chunk.code[index].a = target
+	default:
+		c.chunk.code[index].c = target
+	}
+}
+
+func (c *compiler) constant(v Value) int {
+	c.chunk.consts = append(c.chunk.consts, v)
+	return len(c.chunk.consts) - 1
+}
+
+func (c *compiler) pushScope(slots int, names []string) {
+	c.scopes = append(c.scopes, compileScope{c.next})
+	c.chunk.names = append(c.chunk.names, names...)
+	c.next += slots
+	if c.next > c.chunk.locals {
+		c.chunk.locals = c.next
+	}
+}
+
+func (c *compiler) popScope() {
+	c.next = c.scopes[len(c.scopes)-1].base
+	c.scopes = c.scopes[:len(c.scopes)-1]
+}
+
+// temp reserves a local that no variable uses
+func (c *compiler) temp() int {
+	c.next++
+	if c.next > c.chunk.locals {
+		c.chunk.locals = c.next
+	}
+	return c.next - 1
+}
+
+func (c *compiler) releaseTemp() {
+	c.next--
+}
+
+// local finds where a resolved variable lives in the frame's locals
+func (c *compiler) local(node Node, l local) int {
+	if l.depth >= len(c.scopes) {
+		c.unsupported(node, "variables from an enclosing function aren't supported")
+	}
+	return c.scopes[len(c.scopes)-1-l.depth].base + l.slot
+}
+
+func (c *compiler) stmts(stmts []Stmt) {
+	for _, stmt := range stmts {
+		c.stmt(stmt)
+	}
+}
+
+// stmtsValue compiles a block's statements, leaving its value on the stack:
+// the value of the last statement if it has one, otherwise nil. See
+// Evaluator.blockValue.
+func (c *compiler) stmtsValue(b *StmtBlock) {
+	last, ok := lastValue(b)
+	if !ok {
+		c.stmts(b.Body)
+		c.emit(b, opNil, 0, 0, 0)
+		return
+	}
+	c.stmts(b.Body[:len(b.Body)-1])
+	switch last := last.(type) {
+	case *StmtExpr:
+		c.expr(last.Expr)
+	case *StmtMatch:
+		c.match(last, true)
+	}
+}
+
+func (c *compiler) block(stmt Stmt) {
+	b := stmt.(*StmtBlock)
+	if b.noEnv {
+		c.stmts(b.Body)
+		return
+	}
+	c.pushScope(b.slots, b.names)
+	c.stmts(b.Body)
+	c.popScope()
+}
+
+func (c *compiler) stmt(stmt Stmt) {
+	switch node := stmt.(type) {
+	case *StmtExpr:
+		c.expr(node.Expr)
+		c.emit(node, opPop, 0, 0, 0)
+	case *StmtVar:
+		if node.slot < 0 {
+			c.unsupported(node, "global variables aren't supported")
+		}
+		c.expr(node.Value)
+		c.emit(node, opStore, c.local(node, local{0, node.slot}), 0, 0)
+		c.emit(node, opPop, 0, 0, 0)
+	case *StmtBlock:
+		c.block(node)
+	case *StmtIf:
+		c.expr(node.Condition)
+		skip := c.emit(node, opJumpIfFalse, 0, 0, 0)
+		c.block(node.Body)
+		if node.ElseBody != nil {
+			end := c.emit(node, opJump, 0, 0, 0)
+			c.patch(skip)
+			c.stmt(node.ElseBody)
+			c.patch(end)
+		} else {
+			c.patch(skip)
+		}
+	case *StmtReturn:
+		c.expr(node.Value)
+		c.emit(node, opReturn, 0, 0, 0)
+	case *StmtFor:
+		c.forLoop(node)
+	case *StmtBreak:
+		if len(c.loops) == 0 {
+			c.error(node, "break outside of loop")
+			return
+		}
+		loop := &c.loops[len(c.loops)-1]
+		loop.breaks = append(loop.breaks, c.emit(node, opJump, 0, 0, 0))
+	case *StmtContinue:
+		if len(c.loops) == 0 {
+			c.error(node, "continue outside of loop")
+			return
+		}
+		c.emit(node, opJump, c.loops[len(c.loops)-1].continueTo, 0, 0)
+	case *StmtMatch:
+		c.match(node, false)
+	case *StmtTry:
+		c.unsupported(node, "try/catch isn't supported")
+	default:
+		c.unsupported(node, "%T isn't supported", node)
+	}
+}
+
+func (c *compiler) forLoop(node *StmtFor) {
+	body := node.body.(*StmtBlock).Body
+
+	if node.Value == nil {
+		// infinite loop
+		c.pushScope(node.slots, node.names)
+		top := len(c.chunk.code)
+		c.loops = append(c.loops, compileLoop{continueTo: top})
+		c.stmts(body)
+		c.emit(node, opJump, top, 0, 0)
+		c.endLoop()
+		c.popScope()
+		return
+	}
+
+	c.expr(node.Value)
+	c.emit(node, opIterStart, 0, 0, 0)
+	c.pushScope(node.slots, node.names)
+	ident, index := -1, -1
+	if node.Identifier != "" {
+		ident = c.local(node, local{0, node.identSlot})
+	}
+	if node.IndexIdentifier != "" {
+		index = c.local(node, local{0, node.indexSlot})
+	}
+	next := c.emit(node, opIterNext, ident, index, 0)
+	c.loops = append(c.loops, compileLoop{continueTo: next})
+	c.stmts(body)
+	c.emit(node, opJump, next, 0, 0)
+	c.patch(next)
+	c.endLoop()
+	c.emit(node, opIterEnd, 0, 0, 0)
+	c.popScope()
+}
+
+// endLoop points the innermost loop's breaks at the next instruction
+func (c *compiler) endLoop() {
+	loop := c.loops[len(c.loops)-1]
+	c.loops = c.loops[:len(c.loops)-1]
+	for _, b := range loop.breaks {
+		c.patch(b)
+	}
+}
+
+// match compiles a match, leaving its value on the stack if value is set
+func (c *compiler) match(node *StmtMatch, value bool) {
+	c.expr(node.Value)
+	candidate := c.temp()
+	c.emit(node, opStore, candidate, 0, 0)
+	c.emit(node, opPop, 0, 0, 0)
+
+	var ends []int
+	for i := range node.Cases {
+		mc := &node.Cases[i]
+		switch pattern := mc.Cond.(type) {
+		case *ExprArray:
+			var fails []int
+			if len(pattern.Items) == 0 {
+				fails = append(fails, c.emit(pattern, opMatchIndex, candidate, -1, 0))
+			}
+			for index, item := range pattern.Items {
+				fails = append(fails, c.emit(pattern, opMatchIndex, candidate, index, 0))
+				if _, ok := item.(*ExprIdentifier); !ok {
+					c.expr(item)
+					fails = append(fails, c.emit(item, opMatchItem, candidate, index, 0))
+				}
+			}
+
+			// we found a match
+			c.pushScope(mc.slots, mc.names)
+			for index, item := range pattern.Items {
+				if ident, ok := item.(*ExprIdentifier); ok {
+					c.emit(ident, opMatchBind, candidate, index, c.local(ident, ident.local))
+				}
+			}
+			c.caseBody(mc.Body, false, value)
+			c.popScope()
+			ends = append(ends, c.emit(pattern, opJump, 0, 0, 0))
+			for _, f := range fails {
+				c.patch(f)
+			}
+		case *ExprIdentifier:
+			c.pushScope(mc.slots, mc.names)
+			c.emit(pattern, opLoad, candidate, 0, 0)
+			c.emit(pattern, opStore, c.local(pattern, pattern.local), 0, 0)
+			c.emit(pattern, opPop, 0, 0, 0)
+			c.caseBody(mc.Body, false, value)
+			c.popScope()
+			ends = append(ends, c.emit(pattern, opJump, 0, 0, 0))
+		default:
+			c.expr(pattern)
+			fail := c.emit(pattern, opMatchValue, candidate, 0, 0)
+			c.caseBody(mc.Body, true, value)
+			ends = append(ends, c.emit(pattern, opJump, 0, 0, 0))
+			c.patch(fail)
+		}
+	}
+
+	// nothing matched
+	if value {
+		c.emit(node, opNil, 0, 0, 0)
+	}
+	for _, end := range ends {
+		c.patch(end)
+	}
+	c.releaseTemp()
+}
+
+// caseBody compiles the body of a match case. A block needs its own scope
+// unless the case already pushed one for its bindings.
+func (c *compiler) caseBody(body Stmt, needsScope bool, value bool) {
+	b, ok := body.(*StmtBlock)
+	switch {
+	case !ok && value:
+		c.expr(body.(*StmtExpr).Expr)
+	case !ok:
+		c.stmt(body)
+	case needsScope && !b.noEnv:
+		c.pushScope(b.slots, b.names)
+		c.caseBody(b, false, value)
+		c.popScope()
+	case value:
+		c.stmtsValue(b)
+	default:
+		c.stmts(b.Body)
+	}
+}
+
+func (c *compiler) expr(expr Expr) {
+	switch node := expr.(type) {
+	case *ExprString:
+		c.emit(node, opConst, c.constant(Value{Tag: ValStr, Str: node.Str}), 0, 0)
+	case *ExprNum:
+		c.emit(node, opConst, c.constant(Value{Tag: ValNum, Num: node.Num}), 0, 0)
+	case *ExprFloat:
+		c.emit(node, opConst, c.constant(Value{Tag: ValFloat, Float: node.Float}), 0, 0)
+	case *ExprNil:
+		c.emit(node, opNil, 0, 0, 0)
+	case *ExprIdentifier:
+		if node.local.depth >= 0 {
+			c.emit(node, opLoad, c.local(node, node.local), 0, 0)
+		} else {
+			c.emit(node, opLoadGlobal, c.constant(Value{Tag: ValStr, Str: node.Identifier}), 0, 0)
+		}
+	case *ExprArray:
+		for _, item := range node.Items {
+			c.expr(item)
+		}
+		c.emit(node, opArray, len(node.Items), 0, 0)
+	case *ExprMap:
+		keys := make([]MapKey, 0, len(node.Items))
+		for _, item := range node.Items {
+			c.expr(item.Value)
+			keys = append(keys, item.Key)
+		}
+		c.chunk.mapKeys = append(c.chunk.mapKeys, keys)
+		c.emit(node, opMap, len(c.chunk.mapKeys)-1, 0, 0)
+	case *ExprUnary:
+		c.expr(node.Lhs)
+		c.emit(node, opUnary, int(node.Op.Tag), 0, 0)
+	case *ExprBinary:
+		if node.Op.Tag == Equal {
+			c.assignment(node)
+			return
+		}
+		c.expr(node.Lhs)
+		c.expr(node.Rhs)
+		c.emit(node, opBinary, int(node.Op.Tag), 0, 0)
+	case *ExprFuncall:
+		c.expr(node.Identifier)
+		for _, arg := range node.Args {
+			c.expr(arg)
+		}
+		c.chunk.calls = append(c.chunk.calls, node)
+		spread := 0
+		if node.Spread {
+			spread = 1
+		}
+		c.emit(node, opCall, len(node.Args), len(c.chunk.calls)-1, spread)
+	case *ExprMatch:
+		c.match(node.Match, true)
+	case *ExprFunc:
+		c.unsupported(node, "nested functions aren't supported")
+	default:
+		c.unsupported(node, "%T isn't supported", node)
+	}
+}
+
+func (c *compiler) assignment(expr *ExprBinary) {
+	switch node := expr.Lhs.(type) {
+	case *ExprIdentifier:
+		c.expr(expr.Rhs)
+		if node.local.depth >= 0 {
+			c.emit(node, opStore, c.local(node, node.local), 0, 0)
+		} else {
+			c.emit(node, opStoreGlobal, c.constant(Value{Tag: ValStr, Str: node.Identifier}), 0, 0)
+		}
+		return
+	case *ExprBinary:
+		if node.Op.Tag == LSquare {
+			c.expr(node.Lhs)
+			c.expr(node.Rhs)
+			c.expr(expr.Rhs)
+			c.emit(node, opSetKey, 0, 0, 0)
+			return
+		}
+	}
+	c.error(expr, "left hand side of assignment is not assignable")
+}
+
+// error emits an instruction that raises msg when it's reached, for things
+// the evaluator only complains about at runtime
+func (c *compiler) error(node Node, msg string) {
+	c.emit(node, opError, c.constant(Value{Tag: ValStr, Str: msg}), 0, 0)
+}
@@ -0,0 +1,222 @@
+package lang
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// EvalString evaluates an expression in the evaluator's current scope. That's
+// the globals, unless it's called while the program is stopped in the
+// debugger, when the locals at that point are visible too.
+func (ev *Evaluator) EvalString(src string) (v Value, err error) {
+	lex := NewLexer(src)
+	expr, err := parseExpression(&lex)
+	if err != nil {
+		return NilValue, err
+	}
+
+	// resolve the expression as if it was written where the program is
+	scopes := envScopes(ev.env)
+	slots := 0
+	if scopes != nil {
+		slots = scopes.slots
+	}
+	r := newResolver(scopes, &lex)
+	r.expr(expr)
+	r.resolvePending()
+	if len(r.errs) > 0 {
+		return NilValue, r.errs[0]
+	}
+	// the env is already made, there's no room in it for new names
+	if scopes != nil && scopes.slots > slots {
+		for name, slot := range scopes.names {
+			if slot >= slots {
+				return NilValue, Error{Tag: RuntimeError, Msg: fmt.Sprintf("can't declare %s here, only at the top level", name)}
+			}
+		}
+	}
+
+	env, frames, args := ev.env, len(ev.frames), len(ev.argStack)
+	defer func() {
+		if r := recover(); r != nil {
+			ev.env = env
+			ev.frames = ev.frames[:frames]
+			ev.argStack = ev.argStack[:args]
+			v, err = NilValue, asError(r)
+		}
+	}()
+	return ev.evalExpr(&expr), nil
+}
+
+// envScopes rebuilds the resolver's scopes from envs at runtime
+func envScopes(env *Env) *scope {
+	var envs []*Env
+	for e := env; e != nil && e.vars == nil; e = e.parent {
+		envs = append(envs, e)
+	}
+	var s *scope
+	for i := len(envs) - 1; i >= 0; i-- {
+		names := make(map[string]int)
+		for slot, name := range envs[i].names {
+			names[name] = slot
+		}
+		s = &scope{
+			parent: s,
+			names:  names,
+			slots:  len(envs[i].slots),
+			vars:   make(map[string]*StmtVar),
+			at:     make(map[string]Node),
+		}
+	}
+	return s
+}
+
+type debugMode int
+
+const (
+	debugRun  debugMode = iota // until a breakpoint
+	debugStep                  // stop at the next statement
+	debugNext                  // stop at the next statement not in a deeper call
+)
+
+// Debugger stops the program before the statements on chosen lines and reads
+// commands, to look at variables and step through the program. Commands are
+// read from in, which is usually stdin, and everything is written to out.
+type Debugger struct {
+	in          *bufio.Scanner
+	out         io.Writer
+	breakpoints map[int]bool
+	mode        debugMode
+	depth       int  // the call depth next stops at
+	lastLine    int  // so a breakpoint stops once per line, not per statement
+	done        bool // in has run out, the program carries on to the end
+}
+
+func NewDebugger(in io.Reader, out io.Writer) *Debugger {
+	return &Debugger{
+		in:          bufio.NewScanner(in),
+		out:         out,
+		breakpoints: make(map[int]bool),
+	}
+}
+
+// Break stops the program before it runs line
+func (d *Debugger) Break(line int) {
+	d.breakpoints[line] = true
+}
+
+// Step stops the program before its first statement
+func (d *Debugger) Step() {
+	d.mode = debugStep
+}
+
+// stmt is called before every statement the evaluator runs
+func (d *Debugger) stmt(ev *Evaluator, stmt Stmt) {
+	// the top level only declares functions, there's nothing to stop for
+	if d.done || ev.section == nil {
+		return
+	}
+	if _, ok := stmt.(*StmtBlock); ok {
+		return
+	}
+
+	line, _ := ev.lex.GetLineAndCol(*stmt.Token())
+	stop := d.mode == debugStep || d.mode == debugNext && len(ev.frames) <= d.depth
+	if d.breakpoints[line] && line != d.lastLine {
+		stop = true
+	}
+	d.lastLine = line
+	if stop {
+		d.prompt(ev, line)
+	}
+}
+
+const debugHelp = `commands:
+  step, s         run the next statement
+  next, n         run the next statement, stepping over calls
+  continue, c     run until the next breakpoint
+  break N, b N    stop before line N
+  locals, l       print the local variables
+  print X, p X    evaluate the expression X, or just type X
+`
+
+func (d *Debugger) prompt(ev *Evaluator, line int) {
+	fmt.Fprintf(d.out, "stopped at line %d\n%4d | %s\n", line, line, ev.lex.SourceLine(line))
+	for {
+		fmt.Fprint(d.out, "(debug) ")
+		if !d.in.Scan() {
+			fmt.Fprintln(d.out)
+			d.done = true
+			return
+		}
+
+		cmd := strings.TrimSpace(d.in.Text())
+		word, arg := cmd, ""
+		if i := strings.IndexByte(cmd, ' '); i >= 0 {
+			word, arg = cmd[:i], strings.TrimSpace(cmd[i+1:])
+		}
+
+		switch word {
+		case "":
+		case "step", "s":
+			d.mode = debugStep
+			return
+		case "next", "n":
+			d.mode = debugNext
+			d.depth = len(ev.frames)
+			return
+		case "continue", "c":
+			d.mode = debugRun
+			return
+		case "break", "b":
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				fmt.Fprintln(d.out, "expected a line number")
+				continue
+			}
+			d.Break(n)
+		case "locals", "l":
+			d.printLocals(ev)
+		case "help", "h":
+			fmt.Fprint(d.out, debugHelp)
+		case "print", "p":
+			d.print(ev, arg)
+		default:
+			d.print(ev, cmd)
+		}
+	}
+}
+
+func (d *Debugger) print(ev *Evaluator, src string) {
+	v, err := ev.EvalString(src)
+	if err != nil {
+		if e, ok := err.(Error); ok {
+			fmt.Fprintf(d.out, "%s: %s\n", e.Tag, e.Msg)
+			return
+		}
+		fmt.Fprintln(d.out, err)
+		return
+	}
+	fmt.Fprintln(d.out, v.Repr())
+}
+
+// printLocals prints every local in scope, innermost first. Names shadowed
+// by an inner scope are left out.
+func (d *Debugger) printLocals(ev *Evaluator) {
+	seen := make(map[string]bool)
+	for e := ev.env; e != nil && e.vars == nil; e = e.parent {
+		for slot, name := range e.names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			fmt.Fprintf(d.out, "%s = %s\n", name, e.slots[slot].Repr())
+		}
+	}
+	if len(seen) == 0 {
+		fmt.Fprintln(d.out, "no locals")
+	}
+}
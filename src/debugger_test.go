@@ -0,0 +1,108 @@
+package lang
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const debugSrc = `fn double(n) {
+  var result = n * 2
+  return result
+}
+part1: {
+  var total = 0
+  for i in [1, 2] {
+    total = total + double(i)
+  }
+  return total
+}`
+
+func debug(t *testing.T, commands string, setup func(d *Debugger)) (Value, string) {
+	t.Helper()
+	var out bytes.Buffer
+	d := NewDebugger(strings.NewReader(commands), &out)
+	setup(d)
+	ev := mustCompile(t, debugSrc).NewEvaluator(WithDebugger(d))
+	v, err := ev.EvalSection("part1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, out.String()
+}
+
+func TestDebuggerBreakpoint(t *testing.T) {
+	v, out := debug(t, "locals\ntotal + 100\np double(i)\ncontinue\nc\n", func(d *Debugger) {
+		d.Break(8)
+	})
+	if v.Num != 6 {
+		t.Errorf("expected the program to finish, got %s", v.Repr())
+	}
+
+	want := strings.Join([]string{
+		"stopped at line 8",
+		"   8 |     total = total + double(i)",
+		"(debug) i = 1",
+		"total = 0",
+		"(debug) 100",
+		"(debug) 2",
+		"(debug) stopped at line 8",
+		"   8 |     total = total + double(i)",
+		"(debug) ",
+	}, "\n")
+	if out != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, out)
+	}
+}
+
+func TestDebuggerStepping(t *testing.T) {
+	// next steps over double, step goes into it
+	_, out := debug(t, "next\nnext\nnext\nstep\nstep\nlocals\nc\n", func(d *Debugger) {
+		d.Step()
+	})
+
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if i := strings.Index(line, "stopped at"); i >= 0 {
+			lines = append(lines, line[i:])
+		}
+	}
+	want := "stopped at line 6,stopped at line 7,stopped at line 8,stopped at line 8,stopped at line 2,stopped at line 3"
+	if got := strings.Join(lines, ","); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if !strings.Contains(out, "n = 2\nresult = 4\n") {
+		t.Errorf("expected locals inside double, got\n%s", out)
+	}
+}
+
+func TestDebuggerDeclaration(t *testing.T) {
+	// a named fn has nowhere to go in the locals, but an anonymous one is fine
+	v, out := debug(t, "p fn triple(n) { return n * 3 }\np fn(n) { return n * 3 }(total)\nc\nc\n", func(d *Debugger) {
+		d.Break(8)
+	})
+	if v.Num != 6 {
+		t.Errorf("expected the program to finish, got %s", v.Repr())
+	}
+	if !strings.Contains(out, "can't declare triple here, only at the top level") || !strings.Contains(out, "(debug) 0\n") {
+		t.Errorf("expected the declaration to be rejected, got\n%s", out)
+	}
+}
+
+func TestEvalString(t *testing.T) {
+	ev := mustCompile(t, debugSrc).NewEvaluator()
+	v, err := ev.EvalString("double(21)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Num != 42 {
+		t.Errorf("expected 42, got %s", v.Repr())
+	}
+
+	if _, err := ev.EvalString("1 +"); err == nil {
+		t.Error("expected a syntax error")
+	}
+	if _, err := ev.EvalString("nope"); err == nil {
+		t.Error("expected an unknown variable error")
+	}
+}
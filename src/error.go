@@ -1,5 +1,10 @@
 package lang
 
+import (
+	"fmt"
+	"strings"
+)
+
 type ErrorTag uint8
 
 const (
@@ -21,13 +26,40 @@ func (et ErrorTag) String() string {
 }
 
 type Error struct {
-	Tag  ErrorTag
-	Msg  string
-	Line int
+	Tag    ErrorTag
+	Msg    string
+	Line   int
+	Col    int    // in runes, from 0
+	Source string // the text of the line
+	Trace  []int  // lines of the calls that led to the error, innermost first
 }
 
 func (e Error) Error() string { return e.Msg }
 
 func E(tag ErrorTag, msg string, line int) Error {
-	return Error{tag, msg, line}
+	return Error{Tag: tag, Msg: msg, Line: line}
+}
+
+// Excerpt shows the line the error is on with a caret under its column, or
+// nothing if there's no source for it
+func (e Error) Excerpt() string {
+	if e.Source == "" {
+		return ""
+	}
+
+	// keep tabs so the caret lines up however wide they are
+	var pad strings.Builder
+	for i, r := range []rune(e.Source) {
+		if i >= e.Col {
+			break
+		}
+		if r == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteRune(' ')
+		}
+	}
+
+	gutter := fmt.Sprintf("%d | ", e.Line)
+	return fmt.Sprintf("%s%s\n%*s| %s^\n", gutter, e.Source, len(gutter)-2, "", pad.String())
 }
@@ -1,72 +1,242 @@
 package lang
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
 	"strings"
 	"time"
 )
 
 // control flow errors
 type returnValue struct{ value Value }
-type breakError struct{}
-type continueError struct{}
+type breakError struct{ node *StmtBreak }
+type continueError struct{ node *StmtContinue }
 
 func (r returnValue) Error() string   { return "" }
 func (b breakError) Error() string    { return "" }
 func (c continueError) Error() string { return "" }
 
+// Env is a scope. Locals live in slots at the index the resolver gave them,
+// only the root env has vars, for globals.
 type Env struct {
 	parent *Env
 	vars   map[string]*Value
+	slots  []Value
+	names  []string   // the name of each slot, for the debugger
+	owner  *Evaluator // the evaluator that made it, see pmap
+
+	// globals worked out the first time they're used, see setLazyGlobal
+	lazy map[string]func() Value
 }
 
 type stackFrame struct {
 	callSite Node
 	env      *Env
-	parent   *stackFrame
 }
 
 type Evaluator struct {
 	sections map[string]*StmtSection
 	env      *Env
+	globals  *Env
 	prog     *Program
 	section  *StmtSection
 	lex      *Lexer
-	stackTop *stackFrame
+	frames   []stackFrame
+
+	// arguments for calls in progress, see ExprFuncall in evalExpr
+	argStack []Value
+
+	// the innermost native call in progress. natives don't know which line
+	// they're on, EvalSection uses this to fill it in on their errors.
+	native *ExprFuncall
+
+	// set by EnableVM
+	vm *vm
+
+	// where print and println write to
+	out io.Writer
+
+	// paths given to read, see FilesRead
+	filesRead []string
+
+	// set by WithStdin, stdin() reads all of it once and keeps the result.
+	// pmap's workers share it so only one of them reads.
+	stdin *stdinOnce
+
+	// set by WithDebugger
+	debugger *Debugger
+
+	// set on pmap's workers, which can only assign to their own variables
+	parallel bool
+
+	// set by WithTrace, statements and calls are written here as they run
+	traceOut   io.Writer
+	traceLimit int
+	traceLines int
+
+	// set by EvalSectionContext, checked every cancelCheckInterval steps
+	ctx     context.Context
+	steps   int
+	timeout time.Duration
+	baseCtx context.Context // set by WithContext, every section runs in it
+
+	// how many run_section calls are in progress
+	sectionDepth int
+
+	// for rand and shuffle, made from seed on first use, see random
+	rng  *rand.Rand
+	seed int64
+
+	// for clock_ms and now, set by WithClock. clock_ms counts from started.
+	clock   func() time.Time
+	started time.Time
+
+	// set by WithProgress, print and println go around it
+	progress *progressBar
 
 	profileMode   bool
 	profileEvents []*profileEvent
+	profileStack  []*profileEvent // events in progress, innermost last
 }
 
 type profileEvent struct {
-	node  Node
-	start time.Time
-	end   time.Time
+	node     Node
+	start    time.Time
+	end      time.Time
+	children time.Duration // time spent in events nested inside this one
+	depth    int           // where this event sits in profileStack
+
+	// set when the same node is already in progress, a recursive call's time
+	// is already part of the outer call's total
+	recursive bool
 }
 
 func NewEvaluator(prog *Program, lex *Lexer, profile bool) Evaluator {
+	return newEvaluator(prog, lex, options{output: os.Stdout, stdin: os.Stdin, profile: profile})
+}
+
+func newEvaluator(prog *Program, lex *Lexer, opts options) Evaluator {
 	env := Env{vars: make(map[string]*Value)}
 	ev := Evaluator{
 		env:         &env,
+		globals:     &env,
 		sections:    make(map[string]*StmtSection),
 		lex:         lex,
-		profileMode: profile,
-	}
-
-	ev.setEnv("print", &Value{Tag: ValNativeFn, NativeFn: nativePrint})
-	ev.setEnv("println", &Value{Tag: ValNativeFn, NativeFn: nativePrintLn})
-	ev.setEnv("num", &Value{Tag: ValNativeFn, NativeFn: nativeNum})
-	ev.setEnv("read", &Value{Tag: ValNativeFn, NativeFn: nativeRead})
-	ev.setEnv("split", &Value{Tag: ValNativeFn, NativeFn: nativeSplit})
-	ev.setEnv("len", &Value{Tag: ValNativeFn, NativeFn: nativeLen})
-	ev.setEnv("push", &Value{Tag: ValNativeFn, NativeFn: nativePush})
-	ev.setEnv("slice", &Value{Tag: ValNativeFn, NativeFn: nativeSlice})
-	ev.setEnv("delete", &Value{Tag: ValNativeFn, NativeFn: nativeDelete})
-	ev.setEnv("range", &Value{Tag: ValNativeFn, NativeFn: nativeRange})
-	ev.setEnv("rangei", &Value{Tag: ValNativeFn, NativeFn: nativeRangeI})
-	ev.setEnv("sort", &Value{Tag: ValNativeFn, NativeFn: nativeSort})
-	ev.setEnv("upper", &Value{Tag: ValNativeFn, NativeFn: nativeUpper})
-	ev.setEnv("array", &Value{Tag: ValNativeFn, NativeFn: nativeArray})
+		out:         opts.output,
+		stdin:       &stdinOnce{r: opts.stdin},
+		timeout:     opts.timeout,
+		baseCtx:     opts.ctx,
+		traceOut:    opts.traceOut,
+		traceLimit:  opts.traceLimit,
+		debugger:    opts.debugger,
+		profileMode: opts.profile,
+		clock:       opts.clock,
+		seed:        defaultSeed,
+	}
+	if ev.clock == nil {
+		ev.clock = time.Now
+	}
+	ev.started = ev.clock()
+	if opts.progress != nil {
+		ev.progress = &progressBar{w: opts.progress}
+	}
+
+	ev.setGlobal("print", &Value{Tag: ValNativeFn, NativeFn: nativePrint})
+	ev.setGlobal("println", &Value{Tag: ValNativeFn, NativeFn: nativePrintLn})
+	ev.setGlobal("num", &Value{Tag: ValNativeFn, NativeFn: nativeNum})
+	ev.setGlobal("type", &Value{Tag: ValNativeFn, NativeFn: nativeType})
+	ev.setGlobal("str", &Value{Tag: ValNativeFn, NativeFn: nativeStr})
+	ev.setGlobal("read", &Value{Tag: ValNativeFn, NativeFn: nativeRead})
+	ev.setGlobal("env", &Value{Tag: ValNativeFn, NativeFn: nativeEnv})
+	ev.setGlobal("stdin", &Value{Tag: ValNativeFn, NativeFn: nativeStdin})
+	ev.setGlobal("split", &Value{Tag: ValNativeFn, NativeFn: nativeSplit})
+	ev.setGlobal("len", &Value{Tag: ValNativeFn, NativeFn: nativeLen})
+	ev.setGlobal("push", &Value{Tag: ValNativeFn, NativeFn: nativePush})
+	ev.setGlobal("slice", &Value{Tag: ValNativeFn, NativeFn: nativeSlice})
+	ev.setGlobal("delete", &Value{Tag: ValNativeFn, NativeFn: nativeDelete})
+	ev.setGlobal("map_incr", &Value{Tag: ValNativeFn, NativeFn: nativeMapIncr})
+	ev.setGlobal("range", &Value{Tag: ValNativeFn, NativeFn: nativeRange})
+	ev.setGlobal("rangei", &Value{Tag: ValNativeFn, NativeFn: nativeRangeI})
+	ev.setGlobal("contains", &Value{Tag: ValNativeFn, NativeFn: nativeContains})
+	ev.setGlobal("to_array", &Value{Tag: ValNativeFn, NativeFn: nativeToArray})
+	ev.setGlobal("iter", &Value{Tag: ValNativeFn, NativeFn: nativeIter})
+	ev.setGlobal("nums", &Value{Tag: ValNativeFn, NativeFn: nativeNums})
+	ev.setGlobal("paragraphs", &Value{Tag: ValNativeFn, NativeFn: nativeParagraphs})
+	ev.setGlobal("json", &Value{Tag: ValNativeFn, NativeFn: nativeJSON})
+	ev.setGlobal("parse_json", &Value{Tag: ValNativeFn, NativeFn: nativeParseJSON})
+	ev.setGlobal("get_path", &Value{Tag: ValNativeFn, NativeFn: nativeGetPath})
+	ev.setGlobal("set_path", &Value{Tag: ValNativeFn, NativeFn: nativeSetPath})
+	ev.setGlobal("walk", &Value{Tag: ValNativeFn, NativeFn: nativeWalk})
+	ev.setGlobal("windows", &Value{Tag: ValNativeFn, NativeFn: nativeWindows})
+	ev.setGlobal("sort", &Value{Tag: ValNativeFn, NativeFn: nativeSort})
+	ev.setGlobal("upper", &Value{Tag: ValNativeFn, NativeFn: nativeUpper})
+	ev.setGlobal("format", &Value{Tag: ValNativeFn, NativeFn: nativeFormat})
+	ev.setGlobal("pad_left", &Value{Tag: ValNativeFn, NativeFn: nativePadLeft})
+	ev.setGlobal("pad_right", &Value{Tag: ValNativeFn, NativeFn: nativePadRight})
+	ev.setGlobal("to_bin", &Value{Tag: ValNativeFn, NativeFn: nativeToBin})
+	ev.setGlobal("hex_to_bin", &Value{Tag: ValNativeFn, NativeFn: nativeHexToBin})
+	ev.setGlobal("bin_to_num", &Value{Tag: ValNativeFn, NativeFn: nativeBinToNum})
+	ev.setGlobal("hex", &Value{Tag: ValNativeFn, NativeFn: nativeHex})
+	ev.setGlobal("md5", &Value{Tag: ValNativeFn, NativeFn: nativeMD5})
+	ev.setGlobal("sha256", &Value{Tag: ValNativeFn, NativeFn: nativeSHA256})
+	ev.setGlobal("array", &Value{Tag: ValNativeFn, NativeFn: nativeArray})
+	ev.setGlobal("array2d", &Value{Tag: ValNativeFn, NativeFn: nativeArray2D})
+	ev.setGlobal("assert", &Value{Tag: ValNativeFn, NativeFn: nativeAssert})
+	ev.setGlobal("error", &Value{Tag: ValNativeFn, NativeFn: nativeError})
+	ev.setGlobal("copy", &Value{Tag: ValNativeFn, NativeFn: nativeCopy})
+	ev.setGlobal("set", &Value{Tag: ValNativeFn, NativeFn: nativeSet})
+	ev.setGlobal("add", &Value{Tag: ValNativeFn, NativeFn: nativeAdd})
+	ev.setGlobal("has", &Value{Tag: ValNativeFn, NativeFn: nativeHas})
+	ev.setGlobal("union", &Value{Tag: ValNativeFn, NativeFn: nativeUnion})
+	ev.setGlobal("intersect", &Value{Tag: ValNativeFn, NativeFn: nativeIntersect})
+	ev.setGlobal("difference", &Value{Tag: ValNativeFn, NativeFn: nativeDifference})
+	ev.setGlobal("parse_grid", &Value{Tag: ValNativeFn, NativeFn: nativeParseGrid})
+	ev.setGlobal("transpose", &Value{Tag: ValNativeFn, NativeFn: nativeTranspose})
+	ev.setGlobal("rotate_cw", &Value{Tag: ValNativeFn, NativeFn: nativeRotateCW})
+	ev.setGlobal("rotate_ccw", &Value{Tag: ValNativeFn, NativeFn: nativeRotateCCW})
+	ev.setGlobal("flip_h", &Value{Tag: ValNativeFn, NativeFn: nativeFlipH})
+	ev.setGlobal("flip_v", &Value{Tag: ValNativeFn, NativeFn: nativeFlipV})
+	ev.setGlobal("neighbors4", &Value{Tag: ValNativeFn, NativeFn: nativeNeighbors4})
+	ev.setGlobal("neighbors8", &Value{Tag: ValNativeFn, NativeFn: nativeNeighbors8})
+	ev.setGlobal("in_bounds", &Value{Tag: ValNativeFn, NativeFn: nativeInBounds})
+	ev.setGlobal("heap", &Value{Tag: ValNativeFn, NativeFn: nativeHeap})
+	ev.setGlobal("heap_push", &Value{Tag: ValNativeFn, NativeFn: nativeHeapPush})
+	ev.setGlobal("heap_pop", &Value{Tag: ValNativeFn, NativeFn: nativeHeapPop})
+	ev.setGlobal("queue", &Value{Tag: ValNativeFn, NativeFn: nativeQueue})
+	ev.setGlobal("q_push", &Value{Tag: ValNativeFn, NativeFn: nativeQueuePush})
+	ev.setGlobal("q_pop_front", &Value{Tag: ValNativeFn, NativeFn: nativeQueuePopFront})
+	ev.setGlobal("q_pop_back", &Value{Tag: ValNativeFn, NativeFn: nativeQueuePopBack})
+	ev.setGlobal("buffer", &Value{Tag: ValNativeFn, NativeFn: nativeBuffer})
+	ev.setGlobal("buf_write", &Value{Tag: ValNativeFn, NativeFn: nativeBufWrite})
+	ev.setGlobal("buf_string", &Value{Tag: ValNativeFn, NativeFn: nativeBufString})
+	ev.setGlobal("run_section", &Value{Tag: ValNativeFn, NativeFn: nativeRunSection})
+	ev.setGlobal("rand", &Value{Tag: ValNativeFn, NativeFn: nativeRand})
+	ev.setGlobal("rand_seed", &Value{Tag: ValNativeFn, NativeFn: nativeRandSeed})
+	ev.setGlobal("shuffle", &Value{Tag: ValNativeFn, NativeFn: nativeShuffle})
+	ev.setGlobal("clock_ms", &Value{Tag: ValNativeFn, NativeFn: nativeClockMs})
+	ev.setGlobal("now", &Value{Tag: ValNativeFn, NativeFn: nativeNow})
+	ev.setGlobal("progress", &Value{Tag: ValNativeFn, NativeFn: nativeProgress})
+	ev.setGlobal("memo", &Value{Tag: ValNativeFn, NativeFn: nativeMemo})
+	ev.setGlobal("pmap", &Value{Tag: ValNativeFn, NativeFn: nativePmap})
+	ev.setGlobal("floor", &Value{Tag: ValNativeFn, NativeFn: nativeFloor})
+	ev.setGlobal("ceil", &Value{Tag: ValNativeFn, NativeFn: nativeCeil})
+	ev.setGlobal("round", &Value{Tag: ValNativeFn, NativeFn: nativeRound})
+	ev.setGlobal("gcd", &Value{Tag: ValNativeFn, NativeFn: nativeGcd})
+	ev.setGlobal("lcm", &Value{Tag: ValNativeFn, NativeFn: nativeLcm})
+	ev.setGlobal("divmod", &Value{Tag: ValNativeFn, NativeFn: nativeDivmod})
+	ev.setGlobal("clamp", &Value{Tag: ValNativeFn, NativeFn: nativeClamp})
+	ev.setGlobal("between", &Value{Tag: ValNativeFn, NativeFn: nativeBetween})
+	ev.setGlobal("manhattan", &Value{Tag: ValNativeFn, NativeFn: nativeManhattan})
+
+	for name, v := range opts.vars {
+		v := v
+		ev.setGlobal(name, &v)
+	}
 
 	ev.evalProgram(prog)
 	return ev
@@ -74,8 +244,15 @@ func NewEvaluator(prog *Program, lex *Lexer, profile bool) Evaluator {
 
 func (ev *Evaluator) profileStart(node Node) *profileEvent {
 	if ev.profileMode {
-		evt := profileEvent{node, time.Now(), time.Unix(0, 0)}
+		evt := profileEvent{node: node, start: time.Now(), end: time.Unix(0, 0), depth: len(ev.profileStack)}
+		for _, outer := range ev.profileStack {
+			if outer.node == node {
+				evt.recursive = true
+				break
+			}
+		}
 		ev.profileEvents = append(ev.profileEvents, &evt)
+		ev.profileStack = append(ev.profileStack, &evt)
 		return &evt
 	}
 	return nil
@@ -84,87 +261,155 @@ func (ev *Evaluator) profileStart(node Node) *profileEvent {
 func (ev *Evaluator) profileEnd(evt *profileEvent) {
 	if ev.profileMode {
 		evt.end = time.Now()
+		// anything above this event on the stack never ended, an error
+		// unwound through it
+		if evt.depth > len(ev.profileStack) {
+			return
+		}
+		ev.profileStack = ev.profileStack[:evt.depth]
+		if evt.depth > 0 {
+			ev.profileStack[evt.depth-1].children += evt.duration()
+		}
 	}
 }
 
-func (ev *Evaluator) pushEnv() {
-	env := ev.env
-	newEnv := Env{vars: make(map[string]*Value)}
-	newEnv.parent = env
+// pushEnv creates a new scope with room for the given number of locals.
+// Callers put back the env they had rather than popping one off, a panic
+// unwinding out of a function call leaves the function's env in place.
+func (ev *Evaluator) pushEnv(slots int, names []string) {
+	newEnv := Env{parent: ev.env, names: names, owner: ev}
+	if slots > 0 {
+		newEnv.slots = make([]Value, slots)
+	}
 	ev.env = &newEnv
 }
 
-func (ev *Evaluator) popEnv() {
-	if ev.env.parent == nil {
-		panic("attempted to pop last env")
+// the seed of every evaluator's random numbers until rand_seed is called, a
+// program gives the same answer every time unless it asks not to
+const defaultSeed = 1
+
+// random returns the evaluator's random number generator. Each evaluator has
+// its own, pmap's workers included, none of them share state.
+func (ev *Evaluator) random() *rand.Rand {
+	if ev.rng == nil {
+		ev.rng = rand.New(rand.NewSource(ev.seed))
 	}
-	ev.env = ev.env.parent
+	return ev.rng
 }
 
 func (ev *Evaluator) pushFrame(node Node) {
-	frame := stackFrame{node, ev.env, ev.stackTop}
-	ev.stackTop = &frame
+	ev.frames = append(ev.frames, stackFrame{node, ev.env})
 }
 
 func (ev *Evaluator) popFrame() {
-	if ev.stackTop.parent == nil {
+	if len(ev.frames) <= 1 {
 		panic("attempted to pop last stack frame")
 	}
-	ev.stackTop = ev.stackTop.parent
+	ev.frames = ev.frames[:len(ev.frames)-1]
 }
 
-func (ev *Evaluator) setEnv(name string, val *Value) {
-	ev.env.vars[name] = val
+func (ev *Evaluator) setGlobal(name string, val *Value) {
+	delete(ev.globals.lazy, name)
+	ev.globals.vars[name] = val
 }
 
-func (ev *Evaluator) updateEnv(name string, val *Value) {
-	env := ev.env
-	for env != nil {
-		_, present := env.vars[name]
-		if present {
-			env.vars[name] = val
-			return
-		}
-		env = env.parent
+// setLazyGlobal makes name a global whose value is made by f the first time
+// it's used, for globals that are expensive and often not needed
+func (ev *Evaluator) setLazyGlobal(name string, f func() Value) {
+	if ev.globals.lazy == nil {
+		ev.globals.lazy = make(map[string]func() Value)
+	}
+	delete(ev.globals.vars, name)
+	ev.globals.lazy[name] = f
+}
+
+// updateGlobal assigns to an existing global, assigning to one that doesn't
+// exist does nothing
+func (ev *Evaluator) updateGlobal(name string, val *Value) {
+	_, present := ev.globals.vars[name]
+	if _, lazy := ev.globals.lazy[name]; present || lazy {
+		ev.setGlobal(name, val)
 	}
 }
 
-func (ev *Evaluator) find(name string) (*Value, bool) {
+func (ev *Evaluator) findGlobal(name string) (*Value, bool) {
+	val, present := ev.globals.vars[name]
+	if present {
+		return val, true
+	}
+	if f, lazy := ev.globals.lazy[name]; lazy {
+		v := f()
+		ev.setGlobal(name, &v)
+		return &v, true
+	}
+	return &NilValue, false
+}
+
+func (ev *Evaluator) setLocal(slot int, val Value) {
+	ev.env.slots[slot] = val
+}
+
+// local finds a variable the resolver placed in a local env
+func (ev *Evaluator) local(l local) *Value {
+	return &ev.localEnv(l).slots[l.slot]
+}
+
+func (ev *Evaluator) localEnv(l local) *Env {
 	env := ev.env
-	for env != nil {
-		val, present := env.vars[name]
-		if present {
-			return val, true
-		}
+	for i := 0; i < l.depth; i++ {
 		env = env.parent
 	}
-	return &NilValue, false
+	return env
 }
 
 func (ev *Evaluator) fmtError(node Node, format string, args ...interface{}) Error {
-	line, _ := ev.lex.GetLineAndCol(*node.Token())
-	// lines := make([]string, 0)
-	// frame := ev.stackTop
-	// for frame != nil {
-	// 	frame_line, _ := ev.lex.GetLineAndCol(*frame.callSite.Token())
-	// 	lines = append(lines, fmt.Sprintf("  line %d", frame_line))
-	// 	frame = frame.parent
-	// }
 	msg := fmt.Sprintf(format, args...)
-	// msg = fmt.Sprintf("%s\n%s", strings.Join(lines, "\n"), msg)
-	return E(RuntimeError, msg, line)
+	e := ev.lex.errorAt(RuntimeError, *node.Token(), msg)
+	e.Trace = ev.trace()
+	return e
 }
 
+// trace returns the lines of the calls in progress, innermost first
+func (ev *Evaluator) trace() []int {
+	var lines []int
+	for i := len(ev.frames) - 1; i >= 0; i-- {
+		tok := ev.frames[i].callSite.Token()
+		if tok == nil {
+			// the program
+			continue
+		}
+		line, _ := ev.lex.GetLineAndCol(*tok)
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// ReadInput sets the input and lines globals, and two more that are only
+// worked out if they're used: nums_lines, the numbers in each line or nil for
+// a line without any, and blocks, the lines of each paragraph. CRLF line
+// endings are read as LF, so lines never end in \r.
 func (ev *Evaluator) ReadInput(input string) {
+	input = strings.ReplaceAll(input, "\r\n", "\n")
 	lines := make([]Value, 0)
 
 	for _, line := range strings.Split(strings.TrimSpace(input), "\n") {
-		l := line
-		lines = append(lines, Value{Tag: ValStr, Str: &l})
+		lines = append(lines, Value{Tag: ValStr, Str: line})
 	}
 
-	ev.setEnv("input", &Value{Tag: ValStr, Str: &input})
-	ev.setEnv("lines", &Value{Tag: ValArray, Array: &lines})
+	ev.setGlobal("input", &Value{Tag: ValStr, Str: input})
+	ev.setGlobal("lines", &Value{Tag: ValArray, Array: &lines})
+	ev.setLazyGlobal("nums_lines", func() Value {
+		rows := make([]Value, len(lines))
+		for i, line := range lines {
+			if nums := extractNums(line.Str); len(nums) > 0 {
+				rows[i] = Value{Tag: ValArray, Array: &nums}
+			}
+		}
+		return Value{Tag: ValArray, Array: &rows}
+	})
+	ev.setLazyGlobal("blocks", func() Value {
+		return paragraphs(input)
+	})
 }
 
 func (ev *Evaluator) evalProgram(prog *Program) error {
@@ -174,7 +419,9 @@ func (ev *Evaluator) evalProgram(prog *Program) error {
 
 	ev.pushFrame(prog)
 
-	// read all the sections
+	// read all the sections. Functions are declared in file order, but
+	// nothing runs until a section does and a function looks up globals
+	// when it's called, so functions can call ones declared after them.
 	for _, section := range prog.Stmts {
 		if stmt, ok := section.(*StmtSection); ok {
 			name := stmt.Label
@@ -190,44 +437,285 @@ func (ev *Evaluator) evalProgram(prog *Program) error {
 	return nil
 }
 
+// Parse runs the parse section, if there is one, and makes its value the
+// parsed global. It's for parsing the input once rather than in every part,
+// call it after each ReadInput.
+func (ev *Evaluator) Parse() error {
+	if !ev.HasSection("parse") {
+		return nil
+	}
+	v, err := ev.EvalSection("parse")
+	if err != nil {
+		return err
+	}
+	ev.setGlobal("parsed", &v)
+	return nil
+}
+
+// EvalSection runs the named section. Errors are returned rather than
+// raised, so it's safe to call from outside the package.
 func (ev *Evaluator) EvalSection(name string) (Value, error) {
+	ctx := ev.baseCtx
+	if ev.timeout > 0 {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ev.timeout)
+		defer cancel()
+	}
+	if ctx != nil {
+		return ev.EvalSectionContext(ctx, name)
+	}
+	return ev.evalSection(name)
+}
+
+// EvalSectionContext is EvalSection, stopping with a runtime error if ctx is
+// cancelled or times out before the section finishes
+func (ev *Evaluator) EvalSectionContext(ctx context.Context, name string) (Value, error) {
+	if err := ctx.Err(); err != nil {
+		return NilValue, Error{Tag: RuntimeError, Msg: cancelMessage(err)}
+	}
+	prev := ev.ctx
+	ev.ctx = ctx
+	defer func() { ev.ctx = prev }()
+	return ev.evalSection(name)
+}
+
+// how many statements and loop iterations run between looks at the context,
+// ctx.Err takes a lock
+const cancelCheckInterval = 1024
+
+// checkCancelled raises an error at node if the section's context is done.
+// Callers check ev.ctx isn't nil first, it's the common case and cheaper
+// than a call.
+func (ev *Evaluator) checkCancelled(node Node) {
+	ev.steps++
+	if ev.steps%cancelCheckInterval != 0 {
+		return
+	}
+	if err := ev.ctx.Err(); err != nil {
+		panic(ev.fmtError(node, "%s", cancelMessage(err)))
+	}
+}
+
+func cancelMessage(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "execution timed out"
+	}
+	return "execution cancelled"
+}
+
+func (ev *Evaluator) evalSection(name string) (v Value, err error) {
 	if ev.section != nil {
-		panic("cannot nest sections")
+		return NilValue, Error{Tag: RuntimeError, Msg: "cannot nest sections"}
 	}
 
-	section, preset := ev.sections[name]
-	evt := ev.profileStart(section)
-	if !preset {
-		panic(fmt.Errorf("couldn't find section %s", name))
+	section, present := ev.sections[name]
+	if !present {
+		return NilValue, Error{Tag: RuntimeError, Msg: ev.missingSection(name)}
 	}
+	evt := ev.profileStart(section)
 
+	// restore the scope even if the section panics, the evaluator might be
+	// used for another section afterwards
+	env := ev.env
+	frames := len(ev.frames)
+	args := len(ev.argStack)
 	ev.section = section
 	defer func() {
+		r := recover()
+		if r != nil {
+			r = asError(r)
+		}
+		if e, ok := r.(Error); ok {
+			// this has to happen before the frames are reset for the trace
+			r = ev.nativeError(e)
+		}
+
 		ev.profileEnd(evt)
+		if ev.progress != nil {
+			ev.progress.finish()
+		}
 		ev.section = nil
+		ev.env = env
+		ev.frames = ev.frames[:frames]
+		ev.argStack = ev.argStack[:args]
+		ev.native = nil
+
+		if r != nil {
+			v, err = NilValue, asError(r)
+		}
 	}()
 
-	v, err := ev.evalStmt(&section.Body)
+	return ev.sectionValue(section)
+}
+
+// sectionValue runs a section's body in the current env
+func (ev *Evaluator) sectionValue(section *StmtSection) (Value, error) {
+	if ev.vm != nil {
+		if c, ok := ev.vm.sections[section]; ok {
+			return ev.vm.run(c), nil
+		}
+	}
+
+	var v Value
+	var err error
+	if b, ok := section.Body.(*StmtBlock); ok {
+		v, err = ev.blockValue(b)
+	} else {
+		v, err = ev.evalStmt(&section.Body)
+	}
 	if r, ok := err.(returnValue); ok {
 		return r.value, nil
 	}
 	if err != nil {
-		return NilValue, err
+		return NilValue, ev.controlFlowError(err)
 	}
 
 	return v, nil
 }
 
+func (ev *Evaluator) missingSection(name string) string {
+	msg := fmt.Sprintf("couldn't find section %s", name)
+	if close := suggest(name, ev.Sections()); len(close) > 0 {
+		msg += didYouMean(close)
+	} else {
+		msg += ", the sections are " + strings.Join(ev.Sections(), ", ")
+	}
+	return msg
+}
+
+// how deep run_section can nest, a section that runs itself would otherwise
+// only stop when the go stack runs out
+const maxSectionDepth = 64
+
+// nativeRunSection runs another section and returns its value, so part2 can
+// reuse part1 with different globals. The section runs in the global scope
+// like any other, it can't see the caller's locals.
+func nativeRunSection(ev *Evaluator, args []Value) Value {
+	checkArgs("run_section", args, ValStr)
+	name := args[0].Str
+	section, present := ev.sections[name]
+	if !present {
+		panic(E(RuntimeError, "run_section: "+ev.missingSection(name), 0))
+	}
+	if ev.sectionDepth >= maxSectionDepth {
+		panic(E(RuntimeError, fmt.Sprintf("run_section: sections nested more than %d deep running %s", maxSectionDepth, name), 0))
+	}
+
+	prevSection, env, frames := ev.section, ev.env, len(ev.frames)
+	evt := ev.profileStart(section)
+	ev.sectionDepth++
+	defer func() {
+		ev.sectionDepth--
+		ev.profileEnd(evt)
+		ev.section, ev.env, ev.frames = prevSection, env, ev.frames[:frames]
+	}()
+
+	ev.section = section
+	ev.env = ev.globals
+	ev.pushFrame(ev.native)
+	v, err := ev.sectionValue(section)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// blockValue evaluates a block in a new env, for the value of a section or a
+// match case. A block's value is the value of its last statement if that's an
+// expression, otherwise nil: a block ending in an if or a for is nil.
+func (ev *Evaluator) blockValue(b *StmtBlock) (Value, error) {
+	if b.noEnv {
+		return ev.stmtsValue(b)
+	}
+	prevEnv := ev.env
+	ev.pushEnv(b.slots, b.names)
+	defer func() { ev.env = prevEnv }()
+	return ev.stmtsValue(b)
+}
+
+// stmtsValue is blockValue in the current env
+func (ev *Evaluator) stmtsValue(b *StmtBlock) (Value, error) {
+	for i := range b.Body {
+		v, err := ev.evalStmt(&b.Body[i])
+		if err != nil {
+			return NilValue, err
+		}
+		if i == len(b.Body)-1 {
+			if _, ok := lastValue(b); ok {
+				return v, nil
+			}
+		}
+	}
+	return NilValue, nil
+}
+
+// lastValue returns the last statement of a block if it has a value, an
+// expression or a match
+func lastValue(b *StmtBlock) (Stmt, bool) {
+	if len(b.Body) == 0 {
+		return nil, false
+	}
+	switch last := b.Body[len(b.Body)-1].(type) {
+	case *StmtExpr, *StmtMatch:
+		return last, true
+	}
+	return nil, false
+}
+
+// nativeError fills in the line of an error from a native. Natives don't know
+// their line, it's the line of the call in progress.
+func (ev *Evaluator) nativeError(e Error) Error {
+	if e.Line == 0 && ev.native != nil {
+		pos := ev.lex.errorAt(e.Tag, ev.native.identifierToken, e.Msg)
+		e.Line, e.Col, e.Source = pos.Line, pos.Col, pos.Source
+		e.Trace = append(ev.trace(), e.Trace...)
+	}
+	return e
+}
+
+// asError turns anything recovered from a panic into an Error. Anything
+// other than an Error is a bug in the interpreter or a native, it's still
+// reported rather than crashing whatever's embedding the evaluator.
+func asError(r interface{}) Error {
+	if e, ok := r.(Error); ok {
+		return e
+	}
+	return Error{Tag: RuntimeError, Msg: fmt.Sprintf("internal error, please report: %v", r)}
+}
+
+// FilesRead returns the paths the program has read with read()
+func (ev *Evaluator) FilesRead() []string {
+	return ev.filesRead
+}
+
 func (ev *Evaluator) HasSection(name string) bool {
 	_, present := ev.sections[name]
 	return present
 }
 
+// Sections returns the names of the program's sections in the order they're
+// declared
+func (ev *Evaluator) Sections() []string {
+	names := make([]string, 0, len(ev.sections))
+	for _, stmt := range ev.prog.Stmts {
+		if section, ok := stmt.(*StmtSection); ok {
+			names = append(names, section.Label)
+		}
+	}
+	return names
+}
+
 func (ev *Evaluator) evalBlock(block Stmt) error {
 	switch b := block.(type) {
 	case *StmtBlock:
-		ev.pushEnv()
-		defer func() { ev.popEnv() }()
+		if !b.noEnv {
+			prevEnv := ev.env
+			ev.pushEnv(b.slots, b.names)
+			defer func() { ev.env = prevEnv }()
+		}
 		for _, stmt := range b.Body {
 			_, err := ev.evalStmt(&stmt)
 			if err != nil {
@@ -243,46 +731,59 @@ func (ev *Evaluator) evalBlock(block Stmt) error {
 func (ev *Evaluator) evalExpr(expr *Expr) Value {
 	switch node := (*expr).(type) {
 	case *ExprString:
-		return Value{Tag: ValStr, Str: &node.Str}
+		return Value{Tag: ValStr, Str: node.Str}
 	case *ExprNum:
-		return Value{Tag: ValNum, Num: &node.Num}
+		return Value{Tag: ValNum, Num: node.Num}
+	case *ExprFloat:
+		return Value{Tag: ValFloat, Float: node.Float}
 	case *ExprNil:
 		return NilValue
 	case *ExprIdentifier:
-		v, ok := ev.find(node.Identifier)
+		if node.local.depth >= 0 {
+			return *ev.local(node.local)
+		}
+		v, ok := ev.findGlobal(node.Identifier)
 		if !ok {
-			panic(ev.fmtError(node, "unknown variable %s", node.Identifier))
+			panic(ev.fmtError(node, "%s", ev.unknownVariable(node.Identifier, ev.localNames())))
 		}
 		return *v
 	case *ExprFuncall:
 		fnVal := ev.evalExpr(&node.Identifier)
 
-		args := make([]Value, 0)
-		for _, arg := range node.Args {
-			args = append(args, ev.evalExpr(&arg))
+		// arguments go on a stack shared by every call rather than a new
+		// slice per call. it's truncated once the call returns, so callees
+		// must copy anything they want to keep hold of.
+		base := len(ev.argStack)
+		for i := range node.Args {
+			arg := ev.evalExpr(&node.Args[i])
+			if node.Spread && i == len(node.Args)-1 {
+				ev.argStack = append(ev.argStack, ev.spread(node.Args[i], arg)...)
+				break
+			}
+			ev.argStack = append(ev.argStack, arg)
 		}
+		args := ev.argStack[base:len(ev.argStack):len(ev.argStack)]
 
 		switch fnVal.Tag {
 		case ValNativeFn:
-			defer func() {
-				if r := recover(); r != nil {
-					if e, ok := r.(Error); ok {
-						// patch the line number, native functions don't know it
-						line, _ := ev.lex.GetLineAndCol(node.identifierToken)
-						e.Line = line
-						panic(e)
-					}
-					panic(r)
-				}
-			}()
-			evt := ev.profileStart(node)
-			defer func() { ev.profileEnd(evt) }()
-			return fnVal.NativeFn(args)
-		case ValFn:
-			v, err := ev.fn(node, fnVal, args)
-			if err != nil {
-				panic(err) // FIXME
+			// no defers here, they cost more than most natives. if the native
+			// panics ev.native is left pointing at this call for EvalSection.
+			prevNative := ev.native
+			ev.native = node
+			var v Value
+			if ev.profileMode {
+				evt := ev.profileStart(node)
+				v = fnVal.NativeFn(ev, args)
+				ev.profileEnd(evt)
+			} else {
+				v = fnVal.NativeFn(ev, args)
 			}
+			ev.native = prevNative
+			ev.argStack = ev.argStack[:base]
+			return v
+		case ValFn:
+			v := ev.fn(node, fnVal, args)
+			ev.argStack = ev.argStack[:base]
 			return v
 		}
 
@@ -290,8 +791,20 @@ func (ev *Evaluator) evalExpr(expr *Expr) Value {
 	case *ExprFunc:
 		closure := Closure{node, ev.env}
 		fnVal := Value{Tag: ValFn, Fn: &closure}
-		ev.setEnv(node.Identifier, &fnVal)
+		if node.slot >= 0 {
+			ev.setLocal(node.slot, fnVal)
+		} else if node.Identifier != anonymousFn {
+			ev.setGlobal(node.Identifier, &fnVal)
+		}
 		return fnVal
+	case *ExprMatch:
+		// the parser doesn't allow return, break or continue in a match
+		// expression, there's nothing else it can fail with
+		v, err := ev.match(node.Match)
+		if err != nil {
+			panic(ev.controlFlowError(err))
+		}
+		return v
 	case *ExprBinary:
 		return ev.evalBinaryExpr(node)
 	case *ExprUnary:
@@ -303,53 +816,111 @@ func (ev *Evaluator) evalExpr(expr *Expr) Value {
 		}
 		return Value{Tag: ValArray, Array: &items}
 	case *ExprMap:
-		items := make(map[string]Value)
+		items := make(map[MapKey]Value)
 		for _, item := range node.Items {
 			val := ev.evalExpr(&item.Value)
 			items[item.Key] = val
 		}
 		return Value{Tag: ValMap, Map: &items}
 	default:
-		panic(ev.fmtError(node, "unhandled expression type %#v\n", node))
+		panic(ev.fmtError(node, "unhandled expression type %T", node))
 	}
 }
 
-func (ev *Evaluator) fn(node Node, fnVal Value, args []Value) (Value, error) {
+// fn calls a user function. There's no defer to restore the env and frames
+// if the body panics, whoever recovers (tryBlock or EvalSection) does that.
+func (ev *Evaluator) fn(node Node, fnVal Value, args []Value) Value {
 	closure := fnVal.Fn
 	fn := closure.fn
-	prevEnv := ev.env
-	evt := ev.profileStart(fn)
 
-	if len(fn.Args) != len(args) {
-		panic(ev.fmtError(fn, "arity mismatch: %s expects %d arguments", fn.Identifier, len(fn.Args)))
+	ev.checkFnArity(fn, len(args))
+	passed := args
+	var rest []Value
+	if fn.Variadic {
+		// copied, args is only borrowed from the arg stack
+		fixed := fn.fixed()
+		rest = make([]Value, 0)
+		if len(args) > fixed {
+			rest = append(rest, args[fixed:]...)
+			args = args[:fixed]
+		}
 	}
 
+	if ev.traceOut != nil {
+		ev.traceCall(node, fn, passed)
+	}
+	evt := ev.profileStart(fn)
+	prevEnv := ev.env
 	ev.env = closure.env
-	ev.pushEnv()
+	if fn.needsEnv {
+		ev.pushEnv(fn.slots, fn.names)
+		// arguments are the first locals
+		copy(ev.env.slots, args)
+	}
 	ev.pushFrame(node)
-	defer func() {
-		ev.popFrame()
-		ev.popEnv()
-		ev.env = prevEnv
-		ev.profileEnd(evt)
-	}()
+	for i := len(args); i < fn.fixed(); i++ {
+		ev.setLocal(i, ev.evalExpr(&fn.Defaults[i]))
+	}
+	if fn.Variadic {
+		ev.setLocal(fn.fixed(), Value{Tag: ValArray, Array: &rest})
+	}
+
+	v := ev.fnBody(fn)
 
-	for index, ident := range fn.Args {
-		ev.setEnv(ident, &args[index])
+	ev.popFrame()
+	ev.env = prevEnv
+	ev.profileEnd(evt)
+	return v
+}
+
+// checkFnArity raises an error if a call to fn passes the wrong number of
+// arguments. Args with defaults can be left off the end, and a variadic
+// function takes any number more.
+func (ev *Evaluator) checkFnArity(fn *ExprFunc, n int) {
+	required := fn.required()
+	switch {
+	case n >= required && (n <= len(fn.Args) || fn.Variadic):
+		return
+	case fn.Variadic:
+		panic(ev.fmtError(fn, "arity mismatch: %s expects at least %d arguments, got %d", fn.Identifier, required, n))
+	case required == len(fn.Args):
+		panic(ev.fmtError(fn, "arity mismatch: %s expects %d arguments, got %d", fn.Identifier, len(fn.Args), n))
+	}
+	panic(ev.fmtError(fn, "arity mismatch: %s expects %d to %d arguments, got %d", fn.Identifier, required, len(fn.Args), n))
+}
+
+// spread is the arguments from a spread array, f(xs..)
+func (ev *Evaluator) spread(node Node, v Value) []Value {
+	if v.Tag != ValArray {
+		panic(ev.fmtError(node, "only an array can be spread, got %s", withArticle(v.Tag.String())))
 	}
+	return *v.Array
+}
 
+func (ev *Evaluator) fnBody(fn *ExprFunc) Value {
 	b := fn.Body.(*StmtBlock)
-	for _, stmt := range b.Body {
-		_, err := ev.evalStmt(&stmt)
+	for i := range b.Body {
+		_, err := ev.evalStmt(&b.Body[i])
 		if r, ok := err.(returnValue); ok {
-			return r.value, nil
+			return r.value
 		}
 		if err != nil {
-			return NilValue, err
+			panic(ev.controlFlowError(err))
 		}
 	}
+	return NilValue
+}
 
-	return NilValue, nil
+// controlFlowError turns a break or continue that got out of every loop into
+// an error on its line
+func (ev *Evaluator) controlFlowError(err error) Error {
+	switch e := err.(type) {
+	case breakError:
+		return ev.fmtError(e.node, "break outside of loop")
+	case continueError:
+		return ev.fmtError(e.node, "continue outside of loop")
+	}
+	panic(fmt.Sprintf("unexpected control flow error %#v", err))
 }
 
 func (ev *Evaluator) evalBinaryExpr(expr *ExprBinary) Value {
@@ -360,7 +931,27 @@ func (ev *Evaluator) evalBinaryExpr(expr *ExprBinary) Value {
 	lhs := ev.evalExpr(&expr.Lhs)
 	rhs := ev.evalExpr(&expr.Rhs)
 
-	switch expr.Op.Tag {
+	v, err := binaryOp(expr.Op.Tag, lhs, rhs)
+	if err != nil {
+		panic(ev.fmtError(expr, "%s", err))
+	}
+	return v
+}
+
+func (ev *Evaluator) evalUnaryExpr(expr *ExprUnary) Value {
+	lhs := ev.evalExpr(&expr.Lhs)
+	v, err := unaryOp(expr.Op.Tag, lhs)
+	if err != nil {
+		panic(ev.fmtError(expr, "%s", err))
+	}
+	return v
+}
+
+// binaryOp applies a binary operator, other than assignment, to two
+// evaluated operands. It's shared by the evaluator and the vm so they agree
+// on the results and the errors.
+func binaryOp(op TokenTag, lhs Value, rhs Value) (Value, error) {
+	switch op {
 	case Plus:
 		// coerce nils to 0
 		if lhs.Tag == ValNil {
@@ -372,14 +963,24 @@ func (ev *Evaluator) evalBinaryExpr(expr *ExprBinary) Value {
 
 		switch {
 		case lhs.Tag == ValNum && rhs.Tag == ValNum:
-			result := *lhs.Num + *rhs.Num
-			return Value{Tag: ValNum, Num: &result}
+			result, ok := addInts(lhs.Num, rhs.Num)
+			if !ok {
+				return NilValue, errOverflow
+			}
+			return Value{Tag: ValNum, Num: result}, nil
+		case lhs.isNumber() && rhs.isNumber():
+			return Value{Tag: ValFloat, Float: lhs.asFloat() + rhs.asFloat()}, nil
+		case lhs.Tag == ValArray && rhs.Tag == ValArray:
+			items := make([]Value, 0, len(*lhs.Array)+len(*rhs.Array))
+			items = append(items, *lhs.Array...)
+			items = append(items, *rhs.Array...)
+			return Value{Tag: ValArray, Array: &items}, nil
 		case lhs.Tag == ValStr || rhs.Tag == ValStr:
 			// coerce everything to string
 			result := lhs.String() + rhs.String()
-			return Value{Tag: ValStr, Str: &result}
+			return Value{Tag: ValStr, Str: result}, nil
 		}
-		panic(ev.fmtError(expr, "operator only supported for numbers and strings"))
+		return NilValue, errors.New("operator only supported for numbers and strings")
 	case Minus, Star, Slash, Percent:
 		// coerce nils to 0
 		if lhs.Tag == ValNil {
@@ -389,25 +990,51 @@ func (ev *Evaluator) evalBinaryExpr(expr *ExprBinary) Value {
 			rhs = ZeroValue
 		}
 
-		if lhs.Tag != ValNum || rhs.Tag != ValNum {
-			panic(ev.fmtError(expr, "operator only supported for numbers"))
+		if op == Star {
+			switch {
+			case lhs.Tag == ValStr && rhs.Tag == ValNum:
+				return repeat(lhs.Str, rhs.Num)
+			case lhs.Tag == ValNum && rhs.Tag == ValStr:
+				return repeat(rhs.Str, lhs.Num)
+			case lhs.Tag == ValArray && rhs.Tag == ValNum:
+				return repeatArray(*lhs.Array, rhs.Num)
+			case lhs.Tag == ValNum && rhs.Tag == ValArray:
+				return repeatArray(*rhs.Array, lhs.Num)
+			}
+		}
+		if !lhs.isNumber() || !rhs.isNumber() {
+			return NilValue, errors.New("operator only supported for numbers")
+		}
+		if lhs.Tag == ValFloat || rhs.Tag == ValFloat {
+			return floatOp(op, lhs.asFloat(), rhs.asFloat()), nil
 		}
 
 		var result int
-		switch expr.Op.Tag {
-		case Plus:
-			result = *lhs.Num + *rhs.Num
+		ok := true
+		switch op {
 		case Minus:
-			result = *lhs.Num - *rhs.Num
+			result, ok = subInts(lhs.Num, rhs.Num)
 		case Star:
-			result = *lhs.Num * *rhs.Num
-		case Slash:
-			result = *lhs.Num / *rhs.Num
-		case Percent:
-			result = *lhs.Num % *rhs.Num
+			result, ok = mulInts(lhs.Num, rhs.Num)
+		case Slash, Percent:
+			if rhs.Num == 0 {
+				return NilValue, errors.New("division by zero")
+			}
+			// the smallest integer has no positive counterpart
+			if lhs.Num == math.MinInt && rhs.Num == -1 {
+				return NilValue, errOverflow
+			}
+			if op == Slash {
+				result = lhs.Num / rhs.Num
+			} else {
+				result = lhs.Num % rhs.Num
+			}
+		}
+		if !ok {
+			return NilValue, errOverflow
 		}
 
-		return Value{Tag: ValNum, Num: &result}
+		return Value{Tag: ValNum, Num: result}, nil
 	case LessLess, GreaterGreater, Amp, Pipe:
 		// coerce nils to 0
 		if lhs.Tag == ValNil {
@@ -418,36 +1045,44 @@ func (ev *Evaluator) evalBinaryExpr(expr *ExprBinary) Value {
 		}
 
 		if lhs.Tag != ValNum || rhs.Tag != ValNum {
-			panic(ev.fmtError(expr, "operator only supported for numbers"))
+			return NilValue, errors.New("operator only supported for numbers")
+		}
+
+		if (op == LessLess || op == GreaterGreater) && rhs.Num < 0 {
+			return NilValue, errors.New("cannot shift by a negative amount")
 		}
 
 		var result int
-		switch expr.Op.Tag {
+		switch op {
 		case LessLess:
-			result = *lhs.Num << *rhs.Num
+			result = lhs.Num << rhs.Num
+			// bits shifted off the top, or into the sign bit, don't come back
+			if result>>rhs.Num != lhs.Num {
+				return NilValue, errOverflow
+			}
 		case GreaterGreater:
-			result = *lhs.Num >> *rhs.Num
+			result = lhs.Num >> rhs.Num
 		case Amp:
-			result = *lhs.Num & *rhs.Num
+			result = lhs.Num & rhs.Num
 		case Pipe:
-			result = *lhs.Num | *rhs.Num
+			result = lhs.Num | rhs.Num
 		}
 
-		return Value{Tag: ValNum, Num: &result}
+		return Value{Tag: ValNum, Num: result}, nil
 	case EqualEqual, BangEqual:
 		result, err := lhs.Compare(rhs)
 		if err != nil {
-			panic(ev.fmtError(expr, err.Error()))
+			return NilValue, err
 		}
 		num := 0
 		if result {
 			num = 1
 		}
-		val := Value{Tag: ValNum, Num: &num}
-		if expr.Op.Tag == BangEqual {
-			return val.negate()
+		val := Value{Tag: ValNum, Num: num}
+		if op == BangEqual {
+			return val.negate(), nil
 		}
-		return val
+		return val, nil
 	case Greater, GreaterEqual, Less, LessEqual:
 		// coerce nils to 0
 		if lhs.Tag == ValNil {
@@ -460,23 +1095,59 @@ func (ev *Evaluator) evalBinaryExpr(expr *ExprBinary) Value {
 		switch {
 		case lhs.Tag == ValNum && rhs.Tag == ValNum:
 			result := false
-			switch expr.Op.Tag {
+			switch op {
+			case Greater:
+				result = lhs.Num > rhs.Num
+			case GreaterEqual:
+				result = lhs.Num >= rhs.Num
+			case Less:
+				result = lhs.Num < rhs.Num
+			case LessEqual:
+				result = lhs.Num <= rhs.Num
+			}
+			num := 0
+			if result {
+				num = 1
+			}
+			return Value{Tag: ValNum, Num: num}, nil
+		case lhs.Tag == ValStr && rhs.Tag == ValStr:
+			cmp := strings.Compare(lhs.Str, rhs.Str)
+			result := false
+			switch op {
+			case Greater:
+				result = cmp > 0
+			case GreaterEqual:
+				result = cmp >= 0
+			case Less:
+				result = cmp < 0
+			case LessEqual:
+				result = cmp <= 0
+			}
+			num := 0
+			if result {
+				num = 1
+			}
+			return Value{Tag: ValNum, Num: num}, nil
+		case lhs.isNumber() && rhs.isNumber():
+			a, b := lhs.asFloat(), rhs.asFloat()
+			result := false
+			switch op {
 			case Greater:
-				result = *lhs.Num > *rhs.Num
+				result = a > b
 			case GreaterEqual:
-				result = *lhs.Num >= *rhs.Num
+				result = a >= b
 			case Less:
-				result = *lhs.Num < *rhs.Num
+				result = a < b
 			case LessEqual:
-				result = *lhs.Num <= *rhs.Num
+				result = a <= b
 			}
 			num := 0
 			if result {
 				num = 1
 			}
-			return Value{Tag: ValNum, Num: &num}
+			return Value{Tag: ValNum, Num: num}, nil
 		}
-		panic(ev.fmtError(expr, "cannot compare %v and %v", lhs.Tag, rhs.Tag))
+		return NilValue, fmt.Errorf("cannot compare %v and %v", lhs.Tag, rhs.Tag)
 	case AmpAmp, PipePipe:
 		// coerce nils to 0
 		if lhs.Tag == ValNil {
@@ -486,15 +1157,15 @@ func (ev *Evaluator) evalBinaryExpr(expr *ExprBinary) Value {
 			rhs = ZeroValue
 		}
 
-		if lhs.Tag != ValNum || rhs.Tag != ValNum {
-			panic(ev.fmtError(expr, "operator only supported for numbers"))
+		if !lhs.isNumber() || !rhs.isNumber() {
+			return NilValue, errors.New("operator only supported for numbers")
 		}
 
 		lhs_truthy := lhs.isTruthy()
 		rhs_truthy := rhs.isTruthy()
 
 		result := false
-		switch expr.Op.Tag {
+		switch op {
 		case AmpAmp:
 			result = lhs_truthy && rhs_truthy
 		case PipePipe:
@@ -506,29 +1177,96 @@ func (ev *Evaluator) evalBinaryExpr(expr *ExprBinary) Value {
 			num_result = 1
 		}
 
-		return Value{Tag: ValNum, Num: &num_result}
+		return Value{Tag: ValNum, Num: num_result}, nil
 	case LSquare:
-		val, err := lhs.getKey(rhs)
-		if err != nil {
-			panic(ev.fmtError(expr, "%s", err))
-		}
-		return val
+		return lhs.getKey(rhs)
 	default:
-		panic(ev.fmtError(expr, "unknown operator %s", expr.Op.Tag.String()))
+		return NilValue, fmt.Errorf("unknown operator %s", op.String())
 	}
 }
 
-func (ev *Evaluator) evalUnaryExpr(expr *ExprUnary) Value {
-	lhs := ev.evalExpr(&expr.Lhs)
-	switch expr.Op.Tag {
+// errOverflow is raised rather than letting an integer wrap around and give
+// a wrong answer
+var errOverflow = errors.New("integer overflow")
+
+func addInts(a, b int) (int, bool) {
+	c := a + b
+	return c, (c > a) == (b > 0)
+}
+
+func subInts(a, b int) (int, bool) {
+	c := a - b
+	return c, (c < a) == (b > 0)
+}
+
+func mulInts(a, b int) (int, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	c := a * b
+	return c, c/b == a && !(a == -1 && b == math.MinInt) && !(b == -1 && a == math.MinInt)
+}
+
+// repeat is a string multiplied by a number
+func repeat(s string, count int) (Value, error) {
+	if count < 0 {
+		return NilValue, errors.New("cannot repeat a string a negative number of times")
+	}
+	if _, ok := mulInts(len(s), count); !ok {
+		return NilValue, errOverflow
+	}
+	return Value{Tag: ValStr, Str: strings.Repeat(s, count)}, nil
+}
+
+// repeatArray is an array multiplied by a number. The items are repeated,
+// not copied, so [[0]] * 2 is two references to the same inner array.
+func repeatArray(items []Value, count int) (Value, error) {
+	if count < 0 {
+		return NilValue, errors.New("cannot repeat an array a negative number of times")
+	}
+	n, ok := mulInts(len(items), count)
+	if !ok {
+		return NilValue, errOverflow
+	}
+	result := make([]Value, 0, n)
+	for i := 0; i < count; i++ {
+		result = append(result, items...)
+	}
+	return Value{Tag: ValArray, Array: &result}, nil
+}
+
+// floatOp is the arithmetic operators for when either side is a float
+func floatOp(op TokenTag, a, b float64) Value {
+	var result float64
+	switch op {
 	case Minus:
+		result = a - b
+	case Star:
+		result = a * b
+	case Slash:
+		result = a / b
+	case Percent:
+		result = math.Mod(a, b)
+	}
+	return Value{Tag: ValFloat, Float: result}
+}
+
+func unaryOp(op TokenTag, lhs Value) (Value, error) {
+	switch op {
+	case Minus:
+		if lhs.Tag == ValFloat {
+			return Value{Tag: ValFloat, Float: -lhs.Float}, nil
+		}
 		if lhs.Tag != ValNum {
-			panic(ev.fmtError(expr, "operator only supported for numbers"))
+			return NilValue, errors.New("operator only supported for numbers")
 		}
-		res := 0 - *lhs.Num
-		return Value{Tag: ValNum, Num: &res}
+		res, ok := subInts(0, lhs.Num)
+		if !ok {
+			return NilValue, errOverflow
+		}
+		return Value{Tag: ValNum, Num: res}, nil
 	default:
-		panic(ev.fmtError(expr, "unknown unary operator %s", expr.Op.Tag.String()))
+		return NilValue, fmt.Errorf("unknown unary operator %s", op.String())
 	}
 }
 
@@ -536,9 +1274,18 @@ func (ev *Evaluator) evalAssignment(expr *ExprBinary) Value {
 	switch node := expr.Lhs.(type) {
 
 	case *ExprIdentifier:
-		ident := node.Identifier
 		val := ev.evalExpr(&expr.Rhs)
-		ev.updateEnv(ident, &val)
+		if ev.parallel && (node.local.depth < 0 || ev.localEnv(node.local).owner != ev) {
+			panic(ev.fmtError(node, "pmap: the callback can't assign to %s from outside it, return a value instead", node.Identifier))
+		}
+		if node.local.depth >= 0 {
+			*ev.local(node.local) = val
+			return val
+		}
+		// a copy, taking val's address would move every assignment's value
+		// to the heap
+		global := val
+		ev.updateGlobal(node.Identifier, &global)
 		return val
 
 	case *ExprBinary:
@@ -550,28 +1297,69 @@ func (ev *Evaluator) evalAssignment(expr *ExprBinary) Value {
 		key := ev.evalExpr(&node.Rhs)
 		val := ev.evalExpr(&expr.Rhs)
 
-		ok := lhs.setKey(key, val)
-		if !ok {
-			panic(ev.fmtError(node, "%v is not subscriptable", lhs.Tag))
+		if err := lhs.setKey(key, val); err != nil {
+			panic(ev.fmtError(node, "%s", err))
 		}
 		return val
 	}
 	panic(ev.fmtError(expr, "left hand side of assignment is not assignable"))
 }
 
+// checkScopes makes every statement check that it left the env, frames and
+// argument stack as it found them. The tests turn it on, a statement that
+// doesn't can leave the next section running in a dead scope.
+var checkScopes = false
+
 func (ev *Evaluator) evalStmt(stmt *Stmt) (Value, error) {
+	if checkScopes {
+		return ev.evalStmtChecked(stmt)
+	}
+	return ev.execStmt(stmt)
+}
+
+func (ev *Evaluator) evalStmtChecked(stmt *Stmt) (Value, error) {
+	env, frames, args := ev.env, len(ev.frames), len(ev.argStack)
+	v, err := ev.execStmt(stmt)
+	if ev.env != env || len(ev.frames) != frames || len(ev.argStack) != args {
+		line, _ := ev.lex.GetLineAndCol(*(*stmt).Token())
+		panic(fmt.Sprintf("%T on line %d changed the scope: env %p to %p, %d to %d frames, %d to %d args",
+			*stmt, line, env, ev.env, frames, len(ev.frames), args, len(ev.argStack)))
+	}
+	return v, err
+}
+
+func (ev *Evaluator) execStmt(stmt *Stmt) (Value, error) {
+	if ev.ctx != nil {
+		ev.checkCancelled(*stmt)
+	}
+	if ev.traceOut != nil {
+		ev.traceStmt(*stmt)
+	}
+	if ev.debugger != nil {
+		ev.debugger.stmt(ev, *stmt)
+	}
 	switch node := (*stmt).(type) {
 	case *StmtVar:
-		ident := node.Identifier
 		val := ev.evalExpr(&node.Value)
-		ev.setEnv(ident, &val)
+		if node.slot >= 0 {
+			ev.setLocal(node.slot, val)
+		} else {
+			ev.setGlobal(node.Identifier, &val)
+		}
+		if ev.traceOut != nil {
+			ev.traceResult(node, val)
+		}
 	case *StmtFor:
 		err := ev.forLoop(node)
 		if err != nil {
 			return NilValue, err
 		}
 	case *StmtExpr:
-		return ev.evalExpr(&node.Expr), nil
+		v := ev.evalExpr(&node.Expr)
+		if ev.traceOut != nil {
+			ev.traceResult(node, v)
+		}
+		return v, nil
 	case *StmtIf:
 		val := ev.evalExpr(&node.Condition)
 		if val.isTruthy() {
@@ -589,45 +1377,98 @@ func (ev *Evaluator) evalStmt(stmt *Stmt) (Value, error) {
 		val := ev.evalExpr(&node.Value)
 		return NilValue, returnValue{val}
 	case *StmtContinue:
-		return NilValue, continueError{}
+		return NilValue, continueError{node}
 	case *StmtBreak:
-		return NilValue, breakError{}
+		return NilValue, breakError{node}
 	case *StmtMatch:
-		err := ev.match(node)
+		return ev.match(node)
+	case *StmtBlock:
+		err := ev.evalBlock(node)
 		if err != nil {
 			return NilValue, err
 		}
-	case *StmtBlock:
-		err := ev.evalBlock(node)
+	case *StmtTry:
+		err := ev.try(node)
 		if err != nil {
 			return NilValue, err
 		}
 	default:
-		panic(fmt.Sprintf("unhandled statement type %#v\n", node))
+		panic(ev.fmtError(node, "unhandled statement type %T", node))
 	}
 	return NilValue, nil
 }
 
-func (ev *Evaluator) match(match *StmtMatch) error {
+func (ev *Evaluator) try(node *StmtTry) error {
+	err, caught := ev.tryBlock(node.Body)
+	if caught == nil {
+		return err
+	}
+
+	prevEnv := ev.env
+	ev.pushEnv(node.slots, node.names)
+	defer func() { ev.env = prevEnv }()
+	ev.setLocal(node.identSlot, Value{Tag: ValStr, Str: caught.Msg})
+
+	b := node.CatchBody.(*StmtBlock)
+	for _, stmt := range b.Body {
+		_, err := ev.evalStmt(&stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tryBlock evaluates block, recovering from any runtime error raised inside
+// it. Runtime errors are the user's (error(), a bad subscript, etc.) and are
+// catchable, anything else is an interpreter bug and keeps unwinding. So does
+// a timeout, the program can't catch running out of time.
+func (ev *Evaluator) tryBlock(block Stmt) (err error, caught *Error) {
+	env := ev.env
+	frames := len(ev.frames)
+	args := len(ev.argStack)
+	native := ev.native
+	profile := len(ev.profileStack)
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(Error)
+			if !ok || e.Tag != RuntimeError || (ev.ctx != nil && ev.ctx.Err() != nil) {
+				panic(r)
+			}
+			// the panic may have come from several calls deep, put the scope
+			// back to where it was when the try started
+			ev.env = env
+			ev.frames = ev.frames[:frames]
+			ev.argStack = ev.argStack[:args]
+			ev.native = native
+			ev.profileStack = ev.profileStack[:profile]
+			caught = &e
+		}
+	}()
+	return ev.evalBlock(block), nil
+}
+
+// match evaluates the first case that matches. Its value is the value of the
+// case's body, or nil if no case matched.
+func (ev *Evaluator) match(match *StmtMatch) (Value, error) {
 	candidate := ev.evalExpr(&match.Value)
 
 MatchLoop:
-	for _, c := range match.Cases {
+	for i, c := range match.Cases {
 		switch pattern := c.Cond.(type) {
 		case *ExprArray:
 			if candidate.Tag != ValArray {
 				continue
 			}
 
-			vars := make(map[string]Value)
 			for index, item := range pattern.Items {
 				if index >= len(*candidate.Array) {
 					continue MatchLoop
 				}
 
-				switch itemNode := item.(type) {
+				switch item.(type) {
 				case *ExprIdentifier:
-					vars[itemNode.Identifier] = (*candidate.Array)[index]
+					// bound below, once the whole pattern matches
 				default:
 					itemVal := ev.evalExpr(&item)
 					result, err := (*candidate.Array)[index].Compare(itemVal)
@@ -642,31 +1483,9 @@ MatchLoop:
 			}
 
 			// we found a match
-			ev.pushEnv()
-			defer func() { ev.popEnv() }()
-			for k, v := range vars {
-				ev.env.vars[k] = &v
-			}
-
-			b := c.Body.(*StmtBlock)
-			for _, stmt := range b.Body {
-				_, err := ev.evalStmt(&stmt)
-				if err != nil {
-					return err
-				}
-			}
-			return nil
+			return ev.boundCase(&match.Cases[i], candidate)
 		case *ExprIdentifier:
-			ev.pushEnv()
-			defer func() { ev.popEnv() }()
-			ev.setEnv(pattern.Identifier, &candidate)
-			b := c.Body.(*StmtBlock)
-			for _, stmt := range b.Body {
-				_, err := ev.evalStmt(&stmt)
-				if err != nil {
-					return err
-				}
-			}
+			return ev.boundCase(&match.Cases[i], candidate)
 		default:
 			val := ev.evalExpr(&pattern)
 			if candidate.Tag != val.Tag {
@@ -675,27 +1494,56 @@ MatchLoop:
 
 			eq, err := candidate.Compare(val)
 			if err != nil {
-				panic(ev.fmtError(pattern, err.Error()))
+				panic(ev.fmtError(pattern, "%s", err))
 			}
 
 			if eq {
-				b := c.Body.(*StmtBlock)
-				err := ev.evalBlock(b)
-				if err != nil {
-					return err
-				}
-				return nil
+				return ev.caseBody(c.Body, true)
 			}
 		}
 	}
-	return nil
+	return NilValue, nil
+}
+
+// boundCase evaluates a case whose pattern binds names, in a new env holding
+// them
+func (ev *Evaluator) boundCase(c *MatchCase, candidate Value) (Value, error) {
+	prevEnv := ev.env
+	ev.pushEnv(c.slots, c.names)
+	defer func() { ev.env = prevEnv }()
+	switch pattern := c.Cond.(type) {
+	case *ExprArray:
+		for index, item := range pattern.Items {
+			if ident, ok := item.(*ExprIdentifier); ok {
+				ev.setLocal(ident.local.slot, (*candidate.Array)[index])
+			}
+		}
+	case *ExprIdentifier:
+		ev.setLocal(pattern.local.slot, candidate)
+	}
+	return ev.caseBody(c.Body, false)
+}
+
+// caseBody evaluates the body of a match case. A block needs its own env
+// unless the case already pushed one for its bindings.
+func (ev *Evaluator) caseBody(body Stmt, needsEnv bool) (Value, error) {
+	switch b := body.(type) {
+	case *StmtBlock:
+		if needsEnv {
+			return ev.blockValue(b)
+		}
+		return ev.stmtsValue(b)
+	default:
+		return ev.evalStmt(&body)
+	}
 }
 
 func (ev *Evaluator) forLoop(node *StmtFor) error {
 	if node.Value == nil {
 		// infinite loop
-		ev.pushEnv()
-		defer func() { ev.popEnv() }()
+		prevEnv := ev.env
+		ev.pushEnv(node.slots, node.names)
+		defer func() { ev.env = prevEnv }()
 		for {
 			stop, err := ev.runForLoopBody(node, NilValue, NilValue)
 			if err != nil {
@@ -710,11 +1558,11 @@ func (ev *Evaluator) forLoop(node *StmtFor) error {
 	val := ev.evalExpr(&node.Value)
 	switch val.Tag {
 	case ValArray:
-		ev.pushEnv()
-		defer func() { ev.popEnv() }()
+		prevEnv := ev.env
+		ev.pushEnv(node.slots, node.names)
+		defer func() { ev.env = prevEnv }()
 		for index, item := range *val.Array {
-			i := index
-			stop, err := ev.runForLoopBody(node, item, Value{Tag: ValNum, Num: &i})
+			stop, err := ev.runForLoopBody(node, item, Value{Tag: ValNum, Num: index})
 			if err != nil {
 				return err
 			}
@@ -723,12 +1571,14 @@ func (ev *Evaluator) forLoop(node *StmtFor) error {
 			}
 		}
 	case ValRange:
-		rng := val.Range
-		ev.pushEnv()
-		defer func() { ev.popEnv() }()
+		// a copy, the same range can be looped over again
+		rng := *val.Range
+		prevEnv := ev.env
+		ev.pushEnv(node.slots, node.names)
+		defer func() { ev.env = prevEnv }()
 		for !rng.done() {
 			i := rng.current
-			stop, err := ev.runForLoopBody(node, Value{Tag: ValNum, Num: &i}, Value{Tag: ValNum, Num: &i})
+			stop, err := ev.runForLoopBody(node, Value{Tag: ValNum, Num: i}, Value{Tag: ValNum, Num: i})
 			if err != nil {
 				return err
 			}
@@ -737,13 +1587,63 @@ func (ev *Evaluator) forLoop(node *StmtFor) error {
 			}
 			rng.next()
 		}
+	case ValQueue:
+		prevEnv := ev.env
+		ev.pushEnv(node.slots, node.names)
+		defer func() { ev.env = prevEnv }()
+		for index, item := range val.queue().values() {
+			stop, err := ev.runForLoopBody(node, item, Value{Tag: ValNum, Num: index})
+			if err != nil {
+				return err
+			}
+			if stop {
+				break
+			}
+		}
+	case ValSet:
+		prevEnv := ev.env
+		ev.pushEnv(node.slots, node.names)
+		defer func() { ev.env = prevEnv }()
+		for index, member := range val.setMembers() {
+			stop, err := ev.runForLoopBody(node, member, Value{Tag: ValNum, Num: index})
+			if err != nil {
+				return err
+			}
+			if stop {
+				break
+			}
+		}
+	case ValIter:
+		next := val.iter().start()
+		prevEnv := ev.env
+		ev.pushEnv(node.slots, node.names)
+		defer func() { ev.env = prevEnv }()
+		for index := 0; ; index++ {
+			item, ok := next(ev)
+			if !ok {
+				break
+			}
+			stop, err := ev.runForLoopBody(node, item, Value{Tag: ValNum, Num: index})
+			if err != nil {
+				return err
+			}
+			if stop {
+				break
+			}
+		}
 	case ValMap:
 		mp := val.Map
-		ev.pushEnv()
-		defer func() { ev.popEnv() }()
+		prevEnv := ev.env
+		ev.pushEnv(node.slots, node.names)
+		defer func() { ev.env = prevEnv }()
 		for key, val := range *mp {
-			s := key
-			ev.runForLoopBody(node, Value{Tag: ValStr, Str: &s}, val)
+			stop, err := ev.runForLoopBody(node, key.Value(), val)
+			if err != nil {
+				return err
+			}
+			if stop {
+				break
+			}
 		}
 	default:
 		panic(ev.fmtError(node, "%s is not iterable", val.Tag.String()))
@@ -752,11 +1652,20 @@ func (ev *Evaluator) forLoop(node *StmtFor) error {
 }
 
 func (ev *Evaluator) runForLoopBody(node *StmtFor, val Value, index Value) (bool, error) {
+	if ev.ctx != nil {
+		ev.checkCancelled(node)
+	}
+	if node.captures {
+		// functions made in the body hold on to this iteration's variables,
+		// so each iteration gets its own env rather than reusing the last
+		ev.env = ev.env.parent
+		ev.pushEnv(node.slots, node.names)
+	}
 	if node.Identifier != "" {
-		ev.setEnv(node.Identifier, &val)
+		ev.setLocal(node.identSlot, val)
 	}
 	if node.IndexIdentifier != "" {
-		ev.setEnv(node.IndexIdentifier, &index)
+		ev.setLocal(node.indexSlot, index)
 	}
 
 	b := node.body.(*StmtBlock)
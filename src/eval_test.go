@@ -0,0 +1,1047 @@
+package lang
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+// every statement checks it didn't leak a scope, see checkScopes
+func TestMain(m *testing.M) {
+	checkScopes = true
+	os.Exit(m.Run())
+}
+
+// evalSource parses src and evaluates the named section, turning any
+// language error into a returned error.
+func evalSource(t testing.TB, src string, section string) (v Value, err error) {
+	t.Helper()
+	return evalSourceOn(t, src, section, false)
+}
+
+// evalSourceOn is evalSource, optionally running on the vm
+func evalSourceOn(t testing.TB, src string, section string, vm bool) (v Value, err error) {
+	t.Helper()
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(Error); ok {
+				err = e
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	l := NewLexer(src)
+	p := NewParser(&l)
+	prog, errs := p.ParseErr()
+	if len(errs) > 0 {
+		return NilValue, errs[0]
+	}
+	ev := NewEvaluator(&prog, &l, false)
+	if vm {
+		ev.EnableVM()
+	}
+	return ev.EvalSection(section)
+}
+
+// expectError evaluates the named section on both the tree-walker and the
+// vm and fails unless it raises an Error with the given tag, message and
+// line.
+func expectError(t *testing.T, src string, section string, tag ErrorTag, msg string, line int) {
+	t.Helper()
+	for _, vm := range []bool{false, true} {
+		_, err := evalSourceOn(t, src, section, vm)
+		if err == nil {
+			t.Fatalf("vm: %v: expected %s %q but got no error", vm, tag, msg)
+		}
+		e, ok := err.(Error)
+		if !ok {
+			t.Fatalf("vm: %v: expected a lang.Error but got %#v", vm, err)
+		}
+		if e.Tag != tag || e.Msg != msg || e.Line != line {
+			t.Fatalf("vm: %v: expected %s %q on line %d but got %s %q on line %d", vm, tag, msg, line, e.Tag, e.Msg, e.Line)
+		}
+	}
+}
+
+func TestUncaughtError(t *testing.T) {
+	src := `fn check(n) {
+  if n > 1 {
+    error('invalid state ' + n)
+  }
+}
+part1: {
+  check(1)
+  check(2)
+}`
+	expectError(t, src, "part1", RuntimeError, "invalid state 2", 3)
+}
+
+func TestBreakOutsideLoop(t *testing.T) {
+	src := `fn stop() {
+  break
+}
+part1: {
+  for i in range(0, 3) {
+    stop()
+  }
+}`
+	expectError(t, src, "part1", ParseError, "break outside of loop", 2)
+
+	src = `part1: {
+  if 1 {
+    continue
+  }
+}`
+	expectError(t, src, "part1", ParseError, "continue outside of loop", 3)
+
+	src = `part1: {
+  for {
+    fn inner() {
+      break
+    }
+    break
+  }
+}`
+	expectError(t, src, "part1", ParseError, "break outside of loop", 4)
+}
+
+func TestRedeclaration(t *testing.T) {
+	src := `part1: {
+  var x = 1
+  if x {
+    print(x)
+  }
+  var x = 2
+}`
+	expectError(t, src, "part1", ParseError, "x already declared on line 2", 6)
+
+	src = `fn f(n) {
+  var n = n + 1
+  return n
+}`
+	expectError(t, src, "part1", ParseError, "n already declared on line 1", 2)
+
+	src = `part1: {
+  for x in [1, 2] {
+    var x = 3
+    var x = 4
+  }
+}`
+	expectError(t, src, "part1", ParseError, "x already declared on line 3", 4)
+
+	// an inner block, a loop or a function is a new scope
+	src = `part1: {
+  var x = 1
+  if x {
+    var x = 2
+  }
+  for i in range(0, 2) {
+    var x = i
+  }
+  var f = fn(x) {
+    var i = x
+    return i
+  }
+  return f(x)
+}`
+	for _, vm := range []bool{false, true} {
+		v, err := evalSourceOn(t, src, "part1", vm)
+		if err != nil || v.Repr() != "1" {
+			t.Errorf("vm: %v: expected 1, got %s, %v", vm, v.Repr(), err)
+		}
+	}
+}
+
+// a var can reuse the name of a loop, catch or match binding in the same
+// scope, see TestLintBindingShadowing
+func TestRedeclaringABinding(t *testing.T) {
+	src := `part1: {
+  var total = 0
+  for i in range(0, 3) {
+    var i = i * 10
+    total = total + i
+  }
+  try {
+    error('oops')
+  } catch e {
+    var e = 1
+    total = total + e
+  }
+  return total + match [2] {
+    [n]: {
+      var n = n * 100
+      n
+    }
+  }
+}`
+	for _, vm := range []bool{false, true} {
+		v, err := evalSourceOn(t, src, "part1", vm)
+		if err != nil || v.Repr() != "231" {
+			t.Errorf("vm: %v: expected 231, got %s, %v", vm, v.Repr(), err)
+		}
+	}
+}
+
+func TestJumpOutOfMatchExpr(t *testing.T) {
+	src := `part1: {
+  var x = match 1 {
+    1: {
+      return 2
+    }
+  }
+}`
+	expectError(t, src, "part1", ParseError, "return can't be used inside a match expression", 4)
+
+	src = `part1: {
+  for i in range(0, 3) {
+    var x = match i {
+      1: {
+        break
+      }
+    }
+  }
+}`
+	expectError(t, src, "part1", ParseError, "break can't be used inside a match expression", 5)
+
+	// a loop inside the match is fine
+	src = `part1: {
+  var x = match 1 {
+    1: {
+      for i in range(0, 3) {
+        break
+      }
+      5
+    }
+  }
+  return x
+}`
+	for _, vm := range []bool{false, true} {
+		v, err := evalSourceOn(t, src, "part1", vm)
+		if err != nil {
+			t.Fatalf("vm: %v: %v", vm, err)
+		}
+		if v.Repr() != "5" {
+			t.Errorf("vm: %v: expected 5, got %s", vm, v.Repr())
+		}
+	}
+}
+
+func TestErrorTrace(t *testing.T) {
+	src := `fn inner(n) {
+  return n + [1]
+}
+fn outer(n) {
+  return inner(n + 1)
+}
+fn native(n) {
+  error('nope ' + n)
+}
+part1: {
+  var x = 0
+  x = outer(1)
+}
+part2: {
+  return outer(native(1))
+}`
+	tests := []struct {
+		section string
+		line    int
+		trace   []int
+	}{
+		{"part1", 2, []int{5, 12}},
+		{"part2", 8, []int{15}},
+	}
+	for _, test := range tests {
+		for _, vm := range []bool{false, true} {
+			_, err := evalSourceOn(t, src, test.section, vm)
+			e, ok := err.(Error)
+			if !ok {
+				t.Fatalf("vm: %v: expected a lang.Error but got %#v", vm, err)
+			}
+			if e.Line != test.line || fmt.Sprint(e.Trace) != fmt.Sprint(test.trace) {
+				t.Errorf("vm: %v: %s: expected line %d called from %v but got line %d called from %v", vm, test.section, test.line, test.trace, e.Line, e.Trace)
+			}
+		}
+	}
+}
+
+func TestErrorExcerpt(t *testing.T) {
+	src := `part1: {
+  var x = 1 + 2 / [3]
+}
+part2: {
+  var s = ['é'] - 1
+}`
+	tests := []struct {
+		section string
+		col     int
+		excerpt string
+	}{
+		{"part1", 16, "2 |   var x = 1 + 2 / [3]\n  |                 ^\n"},
+		{"part2", 16, "5 |   var s = ['é'] - 1\n  |                 ^\n"},
+	}
+	for _, test := range tests {
+		for _, vm := range []bool{false, true} {
+			_, err := evalSourceOn(t, src, test.section, vm)
+			e, ok := err.(Error)
+			if !ok {
+				t.Fatalf("vm: %v: expected a lang.Error but got %#v", vm, err)
+			}
+			if e.Col != test.col || e.Excerpt() != test.excerpt {
+				t.Errorf("vm: %v: %s: expected column %d\n%s\nbut got column %d\n%s", vm, test.section, test.col, test.excerpt, e.Col, e.Excerpt())
+			}
+		}
+	}
+}
+
+func TestVMErrorLines(t *testing.T) {
+	src := `fn add(a, b) {
+  return a + b
+}
+part1: {
+  return nope
+}
+part2: {
+  var x = [1]
+  return x + 1
+}
+part3: {
+  for i in 5 {
+  }
+}
+part4: {
+  var n = 1
+  n[0] = 2
+}
+part5: {
+  return add(1)
+}
+part6: {
+  var f = 2
+  f()
+}
+part7: {
+  for i in range(0, 3) {
+    if i == 2 {
+      error('failed at ' + i)
+    }
+  }
+}
+part9: {
+  match 'a' {
+    'b': { return 1 }
+    'a': {
+      return add(1, [])
+    }
+  }
+}`
+	expectError(t, src, "part1", RuntimeError, "unknown variable nope", 5)
+	expectError(t, src, "part2", RuntimeError, "operator only supported for numbers and strings", 9)
+	expectError(t, src, "part3", RuntimeError, "number is not iterable", 12)
+	expectError(t, src, "part4", RuntimeError, "number is not subscriptable", 17)
+	expectError(t, src, "part5", RuntimeError, "arity mismatch: add expects 2 arguments, got 1", 1)
+	expectError(t, src, "part6", RuntimeError, "attempted to call non function", 24)
+	expectError(t, src, "part7", RuntimeError, "failed at 2", 29)
+	expectError(t, src, "part9", RuntimeError, "operator only supported for numbers and strings", 2)
+}
+
+func TestDefaultArgErrors(t *testing.T) {
+	src := `fn add(a, b = 1) {
+  return a + b
+}
+fn bad(a = 1, b) {
+  return a
+}
+part1: {
+  return add()
+}
+part2: {
+  return add(1, 2, 3)
+}`
+	expectError(t, src, "part1", ParseError, "b needs a default, it comes after an argument with one", 4)
+
+	src = `fn add(a, b = 1) {
+  return a + b
+}
+fn broken(a, b = a + []) {
+  return b
+}
+part1: {
+  return add()
+}
+part2: {
+  return add(1, 2, 3)
+}
+part3: {
+  return broken(1)
+}`
+	expectError(t, src, "part1", RuntimeError, "arity mismatch: add expects 1 to 2 arguments, got 0", 1)
+	expectError(t, src, "part2", RuntimeError, "arity mismatch: add expects 1 to 2 arguments, got 3", 1)
+	expectError(t, src, "part3", RuntimeError, "operator only supported for numbers and strings", 4)
+}
+
+func TestRunSectionErrors(t *testing.T) {
+	src := `part1: {
+  return run_section('day1')
+}
+part2: {
+  return run_section('part2')
+}
+part3: {
+  var a = 1
+  return a + [1]
+}
+part4: {
+  return run_section('part3')
+}
+part5: {
+  var tries = 0
+  for i in range(0, 3) {
+    try {
+      run_section('part2')
+    } catch e {
+      tries = tries + 1
+    }
+  }
+  return tries
+}`
+	expectError(t, src, "part1", RuntimeError, "run_section: couldn't find section day1, the sections are part1, part2, part3, part4, part5", 2)
+	expectError(t, src, "part2", RuntimeError, "run_section: sections nested more than 64 deep running part2", 5)
+	expectError(t, src, "part4", RuntimeError, "operator only supported for numbers and strings", 9)
+
+	// a caught error doesn't leave its sections counted against the depth
+	for _, vm := range []bool{false, true} {
+		v, err := evalSourceOn(t, src, "part5", vm)
+		if err != nil || v.Repr() != "3" {
+			t.Errorf("vm: %v: expected 3, got %s, %v", vm, v.Repr(), err)
+		}
+	}
+}
+
+func TestVariadicErrors(t *testing.T) {
+	src := `fn f(rest.., last) {
+  return last
+}`
+	expectError(t, src, "part1", ParseError, "only the last argument can collect the rest", 1)
+
+	src = `part1: {
+  print([1]..,  2)
+}`
+	expectError(t, src, "part1", ParseError, "only the last argument can be spread", 2)
+
+	src = `fn atLeastTwo(a, b, rest..) {
+  return a + b
+}
+part1: {
+  return atLeastTwo([1]..)
+}
+part2: {
+  return atLeastTwo(1, 2..)
+}
+part3: {
+  return len('ab'..)
+}`
+	expectError(t, src, "part1", RuntimeError, "arity mismatch: atLeastTwo expects at least 2 arguments, got 1", 1)
+	expectError(t, src, "part2", RuntimeError, "only an array can be spread, got a number", 8)
+	expectError(t, src, "part3", RuntimeError, "only an array can be spread, got a string", 11)
+}
+
+func TestVMMatchesEvaluator(t *testing.T) {
+	src := `fn fib(n) {
+  if n < 2 {
+    return n
+  }
+  return fib(n - 1) + fib(n - 2)
+}
+fn classify(v) {
+  match v {
+    [1, b]: { return 'one then ' + b }
+    [a, b]: { return a + b }
+    'x': { return 'ex' }
+    other: { return other }
+  }
+}
+part1: {
+  var out = []
+  for i, j in range(0, 10) {
+    if i % 2 == 0 {
+      continue
+    }
+    if i > 7 {
+      break
+    }
+    out = push(out, fib(i) * j)
+  }
+  var m = {a: 1, b: 2}
+  m['c'] = 3
+  var total = 0
+  for k, v in m {
+    total = total + v
+  }
+  out = push(out, total)
+  out = push(out, classify([1, 2]))
+  out = push(out, classify([3, 4]))
+  out = push(out, classify('x'))
+  out = push(out, classify(7))
+  out = push(out, -total)
+  return out
+}`
+	want, err := evalSourceOn(t, src, "part1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := evalSourceOn(t, src, "part1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.Repr() != got.Repr() {
+		t.Fatalf("expected %s but got %s", want.Repr(), got.Repr())
+	}
+}
+
+func TestEnableVMReportsFallbacks(t *testing.T) {
+	src := `fn outer() {
+  fn inner() {
+    return 1
+  }
+  return inner()
+}
+part1: {
+  try {
+    error('oh no')
+  } catch e {
+    return e
+  }
+}`
+	l := NewLexer(src)
+	p := NewParser(&l)
+	prog, errs := p.ParseErr()
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	ev := NewEvaluator(&prog, &l, false)
+	notes := ev.EnableVM()
+	expected := []string{
+		"fn outer runs on the tree-walker: nested functions aren't supported (line 2)",
+		"section part1 runs on the tree-walker: try/catch isn't supported (line 8)",
+	}
+	if strings.Join(notes, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected %q but got %q", expected, notes)
+	}
+
+	v, err := ev.EvalSection("part1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Str != "oh no" {
+		t.Fatalf("expected 'oh no' but got %s", v.Repr())
+	}
+}
+
+// benchSource evaluates part1 of src on both the tree-walker and the vm
+func benchSource(b *testing.B, src string) {
+	for _, vm := range []bool{false, true} {
+		name := "tree"
+		if vm {
+			name = "vm"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := evalSourceOn(b, src, "part1", vm); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSumLoop(b *testing.B) {
+	src := `part1: {
+  var sum = 0
+  for i in range(0, 10000000) {
+    sum = sum + i
+  }
+  return sum
+}`
+	benchSource(b, src)
+}
+
+func BenchmarkCall(b *testing.B) {
+	src := `fn fib(n) {
+  if n < 2 {
+    return n
+  }
+  return fib(n - 1) + fib(n - 2)
+}
+part1: {
+  return fib(25)
+}`
+	benchSource(b, src)
+}
+
+func BenchmarkNestedLoop(b *testing.B) {
+	src := `part1: {
+  var total = 0
+  for x in range(0, 1000) {
+    for y in range(0, 1000) {
+      total = total + x * y
+    }
+  }
+  return total
+}`
+	benchSource(b, src)
+}
+
+// a loop whose body and if block declare nothing
+func BenchmarkLoopBody(b *testing.B) {
+	src := `part1: {
+  var n = 0
+  for i in range(0, 10000000) {
+    if i % 2 == 0 {
+      n = n + 1
+    }
+  }
+  return n
+}`
+	benchSource(b, src)
+}
+
+func TestNativeErrorLine(t *testing.T) {
+	src := `part1: {
+  var g = memo(fn(n) {
+    return n + 1
+  })
+  try {
+    error('caught')
+  } catch e {
+  }
+  g(1)
+  error('uncaught')
+}
+part2: {
+  var h = memo(fn(n) {
+    error('inner ' + n)
+  })
+  h(3)
+}`
+	expectError(t, src, "part1", RuntimeError, "uncaught", 10)
+	expectError(t, src, "part2", RuntimeError, "inner 3", 14)
+}
+
+func BenchmarkNativeCall(b *testing.B) {
+	src := `part1: {
+  var total = 0
+  var xs = [1, 2, 3]
+  for i in range(0, 1000000) {
+    total = total + len(xs)
+  }
+  return total
+}`
+	benchSource(b, src)
+}
+
+func TestUnknownVariableSuggestions(t *testing.T) {
+	src := `part1: {
+  return lenn
+}
+part2: {
+  var total = 1
+  return totl
+}
+part3: {
+  return q_pus
+}`
+	expectError(t, src, "part1", RuntimeError, "unknown variable lenn, did you mean len?", 2)
+	expectError(t, src, "part2", RuntimeError, "unknown variable totl, did you mean total?", 6)
+	expectError(t, src, "part3", RuntimeError, "unknown variable q_pus, did you mean q_push?", 9)
+}
+
+func TestUnknownSectionSuggestions(t *testing.T) {
+	src := "test: ''\ntest_part1: 1\npart1: {\n  return 1\n}"
+	tests := []struct {
+		section string
+		msg     string
+	}{
+		{"part2", "couldn't find section part2, did you mean part1?"},
+		{"test_prat1", "couldn't find section test_prat1, did you mean test_part1?"},
+		{"day4", "couldn't find section day4, the sections are test, test_part1, part1"},
+	}
+	for _, test := range tests {
+		_, err := evalSource(t, src, test.section)
+		if e, ok := err.(Error); !ok || e.Tag != RuntimeError || e.Msg != test.msg {
+			t.Errorf("expected %q, got %v", test.msg, err)
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	got := suggest("a", []string{"ab", "abc", "abcd", "abcde", "b"})
+	if strings.Join(got, ",") != "ab,abc,abcd" {
+		t.Errorf("expected the 3 closest names, got %v", got)
+	}
+	if got := suggest("x", []string{"y"}); len(got) != 0 {
+		t.Errorf("expected no suggestions, got %v", got)
+	}
+}
+
+func TestIntegerOverflow(t *testing.T) {
+	src := `part1: {
+  return 4611686018427387903 * 2 + 1
+}
+part2: {
+  return 4611686018427387904 * 2
+}
+part3: {
+  return 9223372036854775807 + 1
+}
+part4: {
+  var n = 0 - 9223372036854775807
+  return n - 2
+}
+part5: {
+  var total = 1
+  for i in range(0, 100) {
+    total = total + total
+  }
+  return total
+}
+part6: {
+  var n = 0 - 9223372036854775807
+  n = n - 1
+  return -n
+}
+part7: {
+  var n = 0 - 9223372036854775807
+  n = n - 1
+  return n / -1
+}
+part8: {
+  var n = 0 - 9223372036854775807
+  n = n - 1
+  return n % -1
+}
+part9: {
+  return 1 << 63
+}
+part10: {
+  return 3 << 62
+}
+part11: {
+  return 1 << -1
+}`
+	for _, vm := range []bool{false, true} {
+		v, err := evalSourceOn(t, src, "part1", vm)
+		if err != nil || v.Num != math.MaxInt64 {
+			t.Errorf("vm: %v: expected the largest integer, got %s %v", vm, v.Repr(), err)
+		}
+	}
+	expectError(t, src, "part2", RuntimeError, "integer overflow", 5)
+	expectError(t, src, "part3", RuntimeError, "integer overflow", 8)
+	expectError(t, src, "part4", RuntimeError, "integer overflow", 12)
+	expectError(t, src, "part5", RuntimeError, "integer overflow", 17)
+	expectError(t, src, "part6", RuntimeError, "integer overflow", 24)
+	expectError(t, src, "part7", RuntimeError, "integer overflow", 29)
+	expectError(t, src, "part8", RuntimeError, "integer overflow", 34)
+	expectError(t, src, "part9", RuntimeError, "integer overflow", 37)
+	expectError(t, src, "part10", RuntimeError, "integer overflow", 40)
+	expectError(t, src, "part11", RuntimeError, "cannot shift by a negative amount", 43)
+}
+
+func TestStringOperatorErrors(t *testing.T) {
+	src := `part1: {
+  return 'ab' * -1
+}
+part2: {
+  return 'a' < 1
+}
+part3: {
+  return 'a' * 'b'
+}`
+	expectError(t, src, "part1", RuntimeError, "cannot repeat a string a negative number of times", 2)
+	expectError(t, src, "part2", RuntimeError, "cannot compare string and number", 5)
+	expectError(t, src, "part3", RuntimeError, "operator only supported for numbers", 8)
+}
+
+func TestArrayOperatorErrors(t *testing.T) {
+	src := `part1: {
+  return [1] * -1
+}
+part2: {
+  return [1] - [1]
+}`
+	expectError(t, src, "part1", RuntimeError, "cannot repeat an array a negative number of times", 2)
+	expectError(t, src, "part2", RuntimeError, "operator only supported for numbers", 5)
+}
+
+func TestInputSectionErrorLines(t *testing.T) {
+	src := `test: {
+  var xs = 1
+  push(xs, 2)
+}
+file: {
+  read('does-not-exist.txt')
+}
+part1: {
+  var xs = [1, 2]
+  xs[5] = 3
+}
+part2: {
+  return 1 / 0
+}
+part3: {
+  return delete([1], 3)
+}`
+	expectError(t, src, "test", RuntimeError, "push: argument 1 must be an array, got number", 3)
+	expectError(t, src, "file", RuntimeError, "read: open does-not-exist.txt: no such file or directory", 6)
+	expectError(t, src, "part1", RuntimeError, "index 5 out of range", 10)
+	expectError(t, src, "part2", RuntimeError, "division by zero", 13)
+	expectError(t, src, "part3", RuntimeError, "delete: index 3 out of range", 16)
+}
+
+func TestSectionValues(t *testing.T) {
+	src := `part1: {
+  var total = 0
+  for i in range(0, 4) {
+    total = total + i
+  }
+  total
+}
+part2: {
+  for i in range(0, 10) {
+    if i * i > 20 {
+      return i
+    }
+  }
+  error('unreachable')
+}
+part3: {
+  var total = 5
+  if total > 1 {
+    total
+  }
+}
+part4: {
+  var total = 5
+}
+part5: {
+  for i in range(0, 3) {
+    i
+  }
+}
+part6: {}
+part7: 7`
+	tests := []struct {
+		section  string
+		expected string
+	}{
+		{"part1", "6"},
+		{"part2", "5"},
+		// only a trailing expression is the section's value, not the last
+		// value an if or a for produced
+		{"part3", "nil"},
+		{"part4", "nil"},
+		{"part5", "nil"},
+		{"part6", "nil"},
+		{"part7", "7"},
+	}
+	for _, vm := range []bool{false, true} {
+		for _, test := range tests {
+			v, err := evalSourceOn(t, src, test.section, vm)
+			if err != nil {
+				t.Fatalf("vm: %v: %s: %v", vm, test.section, err)
+			}
+			if v.Repr() != test.expected {
+				t.Errorf("vm: %v: %s: expected %s, got %s", vm, test.section, test.expected, v.Repr())
+			}
+		}
+	}
+}
+
+func TestScopeRestoredBetweenSections(t *testing.T) {
+	src := `fn fail(n) {
+  match [n] {
+    [x]: {
+      for i in range(0, 3) {
+        error('failed on ' + x)
+      }
+    }
+  }
+}
+fn double(n) {
+  return n * 2
+}
+part1: {
+  var caught = 0
+  for i in range(0, 5) {
+    var local = i
+    try {
+      fail(i)
+    } catch e {
+      caught = caught + 1
+    }
+  }
+  return caught
+}
+part2: {
+  for i in range(0, 5) {
+    var local = i
+    fail(i)
+  }
+}
+part3: {
+  var total = 0
+  for n in [1, 2, 3] {
+    total = total + double(n)
+  }
+  return total
+}`
+	for _, vm := range []bool{false, true} {
+		l := NewLexer(src)
+		p := NewParser(&l)
+		prog, errs := p.ParseErr()
+		if len(errs) > 0 {
+			t.Fatal(errs[0])
+		}
+		ev := NewEvaluator(&prog, &l, false)
+		if vm {
+			ev.EnableVM()
+		}
+
+		want := []struct {
+			section, value, err string
+		}{
+			{"part1", "5", ""},
+			{"part2", "", "failed on 0"},
+			{"part3", "12", ""},
+		}
+		for _, w := range want {
+			v, err := ev.EvalSection(w.section)
+			switch {
+			case w.err != "" && (err == nil || err.(Error).Msg != w.err):
+				t.Errorf("vm: %v: %s: expected error %q, got %v", vm, w.section, w.err, err)
+			case w.err == "" && err != nil:
+				t.Errorf("vm: %v: %s: %v", vm, w.section, err)
+			case w.err == "" && v.Repr() != w.value:
+				t.Errorf("vm: %v: %s: expected %s, got %s", vm, w.section, w.value, v.Repr())
+			}
+			if ev.env != ev.globals || len(ev.frames) != 1 || len(ev.argStack) != 0 {
+				t.Errorf("vm: %v: %s left a scope behind, %d frames and %d args", vm, w.section, len(ev.frames), len(ev.argStack))
+			}
+		}
+	}
+}
+
+func TestNumsLinesIsLazy(t *testing.T) {
+	src := `part1: {
+  return len(lines)
+}
+part2: {
+  nums_lines = 5
+  return nums_lines
+}
+part3: {
+  return nums_lines[1][0]
+}`
+	for _, vm := range []bool{false, true} {
+		l := NewLexer(src)
+		p := NewParser(&l)
+		prog, errs := p.ParseErr()
+		if len(errs) > 0 {
+			t.Fatal(errs[0])
+		}
+		ev := NewEvaluator(&prog, &l, false)
+		if vm {
+			ev.EnableVM()
+		}
+		ev.ReadInput("1 2\n3 4")
+
+		if v, err := ev.EvalSection("part1"); err != nil || v.Repr() != "2" {
+			t.Fatalf("vm: %v: expected 2, got %s, %v", vm, v.Repr(), err)
+		}
+		if _, lazy := ev.globals.lazy["nums_lines"]; !lazy {
+			t.Errorf("vm: %v: nums_lines was worked out by a section that only uses lines", vm)
+		}
+		if v, err := ev.EvalSection("part3"); err != nil || v.Repr() != "3" {
+			t.Errorf("vm: %v: expected 3, got %s, %v", vm, v.Repr(), err)
+		}
+		if _, lazy := ev.globals.lazy["nums_lines"]; lazy {
+			t.Errorf("vm: %v: nums_lines is still lazy after being used", vm)
+		}
+
+		// assigning before it's used replaces it
+		ev.ReadInput("1 2\n3 4")
+		if v, err := ev.EvalSection("part2"); err != nil || v.Repr() != "5" {
+			t.Errorf("vm: %v: expected 5, got %s, %v", vm, v.Repr(), err)
+		}
+	}
+}
+
+func TestBlocksReadsCRLF(t *testing.T) {
+	src := `part1: {
+  return blocks
+}`
+	l := NewLexer(src)
+	p := NewParser(&l)
+	prog, errs := p.ParseErr()
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	ev := NewEvaluator(&prog, &l, false)
+	ev.ReadInput("\r\na\r\nb\r\n\r\n \r\n\r\nc\r\n\r\n")
+	v, err := ev.EvalSection("part1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "[['a', 'b'], ['c']]"; v.Repr() != expected {
+		t.Errorf("expected %s, got %s", expected, v.Repr())
+	}
+}
+
+// gridSource makes a program that walks a 100x100 grid of # and . twice,
+// once indexing the lines and once splitting them into characters
+func gridSource(cell string) string {
+	var grid strings.Builder
+	for y := 0; y < 100; y++ {
+		if y > 0 {
+			grid.WriteString("\n")
+		}
+		for x := 0; x < 100; x++ {
+			if (x*7+y*13)%5 == 0 {
+				grid.WriteString(cell)
+			} else {
+				grid.WriteString(".")
+			}
+		}
+	}
+	return `part1: {
+  var lines = split('` + grid.String() + `', '
+')
+  var count = 0
+  for line in lines {
+    for x in range(0, len(line)) {
+      if line[x] == '` + cell + `' {
+        count = count + 1
+      }
+    }
+    for c in split(line, '') {
+      if c == '` + cell + `' {
+        count = count + 1
+      }
+    }
+  }
+  return count
+}`
+}
+
+func BenchmarkGrid(b *testing.B) {
+	b.Run("ascii", func(b *testing.B) {
+		benchSource(b, gridSource("#"))
+	})
+	b.Run("unicode", func(b *testing.B) {
+		benchSource(b, gridSource("█"))
+	})
+}
@@ -0,0 +1,143 @@
+package lang
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// nativeFormat builds a string printf style. The verbs are %s for a value as
+// print shows it, %v for its repr, %d for integers and %f for numbers. A verb
+// can have a - to left-align, a 0 to zero-pad numbers, a width, and for %f a
+// precision: %-8s, %04d, %6.2f. %% is a literal %.
+func nativeFormat(ev *Evaluator, args []Value) Value {
+	if len(args) == 0 {
+		panic(E(RuntimeError, "format: expected at least 1 argument, got 0", 0))
+	}
+	checkArg("format", args, 0, ValStr)
+	s, err := format(args[0].Str, args[1:])
+	if err != nil {
+		panic(E(RuntimeError, "format: "+err.Error(), 0))
+	}
+	return Value{Tag: ValStr, Str: s}
+}
+
+// verb is one %... in a format string
+type verb struct {
+	spec      string // the whole verb, for errors
+	pos       int    // where it starts in the format string, from 1
+	char      byte
+	left      bool
+	zero      bool
+	width     int
+	precision int // -1 if there isn't one
+}
+
+func format(layout string, args []Value) (string, error) {
+	var b strings.Builder
+	next := 0
+	for i := 0; i < len(layout); i++ {
+		if layout[i] != '%' {
+			b.WriteByte(layout[i])
+			continue
+		}
+		if i+1 < len(layout) && layout[i+1] == '%' {
+			b.WriteByte('%')
+			i++
+			continue
+		}
+
+		v, end, err := parseVerb(layout, i)
+		if err != nil {
+			return "", err
+		}
+		i = end
+		if next >= len(args) {
+			return "", fmt.Errorf("%s at position %d has no argument", v.spec, v.pos)
+		}
+		s, err := v.format(args[next])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(s)
+		next++
+	}
+	if next < len(args) {
+		return "", fmt.Errorf("too many arguments, the verbs use %d but got %d", next, len(args))
+	}
+	return b.String(), nil
+}
+
+// parseVerb reads the verb starting at the % at start, returning it and the
+// index of its last byte
+func parseVerb(layout string, start int) (verb, int, error) {
+	v := verb{pos: start + 1, precision: -1}
+	i := start + 1
+	for ; i < len(layout) && (layout[i] == '-' || layout[i] == '0'); i++ {
+		if layout[i] == '-' {
+			v.left = true
+		} else {
+			v.zero = true
+		}
+	}
+	v.width, i = readDigits(layout, i)
+	if i < len(layout) && layout[i] == '.' {
+		v.precision, i = readDigits(layout, i+1)
+	}
+	if i >= len(layout) {
+		return v, i, fmt.Errorf("incomplete verb %s at position %d", layout[start:], v.pos)
+	}
+	v.char = layout[i]
+	v.spec = layout[start : i+1]
+	if !strings.ContainsRune("svdf", rune(v.char)) {
+		return v, i, fmt.Errorf("unknown verb %s at position %d", v.spec, v.pos)
+	}
+	if v.precision >= 0 && v.char != 'f' {
+		return v, i, fmt.Errorf("%s at position %d can't have a precision, only %%f can", v.spec, v.pos)
+	}
+	return v, i, nil
+}
+
+func readDigits(s string, i int) (int, int) {
+	n := 0
+	for ; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+		n = n*10 + int(s[i]-'0')
+	}
+	return n, i
+}
+
+func (v verb) format(arg Value) (string, error) {
+	var s string
+	switch v.char {
+	case 's':
+		s = arg.String()
+	case 'v':
+		s = arg.Repr()
+	case 'd':
+		if arg.Tag != ValNum {
+			return "", fmt.Errorf("%s at position %d needs an integer, got %s", v.spec, v.pos, arg.Tag.String())
+		}
+		s = strconv.Itoa(arg.Num)
+	case 'f':
+		if !arg.isNumber() {
+			return "", fmt.Errorf("%s at position %d needs a number, got %s", v.spec, v.pos, arg.Tag.String())
+		}
+		s = strconv.FormatFloat(arg.asFloat(), 'f', v.precision, 64)
+	}
+
+	pad := v.width - utf8.RuneCountInString(s)
+	switch {
+	case pad <= 0:
+		return s, nil
+	case v.left:
+		return s + strings.Repeat(" ", pad), nil
+	case v.zero && (v.char == 'd' || v.char == 'f'):
+		// the sign goes before the zeros
+		if strings.HasPrefix(s, "-") {
+			return "-" + strings.Repeat("0", pad) + s[1:], nil
+		}
+		return strings.Repeat("0", pad) + s, nil
+	}
+	return strings.Repeat(" ", pad) + s, nil
+}
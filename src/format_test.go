@@ -0,0 +1,69 @@
+package lang
+
+import "testing"
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		call     string
+		expected string
+	}{
+		{`format('plain')`, "plain"},
+		{`format('%s: %d', 'count', 4)`, "count: 4"},
+		{`format('%s', 2.5)`, "2.5"},
+		{`format('%s %s', nil, [1, 'a'])`, "nil [1, 'a']"},
+		{`format('%v', 'a')`, "'a'"},
+		{`format('[%5s]', 'ab')`, "[   ab]"},
+		{`format('[%-5s]', 'ab')`, "[ab   ]"},
+		{`format('[%4d]', 42)`, "[  42]"},
+		{`format('[%-4d]', 42)`, "[42  ]"},
+		{`format('[%04d]', 42)`, "[0042]"},
+		{`format('[%04d]', -42)`, "[-042]"},
+		{`format('[%2d]', 1234)`, "[1234]"},
+		{`format('%f', 1.5)`, "1.5"},
+		{`format('%.2f', 2)`, "2.00"},
+		{`format('[%07.3f]', -1.5)`, "[-01.500]"},
+		{`format('100%%')`, "100%"},
+		{`format('%s%%', 50)`, "50%"},
+	}
+	for _, test := range tests {
+		v, err := evalSource(t, "part1: "+test.call, "part1")
+		if err != nil {
+			t.Errorf("%s: %v", test.call, err)
+			continue
+		}
+		if v.Tag != ValStr || v.Str != test.expected {
+			t.Errorf("%s: expected %q, got %s", test.call, test.expected, v.Repr())
+		}
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	src := `part1: {
+  return format('%s and %4d', 'a')
+}
+part2: {
+  return format('%s', 1, 2)
+}
+part3: {
+  return format('x %d', 'a')
+}
+part4: {
+  return format('%q', 1)
+}
+part5: {
+  return format('50%')
+}
+part6: {
+  return format(1)
+}
+part7: {
+  return format('%.2d', 1)
+}`
+	expectError(t, src, "part1", RuntimeError, "format: %4d at position 8 has no argument", 2)
+	expectError(t, src, "part2", RuntimeError, "format: too many arguments, the verbs use 1 but got 2", 5)
+	expectError(t, src, "part3", RuntimeError, "format: %d at position 3 needs an integer, got string", 8)
+	expectError(t, src, "part4", RuntimeError, "format: unknown verb %q at position 1", 11)
+	expectError(t, src, "part5", RuntimeError, "format: incomplete verb % at position 3", 14)
+	expectError(t, src, "part6", RuntimeError, "format: argument 1 must be a string, got number", 17)
+	expectError(t, src, "part7", RuntimeError, "format: %.2d at position 1 can't have a precision, only %f can", 20)
+}
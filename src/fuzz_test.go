@@ -0,0 +1,482 @@
+package lang
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// addSeeds seeds a fuzz target's corpus with the programs in tests/
+func addSeeds(f *testing.F) {
+	paths, err := filepath.Glob("../tests/*.aoc")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range paths {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(src))
+	}
+}
+
+// FuzzCompile checks that any source either compiles or gives parse errors,
+// without panicking
+func FuzzCompile(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, src string) {
+		c, errs := Compile(src)
+		if c == nil && len(errs) == 0 {
+			t.Fatal("expected a program or errors, got neither")
+		}
+		for _, e := range errs {
+			if e.Tag != ParseError {
+				t.Errorf("expected a parse error, got %s: %s", e.Tag, e.Msg)
+			}
+		}
+	})
+}
+
+// FuzzEval runs small programs made from the fuzz data on both engines,
+// checking each finishes, raises a runtime error or runs out of steps, and
+// that the engines agree when both finish
+func FuzzEval(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(checkEval)
+}
+
+func checkEval(t *testing.T, data string) {
+	src := genProgram(data)
+	c, errs := Compile(src)
+	if len(errs) > 0 {
+		t.Fatalf("the generated program doesn't compile: %s\n%s", errs[0].Msg, src)
+	}
+
+	var results [2]string
+	for i, vm := range []bool{false, true} {
+		ev := c.NewEvaluator(WithOutput(io.Discard))
+		if vm {
+			ev.EnableVM()
+		}
+		v, err := ev.EvalSectionContext(&stepBudget{context.Background(), 8}, "part1")
+		if err == nil {
+			results[i] = v.Repr()
+			continue
+		}
+		e, ok := err.(Error)
+		if !ok || e.Tag != RuntimeError || strings.HasPrefix(e.Msg, "internal error") {
+			t.Fatalf("vm: %v: expected a runtime error, got %#v\n%s", vm, err, src)
+		}
+	}
+	if results[0] != "" && results[1] != "" && results[0] != results[1] {
+		t.Fatalf("the tree-walker returned %s but the vm returned %s\n%s", results[0], results[1], src)
+	}
+}
+
+// stepBudget is a context that's done once the evaluator has checked it n
+// times, which it does every cancelCheckInterval steps. Unlike a timeout a
+// program that never finishes stops at the same point every run.
+type stepBudget struct {
+	context.Context
+	n int
+}
+
+func (b *stepBudget) Err() error {
+	if b.n--; b.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+type genType int
+
+const (
+	genNum genType = iota
+	genStr
+	genArr
+	genMap
+	genFn
+)
+
+type genVar struct {
+	name string
+	typ  genType
+}
+
+// progGen writes a program from fuzz data, each byte picking what comes
+// next. Every program it writes compiles, and none can take long per step:
+// strings and arrays only grow a little at a time, and functions can't
+// recurse since they're kept in vars that are never assigned to and can
+// only call the functions declared before them.
+type progGen struct {
+	data  string
+	b     strings.Builder
+	vars  []genVar // the vars in scope, innermost last
+	names int
+	loops int // loops around what's being written, in the same function
+	depth int
+}
+
+func genProgram(data string) string {
+	g := &progGen{data: data}
+	g.b.WriteString("part1: ")
+	g.block("", "return "+g.num()+"\n")
+	g.b.WriteString("\n")
+	return g.b.String()
+}
+
+// choose picks a number below n, 0 once the data runs out
+func (g *progGen) choose(n int) int {
+	if len(g.data) == 0 {
+		return 0
+	}
+	c := int(g.data[0]) % n
+	g.data = g.data[1:]
+	return c
+}
+
+// declare makes a new var, it's in scope until the block it's in ends
+func (g *progGen) declare(typ genType) string {
+	name := g.newName()
+	g.vars = append(g.vars, genVar{name, typ})
+	return name
+}
+
+// newName is a name no other var has, so nothing is ever shadowed
+func (g *progGen) newName() string {
+	g.names++
+	return fmt.Sprintf("v%d", g.names-1)
+}
+
+// pick returns a var in scope of one of the types, or "" if there isn't one
+func (g *progGen) pick(types ...genType) string {
+	var names []string
+	for _, v := range g.vars {
+		for _, typ := range types {
+			if v.typ == typ {
+				names = append(names, v.name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return names[g.choose(len(names))]
+}
+
+func (g *progGen) write(parts ...string) {
+	for _, part := range parts {
+		g.b.WriteString(part)
+	}
+}
+
+// block writes a block of statements between first and last. Vars declared
+// in it, and any declared just before it by the caller for it, go out of
+// scope at its end.
+func (g *progGen) block(first string, last string) {
+	g.depth++
+	g.write("{\n", first)
+	n := g.choose(5)
+	if g.depth > 3 {
+		n = 0
+	}
+	for i := 0; i < n; i++ {
+		g.stmt()
+		g.write("\n")
+	}
+	g.write(last, "}")
+	g.depth--
+}
+
+// scoped runs f and then forgets the vars it declared
+func (g *progGen) scoped(f func()) {
+	vars := len(g.vars)
+	f()
+	g.vars = g.vars[:vars]
+}
+
+// loop writes a loop's body, where break and continue can be used
+func (g *progGen) loop(first string) {
+	g.loops++
+	g.block(first, "")
+	g.loops--
+}
+
+func (g *progGen) stmt() {
+	switch g.choose(11) {
+	case 0:
+		g.varStmt()
+	case 1:
+		g.assign()
+	case 2:
+		g.write("if ", g.num(), " ")
+		g.scoped(func() { g.block("", "") })
+		if g.choose(2) == 0 {
+			g.write(" else ")
+			g.scoped(func() { g.block("", "") })
+		}
+	case 3:
+		limit := strconv.Itoa(g.choose(10))
+		g.scoped(func() {
+			g.write("for ", g.declare(genNum), " in range(0, ", limit, ") ")
+			g.loop("")
+		})
+	case 4:
+		items := g.arr()
+		g.scoped(func() {
+			g.write("for ", g.declare(genNum), ", ", g.declare(genNum), " in ", items, " ")
+			g.loop("")
+		})
+	case 5:
+		// a loop that only ends if the break is reached
+		cond := g.num()
+		g.scoped(func() {
+			g.write("for ")
+			g.loop("if " + cond + " { break }\n")
+		})
+	case 6:
+		switch {
+		case g.loops > 0 && g.choose(2) == 0:
+			g.write("break")
+		case g.loops > 0:
+			g.write("continue")
+		default:
+			g.write("println(", g.str(), ")")
+		}
+	case 7:
+		g.write("try ")
+		g.scoped(func() { g.block("", "") })
+		g.scoped(func() {
+			g.write(" catch ", g.declare(genStr), " ")
+			g.block("", "")
+		})
+	case 8:
+		g.write("assert(", g.num(), ")")
+	case 9:
+		g.write("error(", g.str(), ")")
+	case 10:
+		if m := g.pick(genMap); m != "" {
+			g.write("map_incr(", m, ", ", g.str(), ")")
+		} else {
+			g.write("println(", g.num(), ")")
+		}
+	}
+}
+
+// varStmt declares a var of any type, the name isn't in scope in its value
+func (g *progGen) varStmt() {
+	typ := genType(g.choose(5))
+	if typ == genFn {
+		g.fnStmt()
+		return
+	}
+	value := g.value(typ)
+	g.write("var ", g.declare(typ), " = ", value)
+}
+
+// fnStmt declares a function taking two numbers and returning one. Its
+// name isn't in scope in its body, so it can't call itself.
+func (g *progGen) fnStmt() {
+	name := g.newName()
+	loops := g.loops
+	g.loops = 0
+	g.scoped(func() {
+		g.write("var ", name, " = fn(", g.declare(genNum), ", ", g.declare(genNum), ") ")
+		g.block("", "return "+g.num()+"\n")
+	})
+	g.loops = loops
+	g.vars = append(g.vars, genVar{name, genFn})
+}
+
+// assign assigns to a var, only ever by a little more than it had before
+// for strings and arrays
+func (g *progGen) assign() {
+	name := g.pick(genNum, genStr, genArr, genMap)
+	if name == "" {
+		g.varStmt()
+		return
+	}
+	var typ genType
+	for _, v := range g.vars {
+		if v.name == name {
+			typ = v.typ
+		}
+	}
+	switch typ {
+	case genNum:
+		g.write(name, " = ", g.num())
+	case genStr:
+		g.write(name, " = ", name, " + ", g.strAtom())
+	case genArr:
+		if g.choose(2) == 0 {
+			g.write(name, " = push(", name, ", ", g.num(), ")")
+		} else {
+			g.write(name, "[", g.num(), "] = ", g.num())
+		}
+	case genMap:
+		g.write(name, "[", g.str(), "] = ", g.num())
+	}
+}
+
+func (g *progGen) value(typ genType) string {
+	switch typ {
+	case genStr:
+		return g.str()
+	case genArr:
+		return g.arr()
+	case genMap:
+		return g.mapExpr()
+	}
+	return g.num()
+}
+
+// leaf reports whether an expression should be a literal or a var, to
+// keep expressions from nesting too deeply
+func (g *progGen) leaf() bool {
+	return g.depth > 6
+}
+
+// nested runs f one level deeper
+func (g *progGen) nested(f func() string) string {
+	g.depth++
+	defer func() { g.depth-- }()
+	return f()
+}
+
+var genOps = []string{"+", "-", "*", "/", "%", "==", "!=", "<", ">", "<=", ">=", "&&", "||"}
+
+func (g *progGen) num() string {
+	choice := g.choose(10)
+	if g.leaf() && choice > 1 {
+		choice = 0
+	}
+	return g.nested(func() string {
+		switch choice {
+		case 1:
+			if name := g.pick(genNum); name != "" {
+				return name
+			}
+		case 2:
+			return "(" + g.num() + " " + genOps[g.choose(len(genOps))] + " " + g.num() + ")"
+		case 3:
+			return "(-" + g.num() + ")"
+		case 4:
+			switch g.choose(3) {
+			case 0:
+				return "len(" + g.str() + ")"
+			case 1:
+				return "len(" + g.arr() + ")"
+			}
+			return "len(" + g.mapExpr() + ")"
+		case 5:
+			if name := g.pick(genArr); name != "" {
+				return name + "[" + g.num() + "]"
+			}
+		case 6:
+			if name := g.pick(genMap); name != "" {
+				return name + "[" + g.str() + "]"
+			}
+		case 7:
+			if name := g.pick(genFn); name != "" {
+				return name + "(" + g.num() + ", " + g.num() + ")"
+			}
+		case 8:
+			return "(" + g.str() + " " + genOps[5+g.choose(6)] + " " + g.str() + ")"
+		case 9:
+			return g.match()
+		}
+		return strconv.Itoa(g.choose(10))
+	})
+}
+
+// match is a match expression on a number, with a catch-all case binding
+// it
+func (g *progGen) match() string {
+	value := g.num()
+	cases := ""
+	for i := g.choose(3); i > 0; i-- {
+		cases += strconv.Itoa(g.choose(10)) + ": " + g.num() + "\n"
+	}
+	g.scoped(func() {
+		name := g.declare(genNum)
+		cases += name + ": " + g.num() + "\n"
+	})
+	return "match " + value + " {\n" + cases + "}"
+}
+
+var genStrs = []string{"''", "'a'", "'bc'", "'a,b'"}
+
+// strAtom is a string that's never more than a few characters
+func (g *progGen) strAtom() string {
+	if g.choose(2) == 0 || g.leaf() {
+		return genStrs[g.choose(len(genStrs))]
+	}
+	return g.nested(func() string { return "str(" + g.num() + ")" })
+}
+
+// str is a string at most a few characters longer than one in a var, so
+// strings can't double in size
+func (g *progGen) str() string {
+	choice := g.choose(4)
+	if g.leaf() {
+		choice = 0
+	}
+	switch choice {
+	case 1:
+		if name := g.pick(genStr); name != "" {
+			return name
+		}
+	case 2:
+		if name := g.pick(genStr); name != "" {
+			return "(" + name + " + " + g.strAtom() + ")"
+		}
+	case 3:
+		return g.nested(func() string { return "str(" + g.arr() + ")" })
+	}
+	return g.strAtom()
+}
+
+// arr is an array of numbers, at most one item longer than one in a var
+func (g *progGen) arr() string {
+	choice := g.choose(4)
+	if g.leaf() {
+		choice = 0
+	}
+	return g.nested(func() string {
+		switch choice {
+		case 1:
+			if name := g.pick(genArr); name != "" {
+				return name
+			}
+		case 2:
+			if name := g.pick(genArr); name != "" {
+				return "push(" + name + ", " + g.num() + ")"
+			}
+		case 3:
+			if name := g.pick(genArr); name != "" {
+				return "sort(" + name + ")"
+			}
+		}
+		items := make([]string, g.choose(4))
+		for i := range items {
+			items[i] = g.num()
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	})
+}
+
+func (g *progGen) mapExpr() string {
+	if name := g.pick(genMap); name != "" && g.choose(2) == 0 {
+		return name
+	}
+	if g.leaf() || g.choose(2) == 0 {
+		return "{}"
+	}
+	return g.nested(func() string { return "{a: " + g.num() + ", b: " + g.num() + "}" })
+}
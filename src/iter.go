@@ -0,0 +1,66 @@
+package lang
+
+import "fmt"
+
+// Iter is a sequence for loops produce lazily, one item at a time.
+//
+// Each loop over it calls start for a fresh cursor, so built in iterators
+// start again each time. An iterator made by iter carries on from wherever
+// its function has got to.
+type Iter struct {
+	start func() iterNext
+}
+
+// iterNext returns the next item, or false when there are none left. It runs
+// on the evaluator doing the looping.
+type iterNext func(ev *Evaluator) (Value, bool)
+
+// nativeIter makes an iterator from a function, called with no arguments for
+// each item until it returns nil
+func nativeIter(ev *Evaluator, args []Value) Value {
+	checkArity("iter", args, 1, 1)
+	fnVal := args[0]
+	if fnVal.Tag != ValFn && fnVal.Tag != ValNativeFn {
+		panic(E(RuntimeError, fmt.Sprintf("iter: argument 1 must be a fn, got %s", typeName(fnVal)), 0))
+	}
+	// calls to the function look like they come from the call to iter
+	call := ev.native
+	next := func(ev *Evaluator) (Value, bool) {
+		var v Value
+		if fnVal.Tag == ValNativeFn {
+			prevNative := ev.native
+			ev.native = call
+			v = fnVal.NativeFn(ev, nil)
+			ev.native = prevNative
+		} else {
+			v = ev.fn(call, fnVal, nil)
+		}
+		return v, v.Tag != ValNil
+	}
+	it := Iter{start: func() iterNext { return next }}
+	return Value{Tag: ValIter, ref: &it}
+}
+
+// nativeWindows iterates over each run of n items in an array, in order.
+// Each window is a new array but they're only made as the loop gets to them.
+func nativeWindows(ev *Evaluator, args []Value) Value {
+	checkArgs("windows", args, ValArray, ValNum)
+	items := *args[0].Array
+	n := args[1].Num
+	if n < 1 {
+		panic(E(RuntimeError, fmt.Sprintf("windows: size must be at least 1, got %d", n), 0))
+	}
+	it := Iter{start: func() iterNext {
+		i := 0
+		return func(ev *Evaluator) (Value, bool) {
+			if i+n > len(items) {
+				return NilValue, false
+			}
+			window := make([]Value, n)
+			copy(window, items[i:i+n])
+			i++
+			return Value{Tag: ValArray, Array: &window}, true
+		}
+	}}
+	return Value{Tag: ValIter, ref: &it}
+}
@@ -0,0 +1,52 @@
+package lang
+
+import "testing"
+
+func TestWindowsIsLazy(t *testing.T) {
+	items := make([]Value, 100000)
+	for i := range items {
+		items[i] = NewNum(i)
+	}
+	args := []Value{{Tag: ValArray, Array: &items}, NewNum(3)}
+
+	// making the iterator and taking two windows shouldn't depend on how
+	// big the array is
+	allocs := testing.AllocsPerRun(10, func() {
+		next := nativeWindows(nil, args).iter().start()
+		next(nil)
+		next(nil)
+	})
+	if allocs > 10 {
+		t.Errorf("expected a handful of allocations, got %v", allocs)
+	}
+
+	next := nativeWindows(nil, args).iter().start()
+	for i := 0; i < 2; i++ {
+		next(nil)
+	}
+	w, ok := next(nil)
+	if !ok || w.Repr() != "[2, 3, 4]" {
+		t.Errorf("expected the third window to be [2, 3, 4], got %s", w.Repr())
+	}
+}
+
+func TestIterErrors(t *testing.T) {
+	src := `part1: {
+  return iter(1)
+}
+part2: {
+  for w in windows([1, 2], 0) {
+  }
+}
+part3: {
+  var calls = 0
+  for n in iter(fn() {
+    calls = calls + 1
+    return calls + []
+  }) {
+  }
+}`
+	expectError(t, src, "part1", RuntimeError, "iter: argument 1 must be a fn, got number", 2)
+	expectError(t, src, "part2", RuntimeError, "windows: size must be at least 1, got 0", 5)
+	expectError(t, src, "part3", RuntimeError, "operator only supported for numbers and strings", 12)
+}
@@ -0,0 +1,144 @@
+package lang
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// MarshalJSON encodes plain data: nil as null, numbers, strings, arrays and
+// maps. Anything else, a fn or a set say, is an error.
+func (v Value) MarshalJSON() ([]byte, error) {
+	return appendJSON(nil, v)
+}
+
+func appendJSON(b []byte, v Value) ([]byte, error) {
+	switch v.Tag {
+	case ValNil:
+		return append(b, "null"...), nil
+	case ValNum:
+		return strconv.AppendInt(b, int64(v.Num), 10), nil
+	case ValFloat:
+		f, err := json.Marshal(v.Float)
+		if err != nil {
+			return nil, fmt.Errorf("%s can't be made into json", formatFloat(v.Float))
+		}
+		return append(b, f...), nil
+	case ValStr:
+		s, _ := json.Marshal(v.Str)
+		return append(b, s...), nil
+	case ValArray:
+		b = append(b, '[')
+		for i, item := range *v.Array {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			var err error
+			if b, err = appendJSON(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, ']'), nil
+	case ValMap:
+		// sorted so the same map always gives the same json
+		b = append(b, '{')
+		for i, k := range v.mapKeys() {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			key, _ := json.Marshal(k.String())
+			b = append(append(b, key...), ':')
+			var err error
+			if b, err = appendJSON(b, (*v.Map)[k]); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, '}'), nil
+	}
+	return nil, fmt.Errorf("%s can't be made into json", withArticle(typeName(v)))
+}
+
+// parseJSON is the reverse of MarshalJSON. Numbers written as integers are
+// numbers, the rest are floats.
+func parseJSON(s string) (Value, error) {
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.UseNumber()
+	var data interface{}
+	if err := dec.Decode(&data); err != nil {
+		if err == io.EOF {
+			return NilValue, fmt.Errorf("no json in the string")
+		}
+		return NilValue, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return NilValue, fmt.Errorf("more than one json value in the string")
+	}
+	return fromJSON(data)
+}
+
+func fromJSON(data interface{}) (Value, error) {
+	switch data := data.(type) {
+	case nil:
+		return NilValue, nil
+	case bool:
+		if data {
+			return Value{Tag: ValNum, Num: 1}, nil
+		}
+		return Value{Tag: ValNum, Num: 0}, nil
+	case string:
+		return Value{Tag: ValStr, Str: data}, nil
+	case json.Number:
+		if n, err := strconv.Atoi(data.String()); err == nil {
+			return Value{Tag: ValNum, Num: n}, nil
+		}
+		f, err := data.Float64()
+		if err != nil {
+			return NilValue, fmt.Errorf("number %s is out of range", data)
+		}
+		return Value{Tag: ValFloat, Float: f}, nil
+	case []interface{}:
+		items := make([]Value, len(data))
+		for i, item := range data {
+			v, err := fromJSON(item)
+			if err != nil {
+				return NilValue, err
+			}
+			items[i] = v
+		}
+		return Value{Tag: ValArray, Array: &items}, nil
+	case map[string]interface{}:
+		m := make(map[MapKey]Value, len(data))
+		for k, item := range data {
+			v, err := fromJSON(item)
+			if err != nil {
+				return NilValue, err
+			}
+			m[strKey(k)] = v
+		}
+		return Value{Tag: ValMap, Map: &m}, nil
+	}
+	panic(fmt.Sprintf("unexpected json value %T", data))
+}
+
+// nativeJSON encodes a value as json, see MarshalJSON
+func nativeJSON(ev *Evaluator, args []Value) Value {
+	checkArity("json", args, 1, 1)
+	b, err := appendJSON(nil, args[0])
+	if err != nil {
+		panic(E(RuntimeError, "json: "+err.Error(), 0))
+	}
+	return Value{Tag: ValStr, Str: string(b)}
+}
+
+// nativeParseJSON turns a json string into a value. true and false are 1
+// and 0, like comparisons give.
+func nativeParseJSON(ev *Evaluator, args []Value) Value {
+	checkArgs("parse_json", args, ValStr)
+	v, err := parseJSON(args[0].Str)
+	if err != nil {
+		panic(E(RuntimeError, "parse_json: "+err.Error(), 0))
+	}
+	return v
+}
@@ -0,0 +1,59 @@
+package lang
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		`null`,
+		`-12`,
+		`0.25`,
+		`"a \"quoted\" string\n"`,
+		`[1,[2,[]],{}]`,
+		`{"a":{"b":[null]},"c":"d"}`,
+	} {
+		v, err := parseJSON(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if string(b) != s {
+			t.Errorf("expected %s, got %s", s, b)
+		}
+	}
+
+	// only numbers written as integers are numbers
+	if v, _ := parseJSON(`[3, 3.0, 3.5, 1e3]`); v.Repr() != "[3, 3.0, 3.5, 1000.0]" {
+		t.Errorf("expected [3, 3.0, 3.5, 1000.0], got %s", v.Repr())
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	src := `part1: {
+  return json([1, set()])
+}
+part2: {
+  return json(fn() {})
+}
+part3: {
+  return parse_json('[1,')
+}
+part4: {
+  return parse_json('1 2')
+}
+part5: {
+  return parse_json(' ')
+}`
+	expectError(t, src, "part1", RuntimeError, "json: a set can't be made into json", 2)
+	expectError(t, src, "part2", RuntimeError, "json: a fn can't be made into json", 5)
+	expectError(t, src, "part3", RuntimeError, "parse_json: unexpected EOF", 8)
+	expectError(t, src, "part4", RuntimeError, "parse_json: more than one json value in the string", 11)
+	expectError(t, src, "part5", RuntimeError, "parse_json: no json in the string", 14)
+}
@@ -2,6 +2,7 @@ package lang
 
 import (
 	"fmt"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 )
@@ -40,6 +41,8 @@ const (
 	Pipe           // |
 	GreaterGreater // >>
 	LessLess       // <<
+	DotDot         // ..
+	PipeGreater    // |>
 	Var            // var
 	For            // for
 	In             // in
@@ -51,6 +54,8 @@ const (
 	Break          // break
 	Fn             // fn
 	Nil            // nil
+	Try            // try
+	Catch          // catch
 )
 
 type Token struct {
@@ -66,9 +71,11 @@ type Lexer struct {
 	tokenStart int
 }
 
+// NewLexer makes a lexer for src. CRLF line endings are read as LF, so
+// strings spanning lines come out the same either way.
 func NewLexer(src string) Lexer {
 	return Lexer{
-		src:        src,
+		src:        strings.ReplaceAll(src, "\r\n", "\n"),
 		pos:        0,
 		line:       1,
 		tokenStart: 0,
@@ -85,7 +92,17 @@ func stringToken(lex *Lexer, tag TokenTag, start int) Token {
 
 func (lex *Lexer) fmtError(msg string, args ...interface{}) Error {
 	formattedMsg := fmt.Sprintf(msg, args...)
-	return E(LexError, formattedMsg, lex.line)
+	return lex.errorAt(LexError, Token{Pos: lex.tokenStart}, formattedMsg)
+}
+
+// errorAt makes an error pointing at token, along with the text of its line
+// to show it in context
+func (lex *Lexer) errorAt(tag ErrorTag, token Token, msg string) Error {
+	line, col := lex.GetLineAndCol(token)
+	e := E(tag, msg, line)
+	e.Col = col
+	e.Source = lex.SourceLine(line)
+	return e
 }
 
 func (lex *Lexer) peek() rune {
@@ -116,14 +133,11 @@ func (lex *Lexer) consume(expected rune) error {
 func (lex *Lexer) skipWhitespace() {
 	for {
 		switch lex.peek() {
-		case ' ', '\n', '\r':
+		case ' ', '\t', '\v', '\f', '\n', '\r':
 			lex.advance()
 		case '#':
-			for lex.peek() != '\n' {
+			for lex.pos < len(lex.src) && lex.peek() != '\n' {
 				lex.advance()
-				if lex.pos >= len(lex.src) {
-					return
-				}
 			}
 		default:
 			return
@@ -166,6 +180,10 @@ func (lex *Lexer) identifier() Token {
 		return simpleToken(lex, Fn)
 	case "nil":
 		return simpleToken(lex, Nil)
+	case "try":
+		return simpleToken(lex, Try)
+	case "catch":
+		return simpleToken(lex, Catch)
 	default:
 		return stringToken(lex, Identifier, start)
 	}
@@ -173,6 +191,10 @@ func (lex *Lexer) identifier() Token {
 
 func (lex *Lexer) string() (Token, error) {
 	for lex.peek() != '\'' {
+		if lex.pos >= len(lex.src) {
+			line, _ := lex.GetLineAndCol(Token{Pos: lex.tokenStart})
+			return Token{}, lex.fmtError("unterminated string starting on line %d", line)
+		}
 		lex.advance()
 	}
 	t := stringToken(lex, Str, lex.tokenStart+1)
@@ -183,21 +205,36 @@ func (lex *Lexer) string() (Token, error) {
 	return t, nil
 }
 
+// number lexes an integer, or a float if the digits are followed by a dot
+// and more digits
 func (lex *Lexer) number() Token {
 	for unicode.IsDigit(lex.peek()) {
 		lex.advance()
 	}
+	if lex.peek() == '.' && lex.pos+1 < len(lex.src) && isDigit(lex.src[lex.pos+1]) {
+		lex.advance()
+		for unicode.IsDigit(lex.peek()) {
+			lex.advance()
+		}
+	}
 	return stringToken(lex, Num, lex.tokenStart)
 }
 
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// NextToken returns the next token, or an EOF token at the end of the source
+// and on every call after that. It never panics, bad input is a returned
+// LexError and the next call carries on after it.
 func (lex *Lexer) NextToken() (retToken Token, err error) {
+	lex.skipWhitespace()
+	lex.tokenStart = lex.pos
 	if lex.pos >= len(lex.src) {
 		return simpleToken(lex, EOF), nil
 	}
 
-	lex.skipWhitespace()
 	r := lex.peek()
-	lex.tokenStart = lex.pos
 
 	if unicode.IsLetter(r) {
 		return lex.identifier(), nil
@@ -234,6 +271,11 @@ func (lex *Lexer) NextToken() (retToken Token, err error) {
 		return simpleToken(lex, Percent), nil
 	case ',':
 		return simpleToken(lex, Comma), nil
+	case '.':
+		if lex.peek() == '.' {
+			lex.advance()
+			return simpleToken(lex, DotDot), nil
+		}
 	case '[':
 		return simpleToken(lex, LSquare), nil
 	case ']':
@@ -284,6 +326,10 @@ func (lex *Lexer) NextToken() (retToken Token, err error) {
 			lex.advance()
 			return simpleToken(lex, PipePipe), nil
 		}
+		if lex.peek() == '>' {
+			lex.advance()
+			return simpleToken(lex, PipeGreater), nil
+		}
 		return simpleToken(lex, Pipe), nil
 	}
 	return retToken, lex.fmtError("unexpected character %q (%x)", r, r)
@@ -305,5 +351,14 @@ func (lex *Lexer) GetLineAndCol(token Token) (int, int) {
 			lineStart = i + 1
 		}
 	}
-	return line, token.Pos - lineStart
+	return line, utf8.RuneCountInString(lex.src[lineStart:token.Pos])
+}
+
+// SourceLine returns the text of a line, counting from 1
+func (lex *Lexer) SourceLine(line int) string {
+	lines := strings.SplitN(lex.src, "\n", line+1)
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	return strings.TrimSuffix(lines[line-1], "\r")
 }
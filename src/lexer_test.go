@@ -0,0 +1,122 @@
+package lang
+
+import (
+	"fmt"
+	"testing"
+)
+
+// lexAll returns every token up to EOF, or the first error
+func lexAll(t *testing.T, src string) ([]Token, error) {
+	t.Helper()
+	lex := NewLexer(src)
+	var tokens []Token
+	for {
+		pos := lex.pos
+		token, err := lex.NextToken()
+		if err != nil {
+			return tokens, err
+		}
+		if token.Tag == EOF {
+			return tokens, nil
+		}
+		if lex.pos <= pos {
+			t.Fatalf("lexer stuck at %d in %q", pos, src)
+		}
+		tokens = append(tokens, token)
+	}
+}
+
+func TestLexEndOfSource(t *testing.T) {
+	tests := []struct {
+		src    string
+		tokens int
+		err    string
+	}{
+		{"a # comment", 1, ""},
+		{"a #", 1, ""},
+		{"a  \n\n", 1, ""},
+		{"", 0, ""},
+		{"a\n'abc", 1, "unterminated string starting on line 2"},
+		{"'", 0, "unterminated string starting on line 1"},
+		{"a !", 1, "unexpected character '!' (21)"},
+	}
+	for _, test := range tests {
+		tokens, err := lexAll(t, test.src)
+		if len(tokens) != test.tokens {
+			t.Errorf("%q: expected %d tokens, got %d", test.src, test.tokens, len(tokens))
+		}
+		msg := ""
+		if err != nil {
+			e, ok := err.(Error)
+			if !ok || e.Tag != LexError {
+				t.Errorf("%q: expected a lex error, got %v", test.src, err)
+			}
+			msg = e.Msg
+		}
+		if msg != test.err {
+			t.Errorf("%q: expected error %q, got %q", test.src, test.err, msg)
+		}
+	}
+}
+
+func TestLexEOFRepeats(t *testing.T) {
+	lex := NewLexer("a ")
+	lex.NextToken()
+	for i := 0; i < 3; i++ {
+		token, err := lex.NextToken()
+		if err != nil || token.Tag != EOF || token.Pos != 2 {
+			t.Fatalf("expected EOF at 2, got %v %v", token, err)
+		}
+	}
+}
+
+func FuzzLexer(f *testing.F) {
+	f.Add("part1: {\n  var x = 'abc' # comment\n  return x >= 10 && y\n}")
+	f.Add("'abc")
+	f.Add("a #")
+	f.Add("\xff\xfe")
+	f.Fuzz(func(t *testing.T, src string) {
+		tokens, err := lexAll(t, src)
+		if err != nil {
+			if _, ok := err.(Error); !ok {
+				t.Fatalf("expected an Error, got %T", err)
+			}
+			return
+		}
+		for _, token := range tokens {
+			if token.Pos < 0 || token.Pos+token.Len > len(src) {
+				t.Fatalf("token %v is outside the source", token)
+			}
+		}
+	})
+}
+
+func TestLexWhitespace(t *testing.T) {
+	tokens, err := lexAll(t, "\tvar\vx\f=\r1\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 4 {
+		t.Errorf("expected 4 tokens, got %d", len(tokens))
+	}
+}
+
+func TestLexFloats(t *testing.T) {
+	lex := NewLexer("1.25 3. 4")
+	var got []string
+	for {
+		token, err := lex.NextToken()
+		if err != nil {
+			got = append(got, "error")
+			continue
+		}
+		if token.Tag == EOF {
+			break
+		}
+		got = append(got, lex.GetString(token))
+	}
+	want := []string{"1.25", "3", "error", "4"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,31 @@
+package lang
+
+import "sort"
+
+// Warning is a likely mistake Lint found that isn't an error
+type Warning struct {
+	Line int
+	Msg  string
+}
+
+// lintNote is a warning the resolver noted, before it has a line number
+type lintNote struct {
+	node Node
+	msg  string
+}
+
+// Lint returns the program's warnings in line order: vars that are never
+// read, vars that shadow another variable, top level functions nothing uses
+// and statements that can't run because they come after a return, break or
+// continue. Assigning to a var doesn't count as using it.
+func (c *Compiled) Lint() []Warning {
+	warnings := make([]Warning, 0, len(c.prog.notes))
+	for _, n := range c.prog.notes {
+		line, _ := c.lex.GetLineAndCol(*n.node.Token())
+		warnings = append(warnings, Warning{line, n.msg})
+	}
+	sort.SliceStable(warnings, func(i, j int) bool {
+		return warnings[i].Line < warnings[j].Line
+	})
+	return warnings
+}
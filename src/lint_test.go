@@ -0,0 +1,117 @@
+package lang
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	src := `fn used(n) {
+  return n + 1
+}
+fn unused() {
+  return unused()
+}
+fn helper() {
+  return 1
+}
+part1: {
+  var total = 0
+  var stale = used(1)
+  for x in [1, 2] {
+    var total = x
+    total = total + 1
+    if x > 1 {
+      break
+      total = 0
+    }
+  }
+  var later = 2
+  var f = fn() { return later + helper() }
+  return f()
+  total = 1
+}`
+	got := mustCompile(t, src).Lint()
+	want := []Warning{
+		{4, "fn unused is never used"},
+		{11, "var total is never used"},
+		{12, "var stale is never used"},
+		{14, "var total shadows the one on line 11"},
+		{18, "unreachable code after break"},
+		{24, "unreachable code after return"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected\n%v\ngot\n%v", want, got)
+	}
+}
+
+func TestLintShadowing(t *testing.T) {
+	src := `fn score(n) {
+  return n
+}
+fn f(n) {
+  if n > 1 {
+    var n = 1
+    return n
+  }
+  return score(n)
+}
+part1: {
+  var lines = 1
+  var score = 2
+  return f(lines + score)
+}`
+	got := mustCompile(t, src).Lint()
+	want := []Warning{
+		{6, "var n shadows the one on line 4"},
+		{12, "var lines shadows the lines global"},
+		{13, "var score shadows fn score on line 1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected\n%v\ngot\n%v", want, got)
+	}
+}
+
+func TestLintBindingShadowing(t *testing.T) {
+	src := `part1: {
+  for i in range(0, 3) {
+    var i = i * 10
+  }
+  try {
+    error('oops')
+  } catch e {
+    var e = 1
+    var f = e
+  }
+  return match [2] {
+    [n]: {
+      var n = n * 100
+      n
+    }
+  }
+}`
+	got := mustCompile(t, src).Lint()
+	want := []Warning{
+		{3, "var i shadows the one on line 2"},
+		{3, "var i is never used"},
+		{8, "var e shadows the one on line 5"},
+		{9, "var f is never used"},
+		{13, "var n shadows the one on line 12"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected\n%v\ngot\n%v", want, got)
+	}
+}
+
+func TestLintCleanProgram(t *testing.T) {
+	src := `part1: {
+  var n = 1
+  match [n, 2] {
+    [a, b]: { return a + b }
+  }
+  return n
+}`
+	if got := mustCompile(t, src).Lint(); len(got) != 0 {
+		t.Errorf("expected no warnings, got %v", got)
+	}
+}
@@ -0,0 +1,142 @@
+package lang
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// nativePmap calls a function on each item of an array, several at a time on
+// their own goroutines, and returns the results in order.
+//
+// Each goroutine has its own evaluator with a copy of the globals as they
+// were when pmap was called, so results only come back as return values.
+// Assigning to a variable from outside the callback is an error. Changing an
+// array or map the callbacks share isn't caught and is a race, copy it first.
+//
+// Each item gets its own random numbers, seeded from the caller's in order,
+// so rand in the callback gives the same results for the same seed however
+// many workers there are and whichever one gets the item.
+func nativePmap(ev *Evaluator, args []Value) Value {
+	checkArity("pmap", args, 2, 2)
+	checkArg("pmap", args, 0, ValArray)
+	fnVal := args[1]
+	if fnVal.Tag != ValFn && fnVal.Tag != ValNativeFn {
+		panic(E(RuntimeError, fmt.Sprintf("pmap: argument 2 must be a fn, got %s", typeName(fnVal)), 0))
+	}
+	items := *args[0].Array
+	call := ev.native
+
+	results := make([]Value, len(items))
+	errs := make([]error, len(items))
+	seeds := make([]int64, len(items))
+	for i := range seeds {
+		seeds[i] = ev.random().Int63()
+	}
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(items) {
+		workers = len(items)
+	}
+
+	var next int64 = -1
+	var failed int32
+	var wg sync.WaitGroup
+	out := &lockedWriter{w: ev.out}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := ev.worker(out)
+			for atomic.LoadInt32(&failed) == 0 {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(items) {
+					return
+				}
+				w.rng, w.seed = nil, seeds[i]
+				results[i], errs[i] = w.callWorker(call, fnVal, items[i])
+				if errs[i] != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the first failing item, not whichever goroutine failed first
+	for _, err := range errs {
+		if e, ok := err.(Error); ok {
+			e.Trace = append(e.Trace, ev.trace()...)
+			panic(e)
+		}
+	}
+	return Value{Tag: ValArray, Array: &results}
+}
+
+// worker makes an evaluator for one of pmap's goroutines. It shares the
+// program but has its own globals, copied from ev's.
+func (ev *Evaluator) worker(out io.Writer) *Evaluator {
+	globals := Env{vars: make(map[string]*Value, len(ev.globals.vars))}
+	for name, v := range ev.globals.vars {
+		v := *v
+		globals.vars[name] = &v
+	}
+	// each worker works out a lazy global for itself if it uses it
+	for name, f := range ev.globals.lazy {
+		if globals.lazy == nil {
+			globals.lazy = make(map[string]func() Value)
+		}
+		globals.lazy[name] = f
+	}
+	w := &Evaluator{
+		env:      &globals,
+		globals:  &globals,
+		sections: ev.sections,
+		prog:     ev.prog,
+		section:  ev.section,
+		lex:      ev.lex,
+		out:      out,
+		stdin:    ev.stdin,
+		ctx:      ev.ctx,
+		clock:    ev.clock,
+		started:  ev.started,
+		progress: ev.progress,
+		parallel: true,
+	}
+	w.pushFrame(ev.prog)
+	return w
+}
+
+// callWorker calls fnVal with one argument on a worker, returning the error
+// rather than panicking so it can get back to pmap's goroutine
+func (w *Evaluator) callWorker(call *ExprFuncall, fnVal Value, arg Value) (v Value, err error) {
+	env, frames := w.env, len(w.frames)
+	defer func() {
+		if r := recover(); r != nil {
+			err = w.nativeError(asError(r))
+			w.env, w.frames, w.argStack, w.native = env, w.frames[:frames], w.argStack[:0], nil
+		}
+	}()
+
+	args := []Value{arg}
+	if fnVal.Tag == ValNativeFn {
+		w.native = call
+		v = fnVal.NativeFn(w, args)
+		w.native = nil
+		return v, nil
+	}
+	return w.fn(call, fnVal, args), nil
+}
+
+// lockedWriter lets pmap's workers share the evaluator's output
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
@@ -0,0 +1,157 @@
+package lang
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPmap(t *testing.T) {
+	src := `fn offset() {
+  return 100
+}
+
+fn square(n) {
+  return n * n + offset()
+}
+
+part1: {
+  var xs = []
+  for i in range(0, 50) {
+    xs = push(xs, i)
+  }
+  var ys = pmap(xs, square)
+  var total = 0
+  for y, i in ys {
+    assert(y == i * i + 100, 'item ' + i + ' is ' + y)
+    total = total + y
+  }
+  return total
+}
+
+part2: {
+  var scale = 3
+  var add = memo(fn(n) { return n + 1 })
+  return pmap([1, 2, 3], fn(n) {
+    var scaled = n * scale
+    return add(scaled)
+  })
+}`
+	for _, vm := range []bool{false, true} {
+		v, err := evalSourceOn(t, src, "part1", vm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Num != 45425 {
+			t.Errorf("vm: %v: expected 45425, got %s", vm, v.Repr())
+		}
+
+		v, err = evalSourceOn(t, src, "part2", vm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Repr() != "[4, 7, 10]" {
+			t.Errorf("vm: %v: expected [4, 7, 10], got %s", vm, v.Repr())
+		}
+	}
+}
+
+// stdin hasn't been read when pmap starts, whichever worker reads it first
+// the others must still see all of it
+func TestPmapStdin(t *testing.T) {
+	ev := mustCompile(t, "").NewEvaluator(WithStdin(strings.NewReader("abc")))
+	out := &lockedWriter{w: ev.out}
+	for i, w := range []*Evaluator{ev.worker(out), ev.worker(out), ev} {
+		if v := nativeStdin(w, nil); v.Str != "abc" {
+			t.Errorf("expected evaluator %d to read abc, got %s", i, v.Repr())
+		}
+	}
+}
+
+func TestPmapErrors(t *testing.T) {
+	src := `fn count() {
+  return 0
+}
+
+part1: {
+  var total = 0
+  pmap([1, 2], fn(n) {
+    total = total + n
+  })
+}
+part2: {
+  pmap([1, 2], fn(n) {
+    count = n
+  })
+}
+part3: {
+  pmap([1, 2, 3], fn(n) {
+    if n > 1 {
+      error('failed on ' + n)
+    }
+  })
+}
+part4: {
+  pmap([1], 2)
+}`
+	expectError(t, src, "part1", RuntimeError, "pmap: the callback can't assign to total from outside it, return a value instead", 8)
+	expectError(t, src, "part2", RuntimeError, "pmap: the callback can't assign to count from outside it, return a value instead", 13)
+	expectError(t, src, "part3", RuntimeError, "failed on 2", 19)
+	expectError(t, src, "part4", RuntimeError, "pmap: argument 2 must be a fn, got number", 24)
+}
+
+func TestPmapFasterThanSerial(t *testing.T) {
+	if testing.Short() || runtime.NumCPU() < 4 || runtime.GOMAXPROCS(0) < 4 {
+		t.Skip("needs at least 4 cpus and no -short")
+	}
+	src := `fn work(n) {
+  var total = 0
+  for i in range(0, 50000) {
+    total = (total + i * n) % 1000003
+  }
+  return total
+}
+fn inputs() {
+  var xs = []
+  for n in range(0, 16) {
+    xs = push(xs, n)
+  }
+  return xs
+}
+part1: {
+  var out = []
+  for n in inputs() {
+    out = push(out, work(n))
+  }
+  return out
+}
+part2: pmap(inputs(), work)`
+
+	// timing is noisy on a busy machine, one faster run out of a few is
+	// enough to show the work is spread out
+	for attempt := 0; attempt < 3; attempt++ {
+		start := time.Now()
+		serial, err := evalSource(t, src, "part1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		serialTime := time.Since(start)
+
+		start = time.Now()
+		parallel, err := evalSource(t, src, "part2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		parallelTime := time.Since(start)
+
+		if serial.Repr() != parallel.Repr() {
+			t.Fatalf("expected the same results, got %s and %s", serial.Repr(), parallel.Repr())
+		}
+		if parallelTime < serialTime*3/4 {
+			return
+		}
+		t.Logf("attempt %d: serial %v, parallel %v", attempt, serialTime, parallelTime)
+	}
+	t.Error("expected pmap to be faster than a loop")
+}
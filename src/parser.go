@@ -17,6 +17,25 @@ type Parser struct {
 	token     Token
 	prevToken Token
 	rules     map[TokenTag]rule
+
+	// count of vars and fns declared so far, used to spot functions that
+	// never declare anything
+	declarations int
+
+	// how many for loops enclose the current statement, within the current
+	// function
+	loops int
+
+	// how many match expressions enclose the current statement, within the
+	// current function. return, break and continue can't jump out of one.
+	matchExprs int
+
+	// how many case bodies written as a bare expression enclose the current
+	// expression, see matchCases
+	caseExprs int
+
+	// errors found so far, parsing carries on after one to find the rest
+	errors []Error
 }
 
 type Precedence uint8
@@ -26,6 +45,7 @@ const (
 	PrecAssign
 	PrecLogical
 	PrecCompare
+	PrecPipe
 	PrecShift
 	PrecSum
 	PrecProduct
@@ -55,6 +75,7 @@ func (p *Parser) makeRules() {
 		LParen:         {PrecCall, group, call},
 		LCurly:         {PrecNone, hashMap, nil},
 		Fn:             {PrecNone, fn, nil},
+		Match:          {PrecNone, matchExpr, nil},
 		Equal:          {PrecAssign, nil, binary},
 		AmpAmp:         {PrecLogical, nil, binary},
 		PipePipe:       {PrecLogical, nil, binary},
@@ -73,6 +94,7 @@ func (p *Parser) makeRules() {
 		GreaterGreater: {PrecShift, nil, binary},
 		Amp:            {PrecCompare, nil, binary},
 		Pipe:           {PrecCompare, nil, binary},
+		PipeGreater:    {PrecPipe, nil, pipe},
 	}
 
 	p.rules = rules
@@ -83,16 +105,19 @@ func (p *Parser) atEnd() bool {
 }
 
 func (p *Parser) fmtError(msg string, args ...interface{}) Error {
-	line, _ := p.lex.GetLineAndCol(p.token)
 	formattedMsg := fmt.Sprintf(msg, args...)
-	return E(ParseError, formattedMsg, line)
+	return p.lex.errorAt(ParseError, p.token, formattedMsg)
 }
 
 func (p *Parser) advance() {
 	p.prevToken = p.token
 	token, err := p.lex.NextToken()
 	if err != nil {
-		panic(err)
+		// the lexer has moved past the bad character, report it like any
+		// other syntax error and carry on from there
+		e := err.(Error)
+		e.Tag = ParseError
+		panic(e)
 	}
 	p.token = token
 }
@@ -116,6 +141,20 @@ func (p *Parser) consume(expected ...TokenTag) Token {
 	}
 }
 
+// close consumes the closer for opener. Running out of source, or finding a
+// different closer, is reported at opener, since that's the one left open.
+func (p *Parser) close(closer TokenTag, opener Token) Token {
+	switch p.token.Tag {
+	case closer:
+		p.advance()
+		return p.prevToken
+	case EOF, RCurly, RParen, RSquare:
+		line, _ := p.lex.GetLineAndCol(opener)
+		panic(p.lex.errorAt(ParseError, opener, fmt.Sprintf("unclosed %s opened on line %d", opener.Tag, line)))
+	}
+	return p.consume(closer)
+}
+
 func (p *Parser) section() Stmt {
 	p.consume(Identifier)
 	ident := p.lex.GetString(p.prevToken)
@@ -124,7 +163,7 @@ func (p *Parser) section() Stmt {
 
 	if p.token.Tag == LCurly {
 		block := p.block()
-		return &StmtSection{ident, block, p.token}
+		return &StmtSection{ident, block, identToken}
 	}
 
 	expr := p.expression()
@@ -136,11 +175,57 @@ func (p *Parser) block() Stmt {
 	p.consume(LCurly)
 	openingToken := p.prevToken
 	stmts := make([]Stmt, 0)
-	for p.token.Tag != RCurly {
-		stmts = append(stmts, p.statement())
+	for p.token.Tag != RCurly && !p.atEnd() {
+		if stmt := p.statementOrSync(); stmt != nil {
+			stmts = append(stmts, stmt)
+		}
 	}
-	p.consume(RCurly)
-	return &StmtBlock{stmts, openingToken}
+	p.close(RCurly, openingToken)
+	return &StmtBlock{Body: stmts, openingToken: openingToken}
+}
+
+// statementOrSync parses a statement. If that fails it records the error and
+// skips to the start of the next statement, returning nil.
+func (p *Parser) statementOrSync() (stmt Stmt) {
+	start := p.token
+	defer func() {
+		if r := recover(); r != nil {
+			p.recordError(r)
+			if p.token == start {
+				p.advance()
+			}
+			for !p.atEnd() && !startsStatement(p.token.Tag) {
+				p.advance()
+			}
+			stmt = nil
+		}
+	}()
+	return p.statement()
+}
+
+func startsStatement(tag TokenTag) bool {
+	switch tag {
+	case Var, For, If, Return, Continue, Break, Match, Try, RCurly:
+		return true
+	}
+	return false
+}
+
+// recordError keeps a parse error so parsing can carry on, anything else is
+// re-panicked. An error at the same place as the last one is dropped, a
+// missing } tends to be reported by every block around it.
+func (p *Parser) recordError(r interface{}) {
+	e, ok := r.(Error)
+	if !ok || e.Tag != ParseError {
+		panic(r)
+	}
+	if len(p.errors) > 0 {
+		last := p.errors[len(p.errors)-1]
+		if last.Line == e.Line && last.Msg == e.Msg {
+			return
+		}
+	}
+	p.errors = append(p.errors, e)
 }
 
 func (p *Parser) statement() Stmt {
@@ -152,17 +237,40 @@ func (p *Parser) statement() Stmt {
 	case If:
 		return p.ifStmt()
 	case Return:
+		if p.matchExprs > 0 {
+			panic(p.fmtError("return can't be used inside a match expression"))
+		}
 		p.consume(Return)
+		// a bare return, before a } or another statement, returns nil. A
+		// match on the same line is the value being returned.
+		bare := startsStatement(p.token.Tag) && (p.token.Tag != Match || p.startsLine())
+		if p.atEnd() || bare {
+			return &StmtReturn{&ExprNil{token: p.prevToken}}
+		}
 		expr := p.expression()
 		return &StmtReturn{expr}
 	case Continue:
+		if p.loops == 0 && p.matchExprs > 0 {
+			panic(p.fmtError("continue can't be used inside a match expression"))
+		}
+		if p.loops == 0 {
+			panic(p.fmtError("continue outside of loop"))
+		}
 		p.consume(Continue)
-		return &StmtContinue{}
+		return &StmtContinue{token: p.prevToken}
 	case Break:
+		if p.loops == 0 && p.matchExprs > 0 {
+			panic(p.fmtError("break can't be used inside a match expression"))
+		}
+		if p.loops == 0 {
+			panic(p.fmtError("break outside of loop"))
+		}
 		p.consume(Break)
-		return &StmtBreak{}
+		return &StmtBreak{token: p.prevToken}
 	case Match:
 		return p.matchStmt()
+	case Try:
+		return p.tryStmt()
 	case LCurly:
 		return p.block()
 	default:
@@ -173,19 +281,20 @@ func (p *Parser) statement() Stmt {
 
 func (p *Parser) varDecl() Stmt {
 	p.consume(Var)
+	p.declarations++
 	p.consume(Identifier)
 	ident := p.lex.GetString(p.prevToken)
 	identToken := p.prevToken
 	p.consume(Equal)
 	expr := p.expression()
-	return &StmtVar{ident, expr, identToken}
+	return &StmtVar{Identifier: ident, Value: expr, identifierToken: identToken}
 }
 
 func (p *Parser) forLoop() Stmt {
 	p.consume(For)
 	openingToken := p.prevToken
 	if p.token.Tag == LCurly {
-		body := p.block()
+		body := p.loopBody()
 		return &StmtFor{body: body, openingToken: openingToken}
 	}
 
@@ -199,8 +308,21 @@ func (p *Parser) forLoop() Stmt {
 	}
 	p.consume(In)
 	val := p.expression()
+	body := p.loopBody()
+	return &StmtFor{
+		Identifier:      ident,
+		IndexIdentifier: indexIdent,
+		Value:           val,
+		body:            body,
+		openingToken:    openingToken,
+	}
+}
+
+func (p *Parser) loopBody() Stmt {
+	p.loops++
 	body := p.block()
-	return &StmtFor{ident, indexIdent, val, body, openingToken}
+	p.loops--
+	return body
 }
 
 func (p *Parser) ifStmt() Stmt {
@@ -222,16 +344,63 @@ func (p *Parser) ifStmt() Stmt {
 func (p *Parser) matchStmt() Stmt {
 	p.consume(Match)
 	val := p.expression()
-	p.consume(LCurly)
+	return &StmtMatch{val, p.matchCases()}
+}
+
+// matchExpr is a match anywhere an expression can go, e.g.
+// var score = match c { ')': 3 ']': 57 }
+func matchExpr(p *Parser) Expr {
+	p.consume(Match)
+	token := p.prevToken
+	// loops around the match don't make break valid inside it
+	loops := p.loops
+	p.loops = 0
+	p.matchExprs++
+	val := p.expression()
+	cases := p.matchCases()
+	p.matchExprs--
+	p.loops = loops
+	return &ExprMatch{Match: &StmtMatch{val, cases}, token: token}
+}
+
+// matchCases parses the { ... } of a match. A case's body is a block or a
+// single expression, a { always starts a block. So that an array pattern can
+// follow an expression body, a [ at the start of a line doesn't subscript the
+// body before it.
+func (p *Parser) matchCases() []MatchCase {
+	openingToken := p.consume(LCurly)
 	cases := make([]MatchCase, 0)
-	for p.token.Tag != RCurly {
+	for p.token.Tag != RCurly && !p.atEnd() {
 		cond := p.expression()
 		p.consume(Colon)
-		body := p.block()
-		cases = append(cases, MatchCase{cond, body})
+		var body Stmt
+		if p.token.Tag == LCurly {
+			body = p.block()
+		} else {
+			p.caseExprs++
+			body = &StmtExpr{p.expression()}
+			p.caseExprs--
+		}
+		cases = append(cases, MatchCase{Cond: cond, Body: body})
+	}
+	p.close(RCurly, openingToken)
+	return cases
+}
+
+func (p *Parser) tryStmt() Stmt {
+	p.consume(Try)
+	openingToken := p.prevToken
+	body := p.block()
+	p.consume(Catch)
+	p.consume(Identifier)
+	ident := p.lex.GetString(p.prevToken)
+	catchBody := p.block()
+	return &StmtTry{
+		Body:         body,
+		Identifier:   ident,
+		CatchBody:    catchBody,
+		openingToken: openingToken,
 	}
-	p.consume(RCurly)
-	return &StmtMatch{val, cases}
 }
 
 func (p *Parser) expression() Expr {
@@ -248,6 +417,9 @@ func (p *Parser) expressionWithPrec(prec Precedence) Expr {
 	lhs := prefixRule.prefix(p)
 
 	for prec <= p.rules[p.token.Tag].prec {
+		if p.caseExprs > 0 && p.token.Tag == LSquare && p.startsLine() {
+			break
+		}
 		infixRule := p.rules[p.token.Tag]
 		if infixRule.infix == nil {
 			panic(p.fmtError("unknown operator %s", p.token.Tag.String()))
@@ -257,6 +429,12 @@ func (p *Parser) expressionWithPrec(prec Precedence) Expr {
 	return lhs
 }
 
+// startsLine reports whether the current token is the first on its line
+func (p *Parser) startsLine() bool {
+	gap := p.lex.src[p.prevToken.Pos+p.prevToken.Len : p.token.Pos]
+	return strings.ContainsRune(gap, '\n')
+}
+
 func binary(p *Parser, lhs Expr) Expr {
 	p.advance()
 	op := p.prevToken
@@ -280,9 +458,16 @@ func str(p *Parser) Expr {
 func number(p *Parser) Expr {
 	p.consume(Num)
 	s := p.lex.GetString(p.prevToken)
+	if strings.ContainsRune(s, '.') {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			panic(p.lex.errorAt(ParseError, p.prevToken, s+" is too big to be a number"))
+		}
+		return &ExprFloat{f, p.prevToken}
+	}
 	num, err := strconv.Atoi(s)
 	if err != nil {
-		panic(p.fmtError(err.Error()))
+		panic(p.lex.errorAt(ParseError, p.prevToken, s+" is too big to be a number"))
 	}
 	return &ExprNum{num, p.prevToken}
 }
@@ -295,40 +480,40 @@ func nilExpr(p *Parser) Expr {
 func identifier(p *Parser) Expr {
 	p.consume(Identifier)
 	ident := p.lex.GetString(p.prevToken)
-	return &ExprIdentifier{ident, p.prevToken}
+	return &ExprIdentifier{Identifier: ident, token: p.prevToken}
 }
 
 func array(p *Parser) Expr {
 	p.consume(LSquare)
 	openingToken := p.prevToken
 	items := make([]Expr, 0)
-	for p.token.Tag != RSquare {
+	for p.token.Tag != RSquare && !p.atEnd() {
 		items = append(items, p.expression())
 		if p.token.Tag != Comma {
 			break
 		}
 		p.consume(Comma)
 	}
-	p.consume(RSquare)
+	p.close(RSquare, openingToken)
 	return &ExprArray{items, openingToken}
 }
 
 func hashMap(p *Parser) Expr {
 	openingToken := p.consume(LCurly)
 	items := make([]ExprMapItem, 0)
-	for p.token.Tag != RCurly {
+	for p.token.Tag != RCurly && !p.atEnd() {
 		ident := p.consume(Identifier, Num, Str)
 		if p.token.Tag == Colon {
 			p.consume(Colon)
 			val := p.expression()
-			item := ExprMapItem{Key: p.lex.GetString(ident), Value: val}
+			item := ExprMapItem{Key: literalKey(ident, p.lex.GetString(ident)), Value: val}
 			items = append(items, item)
 		} else {
 			// shorthand
 			key := p.lex.GetString(ident)
 			item := ExprMapItem{
-				Key:   key,
-				Value: &ExprIdentifier{key, ident},
+				Key:   literalKey(ident, key),
+				Value: &ExprIdentifier{Identifier: key, token: ident},
 			}
 			items = append(items, item)
 		}
@@ -337,88 +522,229 @@ func hashMap(p *Parser) Expr {
 		}
 		p.consume(Comma)
 	}
-	p.consume(RCurly)
+	p.close(RCurly, openingToken)
 	return &ExprMap{items, openingToken}
 }
 
+// literalKey is the key a map literal's item has, { 1: x } is keyed on the
+// number 1 like m[1] is and { 1.5: x } on the float like m[1.5]
+func literalKey(tok Token, text string) MapKey {
+	if tok.Tag == Num {
+		if n, err := strconv.Atoi(text); err == nil {
+			return numKey(n)
+		}
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			if k, ok := floatKey(f); ok {
+				return k
+			}
+		}
+	}
+	return strKey(text)
+}
+
 func group(p *Parser) Expr {
-	p.consume(LParen)
+	openingToken := p.consume(LParen)
 	expr := p.expression()
-	p.consume(RParen)
+	p.close(RParen, openingToken)
 	return expr
 }
 
 func fn(p *Parser) Expr {
 	p.consume(Fn)
 	openingToken := p.prevToken
+	p.declarations++
 
-	ident := "<anonymous>"
+	ident := anonymousFn
 	if p.token.Tag == Identifier {
 		p.consume(Identifier)
 		ident = p.lex.GetString(p.prevToken)
 	}
 
-	p.consume(LParen)
+	paren := p.consume(LParen)
 
 	args := make([]string, 0)
-	for p.token.Tag != RParen {
+	defaults := make([]Expr, 0)
+	variadic := false
+	for p.token.Tag != RParen && !p.atEnd() {
 		p.consume(Identifier)
-		args = append(args, p.lex.GetString(p.prevToken))
+		arg := p.lex.GetString(p.prevToken)
+		args = append(args, arg)
+		var def Expr
+		if p.token.Tag == DotDot {
+			p.consume(DotDot)
+			if p.token.Tag != RParen {
+				panic(p.fmtError("only the last argument can collect the rest"))
+			}
+			variadic = true
+		} else if p.token.Tag == Equal {
+			p.consume(Equal)
+			def = p.expression()
+		} else if len(defaults) > 0 && defaults[len(defaults)-1] != nil {
+			panic(p.fmtError("%s needs a default, it comes after an argument with one", arg))
+		}
+		defaults = append(defaults, def)
 		if p.token.Tag != Comma {
 			break
 		}
 		p.consume(Comma)
 	}
 
-	p.consume(RParen)
+	p.close(RParen, paren)
 
+	// a loop around the function doesn't make break valid inside it
+	declarations := p.declarations
+	loops, matchExprs, caseExprs := p.loops, p.matchExprs, p.caseExprs
+	p.loops, p.matchExprs, p.caseExprs = 0, 0, 0
 	body := p.block()
+	p.loops, p.matchExprs, p.caseExprs = loops, matchExprs, caseExprs
 	return &ExprFunc{
 		Identifier:   ident,
 		Args:         args,
+		Defaults:     defaults,
+		Variadic:     variadic,
 		Body:         body,
 		openingToken: openingToken,
+		needsEnv:     len(args) > 0 || p.declarations > declarations,
 	}
 }
 
 func call(p *Parser, lhs Expr) Expr {
-	p.consume(LParen)
+	openingToken := p.consume(LParen)
 	args := make([]Expr, 0)
-	for p.token.Tag != RParen {
+	spread := false
+	for p.token.Tag != RParen && !p.atEnd() {
 		arg := p.expression()
 		args = append(args, arg)
+		if p.token.Tag == DotDot {
+			p.consume(DotDot)
+			if p.token.Tag != RParen {
+				panic(p.fmtError("only the last argument can be spread"))
+			}
+			spread = true
+		}
 		if p.token.Tag != Comma {
 			break
 		}
 		p.consume(Comma)
 	}
-	p.consume(RParen)
-	return &ExprFuncall{lhs, args, *lhs.Token()}
+	p.close(RParen, openingToken)
+	return &ExprFuncall{lhs, args, *lhs.Token(), spread}
+}
+
+// pipe turns x |> f into f(x) and x |> f(a) into f(x, a). The right side is
+// only a callee or a call, so x |> f == 1 compares f(x) with 1.
+func pipe(p *Parser, lhs Expr) Expr {
+	p.consume(PipeGreater)
+	rhs := p.expressionWithPrec(PrecCall)
+	if call, ok := rhs.(*ExprFuncall); ok {
+		call.Args = append([]Expr{lhs}, call.Args...)
+		return call
+	}
+	return &ExprFuncall{rhs, []Expr{lhs}, *rhs.Token(), false}
 }
 
 func subscript(p *Parser, lhs Expr) Expr {
 	opToken := p.token
 	p.consume(LSquare)
 	index := p.expression()
-	p.consume(RSquare)
+	p.close(RSquare, opToken)
 	return &ExprBinary{lhs, index, opToken}
 }
 
-func (p *Parser) Parse() Program {
+// parseExpression parses a single expression, all of lex's source
+func parseExpression(lex *Lexer) (expr Expr, err error) {
+	p := NewParser(lex)
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(Error)
+			if !ok {
+				panic(r)
+			}
+			expr, err = nil, e
+		}
+	}()
+
 	p.advance()
+	expr = p.expression()
+	if !p.atEnd() {
+		panic(p.fmtError("unexpected %s", p.token.Tag.String()))
+	}
+	return expr, nil
+}
+
+// Parse parses the whole program, panicking with the first error
+func (p *Parser) Parse() Program {
+	prog, errs := p.ParseErr()
+	if len(errs) > 0 {
+		panic(errs[0])
+	}
+	return prog
+}
+
+// ParseErr parses the whole program, returning errors rather than panicking.
+// It carries on past parse errors to report as many as it can, the program
+// is only usable if there are none. Errors from the lexer are reported as
+// parse errors.
+func (p *Parser) ParseErr() (prog Program, errs []Error) {
 	sections := make([]Stmt, 0)
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(Error)
+			if !ok {
+				panic(r)
+			}
+			p.recordError(e)
+			prog = Program{Stmts: sections}
+			errs = p.errors
+		}
+	}()
+
+	p.advance()
 	for !p.atEnd() {
-		switch p.token.Tag {
-		case Identifier:
-			section := p.section()
-			sections = append(sections, section)
-		case Fn:
-			fn := fn(p)
-			sections = append(sections, &StmtExpr{fn})
-		default:
-			// let consume panic
-			p.consume(Identifier, Fn)
+		if stmt := p.topLevelOrSync(); stmt != nil {
+			sections = append(sections, stmt)
+		}
+	}
+	prog = Program{Stmts: sections}
+	if len(p.errors) > 0 {
+		return prog, p.errors
+	}
+	if errs := resolve(&prog, p.lex); len(errs) > 0 {
+		return prog, errs
+	}
+	return prog, nil
+}
+
+// topLevelOrSync parses a section or function. If that fails it records the
+// error and skips to the next thing that looks like one, an identifier or fn
+// at the start of a line.
+func (p *Parser) topLevelOrSync() (stmt Stmt) {
+	start := p.token
+	defer func() {
+		if r := recover(); r != nil {
+			p.recordError(r)
+			if p.token == start {
+				p.advance()
+			}
+			for !p.atEnd() {
+				_, col := p.lex.GetLineAndCol(p.token)
+				if col == 0 && (p.token.Tag == Identifier || p.token.Tag == Fn) {
+					break
+				}
+				p.advance()
+			}
+			stmt = nil
 		}
+	}()
+
+	switch p.token.Tag {
+	case Identifier:
+		return p.section()
+	case Fn:
+		return &StmtExpr{fn(p)}
+	default:
+		// let consume panic
+		p.consume(Identifier, Fn)
 	}
-	return Program{sections}
+	return nil
 }
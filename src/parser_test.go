@@ -0,0 +1,132 @@
+package lang
+
+import "testing"
+
+func parseErrors(src string) []Error {
+	l := NewLexer(src)
+	p := NewParser(&l)
+	_, errs := p.ParseErr()
+	return errs
+}
+
+func TestParseReportsEveryError(t *testing.T) {
+	src := `part1: {
+  var x = )
+  return x
+}
+fn helper(a) {
+  return a +
+}
+part2: {
+  var y = 1
+  y = [1, 2
+  return y
+}`
+	errs := parseErrors(src)
+	expected := []struct {
+		line int
+		msg  string
+	}{
+		{2, "unexpected )"},
+		{7, "unexpected }"},
+		{11, "expected ] but saw return"},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors but got %d: %v", len(expected), len(errs), errs)
+	}
+	for i, e := range errs {
+		if e.Tag != ParseError || e.Line != expected[i].line || e.Msg != expected[i].msg {
+			t.Errorf("expected %q on line %d but got %s %q on line %d", expected[i].msg, expected[i].line, e.Tag, e.Msg, e.Line)
+		}
+	}
+}
+
+func TestParseSingleError(t *testing.T) {
+	errs := parseErrors(`part1: {
+  return 1 +
+}`)
+	if len(errs) != 1 || errs[0].Line != 3 || errs[0].Msg != "unexpected }" {
+		t.Fatalf("expected one error on line 3 but got %v", errs)
+	}
+}
+
+func TestParsePanicsWithFirstError(t *testing.T) {
+	defer func() {
+		e, ok := recover().(Error)
+		if !ok || e.Line != 2 || e.Msg != "unexpected )" {
+			t.Errorf("expected the first parse error, got %v", e)
+		}
+	}()
+	l := NewLexer("part1: {\n  var x = )\n  var y = )\n}")
+	p := NewParser(&l)
+	p.Parse()
+}
+
+func TestParseReportsLexErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		line int
+		col  int
+		msg  string
+	}{
+		{"!", 1, 0, "unexpected character '!' (21)"},
+		{"part1: {\n  var x = 1 ~ 2\n}", 2, 12, "unexpected character '~' (7e)"},
+		{"part1: {\n  return 'abc\n}", 2, 9, "unterminated string starting on line 2"},
+		{"fn f(a) {\n  return a\n}\n$", 4, 0, "unexpected character '$' (24)"},
+	}
+	for _, test := range tests {
+		errs := parseErrors(test.src)
+		if len(errs) == 0 {
+			t.Errorf("%q: expected an error", test.src)
+			continue
+		}
+		e := errs[0]
+		if e.Tag != ParseError || e.Line != test.line || e.Col != test.col || e.Msg != test.msg {
+			t.Errorf("%q: expected %q at %d:%d, got %s %q at %d:%d", test.src, test.msg, test.line, test.col, e.Tag, e.Msg, e.Line, e.Col)
+		}
+	}
+}
+
+func TestParseCarriesOnAfterLexErrors(t *testing.T) {
+	errs := parseErrors("part1: {\n  var x = 1 ~ 2\n  return x\n}\npart2: {\n  return @\n}")
+	if len(errs) != 2 || errs[0].Line != 2 || errs[1].Line != 6 {
+		t.Errorf("expected errors on lines 2 and 6, got %v", errs)
+	}
+}
+
+func TestUnclosedReportsOpener(t *testing.T) {
+	tests := []struct {
+		src  string
+		line int
+		msg  string
+	}{
+		{"part1: {\n  var x = 1\n\n  return x\n", 1, "unclosed { opened on line 1"},
+		{"part1: {\n  if 1 {\n    return 1\n  }\n  for i in [1] {\n    return 2\n}", 1, "unclosed { opened on line 1"},
+		{"part1: {\n  match 1 {\n    1: { return 1 }\n}", 1, "unclosed { opened on line 1"},
+		{"part1: {\n  return f(1,\n    2\n}", 2, "unclosed ( opened on line 2"},
+		{"part1: {\n  return [1, 2\n}", 2, "unclosed [ opened on line 2"},
+		{"part1: {\n  return (1 + 2]\n}", 2, "unclosed ( opened on line 2"},
+		{"part1: {\n  return { a: 1\n}", 1, "unclosed { opened on line 1"},
+		{"part1: {\n  return lines[0\n}", 2, "unclosed [ opened on line 2"},
+		{"fn f(a, b", 1, "unclosed ( opened on line 1"},
+	}
+	for _, test := range tests {
+		errs := parseErrors(test.src)
+		found := false
+		for _, e := range errs {
+			if e.Line == test.line && e.Msg == test.msg {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%q: expected %q on line %d, got %v", test.src, test.msg, test.line, errs)
+		}
+	}
+}
+
+func TestNumberTooBig(t *testing.T) {
+	errs := parseErrors("part1: {\n  return 99999999999999999999\n}")
+	if len(errs) != 1 || errs[0].Line != 2 || errs[0].Msg != "99999999999999999999 is too big to be a number" {
+		t.Errorf("expected the number to be too big, got %v", errs)
+	}
+}
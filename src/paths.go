@@ -0,0 +1,94 @@
+package lang
+
+import (
+	"fmt"
+)
+
+// nativeGetPath follows a path of indexes and keys into nested arrays and
+// maps, get_path(v, [0, 1]) is v[0][1]. A path that runs off the end of an
+// array or into a missing key gives nil rather than an error.
+func nativeGetPath(ev *Evaluator, args []Value) Value {
+	checkArity("get_path", args, 2, 2)
+	checkArg("get_path", args, 1, ValArray)
+	v := args[0]
+	for i, key := range *args[1].Array {
+		if v.Tag == ValNil || v.Tag == ValArray && key.Tag == ValNum && (key.Num < 0 || key.Num >= len(*v.Array)) {
+			return NilValue
+		}
+		next, err := v.getKey(key)
+		if err != nil {
+			panic(E(RuntimeError, fmt.Sprintf("get_path: path item %d: %s", i, err.Error()), 0))
+		}
+		v = next
+	}
+	return v
+}
+
+// nativeSetPath sets the value at the end of a path, changing the array or
+// map it's in like an assignment to v[0][1] would, and returns v
+func nativeSetPath(ev *Evaluator, args []Value) Value {
+	checkArity("set_path", args, 3, 3)
+	checkArg("set_path", args, 1, ValArray)
+	path := *args[1].Array
+	if len(path) == 0 {
+		panic(E(RuntimeError, "set_path: the path is empty", 0))
+	}
+
+	v := args[0]
+	for i, key := range path {
+		var err error
+		if i == len(path)-1 {
+			err = v.setKey(key, args[2])
+		} else {
+			v, err = v.getKey(key)
+		}
+		if err != nil {
+			panic(E(RuntimeError, fmt.Sprintf("set_path: path item %d: %s", i, err.Error()), 0))
+		}
+	}
+	return args[0]
+}
+
+// nativeWalk calls a function with every leaf of nested arrays and maps, and
+// the path to it: walk([1, [2]], f) calls f(1, [0]) then f(2, [1, 0]). Maps
+// are walked in key order.
+func nativeWalk(ev *Evaluator, args []Value) Value {
+	checkArity("walk", args, 2, 2)
+	fnVal := args[1]
+	if fnVal.Tag != ValFn && fnVal.Tag != ValNativeFn {
+		panic(E(RuntimeError, fmt.Sprintf("walk: argument 2 must be a fn, got %s", typeName(fnVal)), 0))
+	}
+	// calls to the function look like they come from the call to walk
+	call := ev.native
+
+	var visit func(v Value, path []Value)
+	visit = func(v Value, path []Value) {
+		switch v.Tag {
+		case ValArray:
+			for i, item := range *v.Array {
+				visit(item, append(path, Value{Tag: ValNum, Num: i}))
+			}
+			return
+		case ValMap:
+			for _, k := range v.mapKeys() {
+				visit((*v.Map)[k], append(path, k.Value()))
+			}
+			return
+		}
+
+		// each call gets its own path, the callback might keep it
+		leafPath := make([]Value, len(path))
+		copy(leafPath, path)
+		callArgs := []Value{v, {Tag: ValArray, Array: &leafPath}}
+		if fnVal.Tag == ValNativeFn {
+			prevNative := ev.native
+			ev.native = call
+			fnVal.NativeFn(ev, callArgs)
+			ev.native = prevNative
+		} else {
+			ev.fn(call, fnVal, callArgs)
+		}
+	}
+	visit(args[0], nil)
+	return NilValue
+}
@@ -1,52 +1,262 @@
 package lang
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"sort"
 	"time"
 )
 
-func (ev *Evaluator) PrintProfile() {
-  ev.printProfile(ev.prog, 0)
+// anything quicker than this is left out of the profile, it would only show
+// up as 0µs
+const profileThreshold = time.Microsecond
+
+// how many rows the table sorted by self time has
+const profileTopN = 10
+
+// profileStat is every event for one node added up
+type profileStat struct {
+  node  Node
+  calls int
+  total time.Duration
+  self  time.Duration
 }
 
-func (ev *Evaluator) printProfile(node Node, depth int) {
-  var duration time.Duration
+// PrintProfile writes the time spent in each part of the program to w, with
+// a header giving the total. It's a tree in program order followed by the
+// hottest nodes by self time, the time not spent in anything nested inside.
+func (ev *Evaluator) PrintProfile(w io.Writer) {
+  stats := make(map[Node]*profileStat)
+  var total time.Duration
   for _, evt := range ev.profileEvents {
-    if evt.node == node {
-      duration += evt.end.Sub(evt.start)
+    stat, ok := stats[evt.node]
+    if !ok {
+      stat = &profileStat{node: evt.node}
+      stats[evt.node] = stat
+    }
+    d := evt.duration()
+    stat.calls++
+    if !evt.recursive {
+      stat.total += d
+    }
+    stat.self += d - evt.children
+
+    switch evt.node.(type) {
+    case *Program, *StmtSection:
+      total += d
     }
   }
 
-  nextDepth := depth
-  if duration > 0 {
-    tok := node.Token()
-    line := 0
-    if tok != nil {
-      line, _ = ev.lex.GetLineAndCol(*node.Token())
+  fmt.Fprintf(w, "profile: %s total\n", fmtDuration(total))
+  fmt.Fprintf(w, "%10s %10s %8s\n", "total", "self", "calls")
+  ev.printProfile(w, stats, ev.prog, 0)
+
+  top := make([]*profileStat, 0, len(stats))
+  for _, stat := range stats {
+    if stat.self >= profileThreshold {
+      top = append(top, stat)
     }
-    fmt.Printf("%8dms %*s%s:%d\n", duration.Milliseconds(), depth * 2, "", node.Name(), line)
+  }
+  sort.Slice(top, func(i, j int) bool {
+    return top[i].self > top[j].self
+  })
+  if len(top) > profileTopN {
+    top = top[:profileTopN]
+  }
+
+  fmt.Fprintf(w, "\ntop %d by self time:\n", profileTopN)
+  fmt.Fprintf(w, "%10s %8s\n", "self", "calls")
+  for _, stat := range top {
+    fmt.Fprintf(w, "%10s %8d %s\n", fmtDuration(stat.self), stat.calls, ev.profileLabel(stat.node))
+  }
+}
+
+func (evt *profileEvent) duration() time.Duration {
+  // events that never ended, e.g. a call that raised an error, don't count
+  if evt.end.Before(evt.start) {
+    return 0
+  }
+  return evt.end.Sub(evt.start)
+}
+
+// fmtDuration prints milliseconds, or microseconds when it's under one
+func fmtDuration(d time.Duration) string {
+  if d < time.Millisecond {
+    return fmt.Sprintf("%dµs", d.Microseconds())
+  }
+  return fmt.Sprintf("%.2fms", float64(d) / float64(time.Millisecond))
+}
+
+func (ev *Evaluator) profileLabel(node Node) string {
+  line := 0
+  if tok := node.Token(); tok != nil {
+    line, _ = ev.lex.GetLineAndCol(*tok)
+  }
+  return fmt.Sprintf("%s:%d", node.Name(), line)
+}
+
+func (ev *Evaluator) printProfile(w io.Writer, stats map[Node]*profileStat, node Node, depth int) {
+  nextDepth := depth
+  if stat, ok := stats[node]; ok && stat.total >= profileThreshold {
+    fmt.Fprintf(w, "%10s %10s %8d %*s%s\n", fmtDuration(stat.total), fmtDuration(stat.self), stat.calls, depth * 2, "", ev.profileLabel(node))
     nextDepth++
   }
 
   switch n := node.(type) {
   case *Program:
     for _, stmt := range n.Stmts {
-      ev.printProfile(stmt, nextDepth)
+      ev.printProfile(w, stats, stmt, nextDepth)
     }
+  case *StmtSection:
+    ev.printProfile(w, stats, n.Body, nextDepth)
   case *StmtBlock:
     for _, stmt := range n.Body {
-      ev.printProfile(stmt, nextDepth)
+      ev.printProfile(w, stats, stmt, nextDepth)
     }
   case *StmtExpr:
-    ev.printProfile(n.Expr, nextDepth)
+    ev.printProfile(w, stats, n.Expr, nextDepth)
   case *StmtVar:
-    ev.printProfile(n.Value, nextDepth)
+    ev.printProfile(w, stats, n.Value, nextDepth)
+  case *StmtReturn:
+    ev.printProfile(w, stats, n.Value, nextDepth)
+  case *StmtIf:
+    ev.printProfile(w, stats, n.Condition, nextDepth)
+    ev.printProfile(w, stats, n.Body, nextDepth)
+    if n.ElseBody != nil {
+      ev.printProfile(w, stats, n.ElseBody, nextDepth)
+    }
+  case *StmtFor:
+    if n.Value != nil {
+      ev.printProfile(w, stats, n.Value, nextDepth)
+    }
+    ev.printProfile(w, stats, n.body, nextDepth)
   case *ExprFunc:
-    ev.printProfile(n.Body, nextDepth)
+    ev.printProfile(w, stats, n.Body, nextDepth)
+  case *ExprFuncall:
+    for _, arg := range n.Args {
+      ev.printProfile(w, stats, arg, nextDepth)
+    }
   case *ExprBinary:
-    ev.printProfile(n.Lhs, nextDepth)
-    ev.printProfile(n.Rhs, nextDepth)
+    ev.printProfile(w, stats, n.Lhs, nextDepth)
+    ev.printProfile(w, stats, n.Rhs, nextDepth)
   case *ExprUnary:
-    ev.printProfile(n.Lhs, nextDepth)
+    ev.printProfile(w, stats, n.Lhs, nextDepth)
+  }
+}
+
+// speedscope's file format, see
+// https://github.com/jlfwong/speedscope/wiki/Importing-from-custom-sources
+type speedscopeFile struct {
+  Schema             string              `json:"$schema"`
+  Shared             speedscopeShared    `json:"shared"`
+  Profiles           []speedscopeProfile `json:"profiles"`
+  Name               string              `json:"name"`
+  ActiveProfileIndex int                 `json:"activeProfileIndex"`
+  Exporter           string              `json:"exporter"`
+}
+
+type speedscopeShared struct {
+  Frames []speedscopeFrame `json:"frames"`
+}
+
+type speedscopeFrame struct {
+  Name string `json:"name"`
+  Line int    `json:"line,omitempty"`
+}
+
+type speedscopeProfile struct {
+  Type       string            `json:"type"`
+  Name       string            `json:"name"`
+  Unit       string            `json:"unit"`
+  StartValue int64             `json:"startValue"`
+  EndValue   int64             `json:"endValue"`
+  Events     []speedscopeEvent `json:"events"`
+}
+
+type speedscopeEvent struct {
+  Type  string `json:"type"` // O for open, C for close
+  Frame int    `json:"frame"`
+  At    int64  `json:"at"`
+}
+
+const speedscopeSchema = "https://www.speedscope.app/file-format-schema.json"
+
+// WriteProfile writes the profile to w in a format other tools can read.
+// Only "speedscope" is supported.
+func (ev *Evaluator) WriteProfile(w io.Writer, format string) error {
+  if format != "speedscope" {
+    return fmt.Errorf("unknown profile format %q, expected speedscope", format)
+  }
+
+  file := speedscopeFile{
+    Schema:   speedscopeSchema,
+    Name:     "aoc profile",
+    Exporter: "aoc",
   }
+  profile := speedscopeProfile{
+    Type:   "evented",
+    Name:   "aoc profile",
+    Unit:   "nanoseconds",
+    Events: make([]speedscopeEvent, 0, len(ev.profileEvents)*2),
+  }
+
+  frames := make(map[Node]int)
+  frame := func(node Node) int {
+    if i, ok := frames[node]; ok {
+      return i
+    }
+    line := 0
+    if tok := node.Token(); tok != nil {
+      line, _ = ev.lex.GetLineAndCol(*tok)
+    }
+    frames[node] = len(file.Shared.Frames)
+    file.Shared.Frames = append(file.Shared.Frames, speedscopeFrame{ev.profileLabel(node), line})
+    return frames[node]
+  }
+
+  var origin time.Time
+  if len(ev.profileEvents) > 0 {
+    origin = ev.profileEvents[0].start
+  }
+  // speedscope wants the events in order, a clock going backwards would
+  // upset it
+  var last int64
+  emit := func(typ string, evt *profileEvent, t time.Time) {
+    at := t.Sub(origin).Nanoseconds()
+    if at < last {
+      at = last
+    }
+    last = at
+    profile.Events = append(profile.Events, speedscopeEvent{typ, frame(evt.node), at})
+  }
+
+  // events are recorded as they start, so they're already in order. each
+  // one closes everything open at the same depth or deeper. events that
+  // never ended are left out, whatever ran inside them still nests properly.
+  open := make([]*profileEvent, 0)
+  closeTo := func(depth int) {
+    for len(open) > 0 && open[len(open)-1].depth >= depth {
+      evt := open[len(open)-1]
+      open = open[:len(open)-1]
+      emit("C", evt, evt.end)
+    }
+  }
+  for _, evt := range ev.profileEvents {
+    if evt.end.Before(evt.start) {
+      continue
+    }
+    closeTo(evt.depth)
+    emit("O", evt, evt.start)
+    open = append(open, evt)
+  }
+  closeTo(0)
+
+  if file.Shared.Frames == nil {
+    file.Shared.Frames = make([]speedscopeFrame, 0)
+  }
+  profile.EndValue = last
+  file.Profiles = []speedscopeProfile{profile}
+
+  return json.NewEncoder(w).Encode(file)
 }
@@ -0,0 +1,115 @@
+package lang
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"testing"
+)
+
+const profileSrc = `fn add(a, b) {
+  return a + b
+}
+part1: {
+  var total = 0
+  for i in range(0, 1000) {
+    total = add(total, i)
+  }
+  return total
+}`
+
+func profileSource(t *testing.T, src string) Evaluator {
+	t.Helper()
+	l := NewLexer(src)
+	p := NewParser(&l)
+	prog, errs := p.ParseErr()
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	ev := NewEvaluator(&prog, &l, true)
+	if _, err := ev.EvalSection("part1"); err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+func TestProfileCountsCalls(t *testing.T) {
+	ev := profileSource(t, profileSrc)
+
+	var out bytes.Buffer
+	ev.PrintProfile(&out)
+
+	// the tree and the table sorted by self time both list add
+	rows := regexp.MustCompile(`(?m)^.* 1000 +add:1$`).FindAllString(out.String(), -1)
+	if len(rows) != 2 {
+		t.Errorf("expected add to be listed twice with 1000 calls, got\n%s", out.String())
+	}
+}
+
+func TestWriteProfileSpeedscope(t *testing.T) {
+	ev := profileSource(t, profileSrc)
+
+	var out bytes.Buffer
+	if err := ev.WriteProfile(&out, "speedscope"); err != nil {
+		t.Fatal(err)
+	}
+
+	var file speedscopeFile
+	if err := json.Unmarshal(out.Bytes(), &file); err != nil {
+		t.Fatal(err)
+	}
+	if file.Schema != speedscopeSchema {
+		t.Errorf("unexpected schema %q", file.Schema)
+	}
+	if len(file.Profiles) != 1 || file.Profiles[0].Type != "evented" {
+		t.Fatalf("expected one evented profile, got %+v", file.Profiles)
+	}
+
+	names := make(map[string]bool)
+	for _, f := range file.Shared.Frames {
+		names[f.Name] = true
+	}
+	for _, name := range []string{"add:1", "part1:4"} {
+		if !names[name] {
+			t.Errorf("expected a frame named %s, got %+v", name, file.Shared.Frames)
+		}
+	}
+
+	// every close matches the innermost open, and time never goes backwards
+	profile := file.Profiles[0]
+	var open []int
+	var last int64
+	for _, evt := range profile.Events {
+		if evt.Frame < 0 || evt.Frame >= len(file.Shared.Frames) {
+			t.Fatalf("event refers to unknown frame %d", evt.Frame)
+		}
+		if evt.At < last {
+			t.Fatalf("event at %d is before the previous one at %d", evt.At, last)
+		}
+		last = evt.At
+		switch evt.Type {
+		case "O":
+			open = append(open, evt.Frame)
+		case "C":
+			if len(open) == 0 || open[len(open)-1] != evt.Frame {
+				t.Fatalf("close of frame %d doesn't match the open frames %v", evt.Frame, open)
+			}
+			open = open[:len(open)-1]
+		default:
+			t.Fatalf("unknown event type %q", evt.Type)
+		}
+	}
+	if len(open) > 0 {
+		t.Errorf("frames left open: %v", open)
+	}
+	if profile.EndValue != last {
+		t.Errorf("expected endValue %d, got %d", last, profile.EndValue)
+	}
+}
+
+func TestWriteProfileUnknownFormat(t *testing.T) {
+	ev := profileSource(t, profileSrc)
+	if err := ev.WriteProfile(&bytes.Buffer{}, "pprof"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
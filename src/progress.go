@@ -0,0 +1,129 @@
+package lang
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the progress bar is redrawn at most, and how wide it is
+const (
+	progressInterval = 100 * time.Millisecond
+	progressWidth    = 30
+)
+
+// progressBar is the line progress() draws, see WithProgress. pmap's workers
+// share their evaluator's.
+type progressBar struct {
+	mu      sync.Mutex
+	w       io.Writer
+	line    string // what's on screen, empty if nothing is
+	start   time.Time
+	drawn   time.Time
+	current int
+	first   int // current when start was
+}
+
+// update redraws the bar for current out of total, unless it was drawn less
+// than progressInterval ago. The ETA assumes the rest goes as fast as what's
+// been done since the first update. Once current gets to total the bar's
+// cleared away.
+func (p *progressBar) update(now time.Time, current, total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if current >= total {
+		p.reset()
+		return
+	}
+	// going backwards means a new loop
+	if p.start.IsZero() || current < p.current {
+		p.start, p.first = now, current
+	}
+	p.current = current
+	if now.Sub(p.drawn) < progressInterval {
+		return
+	}
+	p.drawn = now
+
+	// current can't be negative from progress(), but a bar with less than
+	// nothing done is drawn empty rather than panicking
+	filled := progressWidth * current / total
+	if filled < 0 {
+		filled = 0
+	}
+	line := fmt.Sprintf("[%s%s] %3d%% %d/%d", strings.Repeat("=", filled), strings.Repeat(" ", progressWidth-filled), 100*current/total, current, total)
+	if current > p.first {
+		elapsed := now.Sub(p.start)
+		eta := time.Duration(float64(elapsed) * float64(total-current) / float64(current-p.first))
+		if eta < time.Second {
+			eta = eta.Round(10 * time.Millisecond)
+		} else {
+			eta = eta.Round(time.Second)
+		}
+		line += " eta " + eta.String()
+	}
+	p.line = line
+	io.WriteString(p.w, "\r"+line+"\x1b[K")
+}
+
+// around runs write, which prints something, with the bar out of the way. The
+// bar is only drawn again if the output finished its line.
+func (p *progressBar) around(write func(), endsLine bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.line == "" {
+		write()
+		return
+	}
+	io.WriteString(p.w, "\r\x1b[K")
+	write()
+	if endsLine {
+		io.WriteString(p.w, "\r"+p.line+"\x1b[K")
+	} else {
+		p.line = ""
+	}
+}
+
+// finish clears the bar at the end of a section
+func (p *progressBar) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reset()
+}
+
+// reset clears the bar and starts the next one afresh
+func (p *progressBar) reset() {
+	if p.line != "" {
+		io.WriteString(p.w, "\r\x1b[K")
+	}
+	p.line, p.start, p.drawn, p.current, p.first = "", time.Time{}, time.Time{}, 0, 0
+}
+
+// write prints s to the evaluator's output, around the progress bar if there
+// is one
+func (ev *Evaluator) write(s string) {
+	if ev.progress == nil {
+		io.WriteString(ev.out, s)
+		return
+	}
+	ev.progress.around(func() { io.WriteString(ev.out, s) }, strings.HasSuffix(s, "\n"))
+}
+
+// nativeProgress shows how far through something long the program is, as a
+// bar with an ETA. It does nothing unless the evaluator has somewhere to draw
+// it, and it's cheap enough to call on every iteration of a loop.
+func nativeProgress(ev *Evaluator, args []Value) Value {
+	checkArgs("progress", args, ValNum, ValNum)
+	if args[1].Num <= 0 {
+		panic(E(RuntimeError, fmt.Sprintf("progress: the total must be more than 0, got %d", args[1].Num), 0))
+	}
+	if args[0].Num < 0 {
+		panic(E(RuntimeError, fmt.Sprintf("progress: the current count must be 0 or more, got %d", args[0].Num), 0))
+	}
+	if ev.progress != nil {
+		ev.progress.update(ev.clock(), args[0].Num, args[1].Num)
+	}
+	return NilValue
+}
@@ -0,0 +1,99 @@
+package lang
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// progressProgram counts to 10, each step taking 50ms by the clock
+const progressProgram = `part1: {
+  for i in range(0, 10) {
+    progress(i + 1, 10)
+  }
+}
+part2: {
+  progress(1, 4)
+  println('found one')
+  progress(2, 4)
+  print('no newline')
+  return 1
+}`
+
+func progressEvaluator(t *testing.T, w *bytes.Buffer, step time.Duration) *Evaluator {
+	t.Helper()
+	at := time.Date(2021, time.December, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		at = at.Add(step)
+		return at
+	}
+	return mustCompile(t, progressProgram).NewEvaluator(WithOutput(w), WithProgress(w), WithClock(clock))
+}
+
+func TestProgressIsThrottled(t *testing.T) {
+	var out bytes.Buffer
+	ev := progressEvaluator(t, &out, 50*time.Millisecond)
+	if _, err := ev.EvalSection("part1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first call and every other call after that, then it's cleared
+	draws := strings.Count(out.String(), "\x1b[K") - 1
+	if draws != 5 {
+		t.Errorf("expected 5 draws, got %d: %q", draws, out.String())
+	}
+	if !strings.Contains(out.String(), "[=========                     ]  30% 3/10 eta 350ms") {
+		t.Errorf("expected a bar with an eta, got %q", out.String())
+	}
+	if !strings.HasSuffix(out.String(), "90% 9/10 eta 50ms\x1b[K\r\x1b[K") {
+		t.Errorf("expected the bar to be cleared when it's done, got %q", out.String())
+	}
+}
+
+func TestProgressMovesForPrint(t *testing.T) {
+	var out bytes.Buffer
+	ev := progressEvaluator(t, &out, time.Second)
+	if _, err := ev.EvalSection("part2"); err != nil {
+		t.Fatal(err)
+	}
+
+	bar1 := "[=======                       ]  25% 1/4"
+	bar2 := "[===============               ]  50% 2/4 eta 2s"
+	expected := "\r" + bar1 + "\x1b[K" +
+		// cleared for the print and drawn again after it
+		"\r\x1b[K" + "found one\n" + "\r" + bar1 + "\x1b[K" +
+		"\r" + bar2 + "\x1b[K" +
+		// not drawn again after a print that didn't end its line
+		"\r\x1b[K" + "no newline"
+	if out.String() != expected {
+		t.Errorf("expected\n%q\ngot\n%q", expected, out.String())
+	}
+}
+
+func TestProgressWithoutBar(t *testing.T) {
+	src := `part1: {
+  progress(1, 2)
+  return 1
+}
+part2: {
+  progress(1, 0)
+}
+part3: {
+  progress(-1, 10)
+}`
+	if v, err := evalSource(t, src, "part1"); err != nil || v.Repr() != "1" {
+		t.Errorf("expected progress to do nothing, got %s, %v", v.Repr(), err)
+	}
+	expectError(t, src, "part2", RuntimeError, "progress: the total must be more than 0, got 0", 6)
+	expectError(t, src, "part3", RuntimeError, "progress: the current count must be 0 or more, got -1", 9)
+}
+
+func TestProgressNegativeCurrent(t *testing.T) {
+	var out bytes.Buffer
+	p := &progressBar{w: &out}
+	p.update(time.Date(2021, time.December, 1, 0, 0, 0, 0, time.UTC), -5, 10)
+	if !strings.Contains(out.String(), "[                              ] ") {
+		t.Errorf("expected an empty bar, got %q", out.String())
+	}
+}
@@ -0,0 +1,547 @@
+package lang
+
+import "fmt"
+
+// The resolver runs after parsing and works out where each local variable
+// lives at runtime, so the evaluator can index straight into an env's slots
+// instead of looking names up in maps.
+//
+// It has to push scopes in exactly the same places the evaluator pushes
+// envs, otherwise the depths it records will be wrong:
+//   - every StmtBlock evaluated with evalBlock, if anything's declared in it.
+//     Blocks that declare nothing, like most if bodies, get no env.
+//   - function calls, if the function needs an env at all
+//   - for loops, which hold the loop variables and the body's declarations.
+//     Loops whose bodies make functions get a new env every iteration.
+//   - match cases that bind names, which hold the bindings and the body's
+//     declarations. Cases whose body is one expression and that don't bind
+//     anything get no env.
+//   - catch blocks, which hold the error and the body's declarations
+//
+// Anything not found in a local scope is a global, looked up by name. That's
+// natives, top level functions and input/lines.
+//
+// It's also where declaring a var twice in the same scope is caught. Along
+// the way it notes what Lint warns about: vars and top level functions that
+// are never read, vars that shadow another variable, and statements after a
+// return, break or continue.
+
+// local is where a variable lives, depth envs up from the current one at
+// index slot. A depth of -1 means it's a global.
+type local struct {
+	depth int
+	slot  int
+}
+
+var globalVar = local{-1, -1}
+
+type scope struct {
+	parent *scope
+	names  map[string]int
+	slots  int
+	vars   map[string]*StmtVar // the var each name was last declared by
+	at     map[string]Node     // what declared each name, for errors
+
+	// transparent scopes don't exist at runtime, for functions that don't
+	// need an env and blocks that declare nothing
+	transparent bool
+}
+
+// a function body waiting to be resolved, along with the scope it was
+// declared in and the top level function it's part of, if any
+type pendingFn struct {
+	fn    *ExprFunc
+	scope *scope
+	top   *ExprFunc
+}
+
+type resolver struct {
+	lex     *Lexer
+	errs    []Error
+	scope   *scope
+	pending []pendingFn
+	fns     int // how many functions have been seen
+
+	top     *ExprFunc // the top level function being resolved
+	vars    []*StmtVar
+	read    map[*StmtVar]bool
+	globals map[string]bool // globals read from outside their own function
+	fnDecls map[string]Node // top level functions, which a var can shadow
+	notes   []lintNote
+}
+
+// inputGlobals are the globals ReadInput and Parse set. A var with one of
+// their names is noted as shadowing it.
+var inputGlobals = map[string]bool{"input": true, "lines": true, "nums_lines": true, "blocks": true, "parsed": true}
+
+func newResolver(s *scope, lex *Lexer) *resolver {
+	return &resolver{
+		lex:     lex,
+		scope:   s,
+		read:    make(map[*StmtVar]bool),
+		globals: make(map[string]bool),
+		fnDecls: make(map[string]Node),
+	}
+}
+
+// resolve resolves prog, returning an error for each var that's declared
+// again in the same scope
+func resolve(prog *Program, lex *Lexer) []Error {
+	r := newResolver(nil, lex)
+	for _, stmt := range prog.Stmts {
+		if s, ok := stmt.(*StmtExpr); ok {
+			if fn, ok := s.Expr.(*ExprFunc); ok && fn.Identifier != anonymousFn {
+				r.fnDecls[fn.Identifier] = fn
+			}
+		}
+	}
+	for _, stmt := range prog.Stmts {
+		r.stmt(stmt)
+		r.resolvePending()
+	}
+
+	// only now that every function body is resolved is everything read
+	for _, v := range r.vars {
+		if !r.read[v] {
+			r.note(v, "var %s is never used", v.Identifier)
+		}
+	}
+	for _, stmt := range prog.Stmts {
+		if s, ok := stmt.(*StmtExpr); ok {
+			fn, ok := s.Expr.(*ExprFunc)
+			if ok && fn.Identifier != anonymousFn && !r.globals[fn.Identifier] {
+				r.note(fn, "fn %s is never used", fn.Identifier)
+			}
+		}
+	}
+	prog.notes = r.notes
+	return r.errs
+}
+
+// line is the line node is on
+func (r *resolver) line(node Node) int {
+	line, _ := r.lex.GetLineAndCol(*node.Token())
+	return line
+}
+
+func (r *resolver) note(node Node, format string, args ...interface{}) {
+	r.notes = append(r.notes, lintNote{node, fmt.Sprintf(format, args...)})
+}
+
+// resolvePending resolves the function bodies found so far. They're left
+// until everything around them is resolved, so a function can refer to
+// variables declared after it, e.g. a helper calling a memo'd version of
+// itself.
+func (r *resolver) resolvePending() {
+	for len(r.pending) > 0 {
+		p := r.pending[0]
+		r.pending = r.pending[1:]
+
+		prev, prevTop := r.scope, r.top
+		r.scope, r.top = p.scope, p.top
+		r.fnBody(p.fn)
+		r.scope, r.top = prev, prevTop
+	}
+}
+
+func (r *resolver) push(transparent bool) *scope {
+	r.scope = &scope{
+		parent:      r.scope,
+		names:       make(map[string]int),
+		vars:        make(map[string]*StmtVar),
+		at:          make(map[string]Node),
+		transparent: transparent,
+	}
+	return r.scope
+}
+
+// pop leaves the current scope, returning how many slots it needs and the
+// name in each one
+func (r *resolver) pop() (int, []string) {
+	s := r.scope
+	names := make([]string, s.slots)
+	for name, slot := range s.names {
+		names[slot] = name
+	}
+	r.scope = s.parent
+	return s.slots, names
+}
+
+// declaring is the scope names are declared in, the innermost one that
+// exists at runtime. It's nil at the top level.
+func (r *resolver) declaring() *scope {
+	s := r.scope
+	for s != nil && s.transparent {
+		s = s.parent
+	}
+	return s
+}
+
+// declare gives name a slot in the current scope, or returns -1 at the top
+// level where everything is a global. at is what declared it.
+func (r *resolver) declare(name string, at Node) int {
+	s := r.declaring()
+	if s == nil {
+		return -1
+	}
+
+	if slot, present := s.names[name]; present {
+		return slot
+	}
+	slot := s.slots
+	s.names[name] = slot
+	s.at[name] = at
+	s.slots++
+	return slot
+}
+
+// lookup finds a variable that's being read
+func (r *resolver) lookup(name string) local {
+	l, s := r.find(name)
+	switch {
+	case s != nil && s.vars[name] != nil:
+		r.read[s.vars[name]] = true
+	case s == nil && (r.top == nil || r.top.Identifier != name):
+		// a function calling itself doesn't count
+		r.globals[name] = true
+	}
+	return l
+}
+
+// find finds a variable and the scope it's in, nil for a global
+func (r *resolver) find(name string) (local, *scope) {
+	depth := 0
+	for s := r.scope; s != nil; s = s.parent {
+		if s.transparent {
+			continue
+		}
+		if slot, present := s.names[name]; present {
+			return local{depth, slot}, s
+		}
+		depth++
+	}
+	return globalVar, nil
+}
+
+func (r *resolver) stmts(stmts []Stmt) {
+	unreachable := false
+	for i, stmt := range stmts {
+		r.stmt(stmt)
+		if unreachable || i == len(stmts)-1 {
+			continue
+		}
+		switch stmt.(type) {
+		case *StmtReturn:
+			r.note(stmts[i+1], "unreachable code after return")
+			unreachable = true
+		case *StmtBreak:
+			r.note(stmts[i+1], "unreachable code after break")
+			unreachable = true
+		case *StmtContinue:
+			r.note(stmts[i+1], "unreachable code after continue")
+			unreachable = true
+		}
+	}
+}
+
+func (r *resolver) block(stmt Stmt) {
+	b := stmt.(*StmtBlock)
+	b.noEnv = !declares(b.Body)
+	r.push(b.noEnv)
+	r.stmts(b.Body)
+	b.slots, b.names = r.pop()
+}
+
+// declares reports whether any of a block's statements declare a name in
+// the block's scope. That's a var, or a named function anywhere in an
+// expression that's resolved in the block's scope.
+func declares(stmts []Stmt) bool {
+	for _, stmt := range stmts {
+		switch node := stmt.(type) {
+		case *StmtVar:
+			return true
+		case *StmtExpr:
+			if namesFn(node.Expr) {
+				return true
+			}
+		case *StmtIf:
+			if namesFn(node.Condition) {
+				return true
+			}
+		case *StmtReturn:
+			if namesFn(node.Value) {
+				return true
+			}
+		case *StmtFor:
+			if namesFn(node.Value) {
+				return true
+			}
+		case *StmtMatch:
+			if matchNamesFn(node) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func namesFn(expr Expr) bool {
+	switch node := expr.(type) {
+	case *ExprArray:
+		for _, item := range node.Items {
+			if namesFn(item) {
+				return true
+			}
+		}
+	case *ExprMap:
+		for _, item := range node.Items {
+			if namesFn(item.Value) {
+				return true
+			}
+		}
+	case *ExprBinary:
+		return namesFn(node.Lhs) || namesFn(node.Rhs)
+	case *ExprUnary:
+		return namesFn(node.Lhs)
+	case *ExprFuncall:
+		if namesFn(node.Identifier) {
+			return true
+		}
+		for _, arg := range node.Args {
+			if namesFn(arg) {
+				return true
+			}
+		}
+	case *ExprMatch:
+		return matchNamesFn(node.Match)
+	case *ExprFunc:
+		return node.Identifier != anonymousFn
+	}
+	return false
+}
+
+// matchNamesFn is namesFn for the parts of a match resolved in the scope
+// around it, see matchCase
+func matchNamesFn(match *StmtMatch) bool {
+	if namesFn(match.Value) {
+		return true
+	}
+	for _, c := range match.Cases {
+		switch pattern := c.Cond.(type) {
+		case *ExprIdentifier:
+			// the case has a scope for the binding and everything in it
+		case *ExprArray:
+			if namesFn(pattern) {
+				return true
+			}
+		default:
+			body, ok := c.Body.(*StmtExpr)
+			if namesFn(pattern) || (ok && namesFn(body.Expr)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *resolver) stmt(stmt Stmt) {
+	switch node := stmt.(type) {
+	case *StmtExpr:
+		r.expr(node.Expr)
+	case *StmtBlock:
+		r.block(node)
+	case *StmtVar:
+		r.expr(node.Value)
+		r.checkVar(node)
+		node.slot = r.declare(node.Identifier, node)
+		if s := r.declaring(); s != nil {
+			s.vars[node.Identifier] = node
+			r.vars = append(r.vars, node)
+		}
+	case *StmtFor:
+		if node.Value != nil {
+			r.expr(node.Value)
+		}
+		r.push(false)
+		if node.Identifier != "" {
+			node.identSlot = r.declare(node.Identifier, node)
+		}
+		if node.IndexIdentifier != "" {
+			node.indexSlot = r.declare(node.IndexIdentifier, node)
+		}
+		fns := r.fns
+		r.stmts(node.body.(*StmtBlock).Body)
+		node.slots, node.names = r.pop()
+		node.captures = r.fns > fns
+	case *StmtIf:
+		r.expr(node.Condition)
+		r.block(node.Body)
+		if node.ElseBody != nil {
+			r.stmt(node.ElseBody)
+		}
+	case *StmtReturn:
+		r.expr(node.Value)
+	case *StmtMatch:
+		r.expr(node.Value)
+		for i := range node.Cases {
+			r.matchCase(&node.Cases[i])
+		}
+	case *StmtTry:
+		r.block(node.Body)
+		r.push(false)
+		node.identSlot = r.declare(node.Identifier, node)
+		r.stmts(node.CatchBody.(*StmtBlock).Body)
+		node.slots, node.names = r.pop()
+	case *StmtSection:
+		r.stmt(node.Body)
+	}
+}
+
+// checkVar is an error if v declares a name already declared in the same
+// scope, and notes it if it shadows a variable outside it. A loop, catch or
+// match binding shares its scope with the body, a var there reuses the name
+// and is only noted.
+func (r *resolver) checkVar(v *StmtVar) {
+	s := r.declaring()
+	if s == nil {
+		return
+	}
+	name := v.Identifier
+	if _, present := s.names[name]; present {
+		at := s.at[name]
+		if prev := s.vars[name]; prev != nil {
+			at = prev
+		} else if isBinding(at) {
+			r.note(v, "var %s shadows the one on line %d", name, r.line(at))
+			return
+		}
+		msg := fmt.Sprintf("%s already declared", name)
+		if at != nil {
+			msg += fmt.Sprintf(" on line %d", r.line(at))
+		}
+		r.errs = append(r.errs, r.lex.errorAt(ParseError, v.identifierToken, msg))
+		return
+	}
+
+	_, outer := r.find(name)
+	switch {
+	case outer != nil && outer.at[name] != nil:
+		r.note(v, "var %s shadows the one on line %d", name, r.line(outer.at[name]))
+	case outer != nil:
+		r.note(v, "var %s shadows another variable", name)
+	case r.fnDecls[name] != nil:
+		r.note(v, "var %s shadows fn %s on line %d", name, name, r.line(r.fnDecls[name]))
+	case inputGlobals[name]:
+		r.note(v, "var %s shadows the %s global", name, name)
+	}
+}
+
+// isBinding is whether a name was declared by a for loop, a catch or a match
+// pattern rather than a var or a parameter
+func isBinding(at Node) bool {
+	switch at.(type) {
+	case *StmtFor, *StmtTry, *ExprIdentifier:
+		return true
+	}
+	return false
+}
+
+func (r *resolver) matchCase(c *MatchCase) {
+	switch pattern := c.Cond.(type) {
+	case *ExprArray:
+		// identifiers bind, anything else is compared against
+		for _, item := range pattern.Items {
+			if _, ok := item.(*ExprIdentifier); !ok {
+				r.expr(item)
+			}
+		}
+		r.push(false)
+		for _, item := range pattern.Items {
+			if ident, ok := item.(*ExprIdentifier); ok {
+				ident.local = local{0, r.declare(ident.Identifier, ident)}
+			}
+		}
+		r.caseBody(c.Body)
+		c.slots, c.names = r.pop()
+	case *ExprIdentifier:
+		r.push(false)
+		pattern.local = local{0, r.declare(pattern.Identifier, pattern)}
+		r.caseBody(c.Body)
+		c.slots, c.names = r.pop()
+	default:
+		r.expr(pattern)
+		if body, ok := c.Body.(*StmtExpr); ok {
+			r.expr(body.Expr)
+		} else {
+			r.block(c.Body)
+		}
+	}
+}
+
+// caseBody resolves the body of a case in the scope holding its bindings
+func (r *resolver) caseBody(body Stmt) {
+	if b, ok := body.(*StmtBlock); ok {
+		r.stmts(b.Body)
+	} else {
+		r.stmt(body)
+	}
+}
+
+func (r *resolver) fnBody(fn *ExprFunc) {
+	r.push(!fn.needsEnv)
+	for _, arg := range fn.Args {
+		r.declare(arg, fn)
+	}
+	// defaults are evaluated in the function's env, so they can use the
+	// args before them
+	for _, def := range fn.Defaults {
+		if def != nil {
+			r.expr(def)
+		}
+	}
+	r.stmts(fn.Body.(*StmtBlock).Body)
+	fn.slots, fn.names = r.pop()
+}
+
+func (r *resolver) expr(expr Expr) {
+	switch node := expr.(type) {
+	case *ExprIdentifier:
+		node.local = r.lookup(node.Identifier)
+	case *ExprArray:
+		for _, item := range node.Items {
+			r.expr(item)
+		}
+	case *ExprMap:
+		for _, item := range node.Items {
+			r.expr(item.Value)
+		}
+	case *ExprBinary:
+		// assigning to a variable isn't reading it
+		if ident, ok := node.Lhs.(*ExprIdentifier); ok && node.Op.Tag == Equal {
+			ident.local, _ = r.find(ident.Identifier)
+		} else {
+			r.expr(node.Lhs)
+		}
+		r.expr(node.Rhs)
+	case *ExprUnary:
+		r.expr(node.Lhs)
+	case *ExprFuncall:
+		r.expr(node.Identifier)
+		for _, arg := range node.Args {
+			r.expr(arg)
+		}
+	case *ExprMatch:
+		r.stmt(node.Match)
+	case *ExprFunc:
+		r.fns++
+		node.slot = -1
+		if node.Identifier != anonymousFn {
+			node.slot = r.declare(node.Identifier, node)
+		}
+		top := r.top
+		if r.scope == nil {
+			top = node
+		}
+		r.pending = append(r.pending, pendingFn{node, r.scope, top})
+	}
+}
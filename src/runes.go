@@ -0,0 +1,122 @@
+package lang
+
+import (
+	"sync"
+	"unicode/utf8"
+)
+
+// Strings are indexed and measured in runes, not bytes, so 'é'[0] is 'é'.
+//
+// Finding a rune by index means walking the string. That's cheap for short
+// strings, longer ones have where each rune starts cached so a loop indexing
+// the same string over and over doesn't walk it every time.
+//
+// A rune comes back as a slice of the string it's from, so indexing doesn't
+// allocate. Runes that aren't sliced out of a string, like the cells of
+// parse_grid, come from char, which has every ASCII character made already.
+
+// strings at least this long are cached
+const runeCacheMin = 64
+
+type runeEntry struct {
+	s      string
+	starts []int32 // where each rune starts, nil if s is all ASCII
+}
+
+// runeCache holds the last few long strings looked at. It's shared by pmap's
+// workers so it has a lock.
+var runeCache struct {
+	sync.Mutex
+	entries [4]runeEntry
+	next    int
+}
+
+// cachedRunes returns where each rune of a long string starts, or nil if
+// it's all ASCII
+func cachedRunes(s string) []int32 {
+	runeCache.Lock()
+	defer runeCache.Unlock()
+	for _, e := range runeCache.entries {
+		// comparing strings that share their bytes is quick, that's the
+		// usual case of indexing the same value in a loop
+		if len(e.s) == len(s) && e.s == s {
+			return e.starts
+		}
+	}
+	e := runeEntry{s: s}
+	if !isASCII(s) {
+		e.starts = make([]int32, 0, utf8.RuneCountInString(s))
+		for pos := range s {
+			e.starts = append(e.starts, int32(pos))
+		}
+	}
+	runeCache.entries[runeCache.next] = e
+	runeCache.next = (runeCache.next + 1) % len(runeCache.entries)
+	return e.starts
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// runeAt returns the index'th rune of s as a string, or false if s doesn't
+// have that many
+func runeAt(s string, index int) (string, bool) {
+	if index < 0 || index >= len(s) {
+		// a string has at most as many runes as bytes
+		return "", false
+	}
+	if len(s) >= runeCacheMin {
+		starts := cachedRunes(s)
+		switch {
+		case starts == nil:
+			return s[index : index+1], true
+		case index < len(starts)-1:
+			return s[starts[index]:starts[index+1]], true
+		case index == len(starts)-1:
+			return s[starts[index]:], true
+		}
+		return "", false
+	}
+	i := 0
+	for pos, r := range s {
+		if i == index {
+			// a slice of s rather than a new string where possible
+			return s[pos : pos+utf8.RuneLen(r)], true
+		}
+		i++
+	}
+	return "", false
+}
+
+// runeLen is how many runes s has
+func runeLen(s string) int {
+	if len(s) >= runeCacheMin {
+		if starts := cachedRunes(s); starts != nil {
+			return len(starts)
+		}
+		return len(s)
+	}
+	return utf8.RuneCountInString(s)
+}
+
+// asciiChars is every ASCII character, char slices it rather than making a
+// new string for each one
+const asciiChars = "\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f" +
+	"\x10\x11\x12\x13\x14\x15\x16\x17\x18\x19\x1a\x1b\x1c\x1d\x1e\x1f" +
+	" !\"#$%&'()*+,-./0123456789:;<=>?" +
+	"@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_" +
+	"`abcdefghijklmnopqrstuvwxyz{|}~\x7f"
+
+// char returns r as a string, without allocating if it's ASCII
+func char(r rune) string {
+	if r >= 0 && r < utf8.RuneSelf {
+		return asciiChars[r : r+1]
+	}
+	return string(r)
+}
@@ -1,130 +1,558 @@
 package lang
 
 import (
+	"container/heap"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
 )
 
-func checkArgs(args []Value, tags ...ValueTag) {
-	if len(args) != len(tags) {
-		panic(E(RuntimeError, "arity mismatch", 0))
+// checkArity raises an error unless a native was called with between min and
+// max arguments
+func checkArity(fn string, args []Value, min, max int) {
+	if len(args) >= min && len(args) <= max {
+		return
 	}
+	var expected string
+	switch {
+	case max == 0:
+		expected = "no arguments"
+	case min == max && min == 1:
+		expected = "1 argument"
+	case min == max:
+		expected = fmt.Sprintf("%d arguments", min)
+	case max == min+1:
+		expected = fmt.Sprintf("%d or %d arguments", min, max)
+	default:
+		expected = fmt.Sprintf("%d to %d arguments", min, max)
+	}
+	panic(E(RuntimeError, fmt.Sprintf("%s: expected %s, got %d", fn, expected, len(args)), 0))
+}
 
+// checkArgs raises an error unless a native was called with exactly the
+// arguments in tags
+func checkArgs(fn string, args []Value, tags ...ValueTag) {
+	checkArity(fn, args, len(tags), len(tags))
 	for index, tag := range tags {
-		if args[index].Tag != tag {
-			msg := fmt.Sprintf("arg type mismatch: expected %s got %s", tag.String(), args[index].Tag.String())
-			panic(E(RuntimeError, msg, 0))
-		}
+		checkArg(fn, args, index, tag)
 	}
 }
 
-func nativePrint(args []Value) Value {
-	for idx, arg := range args {
-		if idx > 0 {
-			fmt.Print(" " + arg.String())
-		} else {
-			fmt.Print(arg.String())
-		}
+// checkArg raises an error unless the argument at index is a tag
+func checkArg(fn string, args []Value, index int, tag ValueTag) {
+	if args[index].Tag != tag {
+		msg := fmt.Sprintf("%s: argument %d must be %s, got %s", fn, index+1, withArticle(tag.String()), typeName(args[index]))
+		panic(E(RuntimeError, msg, 0))
+	}
+}
+
+// typeName is what error messages call a value's type, the same name type()
+// gives it
+func typeName(v Value) string {
+	if v.Tag == ValFn || v.Tag == ValNativeFn {
+		return "fn"
 	}
+	return v.Tag.String()
+}
+
+func withArticle(noun string) string {
+	if strings.ContainsRune("aeiou", rune(noun[0])) {
+		return "an " + noun
+	}
+	return "a " + noun
+}
+
+func nativePrint(ev *Evaluator, args []Value) Value {
+	ev.write(printed(args))
 	return NilValue
 }
 
-func nativePrintLn(args []Value) Value {
-	v := nativePrint(args)
-	fmt.Println()
-	return v
+func nativePrintLn(ev *Evaluator, args []Value) Value {
+	ev.write(printed(args) + "\n")
+	return NilValue
+}
+
+// printed is what print shows for its arguments, separated by spaces
+func printed(args []Value) string {
+	var b strings.Builder
+	for idx, arg := range args {
+		if idx > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(arg.String())
+	}
+	return b.String()
 }
 
-func nativeNum(args []Value) Value {
+func nativeNum(ev *Evaluator, args []Value) Value {
 	base := 10
-	if len(args) == 1 {
-		checkArgs(args, ValStr)
-	} else {
-		checkArgs(args, ValStr, ValNum)
-		base = *args[1].Num
+	checkArity("num", args, 1, 2)
+	// numbers and nil pass straight through
+	if args[0].isNumber() || args[0].Tag == ValNil {
+		return args[0]
+	}
+	if args[0].Tag != ValStr {
+		msg := fmt.Sprintf("num: argument 1 must be a string or a number, got %s", args[0].Tag.String())
+		panic(E(RuntimeError, msg, 0))
+	}
+	if len(args) == 2 {
+		checkArg("num", args, 1, ValNum)
+		base = args[1].Num
 	}
-	i64, err := strconv.ParseInt(*args[0].Str, base, 0)
+	i64, err := strconv.ParseInt(args[0].Str, base, 0)
 	if err != nil {
+		// decimals are only read in base 10
+		if base == 10 && strings.ContainsRune(args[0].Str, '.') {
+			if f, err := strconv.ParseFloat(args[0].Str, 64); err == nil {
+				return Value{Tag: ValFloat, Float: f}
+			}
+		}
 		return NilValue
 	}
 	i := int(i64)
-	return Value{Tag: ValNum, Num: &i}
+	return Value{Tag: ValNum, Num: i}
+}
+
+// checkNumber raises an error unless the argument at index is an integer or
+// a float
+func checkNumber(fn string, args []Value, index int) {
+	if !args[index].isNumber() {
+		msg := fmt.Sprintf("%s: argument %d must be a number, got %s", fn, index+1, typeName(args[index]))
+		panic(E(RuntimeError, msg, 0))
+	}
+}
+
+// rounding makes floor, ceil and round, which turn a float into an integer
+// and leave integers as they are. A float too big for an integer is an
+// overflow rather than whatever the conversion happens to give.
+func rounding(name string, f func(float64) float64) func(*Evaluator, []Value) Value {
+	return func(ev *Evaluator, args []Value) Value {
+		checkArity(name, args, 1, 1)
+		checkNumber(name, args, 0)
+		if args[0].Tag == ValNum {
+			return args[0]
+		}
+		r := f(args[0].Float)
+		if math.IsNaN(r) {
+			panic(E(RuntimeError, name+": cannot turn NaN into an integer", 0))
+		}
+		// -2^63 is exact as a float, 2^63 is the first one past the top
+		if r < math.MinInt64 || r >= -math.MinInt64 {
+			panic(E(RuntimeError, name+": integer overflow", 0))
+		}
+		return Value{Tag: ValNum, Num: int(r)}
+	}
+}
+
+var (
+	nativeFloor = rounding("floor", math.Floor)
+	nativeCeil  = rounding("ceil", math.Ceil)
+	nativeRound = rounding("round", math.Round)
+)
+
+// intArgs is the integers a native like gcd was called with, either as
+// separate arguments or as a single array
+func intArgs(fn string, args []Value) []Value {
+	if len(args) == 1 && args[0].Tag == ValArray {
+		items := *args[0].Array
+		if len(items) == 0 {
+			panic(E(RuntimeError, fn+": expected at least 1 number, got an empty array", 0))
+		}
+		for i, item := range items {
+			if item.Tag != ValNum {
+				msg := fmt.Sprintf("%s: item %d must be a number, got %s", fn, i, item.Tag.String())
+				panic(E(RuntimeError, msg, 0))
+			}
+		}
+		return items
+	}
+	checkArity(fn, args, 2, 2)
+	checkArg(fn, args, 0, ValNum)
+	checkArg(fn, args, 1, ValNum)
+	return args
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+// nativeGcd is the greatest common divisor of two numbers or an array of
+// them, it's never negative
+func nativeGcd(ev *Evaluator, args []Value) Value {
+	items := intArgs("gcd", args)
+	result := 0
+	for _, item := range items {
+		result = gcd(result, item.Num)
+	}
+	return Value{Tag: ValNum, Num: result}
+}
+
+// nativeLcm is the least common multiple of two numbers or an array of them.
+// Dividing by the gcd first keeps it from overflowing before it has to.
+func nativeLcm(ev *Evaluator, args []Value) Value {
+	items := intArgs("lcm", args)
+	result := 1
+	for _, item := range items {
+		if item.Num == 0 {
+			return Value{Tag: ValNum, Num: 0}
+		}
+		n, ok := mulInts(result/gcd(result, item.Num), item.Num)
+		if !ok {
+			panic(E(RuntimeError, "lcm: integer overflow", 0))
+		}
+		result = n
+	}
+	if result < 0 {
+		result = -result
+	}
+	return Value{Tag: ValNum, Num: result}
+}
+
+// nativeDivmod returns [quotient, remainder] using Euclidean division, the
+// remainder is never negative: divmod(-7, 3) is [-3, 2] where -7 / 3 and
+// -7 % 3 are -2 and -1
+func nativeDivmod(ev *Evaluator, args []Value) Value {
+	checkArgs("divmod", args, ValNum, ValNum)
+	a, b := args[0].Num, args[1].Num
+	if b == 0 {
+		panic(E(RuntimeError, "divmod: division by zero", 0))
+	}
+	if a == math.MinInt && b == -1 {
+		panic(E(RuntimeError, "divmod: integer overflow", 0))
+	}
+	q, r := a/b, a%b
+	if r < 0 {
+		if b > 0 {
+			q, r = q-1, r+b
+		} else {
+			q, r = q+1, r-b
+		}
+	}
+	result := []Value{{Tag: ValNum, Num: q}, {Tag: ValNum, Num: r}}
+	return Value{Tag: ValArray, Array: &result}
+}
+
+// checkRange raises an error unless a native like clamp was called with x, lo
+// and hi where lo <= hi
+func checkRange(fn string, args []Value) {
+	checkArity(fn, args, 3, 3)
+	for i := range args {
+		checkNumber(fn, args, i)
+	}
+	if c, _ := compareOrder(args[1], args[2]); c > 0 {
+		msg := fmt.Sprintf("%s: lo must not be greater than hi, got %s and %s", fn, args[1].String(), args[2].String())
+		panic(E(RuntimeError, msg, 0))
+	}
+}
+
+// nativeClamp is x limited to lo to hi inclusive
+func nativeClamp(ev *Evaluator, args []Value) Value {
+	checkRange("clamp", args)
+	x, lo, hi := args[0], args[1], args[2]
+	if c, _ := compareOrder(x, lo); c < 0 {
+		return lo
+	}
+	if c, _ := compareOrder(x, hi); c > 0 {
+		return hi
+	}
+	return x
+}
+
+// nativeBetween is 1 if x is in lo to hi inclusive
+func nativeBetween(ev *Evaluator, args []Value) Value {
+	checkRange("between", args)
+	lo, _ := compareOrder(args[0], args[1])
+	hi, _ := compareOrder(args[0], args[2])
+	between := 0
+	if lo >= 0 && hi <= 0 {
+		between = 1
+	}
+	return Value{Tag: ValNum, Num: between}
+}
+
+// nativeManhattan is the distance between two points moving only along the
+// axes, given as x1, y1, x2, y2 or as two [x, y] arrays
+func nativeManhattan(ev *Evaluator, args []Value) Value {
+	if len(args) != 2 && len(args) != 4 {
+		panic(E(RuntimeError, fmt.Sprintf("manhattan: expected 2 or 4 arguments, got %d", len(args)), 0))
+	}
+	if len(args) == 2 {
+		checkArgs("manhattan", args, ValArray, ValArray)
+		var coords []Value
+		for i, arg := range args {
+			point := *arg.Array
+			if len(point) != 2 || point[0].Tag != ValNum || point[1].Tag != ValNum {
+				msg := fmt.Sprintf("manhattan: argument %d must be an [x, y] pair of numbers, got %s", i+1, arg.Repr())
+				panic(E(RuntimeError, msg, 0))
+			}
+			coords = append(coords, point...)
+		}
+		args = coords
+	} else {
+		checkArgs("manhattan", args, ValNum, ValNum, ValNum, ValNum)
+	}
+	dx := args[0].Num - args[2].Num
+	dy := args[1].Num - args[3].Num
+	if dx < 0 {
+		dx = -dx
+	}
+	if dy < 0 {
+		dy = -dy
+	}
+	return Value{Tag: ValNum, Num: dx + dy}
+}
+
+// nativeType returns the name of a value's type
+func nativeType(ev *Evaluator, args []Value) Value {
+	checkArity("type", args, 1, 1)
+	return Value{Tag: ValStr, Str: typeName(args[0])}
+}
+
+func nativeStr(ev *Evaluator, args []Value) Value {
+	checkArity("str", args, 1, 1)
+	return Value{Tag: ValStr, Str: args[0].String()}
 }
 
-func nativeRead(args []Value) Value {
-	checkArgs(args, ValStr)
-	f, err := os.ReadFile(*args[0].Str)
+func nativeRead(ev *Evaluator, args []Value) Value {
+	checkArgs("read", args, ValStr)
+	ev.filesRead = append(ev.filesRead, args[0].Str)
+	f, err := os.ReadFile(args[0].Str)
 	if err != nil {
-		panic(err)
+		panic(E(RuntimeError, "read: "+err.Error(), 0))
 	}
 	s := string(f)
-	return Value{Tag: ValStr, Str: &s}
+	return Value{Tag: ValStr, Str: s}
 }
 
-func nativeSplit(args []Value) Value {
-	checkArgs(args, ValStr, ValStr)
-	sp := strings.Split(*args[0].Str, *args[1].Str)
-	arr := make([]Value, 0)
+// nativeEnv returns an environment variable, or nil if it isn't set
+func nativeEnv(ev *Evaluator, args []Value) Value {
+	checkArgs("env", args, ValStr)
+	if s, ok := os.LookupEnv(args[0].Str); ok {
+		return Value{Tag: ValStr, Str: s}
+	}
+	return NilValue
+}
+
+// stdinOnce is the evaluator's stdin, read all at once the first time it's
+// asked for
+type stdinOnce struct {
+	once sync.Once
+	r    io.Reader
+	s    string
+	err  error
+}
+
+func (in *stdinOnce) read() (string, error) {
+	in.once.Do(func() {
+		b, err := io.ReadAll(in.r)
+		in.s, in.err = string(b), err
+	})
+	return in.s, in.err
+}
+
+// nativeStdin reads all of stdin the first time it's called, later calls
+// return the same string rather than blocking on an empty stdin
+func nativeStdin(ev *Evaluator, args []Value) Value {
+	checkArity("stdin", args, 0, 0)
+	s, err := ev.stdin.read()
+	if err != nil {
+		panic(E(RuntimeError, "stdin: "+err.Error(), 0))
+	}
+	return Value{Tag: ValStr, Str: s}
+}
+
+func nativeSplit(ev *Evaluator, args []Value) Value {
+	checkArgs("split", args, ValStr, ValStr)
+	sp := strings.Split(args[0].Str, args[1].Str)
+	arr := make([]Value, 0, len(sp))
 	for _, s := range sp {
-		p := s
-		arr = append(arr, Value{Tag: ValStr, Str: &p})
+		arr = append(arr, Value{Tag: ValStr, Str: s})
 	}
 	return Value{Tag: ValArray, Array: &arr}
 }
 
-func nativeLen(args []Value) Value {
+func nativeLen(ev *Evaluator, args []Value) Value {
+	checkArity("len", args, 1, 1)
 	l := 0
 	switch args[0].Tag {
 	case ValArray:
 		l = len(*args[0].Array)
 	case ValStr:
-		l = len(*args[0].Str)
+		l = runeLen(args[0].Str)
+	case ValMap:
+		l = len(*args[0].Map)
+	case ValSet:
+		l = len(*args[0].set())
+	case ValHeap:
+		l = len(*args[0].heap())
+	case ValQueue:
+		l = args[0].queue().len()
+	case ValRange:
+		l = args[0].Range.len()
+	case ValBuffer:
+		l = runeLen(args[0].buffer().String())
+	case ValNil:
+		// a missing map key has nothing in it
+	default:
+		panic(E(RuntimeError, fmt.Sprintf("len: %s has no length", withArticle(args[0].Tag.String())), 0))
 	}
-	return Value{Tag: ValNum, Num: &l}
+	return Value{Tag: ValNum, Num: l}
 }
 
-func nativePush(args []Value) Value {
-	if len(args) < 2 {
-		panic("arg count mismatch")
+// nativeNums returns every integer in a string, a - directly before digits
+// makes it negative: nums('x=-3..5, y=12') is [-3, 5, 12]. A - straight after
+// a digit or letter is a hyphen, so nums('2-4,6-8') is [2, 4, 6, 8].
+func nativeNums(ev *Evaluator, args []Value) Value {
+	checkArgs("nums", args, ValStr)
+	nums := extractNums(args[0].Str)
+	return Value{Tag: ValArray, Array: &nums}
+}
+
+func extractNums(s string) []Value {
+	nums := make([]Value, 0)
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			continue
+		}
+		start := i
+		if start > 0 && s[start-1] == '-' && !afterWord(s[:start-1]) {
+			start--
+		}
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		n, err := strconv.Atoi(s[start:i])
+		if err != nil {
+			panic(E(RuntimeError, fmt.Sprintf("nums: %s is too big", s[start:i]), 0))
+		}
+		nums = append(nums, Value{Tag: ValNum, Num: n})
 	}
+	return nums
+}
+
+// afterWord is whether s ends in a digit or letter
+func afterWord(s string) bool {
+	r, _ := utf8.DecodeLastRuneInString(s)
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// nativeParagraphs splits a string on blank lines, into an array of each
+// paragraph's lines
+func nativeParagraphs(ev *Evaluator, args []Value) Value {
+	checkArgs("paragraphs", args, ValStr)
+	return paragraphs(args[0].Str)
+}
 
-	if args[0].Tag != ValArray {
-		panic("can only push to an array")
+// paragraphs splits s into arrays of lines, on runs of blank or whitespace
+// only lines. Blank lines at either end don't make empty paragraphs.
+func paragraphs(s string) Value {
+	blocks := make([]Value, 0)
+	var block []Value
+	end := func() {
+		if len(block) > 0 {
+			lines := block
+			blocks = append(blocks, Value{Tag: ValArray, Array: &lines})
+			block = nil
+		}
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n") {
+		if strings.TrimSpace(line) == "" {
+			end()
+			continue
+		}
+		block = append(block, Value{Tag: ValStr, Str: line})
 	}
+	end()
+	return Value{Tag: ValArray, Array: &blocks}
+}
+
+func nativePush(ev *Evaluator, args []Value) Value {
+	checkArity("push", args, 2, 2)
+	checkArg("push", args, 0, ValArray)
 
 	array := *args[0].Array
 	array = append(array, args[1])
 	return Value{Tag: ValArray, Array: &array}
 }
 
-func nativeSlice(args []Value) Value {
-	checkArgs(args, ValArray, ValNum, ValNum)
+func nativeSlice(ev *Evaluator, args []Value) Value {
+	checkArgs("slice", args, ValArray, ValNum, ValNum)
 	array := *args[0].Array
-	from := *args[1].Num
-	to := *args[2].Num
+	from := args[1].Num
+	to := args[2].Num
 
-	if from < 0 || from > len(array)-1 || to < 0 || to > len(array)-1 {
-		panic(E(RuntimeError, "invalid index", 0))
+	if from < 0 || to > len(array) || from > to {
+		panic(E(RuntimeError, "slice: invalid index", 0))
 	}
-	slice := array[from:to]
+	// capped so pushing onto the slice can't overwrite the rest of array
+	slice := array[from:to:to]
 	return Value{Tag: ValArray, Array: &slice}
 }
 
-func nativeDelete(args []Value) Value {
-	checkArgs(args, ValArray, ValNum)
+func nativeDelete(ev *Evaluator, args []Value) Value {
+	checkArgs("delete", args, ValArray, ValNum)
 	array := *args[0].Array
-	index := *args[1].Num
-	newArray := append(array[:index], array[index+1:]...)
+	index := args[1].Num
+	if index < 0 || index >= len(array) {
+		panic(E(RuntimeError, fmt.Sprintf("delete: index %d out of range", index), 0))
+	}
+	newArray := make([]Value, 0, len(array)-1)
+	newArray = append(newArray, array[:index]...)
+	newArray = append(newArray, array[index+1:]...)
 	return Value{Tag: ValArray, Array: &newArray}
 }
 
-func nativeRange(args []Value) Value {
-	checkArgs(args, ValNum, ValNum)
-	from := *args[0].Num
-	to := *args[1].Num
+// nativeMapIncr adds to the number at a key in a map, 1 by default, and
+// returns the new number. A missing key counts as 0. It's
+// counts[k] = counts[k] + n with one lookup of the key rather than two.
+func nativeMapIncr(ev *Evaluator, args []Value) Value {
+	checkArity("map_incr", args, 2, 3)
+	checkArg("map_incr", args, 0, ValMap)
+	delta := Value{Tag: ValNum, Num: 1}
+	if len(args) == 3 {
+		delta = args[2]
+		if !delta.isNumber() {
+			panic(E(RuntimeError, fmt.Sprintf("map_incr: argument 3 must be a number, got %s", delta.Tag.String()), 0))
+		}
+	}
+	key, ok := keyOf(args[1])
+	if !ok {
+		panic(E(RuntimeError, fmt.Sprintf("map_incr: %s can't be a map key", withArticle(args[1].Tag.String())), 0))
+	}
+
+	m := *args[0].Map
+	current := m[key]
+	if current.Tag != ValNil && !current.isNumber() {
+		panic(E(RuntimeError, fmt.Sprintf("map_incr: the value at %s is %s, not a number", args[1].Repr(), withArticle(current.Tag.String())), 0))
+	}
+	v, err := binaryOp(Plus, current, delta)
+	if err != nil {
+		panic(E(RuntimeError, "map_incr: "+err.Error(), 0))
+	}
+	m[key] = v
+	return v
+}
+
+func nativeRange(ev *Evaluator, args []Value) Value {
+	checkArgs("range", args, ValNum, ValNum)
+	from := args[0].Num
+	to := args[1].Num
 	step := 1
 	if to < from {
 		step = -1
@@ -133,10 +561,10 @@ func nativeRange(args []Value) Value {
 	return Value{Tag: ValRange, Range: &r}
 }
 
-func nativeRangeI(args []Value) Value {
-	checkArgs(args, ValNum, ValNum)
-	from := *args[0].Num
-	to := *args[1].Num
+func nativeRangeI(ev *Evaluator, args []Value) Value {
+	checkArgs("rangei", args, ValNum, ValNum)
+	from := args[0].Num
+	to := args[1].Num
 	step := 1
 	if to < from {
 		step = -1
@@ -146,39 +574,728 @@ func nativeRangeI(args []Value) Value {
 	return Value{Tag: ValRange, Range: &r}
 }
 
-func nativeSort(args []Value) Value {
-	checkArgs(args, ValArray)
+// nativeContains reports whether a range or array has a value in it, or a
+// string has a substring
+func nativeContains(ev *Evaluator, args []Value) Value {
+	checkArity("contains", args, 2, 2)
+	found := 0
+	switch haystack, needle := args[0], args[1]; haystack.Tag {
+	case ValRange:
+		if needle.Tag == ValNum && haystack.Range.contains(needle.Num) {
+			found = 1
+		}
+	case ValArray:
+		for _, item := range *haystack.Array {
+			if eq, err := item.Compare(needle); err == nil && eq {
+				found = 1
+				break
+			}
+		}
+	case ValStr:
+		checkArg("contains", args, 1, ValStr)
+		if strings.Contains(haystack.Str, needle.Str) {
+			found = 1
+		}
+	default:
+		msg := fmt.Sprintf("contains: argument 1 must be a range, array or string, got %s", haystack.Tag.String())
+		panic(E(RuntimeError, msg, 0))
+	}
+	return Value{Tag: ValNum, Num: found}
+}
+
+// nativeToArray makes an array of a range's numbers
+func nativeToArray(ev *Evaluator, args []Value) Value {
+	checkArgs("to_array", args, ValRange)
+	r := args[0].Range
+	arr := make([]Value, r.len())
+	for i := range arr {
+		n, _ := r.at(i)
+		arr[i] = Value{Tag: ValNum, Num: n}
+	}
+	return Value{Tag: ValArray, Array: &arr}
+}
+
+func nativeSort(ev *Evaluator, args []Value) Value {
+	checkArgs("sort", args, ValArray)
 	arr := *args[0].Array
 	dest := make([]Value, len(arr))
 	copy(dest, arr)
-	sort.Slice(dest, func(a int, b int) bool {
-		if dest[a].Tag == ValNum {
-			valA := dest[a].Num
-			valB := dest[b].Num
-			return *valA < *valB
-		}
 
-		if dest[a].Tag == ValStr {
-			valA := dest[a].Str
-			valB := dest[b].Str
-			return *valA < *valB
+	// everything has to be the same kind of thing, numbers of either sort
+	// count as one kind
+	for i, item := range dest {
+		if !sortable(item) {
+			msg := fmt.Sprintf("sort: item %d is %s, only numbers, strings and arrays can be sorted", i, withArticle(item.Tag.String()))
+			panic(E(RuntimeError, msg, 0))
+		}
+		if i > 0 && sortKind(item) != sortKind(dest[0]) {
+			msg := fmt.Sprintf("sort: item %d is %s but item 0 is %s", i, withArticle(item.Tag.String()), withArticle(dest[0].Tag.String()))
+			panic(E(RuntimeError, msg, 0))
 		}
+	}
 
-		return false
+	var err error
+	sort.SliceStable(dest, func(a int, b int) bool {
+		c, cmpErr := compareOrder(dest[a], dest[b])
+		if cmpErr != nil && err == nil {
+			err = cmpErr
+		}
+		return c < 0
 	})
+	if err != nil {
+		panic(E(RuntimeError, "sort: "+err.Error(), 0))
+	}
 	return Value{Tag: ValArray, Array: &dest}
 }
 
-func nativeUpper(args []Value) Value {
-	checkArgs(args, ValStr)
-	str := *args[0].Str
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func sortable(v Value) bool {
+	return v.isNumber() || v.Tag == ValStr || v.Tag == ValArray
+}
+
+func sortKind(v Value) ValueTag {
+	if v.Tag == ValFloat {
+		return ValNum
+	}
+	return v.Tag
+}
+
+// compareOrder orders numbers, strings, and arrays of them element by
+// element. It's negative if a comes first, positive if b does.
+func compareOrder(a, b Value) (int, error) {
+	switch {
+	case a.isNumber() && b.isNumber():
+		if a.Tag == ValNum && b.Tag == ValNum {
+			return compareInts(a.Num, b.Num), nil
+		}
+		switch x, y := a.asFloat(), b.asFloat(); {
+		case x < y:
+			return -1, nil
+		case x > y:
+			return 1, nil
+		}
+		return 0, nil
+	case a.Tag == ValStr && b.Tag == ValStr:
+		return strings.Compare(a.Str, b.Str), nil
+	case a.Tag == ValArray && b.Tag == ValArray:
+		x, y := *a.Array, *b.Array
+		for i := 0; i < len(x) && i < len(y); i++ {
+			c, err := compareOrder(x[i], y[i])
+			if err != nil || c != 0 {
+				return c, err
+			}
+		}
+		return compareInts(len(x), len(y)), nil
+	}
+	return 0, fmt.Errorf("cannot order %s and %s", withArticle(a.Tag.String()), withArticle(b.Tag.String()))
+}
+
+func nativeUpper(ev *Evaluator, args []Value) Value {
+	checkArgs("upper", args, ValStr)
+	str := args[0].Str
 	ustr := strings.ToUpper(str)
-	return Value{Tag: ValStr, Str: &ustr}
+	return Value{Tag: ValStr, Str: ustr}
+}
+
+// padding makes pad_left and pad_right, which pad a string to a width in
+// runes with spaces or a given character. Strings that are already long
+// enough are left alone.
+func padding(name string, left bool) func(*Evaluator, []Value) Value {
+	return func(ev *Evaluator, args []Value) Value {
+		checkArity(name, args, 2, 3)
+		checkArg(name, args, 0, ValStr)
+		checkArg(name, args, 1, ValNum)
+		padChar := " "
+		if len(args) == 3 {
+			checkArg(name, args, 2, ValStr)
+			padChar = args[2].Str
+			if utf8.RuneCountInString(padChar) != 1 {
+				msg := fmt.Sprintf("%s: the pad character must be 1 character long, got %s", name, args[2].Repr())
+				panic(E(RuntimeError, msg, 0))
+			}
+		}
+		s := args[0].Str
+		n := args[1].Num - utf8.RuneCountInString(s)
+		if n <= 0 {
+			return args[0]
+		}
+		pad := strings.Repeat(padChar, n)
+		if left {
+			return Value{Tag: ValStr, Str: pad + s}
+		}
+		return Value{Tag: ValStr, Str: s + pad}
+	}
+}
+
+var (
+	nativePadLeft  = padding("pad_left", true)
+	nativePadRight = padding("pad_right", false)
+)
+
+// nativeToBin is a number in binary, zero-padded to a width if one's given
+func nativeToBin(ev *Evaluator, args []Value) Value {
+	checkArity("to_bin", args, 1, 2)
+	checkArg("to_bin", args, 0, ValNum)
+	n := args[0].Num
+	if n < 0 {
+		panic(E(RuntimeError, fmt.Sprintf("to_bin: expected a number of 0 or more, got %d", n), 0))
+	}
+	s := strconv.FormatInt(int64(n), 2)
+	if len(args) == 2 {
+		checkArg("to_bin", args, 1, ValNum)
+		if pad := args[1].Num - len(s); pad > 0 {
+			s = strings.Repeat("0", pad) + s
+		}
+	}
+	return Value{Tag: ValStr, Str: s}
+}
+
+// nativeHexToBin expands each hex digit of a string to 4 bits, leading zeros
+// included
+func nativeHexToBin(ev *Evaluator, args []Value) Value {
+	checkArgs("hex_to_bin", args, ValStr)
+	var b strings.Builder
+	for i, c := range args[0].Str {
+		n, err := strconv.ParseUint(string(c), 16, 8)
+		if err != nil {
+			msg := fmt.Sprintf("hex_to_bin: invalid hex digit %q at position %d", c, i)
+			panic(E(RuntimeError, msg, 0))
+		}
+		fmt.Fprintf(&b, "%04b", n)
+	}
+	return Value{Tag: ValStr, Str: b.String()}
+}
+
+// nativeBinToNum reads a string of 0s and 1s as a number
+func nativeBinToNum(ev *Evaluator, args []Value) Value {
+	checkArgs("bin_to_num", args, ValStr)
+	s := args[0].Str
+	if s == "" {
+		panic(E(RuntimeError, "bin_to_num: expected a binary number, got ''", 0))
+	}
+	n := 0
+	for i, c := range s {
+		if c != '0' && c != '1' {
+			msg := fmt.Sprintf("bin_to_num: invalid binary digit %q at position %d", c, i)
+			panic(E(RuntimeError, msg, 0))
+		}
+		next, ok := mulInts(n, 2)
+		if !ok {
+			panic(E(RuntimeError, "bin_to_num: integer overflow", 0))
+		}
+		n = next + int(c-'0')
+	}
+	return Value{Tag: ValNum, Num: n}
+}
+
+// nativeHex formats a number in lowercase hex, zero-padded to a width if one
+// is given. num(s, 16) reads it back.
+func nativeHex(ev *Evaluator, args []Value) Value {
+	checkArity("hex", args, 1, 2)
+	checkArg("hex", args, 0, ValNum)
+	n := args[0].Num
+	if n < 0 {
+		panic(E(RuntimeError, fmt.Sprintf("hex: expected a number of 0 or more, got %d", n), 0))
+	}
+	s := strconv.FormatInt(int64(n), 16)
+	if len(args) == 2 {
+		checkArg("hex", args, 1, ValNum)
+		if pad := args[1].Num - len(s); pad > 0 {
+			s = strings.Repeat("0", pad) + s
+		}
+	}
+	return Value{Tag: ValStr, Str: s}
+}
+
+// nativeMD5 returns the md5 digest of a string in lowercase hex
+func nativeMD5(ev *Evaluator, args []Value) Value {
+	checkArgs("md5", args, ValStr)
+	sum := md5.Sum([]byte(args[0].Str))
+	return Value{Tag: ValStr, Str: hexDigest(sum[:])}
+}
+
+// nativeSHA256 returns the sha256 digest of a string in lowercase hex
+func nativeSHA256(ev *Evaluator, args []Value) Value {
+	checkArgs("sha256", args, ValStr)
+	sum := sha256.Sum256([]byte(args[0].Str))
+	return Value{Tag: ValStr, Str: hexDigest(sum[:])}
+}
+
+// hexDigest is hex.EncodeToString with one allocation rather than two,
+// hashing in a loop is the usual way these get used
+func hexDigest(sum []byte) string {
+	var buf [2 * sha256.Size]byte
+	n := hex.Encode(buf[:], sum)
+	return string(buf[:n])
+}
+
+// nativeRand returns a random number from 0 to n-1
+func nativeRand(ev *Evaluator, args []Value) Value {
+	checkArgs("rand", args, ValNum)
+	n := args[0].Num
+	if n <= 0 {
+		panic(E(RuntimeError, fmt.Sprintf("rand: expected a number more than 0, got %d", n), 0))
+	}
+	return Value{Tag: ValNum, Num: ev.random().Intn(n)}
+}
+
+// nativeRandSeed restarts the evaluator's random numbers from a seed
+func nativeRandSeed(ev *Evaluator, args []Value) Value {
+	checkArgs("rand_seed", args, ValNum)
+	ev.random().Seed(int64(args[0].Num))
+	return NilValue
+}
+
+// nativeShuffle returns a shuffled copy of an array
+func nativeShuffle(ev *Evaluator, args []Value) Value {
+	checkArgs("shuffle", args, ValArray)
+	shuffled := make([]Value, len(*args[0].Array))
+	copy(shuffled, *args[0].Array)
+	ev.random().Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return Value{Tag: ValArray, Array: &shuffled}
+}
+
+// nativeClockMs returns how many milliseconds it's been since the evaluator
+// was made, for showing progress
+func nativeClockMs(ev *Evaluator, args []Value) Value {
+	checkArity("clock_ms", args, 0, 0)
+	return Value{Tag: ValNum, Num: int(ev.clock().Sub(ev.started).Milliseconds())}
+}
+
+// nativeNow returns the local date and time, e.g. 2021-12-07 09:30:00
+func nativeNow(ev *Evaluator, args []Value) Value {
+	checkArity("now", args, 0, 0)
+	return Value{Tag: ValStr, Str: ev.clock().Format("2006-01-02 15:04:05")}
 }
 
-func nativeArray(args []Value) Value {
-	checkArgs(args, ValNum)
-	length := *args[0].Num
-	arr := make([]Value, length)
+// nativeArray makes an array of n nils, or n of a fill value
+func nativeArray(ev *Evaluator, args []Value) Value {
+	checkArity("array", args, 1, 2)
+	checkArg("array", args, 0, ValNum)
+	fill := NilValue
+	if len(args) == 2 {
+		fill = args[1]
+	}
+	arr := filled("array", args[0].Num, fill)
 	return Value{Tag: ValArray, Array: &arr}
 }
+
+// nativeArray2D makes a grid of h rows of w fill values. Every row is a new
+// array, setting grid[0][0] doesn't change grid[1][0].
+func nativeArray2D(ev *Evaluator, args []Value) Value {
+	checkArity("array2d", args, 3, 3)
+	checkArg("array2d", args, 0, ValNum)
+	checkArg("array2d", args, 1, ValNum)
+	w, h := args[0].Num, args[1].Num
+	if w < 0 || h < 0 {
+		panic(E(RuntimeError, fmt.Sprintf("array2d: size must not be negative, got %d by %d", w, h), 0))
+	}
+	grid := filled("array2d", h, NilValue)
+	for y := range grid {
+		row := filled("array2d", w, args[2])
+		grid[y] = Value{Tag: ValArray, Array: &row}
+	}
+	return Value{Tag: ValArray, Array: &grid}
+}
+
+func filled(fn string, n int, fill Value) []Value {
+	if n < 0 {
+		panic(E(RuntimeError, fmt.Sprintf("%s: size must not be negative, got %d", fn, n), 0))
+	}
+	arr := make([]Value, n)
+	if fill.Tag != ValNil {
+		for i := range arr {
+			arr[i] = fill
+		}
+	}
+	return arr
+}
+
+func nativeAssert(ev *Evaluator, args []Value) Value {
+	checkArity("assert", args, 1, 2)
+
+	if args[0].isTruthy() {
+		return NilValue
+	}
+
+	if len(args) == 2 {
+		panic(E(RuntimeError, "assertion failed: "+args[1].String(), 0))
+	}
+	panic(E(RuntimeError, "assertion failed", 0))
+}
+
+func nativeError(ev *Evaluator, args []Value) Value {
+	checkArity("error", args, 1, 1)
+	panic(E(RuntimeError, args[0].String(), 0))
+}
+
+func nativeCopy(ev *Evaluator, args []Value) Value {
+	checkArity("copy", args, 1, 1)
+	if fn := args[0].Tag; fn == ValFn || fn == ValNativeFn {
+		panic(E(RuntimeError, "copy: argument 1 is a fn, which can't be copied", 0))
+	}
+	v, err := args[0].deepCopy()
+	if err != nil {
+		panic(E(RuntimeError, "copy: argument 1 has "+err.Error(), 0))
+	}
+	return v
+}
+
+// setKey is the key a value is a member of a set under. what is the value
+// for the error if it can't be one, e.g. "add: argument 2".
+func setKey(what string, v Value) MapKey {
+	key, ok := keyOf(v)
+	if !ok {
+		msg := fmt.Sprintf("%s can't be a set member, got %s", what, withArticle(typeName(v)))
+		if bad := unkeyable(v); bad.Tag != v.Tag {
+			msg = fmt.Sprintf("%s can't be a set member, it has %s in it", what, withArticle(typeName(bad)))
+		}
+		panic(E(RuntimeError, msg, 0))
+	}
+	return key
+}
+
+// unkeyable finds what stops an array being a key, or returns v itself
+func unkeyable(v Value) Value {
+	if v.Tag == ValArray {
+		for _, item := range *v.Array {
+			if _, ok := keyOf(item); !ok {
+				return unkeyable(item)
+			}
+		}
+	}
+	return v
+}
+
+// setMember is setKey and the value to keep for it. Arrays are copied so
+// changing one after adding it can't leave the set holding a member that
+// doesn't match its key.
+func setMember(what string, v Value) (MapKey, Value) {
+	key := setKey(what, v)
+	if v.Tag == ValArray {
+		v, _ = v.deepCopy()
+	}
+	return key, v
+}
+
+// checkSetMemberArgs checks for a set followed by a value of any type
+func checkSetMemberArgs(fn string, args []Value) {
+	checkArity(fn, args, 2, 2)
+	checkArg(fn, args, 0, ValSet)
+}
+
+func nativeSet(ev *Evaluator, args []Value) Value {
+	set := make(map[MapKey]Value)
+	checkArity("set", args, 0, 1)
+	if len(args) == 0 {
+		return Value{Tag: ValSet, ref: &set}
+	}
+
+	switch args[0].Tag {
+	case ValArray:
+		for i, item := range *args[0].Array {
+			key, member := setMember(fmt.Sprintf("set: item %d of argument 1", i), item)
+			set[key] = member
+		}
+	case ValStr:
+		for _, c := range args[0].Str {
+			set[strKey(char(c))] = Value{Tag: ValStr, Str: char(c)}
+		}
+	default:
+		panic(E(RuntimeError, fmt.Sprintf("set: cannot make a set from %s", withArticle(args[0].Tag.String())), 0))
+	}
+	return Value{Tag: ValSet, ref: &set}
+}
+
+func nativeAdd(ev *Evaluator, args []Value) Value {
+	checkSetMemberArgs("add", args)
+	key, member := setMember("add: argument 2", args[1])
+	(*args[0].set())[key] = member
+	return args[0]
+}
+
+func nativeHas(ev *Evaluator, args []Value) Value {
+	checkSetMemberArgs("has", args)
+	has := 0
+	if _, present := (*args[0].set())[setKey("has: argument 2", args[1])]; present {
+		has = 1
+	}
+	return Value{Tag: ValNum, Num: has}
+}
+
+func nativeUnion(ev *Evaluator, args []Value) Value {
+	checkArgs("union", args, ValSet, ValSet)
+	set := make(map[MapKey]Value)
+	for key, member := range *args[0].set() {
+		set[key] = member
+	}
+	for key, member := range *args[1].set() {
+		set[key] = member
+	}
+	return Value{Tag: ValSet, ref: &set}
+}
+
+func nativeIntersect(ev *Evaluator, args []Value) Value {
+	checkArgs("intersect", args, ValSet, ValSet)
+	set := make(map[MapKey]Value)
+	for key, member := range *args[0].set() {
+		if _, present := (*args[1].set())[key]; present {
+			set[key] = member
+		}
+	}
+	return Value{Tag: ValSet, ref: &set}
+}
+
+func nativeDifference(ev *Evaluator, args []Value) Value {
+	checkArgs("difference", args, ValSet, ValSet)
+	set := make(map[MapKey]Value)
+	for key, member := range *args[0].set() {
+		if _, present := (*args[1].set())[key]; !present {
+			set[key] = member
+		}
+	}
+	return Value{Tag: ValSet, ref: &set}
+}
+
+func nativeParseGrid(ev *Evaluator, args []Value) Value {
+	asNums := false
+	checkArity("parse_grid", args, 1, 2)
+	checkArg("parse_grid", args, 0, ValArray)
+	if len(args) == 2 {
+		checkArg("parse_grid", args, 1, ValNum)
+		asNums = args[1].isTruthy()
+	}
+
+	lines := *args[0].Array
+	grid := make([]Value, 0, len(lines))
+	for y, line := range lines {
+		if line.Tag != ValStr {
+			msg := fmt.Sprintf("parse_grid: line %d is %s, expected a string", y, withArticle(line.Tag.String()))
+			panic(E(RuntimeError, msg, 0))
+		}
+
+		row := make([]Value, 0, runeLen(line.Str))
+		x := 0
+		for _, c := range line.Str {
+			if asNums {
+				if c < '0' || c > '9' {
+					msg := fmt.Sprintf("parse_grid: %q at %d, %d is not a digit", c, x, y)
+					panic(E(RuntimeError, msg, 0))
+				}
+				n := int(c - '0')
+				row = append(row, Value{Tag: ValNum, Num: n})
+			} else {
+				row = append(row, Value{Tag: ValStr, Str: char(c)})
+			}
+			x++
+		}
+		grid = append(grid, Value{Tag: ValArray, Array: &row})
+	}
+	return Value{Tag: ValArray, Array: &grid}
+}
+
+// gridTransform makes transpose, rotate_cw and friends. They take a grid of
+// equal length rows, either arrays or strings, and return a new grid of the
+// same kind. move gives where the item at x, y in a w by h grid goes, turns
+// says whether the new grid is h by w.
+func gridTransform(name string, turns bool, move func(x, y, w, h int) (nx, ny int)) func(*Evaluator, []Value) Value {
+	return func(ev *Evaluator, args []Value) Value {
+		checkArgs(name, args, ValArray)
+		in := *args[0].Array
+		if len(in) == 0 {
+			return Value{Tag: ValArray, Array: &[]Value{}}
+		}
+
+		strs := in[0].Tag == ValStr
+		rows := make([][]Value, len(in))
+		for y, row := range in {
+			switch {
+			case strs && row.Tag == ValStr:
+				for _, c := range row.Str {
+					rows[y] = append(rows[y], Value{Tag: ValStr, Str: char(c)})
+				}
+			case !strs && row.Tag == ValArray:
+				rows[y] = *row.Array
+			default:
+				msg := fmt.Sprintf("%s: row %d is %s but row 0 is %s", name, y, withArticle(row.Tag.String()), withArticle(in[0].Tag.String()))
+				panic(E(RuntimeError, msg, 0))
+			}
+			if len(rows[y]) != len(rows[0]) {
+				msg := fmt.Sprintf("%s: row %d has %d items but row 0 has %d", name, y, len(rows[y]), len(rows[0]))
+				panic(E(RuntimeError, msg, 0))
+			}
+		}
+
+		w, h := len(rows[0]), len(rows)
+		nw, nh := w, h
+		if turns {
+			nw, nh = h, w
+		}
+		out := make([][]Value, nh)
+		for i := range out {
+			out[i] = make([]Value, nw)
+		}
+		for y, row := range rows {
+			for x, v := range row {
+				nx, ny := move(x, y, w, h)
+				out[ny][nx] = v
+			}
+		}
+
+		grid := make([]Value, len(out))
+		for i, row := range out {
+			if strs {
+				var b strings.Builder
+				for _, c := range row {
+					b.WriteString(c.Str)
+				}
+				grid[i] = Value{Tag: ValStr, Str: b.String()}
+			} else {
+				row := row
+				grid[i] = Value{Tag: ValArray, Array: &row}
+			}
+		}
+		return Value{Tag: ValArray, Array: &grid}
+	}
+}
+
+var (
+	nativeTranspose = gridTransform("transpose", true, func(x, y, w, h int) (int, int) { return y, x })
+	nativeRotateCW  = gridTransform("rotate_cw", true, func(x, y, w, h int) (int, int) { return h - 1 - y, x })
+	nativeRotateCCW = gridTransform("rotate_ccw", true, func(x, y, w, h int) (int, int) { return y, w - 1 - x })
+	nativeFlipH     = gridTransform("flip_h", false, func(x, y, w, h int) (int, int) { return w - 1 - x, y })
+	nativeFlipV     = gridTransform("flip_v", false, func(x, y, w, h int) (int, int) { return x, h - 1 - y })
+)
+
+// offsets for neighbors4 and neighbors8, in reading order
+var orthogonalOffsets = [][2]int{{0, -1}, {-1, 0}, {1, 0}, {0, 1}}
+var allOffsets = [][2]int{{-1, -1}, {0, -1}, {1, -1}, {-1, 0}, {1, 0}, {-1, 1}, {0, 1}, {1, 1}}
+
+func neighbors(fn string, args []Value, offsets [][2]int) Value {
+	checkArgs(fn, args, ValNum, ValNum)
+	x := args[0].Num
+	y := args[1].Num
+	points := make([]Value, 0, len(offsets))
+	for _, offset := range offsets {
+		nx := x + offset[0]
+		ny := y + offset[1]
+		point := []Value{{Tag: ValNum, Num: nx}, {Tag: ValNum, Num: ny}}
+		points = append(points, Value{Tag: ValArray, Array: &point})
+	}
+	return Value{Tag: ValArray, Array: &points}
+}
+
+func nativeNeighbors4(ev *Evaluator, args []Value) Value {
+	return neighbors("neighbors4", args, orthogonalOffsets)
+}
+
+func nativeNeighbors8(ev *Evaluator, args []Value) Value {
+	return neighbors("neighbors8", args, allOffsets)
+}
+
+func nativeInBounds(ev *Evaluator, args []Value) Value {
+	checkArgs("in_bounds", args, ValArray, ValNum, ValNum)
+	grid := *args[0].Array
+	x := args[1].Num
+	y := args[2].Num
+
+	inBounds := 0
+	if y >= 0 && y < len(grid) && x >= 0 {
+		switch row := grid[y]; row.Tag {
+		case ValArray:
+			if x < len(*row.Array) {
+				inBounds = 1
+			}
+		case ValStr:
+			if x < runeLen(row.Str) {
+				inBounds = 1
+			}
+		}
+	}
+	return Value{Tag: ValNum, Num: inBounds}
+}
+
+func nativeHeap(ev *Evaluator, args []Value) Value {
+	checkArgs("heap", args)
+	h := make(Heap, 0)
+	return Value{Tag: ValHeap, ref: &h}
+}
+
+func nativeHeapPush(ev *Evaluator, args []Value) Value {
+	checkArity("heap_push", args, 3, 3)
+	checkArg("heap_push", args, 0, ValHeap)
+	checkArg("heap_push", args, 1, ValNum)
+	heap.Push(args[0].heap(), heapItem{args[1].Num, args[2]})
+	return NilValue
+}
+
+func nativeHeapPop(ev *Evaluator, args []Value) Value {
+	checkArgs("heap_pop", args, ValHeap)
+	if args[0].heap().Len() == 0 {
+		return NilValue
+	}
+	item := heap.Pop(args[0].heap()).(heapItem)
+	pair := []Value{{Tag: ValNum, Num: item.priority}, item.value}
+	return Value{Tag: ValArray, Array: &pair}
+}
+
+func nativeQueue(ev *Evaluator, args []Value) Value {
+	checkArgs("queue", args)
+	return Value{Tag: ValQueue, ref: &Queue{}}
+}
+
+func nativeQueuePush(ev *Evaluator, args []Value) Value {
+	checkArity("q_push", args, 2, 2)
+	checkArg("q_push", args, 0, ValQueue)
+	args[0].queue().push(args[1])
+	return NilValue
+}
+
+func nativeQueuePopFront(ev *Evaluator, args []Value) Value {
+	checkArgs("q_pop_front", args, ValQueue)
+	return args[0].queue().popFront()
+}
+
+func nativeQueuePopBack(ev *Evaluator, args []Value) Value {
+	checkArgs("q_pop_back", args, ValQueue)
+	return args[0].queue().popBack()
+}
+
+// nativeMemo wraps a function in a cache keyed on the repr of its arguments.
+// It's only correct for functions whose result depends on nothing else.
+func nativeMemo(ev *Evaluator, args []Value) Value {
+	checkArgs("memo", args, ValFn)
+	fnVal := args[0]
+	cache := make(map[string]Value)
+	// pmap's workers can share a memoized function
+	var mu sync.Mutex
+
+	memoized := func(ev *Evaluator, args []Value) Value {
+		key := Value{Tag: ValArray, Array: &args}.Repr()
+		mu.Lock()
+		v, present := cache[key]
+		mu.Unlock()
+		if present {
+			return v
+		}
+
+		// ev.native is the call to the memoized function
+		v = ev.fn(ev.native, fnVal, args)
+		mu.Lock()
+		cache[key] = v
+		mu.Unlock()
+		return v
+	}
+	return Value{Tag: ValNativeFn, NativeFn: memoized}
+}
@@ -0,0 +1,793 @@
+package lang
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestAssert(t *testing.T) {
+	src := `part1: {
+  assert(1 == 1)
+  assert(2 > 1, 'unreachable')
+  return 1
+}
+part2: {
+  var x = 2
+  assert(x == 3)
+}
+part3: {
+  var x = 2
+
+  assert(x == 3, 'x should be 3 but was ' + x)
+}`
+	v, err := evalSource(t, src, "part1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Tag != ValNum || v.Num != 1 {
+		t.Fatalf("expected 1 but got %s", v.Repr())
+	}
+
+	expectError(t, src, "part2", RuntimeError, "assertion failed", 8)
+	expectError(t, src, "part3", RuntimeError, "assertion failed: x should be 3 but was 2", 13)
+}
+
+func TestAssertMessageFormatting(t *testing.T) {
+	tests := []struct {
+		msg      string
+		expected string
+	}{
+		{"'plain'", "assertion failed: plain"},
+		{"42", "assertion failed: 42"},
+		{"nil", "assertion failed: nil"},
+		{"[1, 'a']", "assertion failed: [1, 'a']"},
+	}
+
+	for _, test := range tests {
+		src := "part1: {\n  assert(0, " + test.msg + ")\n}"
+		expectError(t, src, "part1", RuntimeError, test.expected, 2)
+	}
+}
+
+func TestCopyFunction(t *testing.T) {
+	src := `fn f() {}
+part1: {
+  copy([1, f])
+}
+part2: {
+  copy(print)
+}`
+	expectError(t, src, "part1", RuntimeError, "copy: argument 1 has a fn in it, which can't be copied", 3)
+	expectError(t, src, "part2", RuntimeError, "copy: argument 1 is a fn, which can't be copied", 6)
+}
+
+func TestSetErrors(t *testing.T) {
+	src := `part1: {
+  set([[1, { a: 1 }]])
+}
+part2: {
+  has([1], 1)
+}
+part3: {
+  add(set(), { a: 1 })
+}
+part4: {
+  has(set(), [1, [print]])
+}`
+	expectError(t, src, "part1", RuntimeError, "set: item 0 of argument 1 can't be a set member, it has a map in it", 2)
+	expectError(t, src, "part2", RuntimeError, "has: argument 1 must be a set, got array", 5)
+	expectError(t, src, "part3", RuntimeError, "add: argument 2 can't be a set member, got a map", 8)
+	expectError(t, src, "part4", RuntimeError, "has: argument 2 can't be a set member, it has a fn in it", 11)
+}
+
+func TestParseGridErrors(t *testing.T) {
+	src := `part1: {
+  parse_grid(['12', '3x'], 1)
+}
+part2: {
+  parse_grid(['12', 3])
+}
+part3: {
+  parse_grid(['1é'], 1)
+}`
+	expectError(t, src, "part1", RuntimeError, "parse_grid: 'x' at 1, 1 is not a digit", 2)
+	expectError(t, src, "part2", RuntimeError, "parse_grid: line 1 is a number, expected a string", 5)
+	expectError(t, src, "part3", RuntimeError, "parse_grid: 'é' at 1, 0 is not a digit", 8)
+}
+
+// compares the queue with shifting the front off an array using delete
+func BenchmarkQueue(b *testing.B) {
+	src := `queue: {
+  var q = queue()
+  for i in range(0, %[1]d) {
+    q_push(q, i)
+  }
+  for i in range(0, %[1]d) {
+    q_pop_front(q)
+  }
+}
+shift: {
+  var q = []
+  for i in range(0, %[1]d) {
+    q = push(q, i)
+  }
+  for i in range(0, %[1]d) {
+    q = delete(q, 0)
+  }
+}`
+
+	// shift is quadratic, at 100k it takes minutes a run, so give this
+	// -benchtime=1x and a bigger -timeout
+	for _, n := range []int{1000, 10000, 100000} {
+		for _, section := range []string{"queue", "shift"} {
+			b.Run(fmt.Sprintf("%s_%d", section, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := evalSource(b, fmt.Sprintf(src, n), section); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestMemoErrorLine(t *testing.T) {
+	src := `part1: {
+  fn f(n) {
+    if n > 2 {
+      error('too big')
+    }
+    return mf(n + 1)
+  }
+  var mf = memo(f)
+  mf(0)
+}`
+	// the error keeps the line it was raised on rather than the memo call
+	expectError(t, src, "part1", RuntimeError, "too big", 4)
+}
+
+func TestNativeArgErrors(t *testing.T) {
+	src := `part1: {
+  split('a b', 1)
+}
+part2: {
+  split('a')
+}
+part3: {
+  assert()
+}
+part4: {
+  push(1, 2)
+}
+part5: {
+  num('1', 2, 3)
+}
+part6: {
+  heap_push(heap(), 'a', 1)
+}
+part7: {
+  queue(1)
+}
+part8: {
+  add(set(), 1, 2)
+}`
+	expectError(t, src, "part1", RuntimeError, "split: argument 2 must be a string, got number", 2)
+	expectError(t, src, "part2", RuntimeError, "split: expected 2 arguments, got 1", 5)
+	expectError(t, src, "part3", RuntimeError, "assert: expected 1 or 2 arguments, got 0", 8)
+	expectError(t, src, "part4", RuntimeError, "push: argument 1 must be an array, got number", 11)
+	expectError(t, src, "part5", RuntimeError, "num: expected 1 or 2 arguments, got 3", 14)
+	expectError(t, src, "part6", RuntimeError, "heap_push: argument 2 must be a number, got string", 17)
+	expectError(t, src, "part7", RuntimeError, "queue: expected no arguments, got 1", 20)
+	expectError(t, src, "part8", RuntimeError, "add: expected 2 arguments, got 3", 23)
+}
+
+func TestArrayBuiltins(t *testing.T) {
+	src := `part1: {
+  return [array(3), array(2, 0), array(0, 1)]
+}
+part2: {
+  var grid = array2d(3, 2, '.')
+  grid[0][0] = '#'
+  return grid
+}
+part3: {
+  array(-1)
+}
+part4: {
+  array2d(2, -3, 0)
+}`
+	tests := map[string]string{
+		"part1": "[[nil, nil, nil], [0, 0], []]",
+		"part2": "[['#', '.', '.'], ['.', '.', '.']]",
+	}
+	for section, want := range tests {
+		for _, vm := range []bool{false, true} {
+			v, err := evalSourceOn(t, src, section, vm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Repr() != want {
+				t.Errorf("vm: %v: %s: expected %s, got %s", vm, section, want, v.Repr())
+			}
+		}
+	}
+	expectError(t, src, "part3", RuntimeError, "array: size must not be negative, got -1", 10)
+	expectError(t, src, "part4", RuntimeError, "array2d: size must not be negative, got 2 by -3", 13)
+}
+
+func TestTypeAndConversions(t *testing.T) {
+	src := `fn f() {}
+part1: {
+  return [type(1), type(1.5), type('a'), type([]), type({}), type(nil), type(f), type(len), type(set())]
+}
+part2: {
+  return [str(1), str('a'), str(nil), str([1, 'a']), str(2.0)]
+}
+part3: {
+  return [num('12'), num('ff', 16), num(7), num(2.5), num(nil), num('x')]
+}
+part4: {
+  num([1])
+}`
+	tests := map[string]string{
+		"part1": "['number', 'float', 'string', 'array', 'map', 'nil', 'fn', 'fn', 'set']",
+		"part2": "['1', 'a', 'nil', '[1, 'a']', '2.0']",
+		"part3": "[12, 255, 7, 2.5, nil, nil]",
+	}
+	for section, want := range tests {
+		v, err := evalSource(t, src, section)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Repr() != want {
+			t.Errorf("%s: expected %s, got %s", section, want, v.Repr())
+		}
+	}
+	expectError(t, src, "part4", RuntimeError, "num: argument 1 must be a string or a number, got array", 12)
+}
+
+func TestSort(t *testing.T) {
+	src := `part1: {
+  return sort([3, 1.5, 2, -1])
+}
+part2: {
+  return sort([[2, 'b'], [1, 'z'], [2, 'a'], [1], [10, 'a']])
+}
+part3: {
+  return sort(['b', 'a', 'c'])
+}
+part4: {
+  sort([1, 'a', 2])
+}
+part5: {
+  sort([[1, 'a'], ['b', 2]])
+}
+part6: {
+  sort([{}, {}])
+}`
+	tests := map[string]string{
+		"part1": "[-1, 1.5, 2, 3]",
+		"part2": "[[1], [1, 'z'], [2, 'a'], [2, 'b'], [10, 'a']]",
+		"part3": "['a', 'b', 'c']",
+	}
+	for section, want := range tests {
+		v, err := evalSource(t, src, section)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Repr() != want {
+			t.Errorf("%s: expected %s, got %s", section, want, v.Repr())
+		}
+	}
+	expectError(t, src, "part4", RuntimeError, "sort: item 1 is a string but item 0 is a number", 11)
+	expectError(t, src, "part5", RuntimeError, "sort: cannot order a string and a number", 14)
+	expectError(t, src, "part6", RuntimeError, "sort: item 0 is a map, only numbers, strings and arrays can be sorted", 17)
+}
+
+func TestGcdLcmDivmodErrors(t *testing.T) {
+	src := `part1: {
+  return gcd(1, 'a')
+}
+part2: {
+  return lcm([2, 3, 'x'])
+}
+part3: {
+  return lcm(9223372036854775807, 2)
+}
+part4: {
+  return divmod(1, 0)
+}
+part5: {
+  return gcd([])
+}`
+	expectError(t, src, "part1", RuntimeError, "gcd: argument 2 must be a number, got string", 2)
+	expectError(t, src, "part2", RuntimeError, "lcm: item 2 must be a number, got string", 5)
+	expectError(t, src, "part3", RuntimeError, "lcm: integer overflow", 8)
+	expectError(t, src, "part4", RuntimeError, "divmod: division by zero", 11)
+	expectError(t, src, "part5", RuntimeError, "gcd: expected at least 1 number, got an empty array", 14)
+}
+
+func TestClampBetweenManhattanErrors(t *testing.T) {
+	src := `part1: {
+  return clamp(5, 10, 0)
+}
+part2: {
+  return between(1, 2.5, 2)
+}
+part3: {
+  return clamp('a', 0, 1)
+}
+part4: {
+  return manhattan([1, 2], [3])
+}
+part5: {
+  return manhattan(1, 2, 3)
+}`
+	expectError(t, src, "part1", RuntimeError, "clamp: lo must not be greater than hi, got 10 and 0", 2)
+	expectError(t, src, "part2", RuntimeError, "between: lo must not be greater than hi, got 2.5 and 2", 5)
+	expectError(t, src, "part3", RuntimeError, "clamp: argument 1 must be a number, got string", 8)
+	expectError(t, src, "part4", RuntimeError, "manhattan: argument 2 must be an [x, y] pair of numbers, got [3]", 11)
+	expectError(t, src, "part5", RuntimeError, "manhattan: expected 2 or 4 arguments, got 3", 14)
+}
+
+func TestPadErrors(t *testing.T) {
+	src := `part1: {
+  return pad_left('1', 4, '00')
+}
+part2: {
+  return pad_right('1', 4, '')
+}
+part3: {
+  return pad_left(1, 4)
+}`
+	expectError(t, src, "part1", RuntimeError, "pad_left: the pad character must be 1 character long, got '00'", 2)
+	expectError(t, src, "part2", RuntimeError, "pad_right: the pad character must be 1 character long, got ''", 5)
+	expectError(t, src, "part3", RuntimeError, "pad_left: argument 1 must be a string, got number", 8)
+}
+
+func TestBinaryConversionErrors(t *testing.T) {
+	src := `part1: {
+  return hex_to_bin('1fg')
+}
+part2: {
+  return bin_to_num('1021')
+}
+part3: {
+  return to_bin(-1)
+}
+part4: {
+  return bin_to_num('1' + to_bin(0, 63))
+}`
+	expectError(t, src, "part1", RuntimeError, "hex_to_bin: invalid hex digit 'g' at position 2", 2)
+	expectError(t, src, "part2", RuntimeError, "bin_to_num: invalid binary digit '2' at position 2", 5)
+	expectError(t, src, "part3", RuntimeError, "to_bin: expected a number of 0 or more, got -1", 8)
+	expectError(t, src, "part4", RuntimeError, "bin_to_num: integer overflow", 11)
+}
+
+func TestGridTransformErrors(t *testing.T) {
+	src := `part1: {
+  return transpose([[1, 2], [3]])
+}
+part2: {
+  return rotate_cw(['ab', [1, 2]])
+}
+part3: {
+  return flip_h('ab')
+}`
+	expectError(t, src, "part1", RuntimeError, "transpose: row 1 has 1 items but row 0 has 2", 2)
+	expectError(t, src, "part2", RuntimeError, "rotate_cw: row 1 is an array but row 0 is a string", 5)
+	expectError(t, src, "part3", RuntimeError, "flip_h: argument 1 must be an array, got string", 8)
+}
+
+func TestRangeValueErrors(t *testing.T) {
+	src := `part1: {
+  var r = range(0, 3)
+  return r[3]
+}
+part2: {
+  return rangei(3, 1)[-1]
+}
+part3: {
+  return contains(5, 1)
+}
+part4: {
+  return to_array([1])
+}`
+	expectError(t, src, "part1", RuntimeError, "index 3 out of range", 3)
+	expectError(t, src, "part2", RuntimeError, "index -1 out of range", 6)
+	expectError(t, src, "part3", RuntimeError, "contains: argument 1 must be a range, array or string, got number", 9)
+	expectError(t, src, "part4", RuntimeError, "to_array: argument 1 must be a range, got array", 12)
+}
+
+func TestPathErrors(t *testing.T) {
+	src := `part1: {
+  return get_path([1, [2]], [1, 0, 0])
+}
+part2: {
+  return set_path([1, [2]], [1, 3], 0)
+}
+part3: {
+  return set_path([1], [], 0)
+}
+part4: {
+  return walk([1], 2)
+}`
+	expectError(t, src, "part1", RuntimeError, "get_path: path item 2: cannot subscript a number with a number", 2)
+	expectError(t, src, "part2", RuntimeError, "set_path: path item 1: index 3 out of range", 5)
+	expectError(t, src, "part3", RuntimeError, "set_path: the path is empty", 8)
+	expectError(t, src, "part4", RuntimeError, "walk: argument 2 must be a fn, got number", 11)
+}
+
+func TestHashErrors(t *testing.T) {
+	src := `part1: {
+  return md5(1)
+}
+part2: {
+  return hex(-1)
+}`
+	expectError(t, src, "part1", RuntimeError, "md5: argument 1 must be a string, got number", 2)
+	expectError(t, src, "part2", RuntimeError, "hex: expected a number of 0 or more, got -1", 5)
+}
+
+func TestHashAllocations(t *testing.T) {
+	args := []Value{NewStr("abcdef609043")}
+	for name, native := range map[string]func(*Evaluator, []Value) Value{"md5": nativeMD5, "sha256": nativeSHA256} {
+		// just the digest's string
+		if allocs := testing.AllocsPerRun(100, func() { native(nil, args) }); allocs > 1 {
+			t.Errorf("%s: expected 1 allocation, got %v", name, allocs)
+		}
+	}
+}
+
+func BenchmarkMD5(b *testing.B) {
+	args := []Value{NewStr("abcdef609043")}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		nativeMD5(nil, args)
+	}
+}
+
+func TestRandIsPerEvaluator(t *testing.T) {
+	src := `part1: {
+  var out = []
+  for i in range(0, 10) {
+    out = push(out, rand(1000))
+  }
+  return out
+}
+part2: {
+  rand_seed(7)
+  return shuffle(range(0, 50) |> to_array)
+}
+part3: {
+  rand_seed(42)
+  return pmap(array(40, 0), fn(x) { return rand(1000) })
+}
+part4: {
+  rand_seed(43)
+  return pmap(array(40, 0), fn(x) { return rand(1000) })
+}`
+	// without a seed every evaluator gives the same numbers
+	first, err := evalSource(t, src, "part1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := evalSource(t, src, "part1")
+	if first.Repr() != second.Repr() {
+		t.Errorf("expected the same numbers, got %s and %s", first.Repr(), second.Repr())
+	}
+
+	shuffled, err := evalSource(t, src, "part2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := *shuffled.Array
+	sorted := make([]int, len(items))
+	for i, item := range items {
+		sorted[i] = item.Num
+	}
+	inOrder := sort.IntsAreSorted(sorted)
+	sort.Ints(sorted)
+	for i, n := range sorted {
+		if n != i {
+			t.Fatalf("expected a shuffle of 0 to 49, got %s", shuffled.Repr())
+		}
+	}
+	if inOrder {
+		t.Errorf("expected the items to move, got %s", shuffled.Repr())
+	}
+
+	// pmap's items are seeded from rand_seed, not by which worker runs them
+	var want string
+	for i, procs := range []int{1, 4, 4, 4} {
+		prev := runtime.GOMAXPROCS(procs)
+		v, err := evalSource(t, src, "part3")
+		runtime.GOMAXPROCS(prev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			want = v.Repr()
+			if items := *v.Array; items[0].Num == items[1].Num && items[1].Num == items[2].Num {
+				t.Errorf("expected each item to get its own numbers, got %s", want)
+			}
+		} else if v.Repr() != want {
+			t.Errorf("expected the same numbers with %d workers, got %s and %s", procs, want, v.Repr())
+		}
+	}
+	if other, _ := evalSource(t, src, "part4"); other.Repr() == want {
+		t.Errorf("expected another seed to change pmap's numbers, got %s both times", want)
+	}
+}
+
+func TestMapIncr(t *testing.T) {
+	src := `part1: {
+  var m = { a: 1 }
+  var keys = ['a', 'b', [1, 2], 3, 'a']
+  var deltas = [2, -1, 0.5, 4, 1]
+  for k, i in keys {
+    map_incr(m, k, deltas[i])
+  }
+  return [m, map_incr(m, 'c')]
+}
+part2: {
+  var m = { a: 1 }
+  var keys = ['a', 'b', [1, 2], 3, 'a']
+  var deltas = [2, -1, 0.5, 4, 1]
+  for k, i in keys {
+    m[k] = m[k] + deltas[i]
+  }
+  m['c'] = m['c'] + 1
+  return [m, m['c']]
+}`
+	for _, vm := range []bool{false, true} {
+		incr, err := evalSourceOn(t, src, "part1", vm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assign, err := evalSourceOn(t, src, "part2", vm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if incr.Repr() != assign.Repr() {
+			t.Errorf("expected map_incr to match assigning, got %s and %s", incr.Repr(), assign.Repr())
+		}
+	}
+}
+
+func TestMapIncrErrors(t *testing.T) {
+	src := `part1: {
+  map_incr({ a: 'x' }, 'a')
+}
+part2: {
+  map_incr({}, 'a', '1')
+}
+part3: {
+  map_incr({}, {})
+}`
+	expectError(t, src, "part1", RuntimeError, "map_incr: the value at 'a' is a string, not a number", 2)
+	expectError(t, src, "part2", RuntimeError, "map_incr: argument 3 must be a number, got string", 5)
+	expectError(t, src, "part3", RuntimeError, "map_incr: a map can't be a map key", 8)
+}
+
+// a million increments spread over the pairs of a day 14 polymer
+func BenchmarkMapIncr(b *testing.B) {
+	loop := `part1: {
+  var pairs = []
+  for a in split('BCHN', '') {
+    for b in split('BCHN', '') {
+      pairs = push(pairs, a + b)
+    }
+  }
+  var counts = {}
+  for i in range(0, 1000000) {
+    var pair = pairs[i %% 16]
+    %s
+  }
+  return counts['BB']
+}`
+	b.Run("assign", func(b *testing.B) {
+		benchSource(b, fmt.Sprintf(loop, "counts[pair] = counts[pair] + 1"))
+	})
+	b.Run("map_incr", func(b *testing.B) {
+		benchSource(b, fmt.Sprintf(loop, "map_incr(counts, pair)"))
+	})
+}
+
+// a million increments keyed on integers, like day 6's buckets
+func BenchmarkIntKeys(b *testing.B) {
+	src := `part1: {
+  var counts = {}
+  for i in range(0, 1000000) {
+    var k = i % 1000
+    counts[k] = counts[k] + 1
+  }
+  return counts[999]
+}`
+	benchSource(b, src)
+}
+
+// nativeTest is a call to a native and either the repr of what it returns
+// or the error it raises
+type nativeTest struct {
+	native string
+	args   []Value
+	want   string
+	err    string
+}
+
+func arr(items ...Value) Value {
+	return NewArray(items)
+}
+
+func TestNatives(t *testing.T) {
+	n, f, s := NewNum, NewFloat, NewStr
+	tests := []nativeTest{
+		{native: "num", args: []Value{s("007")}, want: "7"},
+		{native: "num", args: []Value{s("-3")}, want: "-3"},
+		{native: "num", args: []Value{s("1.5")}, want: "1.5"},
+		{native: "num", args: []Value{s("ff"), n(16)}, want: "255"},
+		{native: "num", args: []Value{s("")}, want: "nil"},
+		{native: "num", args: []Value{s(" 7")}, want: "nil"},
+		{native: "num", args: []Value{NilValue}, want: "nil"},
+		{native: "num", args: []Value{arr()}, err: "num: argument 1 must be a string or a number, got array"},
+		{native: "num", args: []Value{s("1"), s("2")}, err: "num: argument 2 must be a number, got string"},
+		{native: "num", err: "num: expected 1 or 2 arguments, got 0"},
+
+		{native: "str", args: []Value{arr(n(1), s("a"))}, want: "'[1, 'a']'"},
+		{native: "str", args: []Value{NilValue}, want: "'nil'"},
+		{native: "type", args: []Value{f(1)}, want: "'float'"},
+
+		{native: "split", args: []Value{s("a,b"), s(",")}, want: "['a', 'b']"},
+		{native: "split", args: []Value{s("abc"), s("")}, want: "['a', 'b', 'c']"},
+		{native: "split", args: []Value{s(""), s(",")}, want: "['']"},
+		{native: "split", args: []Value{n(1), s(",")}, err: "split: argument 1 must be a string, got number"},
+		{native: "split", args: []Value{s("a")}, err: "split: expected 2 arguments, got 1"},
+
+		{native: "len", args: []Value{s("héllo")}, want: "5"},
+		{native: "len", args: []Value{arr()}, want: "0"},
+		{native: "len", args: []Value{NewMap(map[string]Value{"a": n(1)})}, want: "1"},
+		{native: "len", args: []Value{NilValue}, want: "0"},
+		{native: "len", args: []Value{n(3)}, err: "len: a number has no length"},
+
+		{native: "push", args: []Value{arr(), n(1)}, want: "[1]"},
+		{native: "push", args: []Value{n(1), n(1)}, err: "push: argument 1 must be an array, got number"},
+
+		{native: "slice", args: []Value{arr(n(1), n(2), n(3)), n(0), n(2)}, want: "[1, 2]"},
+		{native: "slice", args: []Value{arr(n(1), n(2), n(3)), n(1), n(3)}, want: "[2, 3]"},
+		{native: "slice", args: []Value{arr(n(1)), n(1), n(1)}, want: "[]"},
+		{native: "slice", args: []Value{arr(), n(0), n(0)}, want: "[]"},
+		{native: "slice", args: []Value{arr(n(1), n(2), n(3)), n(-1), n(2)}, err: "slice: invalid index"},
+		{native: "slice", args: []Value{arr(n(1), n(2), n(3)), n(0), n(4)}, err: "slice: invalid index"},
+		{native: "slice", args: []Value{arr(n(1), n(2), n(3)), n(2), n(1)}, err: "slice: invalid index"},
+
+		{native: "delete", args: []Value{arr(n(1), n(2)), n(0)}, want: "[2]"},
+		{native: "delete", args: []Value{arr(n(1), n(2)), n(1)}, want: "[1]"},
+		{native: "delete", args: []Value{arr(n(1), n(2)), n(2)}, err: "delete: index 2 out of range"},
+		{native: "delete", args: []Value{arr(n(1), n(2)), n(-1)}, err: "delete: index -1 out of range"},
+		{native: "delete", args: []Value{arr(), n(0)}, err: "delete: index 0 out of range"},
+
+		{native: "range", args: []Value{n(0), n(3)}, want: "range(0, 3)"},
+		{native: "range", args: []Value{s("a"), n(2)}, err: "range: argument 1 must be a number, got string"},
+		{native: "contains", args: []Value{arr(n(1)), n(1)}, want: "1"},
+		{native: "contains", args: []Value{s("abc"), s("")}, want: "1"},
+		{native: "contains", args: []Value{n(1), n(1)}, err: "contains: argument 1 must be a range, array or string, got number"},
+
+		{native: "nums", args: []Value{s("a=-1 b22,3")}, want: "[-1, 22, 3]"},
+		{native: "nums", args: []Value{s("2-4,6-8")}, want: "[2, 4, 6, 8]"},
+		{native: "nums", args: []Value{s("a-1 é-2 (-3)")}, want: "[1, 2, -3]"},
+		{native: "nums", args: []Value{s("")}, want: "[]"},
+		{native: "nums", args: []Value{s("99999999999999999999")}, err: "nums: 99999999999999999999 is too big"},
+		{native: "paragraphs", args: []Value{s("")}, want: "[]"},
+		{native: "paragraphs", args: []Value{s("a\nb\n\nc")}, want: "[['a', 'b'], ['c']]"},
+
+		{native: "sort", args: []Value{arr()}, want: "[]"},
+		{native: "sort", args: []Value{arr(n(3), f(1.5), n(2))}, want: "[1.5, 2, 3]"},
+		{native: "sort", args: []Value{arr(s("b"), s("a"))}, want: "['a', 'b']"},
+		{native: "sort", args: []Value{arr(n(1), s("a"))}, err: "sort: item 1 is a string but item 0 is a number"},
+		{native: "sort", args: []Value{arr(NilValue)}, err: "sort: item 0 is a nil, only numbers, strings and arrays can be sorted"},
+
+		{native: "upper", args: []Value{s("abC")}, want: "'ABC'"},
+		{native: "upper", args: []Value{n(1)}, err: "upper: argument 1 must be a string, got number"},
+		{native: "pad_left", args: []Value{s("7"), n(3), s("0")}, want: "'007'"},
+		{native: "pad_left", args: []Value{s("1234"), n(3), s("0")}, want: "'1234'"},
+		{native: "pad_right", args: []Value{s("a"), n(3)}, want: "'a  '"},
+		{native: "format", args: []Value{s("%03d|%-3s|"), n(7), s("a")}, want: "'007|a  |'"},
+		{native: "format", args: []Value{s("%d"), s("a")}, err: "format: %d at position 1 needs an integer, got string"},
+
+		{native: "to_bin", args: []Value{n(5)}, want: "'101'"},
+		{native: "to_bin", args: []Value{n(5), n(8)}, want: "'00000101'"},
+		{native: "to_bin", args: []Value{n(-1)}, err: "to_bin: expected a number of 0 or more, got -1"},
+		{native: "hex_to_bin", args: []Value{s("F")}, want: "'1111'"},
+		{native: "hex_to_bin", args: []Value{s("G")}, err: "hex_to_bin: invalid hex digit 'G' at position 0"},
+		{native: "bin_to_num", args: []Value{s("101")}, want: "5"},
+		{native: "bin_to_num", args: []Value{s("")}, err: "bin_to_num: expected a binary number, got ''"},
+		{native: "bin_to_num", args: []Value{s("102")}, err: "bin_to_num: invalid binary digit '2' at position 2"},
+		{native: "hex", args: []Value{n(255)}, want: "'ff'"},
+		{native: "md5", args: []Value{s("")}, want: "'d41d8cd98f00b204e9800998ecf8427e'"},
+
+		{native: "array", args: []Value{n(3), n(0)}, want: "[0, 0, 0]"},
+		{native: "array", args: []Value{n(0), n(0)}, want: "[]"},
+		{native: "array", args: []Value{n(-1), n(0)}, err: "array: size must not be negative, got -1"},
+		{native: "array2d", args: []Value{n(2), n(1), NilValue}, want: "[[nil, nil]]"},
+		{native: "copy", args: []Value{arr(arr(n(1)))}, want: "[[1]]"},
+
+		{native: "set", want: "{}"},
+		{native: "set", args: []Value{s("aab")}, want: "{a, b}"},
+		{native: "set", args: []Value{n(1)}, err: "set: cannot make a set from a number"},
+
+		{native: "transpose", args: []Value{arr()}, want: "[]"},
+		{native: "transpose", args: []Value{arr(arr(n(1), n(2)), arr(n(3), n(4)))}, want: "[[1, 3], [2, 4]]"},
+		{native: "transpose", args: []Value{arr(arr(n(1), n(2)), arr(n(3)))}, err: "transpose: row 1 has 1 items but row 0 has 2"},
+		{native: "heap_pop", args: []Value{NilValue}, err: "heap_pop: argument 1 must be a heap, got nil"},
+		{native: "q_pop_front", args: []Value{n(1)}, err: "q_pop_front: argument 1 must be a queue, got number"},
+
+		{native: "floor", args: []Value{f(-1.5)}, want: "-2"},
+		{native: "ceil", args: []Value{f(1.2)}, want: "2"},
+		{native: "round", args: []Value{f(2.5)}, want: "3"},
+		{native: "floor", args: []Value{s("1")}, err: "floor: argument 1 must be a number, got string"},
+		{native: "floor", args: []Value{f(math.NaN())}, err: "floor: cannot turn NaN into an integer"},
+		{native: "ceil", args: []Value{f(math.Inf(1))}, err: "ceil: integer overflow"},
+		{native: "round", args: []Value{f(-1e300)}, err: "round: integer overflow"},
+		{native: "floor", args: []Value{f(math.Pow(2, 63))}, err: "floor: integer overflow"},
+		{native: "floor", args: []Value{f(-math.Pow(2, 63))}, want: "-9223372036854775808"},
+		{native: "gcd", args: []Value{n(12), n(18)}, want: "6"},
+		{native: "gcd", args: []Value{n(0), n(0)}, want: "0"},
+		{native: "lcm", args: []Value{n(0), n(6)}, want: "0"},
+		{native: "divmod", args: []Value{n(-7), n(2)}, want: "[-4, 1]"},
+		{native: "divmod", args: []Value{n(1), n(0)}, err: "divmod: division by zero"},
+		{native: "clamp", args: []Value{n(5), n(0), n(3)}, want: "3"},
+		{native: "clamp", args: []Value{n(1), n(3), n(0)}, err: "clamp: lo must not be greater than hi, got 3 and 0"},
+		{native: "between", args: []Value{n(3), n(0), n(3)}, want: "1"},
+		{native: "manhattan", args: []Value{arr(n(0), n(0)), arr(n(-2), n(3))}, want: "5"},
+		{native: "manhattan", args: []Value{arr(n(0)), arr(n(1), n(2))}, err: "manhattan: argument 1 must be an [x, y] pair of numbers, got [0]"},
+
+		{native: "json", args: []Value{arr(n(1), s("a"), NilValue)}, want: `'[1,"a",null]'`},
+		{native: "parse_json", args: []Value{s(`{"a": [1.5, true]}`)}, want: "{a: [1.5, 1]}"},
+		{native: "parse_json", args: []Value{s("[1, ")}, err: "parse_json: unexpected EOF"},
+		{native: "error", args: []Value{s("boom")}, err: "boom"},
+		{native: "assert", args: []Value{n(0)}, err: "assertion failed"},
+	}
+
+	ev := NewBareEvaluator()
+	for _, test := range tests {
+		v, err := ev.CallNative(test.native, test.args...)
+		switch {
+		case test.err != "" && (err == nil || err.Error() != test.err):
+			t.Errorf("%s%s: expected the error %q, got %s, %v", test.native, argsRepr(test.args), test.err, v.Repr(), err)
+		case test.err == "" && (err != nil || v.Repr() != test.want):
+			t.Errorf("%s%s: expected %s, got %s, %v", test.native, argsRepr(test.args), test.want, v.Repr(), err)
+		}
+	}
+}
+
+func argsRepr(args []Value) string {
+	reprs := make([]string, len(args))
+	for i, arg := range args {
+		reprs[i] = arg.Repr()
+	}
+	return "(" + strings.Join(reprs, ", ") + ")"
+}
+
+func TestSliceAndDeleteDontChangeTheirArgument(t *testing.T) {
+	ev := NewBareEvaluator()
+	xs := arr(NewNum(1), NewNum(2), NewNum(3))
+
+	if _, err := ev.CallNative("delete", xs, NewNum(0)); err != nil {
+		t.Fatal(err)
+	}
+	head, err := ev.CallNative("slice", xs, NewNum(0), NewNum(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ev.CallNative("push", head, NewNum(9)); err != nil {
+		t.Fatal(err)
+	}
+	if xs.Repr() != "[1, 2, 3]" {
+		t.Errorf("expected [1, 2, 3] to be left alone, got %s", xs.Repr())
+	}
+}
@@ -0,0 +1,118 @@
+package lang
+
+import (
+	"sort"
+	"strings"
+)
+
+// maxSuggestions is how many names a "did you mean" lists at most
+const maxSuggestions = 3
+
+// suggest returns the candidates close enough to name to be what was meant,
+// closest first. Close means a few edits away, or starting with name.
+func suggest(name string, candidates []string) []string {
+	type match struct {
+		name string
+		dist int
+	}
+	limit := len(name) / 3
+	if limit < 1 {
+		limit = 1
+	}
+
+	seen := make(map[string]bool)
+	var matches []match
+	for _, c := range candidates {
+		if c == name || seen[c] {
+			continue
+		}
+		seen[c] = true
+		d := editDistance(name, c)
+		// a name one letter long is one edit away from every other
+		if d <= limit && d < len(name) || strings.HasPrefix(c, name) {
+			matches = append(matches, match{c, d})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].dist != matches[j].dist {
+			return matches[i].dist < matches[j].dist
+		}
+		return matches[i].name < matches[j].name
+	})
+	if len(matches) > maxSuggestions {
+		matches = matches[:maxSuggestions]
+	}
+	names := make([]string, len(matches))
+	for i, m := range matches {
+		names[i] = m.name
+	}
+	return names
+}
+
+// didYouMean formats suggestions to go after an error message, e.g.
+// ", did you mean a or b?", or nothing if there are none
+func didYouMean(names []string) string {
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		return ", did you mean " + names[0] + "?"
+	}
+	return ", did you mean " + strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1] + "?"
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// localNames returns the locals in scope where the evaluator is
+func (ev *Evaluator) localNames() []string {
+	var names []string
+	for e := ev.env; e != nil && e.vars == nil; e = e.parent {
+		names = append(names, e.names...)
+	}
+	return names
+}
+
+// unknownVariable is the message for using a variable that doesn't exist,
+// suggesting one of locals or the globals
+func (ev *Evaluator) unknownVariable(name string, locals []string) string {
+	names := make([]string, 0, len(locals)+len(ev.globals.vars))
+	names = append(names, locals...)
+	for global := range ev.globals.vars {
+		names = append(names, global)
+	}
+	for global := range ev.globals.lazy {
+		names = append(names, global)
+	}
+	return "unknown variable " + name + didYouMean(suggest(name, names))
+}
@@ -38,26 +38,31 @@ func _() {
 	_ = x[Pipe-27]
 	_ = x[GreaterGreater-28]
 	_ = x[LessLess-29]
-	_ = x[Var-30]
-	_ = x[For-31]
-	_ = x[In-32]
-	_ = x[If-33]
-	_ = x[Return-34]
-	_ = x[Continue-35]
-	_ = x[Match-36]
-	_ = x[Else-37]
-	_ = x[Break-38]
-	_ = x[Fn-39]
-	_ = x[Nil-40]
+	_ = x[DotDot-30]
+	_ = x[PipeGreater-31]
+	_ = x[Var-32]
+	_ = x[For-33]
+	_ = x[In-34]
+	_ = x[If-35]
+	_ = x[Return-36]
+	_ = x[Continue-37]
+	_ = x[Match-38]
+	_ = x[Else-39]
+	_ = x[Break-40]
+	_ = x[Fn-41]
+	_ = x[Nil-42]
+	_ = x[Try-43]
+	_ = x[Catch-44]
 }
 
-const _TokenTag_name = "EOFIdentifierStrNum:{}()[]===!=>>=<<=+*,-/%&&||&|>><<varforinifreturncontinuematchelsebreakfnnil"
+const _TokenTag_name = "EOFIdentifierStrNum:{}()[]===!=>>=<<=+*,-/%&&||&|>><<..|>varforinifreturncontinuematchelsebreakfnniltrycatch"
 
-var _TokenTag_index = [...]uint8{0, 3, 13, 16, 19, 20, 21, 22, 23, 24, 25, 26, 27, 29, 31, 32, 34, 35, 37, 38, 39, 40, 41, 42, 43, 45, 47, 48, 49, 51, 53, 56, 59, 61, 63, 69, 77, 82, 86, 91, 93, 96}
+var _TokenTag_index = [...]uint8{0, 3, 13, 16, 19, 20, 21, 22, 23, 24, 25, 26, 27, 29, 31, 32, 34, 35, 37, 38, 39, 40, 41, 42, 43, 45, 47, 48, 49, 51, 53, 55, 57, 60, 63, 65, 67, 73, 81, 86, 90, 95, 97, 100, 103, 108}
 
 func (i TokenTag) String() string {
-	if i >= TokenTag(len(_TokenTag_index)-1) {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_TokenTag_index)-1 {
 		return "TokenTag(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
-	return _TokenTag_name[_TokenTag_index[i]:_TokenTag_index[i+1]]
+	return _TokenTag_name[_TokenTag_index[idx]:_TokenTag_index[idx+1]]
 }
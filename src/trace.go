@@ -0,0 +1,133 @@
+package lang
+
+import (
+	"fmt"
+	"strings"
+)
+
+// statements and calls are cut short in the trace past this many characters
+const maxTraceText = 60
+
+// traceLine writes a line of the trace, indented by call depth
+func (ev *Evaluator) traceLine(node Node, text string) {
+	ev.traceLines++
+	if ev.traceLimit > 0 && ev.traceLines > ev.traceLimit {
+		if ev.traceLines == ev.traceLimit+1 {
+			fmt.Fprintf(ev.traceOut, "trace stopped after %d lines\n", ev.traceLimit)
+		}
+		return
+	}
+
+	line, _ := ev.lex.GetLineAndCol(*node.Token())
+	if r := []rune(text); len(r) > maxTraceText {
+		text = string(r[:maxTraceText-1]) + "…"
+	}
+	depth := len(ev.frames) - 1
+	fmt.Fprintf(ev.traceOut, "%4d | %s%s\n", line, strings.Repeat("  ", depth), text)
+}
+
+// traceStmt traces a statement as it starts. Statements that set a variable
+// are traced by traceResult instead, once the value is known.
+func (ev *Evaluator) traceStmt(stmt Stmt) {
+	switch node := stmt.(type) {
+	case *StmtVar, *StmtBlock:
+	case *StmtExpr:
+		if !isAssignment(node.Expr) {
+			ev.traceLine(node, exprText(node.Expr))
+		}
+	case *StmtFor:
+		switch {
+		case node.Value == nil:
+			ev.traceLine(node, "for")
+		case node.IndexIdentifier != "":
+			ev.traceLine(node, fmt.Sprintf("for %s, %s in %s", node.Identifier, node.IndexIdentifier, exprText(node.Value)))
+		default:
+			ev.traceLine(node, fmt.Sprintf("for %s in %s", node.Identifier, exprText(node.Value)))
+		}
+	case *StmtIf:
+		ev.traceLine(node, "if "+exprText(node.Condition))
+	case *StmtReturn:
+		ev.traceLine(node, "return "+exprText(node.Value))
+	case *StmtMatch:
+		ev.traceLine(node, "match "+exprText(node.Value))
+	case *StmtBreak:
+		ev.traceLine(node, "break")
+	case *StmtContinue:
+		ev.traceLine(node, "continue")
+	case *StmtTry:
+		ev.traceLine(node, "try")
+	}
+}
+
+// traceResult traces a var or an assignment with the value it set
+func (ev *Evaluator) traceResult(stmt Stmt, v Value) {
+	switch node := stmt.(type) {
+	case *StmtVar:
+		ev.traceLine(node, fmt.Sprintf("var %s = %s", node.Identifier, v.Repr()))
+	case *StmtExpr:
+		if isAssignment(node.Expr) {
+			ev.traceLine(node, fmt.Sprintf("%s = %s", exprText(node.Expr.(*ExprBinary).Lhs), v.Repr()))
+		}
+	}
+}
+
+// traceCall traces a call to a function written in the language, natives
+// aren't traced
+func (ev *Evaluator) traceCall(callSite Node, fn *ExprFunc, args []Value) {
+	reprs := make([]string, len(args))
+	for i, arg := range args {
+		reprs[i] = arg.Repr()
+	}
+	ev.traceLine(callSite, fmt.Sprintf("call %s(%s)", fn.Identifier, strings.Join(reprs, ", ")))
+}
+
+func isAssignment(expr Expr) bool {
+	b, ok := expr.(*ExprBinary)
+	return ok && b.Op.Tag == Equal
+}
+
+// exprText is a short description of an expression, close to its source
+func exprText(expr Expr) string {
+	switch e := expr.(type) {
+	case *ExprString:
+		return "'" + e.Str + "'"
+	case *ExprIdentifier:
+		return e.Identifier
+	case *ExprNum:
+		return fmt.Sprint(e.Num)
+	case *ExprFloat:
+		return formatFloat(e.Float)
+	case *ExprNil:
+		return "nil"
+	case *ExprArray:
+		items := make([]string, len(e.Items))
+		for i, item := range e.Items {
+			items[i] = exprText(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case *ExprMap:
+		return "{...}"
+	case *ExprBinary:
+		if e.Op.Tag == LSquare {
+			return exprText(e.Lhs) + "[" + exprText(e.Rhs) + "]"
+		}
+		return exprText(e.Lhs) + " " + e.Op.Tag.String() + " " + exprText(e.Rhs)
+	case *ExprUnary:
+		return e.Op.Tag.String() + exprText(e.Lhs)
+	case *ExprFuncall:
+		args := make([]string, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = exprText(arg)
+		}
+		if e.Spread {
+			args[len(args)-1] += ".."
+		}
+		return exprText(e.Identifier) + "(" + strings.Join(args, ", ") + ")"
+	case *ExprFunc:
+		return "fn " + e.Identifier
+	case *ExprMatch:
+		return "match " + exprText(e.Match.Value) + " {...}"
+	default:
+		return "?"
+	}
+}
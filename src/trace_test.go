@@ -0,0 +1,64 @@
+package lang
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const traceSrc = `fn double(n) {
+  var result = n * 2
+  return result
+}
+part1: {
+  var total = 0
+  for i in [1, 2] {
+    total = total + double(i)
+  }
+  return total
+}`
+
+func TestTrace(t *testing.T) {
+	var out bytes.Buffer
+	ev := mustCompile(t, traceSrc).NewEvaluator(WithTrace(&out, 0))
+	if _, err := ev.EvalSection("part1"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"   6 | var total = 0",
+		"   7 | for i in [1, 2]",
+		"   8 | call double(1)",
+		"   2 |   var result = 2",
+		"   3 |   return result",
+		"   8 | total = 2",
+		"   8 | call double(2)",
+		"   2 |   var result = 4",
+		"   3 |   return result",
+		"   8 | total = 6",
+		"  10 | return total",
+	}
+	got := strings.Split(strings.TrimSpace(out.String()), "\n")
+	// the top level declares double before the section runs
+	got = got[1:]
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(want, "\n"), out.String())
+	}
+}
+
+func TestTraceLimit(t *testing.T) {
+	var out bytes.Buffer
+	ev := mustCompile(t, traceSrc).NewEvaluator(WithTrace(&out, 3))
+	v, err := ev.EvalSection("part1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Num != 6 {
+		t.Errorf("expected the program to carry on, got %s", v.Repr())
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || lines[3] != "trace stopped after 3 lines" {
+		t.Errorf("expected 3 lines and a note, got\n%s", out.String())
+	}
+}
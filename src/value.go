@@ -2,6 +2,8 @@ package lang
 
 import (
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -15,39 +17,87 @@ const (
 	ValNum                      // number
 	ValArray                    // array
 	ValMap                      // map
+	ValSet                      // set
 	ValRange                    // range
+	ValHeap                     // heap
+	ValQueue                    // queue
 	ValNativeFn                 // <nativeFn>
 	ValFn                       // <fn>
+	ValFloat                    // float
+	ValIter                     // iterator
+	ValBuffer                   // buffer
 )
 
 type Value struct {
 	Tag      ValueTag
-	Str      *string
-	Num      *int
+	Str      string
+	Num      int
+	Float    float64
 	Array    *[]Value
-	Map      *map[string]Value
+	Map      *map[MapKey]Value
 	Range    *Range
-	NativeFn func([]Value) Value
+	NativeFn func(*Evaluator, []Value) Value
 	Fn       *Closure
+
+	// the rarer kinds share one field rather than each making every value,
+	// array item and argument a word bigger, see set, heap and friends
+	ref interface{}
 }
 
+// set, heap, queue, iter and buffer are what ref holds for a value with
+// that tag
+func (v Value) set() *map[MapKey]Value   { return v.ref.(*map[MapKey]Value) }
+func (v Value) heap() *Heap              { return v.ref.(*Heap) }
+func (v Value) queue() *Queue            { return v.ref.(*Queue) }
+func (v Value) iter() *Iter              { return v.ref.(*Iter) }
+func (v Value) buffer() *strings.Builder { return v.ref.(*strings.Builder) }
+
 type Closure struct {
 	fn  *ExprFunc
 	env *Env
 }
 
 var NilValue = Value{Tag: ValNil}
-var zero = 0
-var ZeroValue = Value{Tag: ValNum, Num: &zero}
+var ZeroValue = Value{Tag: ValNum, Num: 0}
+
+func NewNum(n int) Value {
+	return Value{Tag: ValNum, Num: n}
+}
+
+func NewFloat(f float64) Value {
+	return Value{Tag: ValFloat, Float: f}
+}
+
+func NewStr(s string) Value {
+	return Value{Tag: ValStr, Str: s}
+}
+
+// NewArray makes an array holding items. The array shares items' backing
+// storage, changes from either side are visible to the other.
+func NewArray(items []Value) Value {
+	return Value{Tag: ValArray, Array: &items}
+}
+
+// NewMap makes a map of items with string keys. The map is a copy of items,
+// unlike NewArray it doesn't share them.
+func NewMap(items map[string]Value) Value {
+	m := make(map[MapKey]Value, len(items))
+	for k, v := range items {
+		m[strKey(k)] = v
+	}
+	return Value{Tag: ValMap, Map: &m}
+}
 
 func (v Value) Repr() string {
 	switch v.Tag {
 	case ValNil:
 		return "nil"
 	case ValStr:
-		return "'" + *v.Str + "'"
+		return "'" + v.Str + "'"
 	case ValNum:
-		return strconv.Itoa(*v.Num)
+		return strconv.Itoa(v.Num)
+	case ValFloat:
+		return formatFloat(v.Float)
 	case ValArray:
 		var sb strings.Builder
 		sb.WriteString("[")
@@ -60,24 +110,38 @@ func (v Value) Repr() string {
 		sb.WriteString("]")
 		return sb.String()
 	case ValMap:
+		// sorted so the same map always looks the same
 		var sb strings.Builder
 		sb.WriteString("{")
-		empty := true
-		for k, v := range *v.Map {
-			sb.WriteString(k)
+		for index, k := range v.mapKeys() {
+			if index > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(k.String())
 			sb.WriteString(": ")
-			sb.WriteString(v.Repr())
-			sb.WriteString(", ")
-			empty = false
-		}
-		if empty {
-			sb.WriteString("}")
-		} else {
-			sb.WriteString("\b\b}") // backspace over the last comma
+			sb.WriteString((*v.Map)[k].Repr())
 		}
+		sb.WriteString("}")
 		return sb.String()
+	case ValSet:
+		keys := sortKeys(*v.set())
+		members := make([]string, len(keys))
+		for i, k := range keys {
+			members[i] = k.String()
+		}
+		return "{" + strings.Join(members, ", ") + "}"
+	case ValRange:
+		return fmt.Sprintf("range(%d, %d)", v.Range.current, v.Range.end)
+	case ValFn:
+		fn := v.Fn.fn
+		if fn.Identifier == anonymousFn {
+			return fmt.Sprintf("<fn(%d)>", len(fn.Args))
+		}
+		return fmt.Sprintf("<fn %s(%d)>", fn.Identifier, len(fn.Args))
+	case ValNativeFn:
+		return v.Tag.String()
 	default:
-		return fmt.Sprintf("<%s>\n", v.Tag.String())
+		return "<" + v.Tag.String() + ">"
 	}
 }
 
@@ -86,9 +150,11 @@ func (v Value) String() string {
 	case ValNil:
 		return "nil"
 	case ValStr:
-		return *v.Str
+		return v.Str
 	case ValNum:
-		return strconv.Itoa(*v.Num)
+		return strconv.Itoa(v.Num)
+	case ValFloat:
+		return formatFloat(v.Float)
 	default:
 		return v.Repr()
 	}
@@ -97,101 +163,403 @@ func (v Value) String() string {
 func (v Value) isTruthy() bool {
 	switch v.Tag {
 	case ValNum:
-		return *v.Num != 0
+		return v.Num != 0
+	case ValFloat:
+		return v.Float != 0
 	}
 	return false
 }
 
+// formatFloat always shows a decimal point, so 4.0 doesn't look like the
+// integer 4
+func formatFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	if strings.ContainsAny(s, ".IN") {
+		return s
+	}
+	return s + ".0"
+}
+
+// isNumber is true for integers and floats
+func (v Value) isNumber() bool {
+	return v.Tag == ValNum || v.Tag == ValFloat
+}
+
+// asFloat returns a number as a float, integers are converted
+func (v Value) asFloat() float64 {
+	if v.Tag == ValFloat {
+		return v.Float
+	}
+	return float64(v.Num)
+}
+
 func (v Value) negate() Value {
 	switch v.Tag {
 	case ValNum:
-		num := *v.Num
+		num := v.Num
 		num = num - 1
 		if num < 0 {
 			num = -num
 		}
-		return Value{Tag: ValNum, Num: &num}
+		return Value{Tag: ValNum, Num: num}
 	}
 	return NilValue
 }
 
+// setMembers returns the members of a set in the order repr shows them, as
+// the values they were added as
+func (v Value) setMembers() []Value {
+	keys := sortKeys(*v.set())
+	members := make([]Value, len(keys))
+	for i, k := range keys {
+		members[i] = (*v.set())[k]
+	}
+	return members
+}
+
+// mapKey converts a value to the string used to key strings and arrays.
+// Arrays of keyable values are keyed by their repr, so m[[1, 2]] is stored
+// under the string '[1, 2]' and that string is the key a for loop over m
+// gives back. A float in the array that's a whole number is written as the
+// integer, so [1.0] is the same key as [1] like 1.0 is the same key as 1.
+func mapKey(key Value) (string, bool) {
+	switch key.Tag {
+	case ValStr:
+		return key.Str, true
+	case ValArray:
+		var sb strings.Builder
+		sb.WriteString("[")
+		for i, item := range *key.Array {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			k, ok := keyOf(item)
+			switch {
+			case !ok:
+				return "", false
+			case item.Tag == ValStr:
+				sb.WriteString(item.Repr())
+			default:
+				sb.WriteString(k.String())
+			}
+		}
+		sb.WriteString("]")
+		return sb.String(), true
+	}
+	return "", false
+}
+
+// MapKey is what a map's items are keyed on. Integers are keys of their own
+// rather than strings, so m[1] doesn't format 1 and a for loop over m gives
+// back the number. A float that's a whole number is keyed as that integer,
+// any other float is a key of its own, and every other key is the string
+// mapKey makes.
+type MapKey struct {
+	str  string
+	num  int // the integer, or a float's bits
+	kind keyKind
+}
+
+type keyKind uint8
+
+const (
+	keyStr keyKind = iota
+	keyNum
+	keyFloat
+)
+
+func numKey(n int) MapKey    { return MapKey{num: n, kind: keyNum} }
+func strKey(s string) MapKey { return MapKey{str: s} }
+
+// floatKey is the key for f, NaN isn't equal to itself so it can't be one
+func floatKey(f float64) (MapKey, bool) {
+	switch {
+	case math.IsNaN(f):
+		return MapKey{}, false
+	// -2^63 is exact as a float, 2^63 is the first one past the top
+	case f == math.Trunc(f) && f >= math.MinInt64 && f < -math.MinInt64:
+		return numKey(int(f)), true
+	}
+	return MapKey{num: int(math.Float64bits(f)), kind: keyFloat}, true
+}
+
+// keyOf converts a value to a map key, or false if it can't be one
+func keyOf(v Value) (MapKey, bool) {
+	switch v.Tag {
+	case ValNum:
+		return numKey(v.Num), true
+	case ValFloat:
+		return floatKey(v.Float)
+	}
+	s, ok := mapKey(v)
+	return strKey(s), ok
+}
+
+func (k MapKey) float() float64 {
+	if k.kind == keyNum {
+		return float64(k.num)
+	}
+	return math.Float64frombits(uint64(k.num))
+}
+
+// Value is the key as a for loop over the map gives it back
+func (k MapKey) Value() Value {
+	switch k.kind {
+	case keyNum:
+		return Value{Tag: ValNum, Num: k.num}
+	case keyFloat:
+		return Value{Tag: ValFloat, Float: k.float()}
+	}
+	return Value{Tag: ValStr, Str: k.str}
+}
+
+func (k MapKey) String() string {
+	switch k.kind {
+	case keyNum:
+		return strconv.Itoa(k.num)
+	case keyFloat:
+		return formatFloat(k.float())
+	}
+	return k.str
+}
+
+// mapKeys returns a map's keys in the order repr shows them
+func (v Value) mapKeys() []MapKey {
+	return sortKeys(*v.Map)
+}
+
+// sortKeys returns the keys of a map or set, the numbers from smallest to
+// largest and then the strings in order
+func sortKeys(m map[MapKey]Value) []MapKey {
+	keys := make([]MapKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if (a.kind == keyStr) != (b.kind == keyStr) {
+			return b.kind == keyStr
+		}
+		switch {
+		case a.kind == keyNum && b.kind == keyNum:
+			return a.num < b.num
+		case a.kind != keyStr:
+			return a.float() < b.float()
+		}
+		return a.str < b.str
+	})
+	return keys
+}
+
 func (v Value) getKey(key Value) (Value, error) {
-tagSwitch:
 	switch v.Tag {
 	case ValArray:
 		if key.Tag == ValNum {
-			index := *key.Num
+			index := key.Num
 			array := *v.Array
 			if index >= len(array) || index < 0 {
 				return NilValue, fmt.Errorf("index %d out of range", index)
 			}
-			return (*v.Array)[*key.Num], nil
+			return (*v.Array)[key.Num], nil
 		}
 	case ValMap:
-		var keyStr string
-
-		switch key.Tag {
-		case ValNum:
-			keyStr = strconv.Itoa(*key.Num)
-		case ValStr:
-			keyStr = *key.Str
-		default:
-			break tagSwitch
+		if k, ok := keyOf(key); ok {
+			return (*v.Map)[k], nil
 		}
-
-		return (*v.Map)[keyStr], nil
 	case ValStr:
 		if key.Tag == ValNum {
-			index := *key.Num
-			str := *v.Str
-			if index >= len(str) {
-				return NilValue, fmt.Errorf("index %d out of range", index)
+			c, ok := runeAt(v.Str, key.Num)
+			if !ok {
+				return NilValue, fmt.Errorf("index %d out of range", key.Num)
 			}
-			s := string((*v.Str)[*key.Num])
-			return Value{Tag: ValStr, Str: &s}, nil
+			return Value{Tag: ValStr, Str: c}, nil
+		}
+	case ValRange:
+		if key.Tag == ValNum {
+			n, ok := v.Range.at(key.Num)
+			if !ok {
+				return NilValue, fmt.Errorf("index %d out of range", key.Num)
+			}
+			return Value{Tag: ValNum, Num: n}, nil
 		}
 	}
 	return NilValue, fmt.Errorf("cannot subscript a %v with a %v", v.Tag, key.Tag)
 }
 
-func (v Value) setKey(key Value, val Value) bool {
-tagSwitch:
+func (v Value) setKey(key Value, val Value) error {
 	switch v.Tag {
 	case ValArray:
 		if key.Tag == ValNum {
-			(*v.Array)[*key.Num] = val
-			return true
+			if key.Num < 0 || key.Num >= len(*v.Array) {
+				return fmt.Errorf("index %d out of range", key.Num)
+			}
+			(*v.Array)[key.Num] = val
+			return nil
 		}
 	case ValMap:
-		var keyStr string
+		if k, ok := keyOf(key); ok {
+			(*v.Map)[k] = val
+			return nil
+		}
+	}
+	return fmt.Errorf("%v is not subscriptable", v.Tag)
+}
+
+// deepCopy copies arrays and maps all the way down. It uses an explicit stack
+// rather than recursion so deeply nested values can't overflow the go stack.
+func (v Value) deepCopy() (Value, error) {
+	type copyTask struct{ src, dst Value }
+	stack := make([]copyTask, 0)
 
-		switch key.Tag {
-		case ValNum:
-			keyStr = strconv.Itoa(*key.Num)
-		case ValStr:
-			keyStr = *key.Str
-		default:
-			break tagSwitch
+	// shallow makes an empty container to copy into and queues up filling it
+	shallow := func(v Value) (Value, error) {
+		switch v.Tag {
+		case ValArray:
+			arr := make([]Value, len(*v.Array))
+			dst := Value{Tag: ValArray, Array: &arr}
+			stack = append(stack, copyTask{v, dst})
+			return dst, nil
+		case ValMap:
+			m := make(map[MapKey]Value, len(*v.Map))
+			dst := Value{Tag: ValMap, Map: &m}
+			stack = append(stack, copyTask{v, dst})
+			return dst, nil
+		case ValSet:
+			set := make(map[MapKey]Value, len(*v.set()))
+			dst := Value{Tag: ValSet, ref: &set}
+			stack = append(stack, copyTask{v, dst})
+			return dst, nil
+		case ValRange:
+			r := *v.Range
+			return Value{Tag: ValRange, Range: &r}, nil
+		case ValHeap:
+			h := make(Heap, len(*v.heap()))
+			dst := Value{Tag: ValHeap, ref: &h}
+			stack = append(stack, copyTask{v, dst})
+			return dst, nil
+		case ValQueue:
+			q := Queue{items: make([]Value, v.queue().len())}
+			dst := Value{Tag: ValQueue, ref: &q}
+			stack = append(stack, copyTask{v, dst})
+			return dst, nil
+		case ValBuffer:
+			var b strings.Builder
+			b.WriteString(v.buffer().String())
+			return Value{Tag: ValBuffer, ref: &b}, nil
+		case ValFn, ValNativeFn:
+			return NilValue, fmt.Errorf("%s in it, which can't be copied", withArticle(typeName(v)))
 		}
+		return v, nil
+	}
 
-		(*v.Map)[keyStr] = val
-		return true
+	root, err := shallow(v)
+	if err != nil {
+		return NilValue, err
 	}
-	return false
+
+	for len(stack) > 0 {
+		task := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		switch task.src.Tag {
+		case ValArray:
+			for index, item := range *task.src.Array {
+				c, err := shallow(item)
+				if err != nil {
+					return NilValue, err
+				}
+				(*task.dst.Array)[index] = c
+			}
+		case ValMap:
+			for key, item := range *task.src.Map {
+				c, err := shallow(item)
+				if err != nil {
+					return NilValue, err
+				}
+				(*task.dst.Map)[key] = c
+			}
+		case ValSet:
+			for key, member := range *task.src.set() {
+				c, err := shallow(member)
+				if err != nil {
+					return NilValue, err
+				}
+				(*task.dst.set())[key] = c
+			}
+		case ValHeap:
+			// the copy keeps the same order, it's still a valid heap
+			for index, item := range *task.src.heap() {
+				c, err := shallow(item.value)
+				if err != nil {
+					return NilValue, err
+				}
+				(*task.dst.heap())[index] = heapItem{item.priority, c}
+			}
+		case ValQueue:
+			for index, item := range task.src.queue().values() {
+				c, err := shallow(item)
+				if err != nil {
+					return NilValue, err
+				}
+				task.dst.queue().items[index] = c
+			}
+		}
+	}
+
+	return root, nil
+}
+
+// AsNum returns the number v holds, or false if it isn't a number
+func (v Value) AsNum() (int, bool) {
+	return v.Num, v.Tag == ValNum
+}
+
+// AsFloat returns the number v holds as a float, or false if it isn't a
+// number. Integers are converted.
+func (v Value) AsFloat() (float64, bool) {
+	return v.asFloat(), v.isNumber()
+}
+
+// AsStr returns the string v holds, or false if it isn't a string
+func (v Value) AsStr() (string, bool) {
+	return v.Str, v.Tag == ValStr
+}
+
+// AsArray returns the items of an array, or false if v isn't one
+func (v Value) AsArray() ([]Value, bool) {
+	if v.Tag != ValArray {
+		return nil, false
+	}
+	return *v.Array, true
+}
+
+// AsMap returns a copy of the items of a map keyed by strings, integer keys
+// are formatted, or false if v isn't a map
+func (v Value) AsMap() (map[string]Value, bool) {
+	if v.Tag != ValMap {
+		return nil, false
+	}
+	items := make(map[string]Value, len(*v.Map))
+	for k, item := range *v.Map {
+		items[k.String()] = item
+	}
+	return items, true
 }
 
 func (v Value) CheckTagOrPanic(expectedTag ValueTag) {
 	if v.Tag != expectedTag {
-		panic(fmt.Errorf("expected a %s but found a %s", expectedTag.String(), v.Tag.String()))
+		panic(E(RuntimeError, fmt.Sprintf("expected a %s but found a %s", expectedTag.String(), v.Tag.String()), 0))
 	}
 }
 
 func (v Value) Compare(b Value) (bool, error) {
 	switch {
 	case v.Tag == ValNum && b.Tag == ValNum:
-		return *v.Num == *b.Num, nil
+		return v.Num == b.Num, nil
+	case v.isNumber() && b.isNumber():
+		return v.asFloat() == b.asFloat(), nil
 	case v.Tag == ValStr && b.Tag == ValStr:
-		return *v.Str == *b.Str, nil
+		return v.Str == b.Str, nil
 	case v.Tag == ValNil && b.Tag == ValNil:
 		return true, nil
 	case v.Tag == ValNil && b.Tag != ValNil, v.Tag != ValNil && b.Tag == ValNil:
@@ -215,3 +583,89 @@ func (r *Range) next() {
 func (r *Range) done() bool {
 	return r.current == r.end
 }
+
+// len is how many numbers are left in the range
+func (r *Range) len() int {
+	return (r.end - r.current) * r.step
+}
+
+// at is the range's index'th number, ok is false if it's out of range
+func (r *Range) at(index int) (int, bool) {
+	if index < 0 || index >= r.len() {
+		return 0, false
+	}
+	return r.current + index*r.step, true
+}
+
+// contains reports whether n is one of the range's numbers
+func (r *Range) contains(n int) bool {
+	_, ok := r.at((n - r.current) * r.step)
+	return ok
+}
+
+// Heap is a min-heap of values ordered by priority, it implements
+// container/heap's Interface
+type Heap []heapItem
+
+type heapItem struct {
+	priority int
+	value    Value
+}
+
+func (h Heap) Len() int            { return len(h) }
+func (h Heap) Less(i, j int) bool  { return h[i].priority < h[j].priority }
+func (h Heap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *Heap) Push(x interface{}) { *h = append(*h, x.(heapItem)) }
+func (h *Heap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// Queue is a double ended queue. Popping from the front moves head forward
+// rather than copying, the dead space is reclaimed once it's more than half
+// of the slice.
+type Queue struct {
+	items []Value
+	head  int
+}
+
+func (q *Queue) len() int {
+	return len(q.items) - q.head
+}
+
+// values returns a copy of the items in the queue from front to back
+func (q *Queue) values() []Value {
+	items := make([]Value, q.len())
+	copy(items, q.items[q.head:])
+	return items
+}
+
+func (q *Queue) push(v Value) {
+	q.items = append(q.items, v)
+}
+
+func (q *Queue) popFront() Value {
+	if q.len() == 0 {
+		return NilValue
+	}
+	v := q.items[q.head]
+	q.items[q.head] = NilValue
+	q.head++
+
+	if q.head > len(q.items)/2 {
+		q.items = append(q.items[:0], q.items[q.head:]...)
+		q.head = 0
+	}
+	return v
+}
+
+func (q *Queue) popBack() Value {
+	if q.len() == 0 {
+		return NilValue
+	}
+	v := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	return v
+}
@@ -0,0 +1,153 @@
+package lang
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// every array item and argument is a Value, new kinds of value go in ref
+// rather than making them all bigger
+func TestValueSize(t *testing.T) {
+	if size := unsafe.Sizeof(Value{}); size > 96 {
+		t.Errorf("expected a value to be at most 96 bytes, got %d", size)
+	}
+}
+
+func TestSetRepr(t *testing.T) {
+	set := map[MapKey]Value{}
+	for _, member := range []Value{{Tag: ValStr, Str: "c"}, {Tag: ValStr, Str: "a"}, {Tag: ValNum, Num: 10}, {Tag: ValNum, Num: 9}} {
+		key, _ := keyOf(member)
+		set[key] = member
+	}
+	v := Value{Tag: ValSet, ref: &set}
+	if v.Repr() != "{9, 10, a, c}" {
+		t.Fatalf("expected {9, 10, a, c} but got %s", v.Repr())
+	}
+
+	empty := map[MapKey]Value{}
+	v = Value{Tag: ValSet, ref: &empty}
+	if v.Repr() != "{}" {
+		t.Fatalf("expected {} but got %s", v.Repr())
+	}
+}
+
+func TestFloatRepr(t *testing.T) {
+	tests := map[float64]string{
+		3.5:   "3.5",
+		4:     "4.0",
+		-0.25: "-0.25",
+		1e21:  "1000000000000000000000.0",
+	}
+	for f, want := range tests {
+		if got := NewFloat(f).Repr(); got != want {
+			t.Errorf("expected %s but got %s", want, got)
+		}
+	}
+}
+
+func TestIntegerArithmeticUnchanged(t *testing.T) {
+	for _, op := range []TokenTag{Plus, Minus, Star, Slash, Percent} {
+		v, err := binaryOp(op, NewNum(7), NewNum(2))
+		if err != nil || v.Tag != ValNum {
+			t.Errorf("%s: expected an integer, got %s %v", op, v.Tag, err)
+		}
+		v, err = binaryOp(op, NewNum(7), NewFloat(2))
+		if err != nil || v.Tag != ValFloat {
+			t.Errorf("%s: expected a float, got %s %v", op, v.Tag, err)
+		}
+	}
+}
+
+func TestFloatKeys(t *testing.T) {
+	tests := []struct {
+		f    float64
+		want MapKey
+	}{
+		{2, numKey(2)},
+		{math.Copysign(0, -1), numKey(0)},
+		{-math.Pow(2, 63), numKey(math.MinInt64)},
+		{1.5, MapKey{num: int(math.Float64bits(1.5)), kind: keyFloat}},
+		{math.Pow(2, 63), MapKey{num: int(math.Float64bits(math.Pow(2, 63))), kind: keyFloat}},
+	}
+	for _, test := range tests {
+		if got, ok := floatKey(test.f); !ok || got != test.want {
+			t.Errorf("expected %v to be keyed as %v, got %v", test.f, test.want, got)
+		}
+	}
+	if _, ok := floatKey(math.NaN()); ok {
+		t.Errorf("expected NaN not to be a key")
+	}
+}
+
+func TestMapRepr(t *testing.T) {
+	inner := map[string]Value{}
+	m := map[string]Value{"b": NewNum(2), "a": NewStr("x"), "c": NewMap(inner)}
+	for i := 0; i < 10; i++ {
+		if got := NewMap(m).Repr(); got != "{a: 'x', b: 2, c: {}}" {
+			t.Fatalf("expected {a: 'x', b: 2, c: {}} but got %q", got)
+		}
+	}
+}
+
+func TestRepr(t *testing.T) {
+	src := `fn add(a, b) { return a + b }
+part1: {
+  return [nil, 1, 'a', [1], add, fn(x) { return x }, len, range(2, 10), rangei(5, 3), heap(), queue()]
+}`
+	v, err := evalSource(t, src, "part1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"nil", "1", "'a'", "[1]", "<fn add(2)>", "<fn(1)>", "<nativeFn>", "range(2, 10)", "range(5, 2)", "<heap>", "<queue>"}
+	for i, item := range *v.Array {
+		if item.Repr() != want[i] {
+			t.Errorf("expected %s but got %q", want[i], item.Repr())
+		}
+		if item.Tag != ValStr && item.String() != want[i] {
+			t.Errorf("expected String() to be %s but got %q", want[i], item.String())
+		}
+	}
+}
+
+func TestStringIndexByRune(t *testing.T) {
+	short := "a→b"
+	long := short + strings.Repeat("x", runeCacheMin)
+	for _, s := range []string{short, long} {
+		v := NewStr(s)
+		c, err := v.getKey(NewNum(1))
+		if err != nil || c.Str != "→" {
+			t.Errorf("expected → at index 1, got %q, %v", c.Str, err)
+		}
+		n := utf8.RuneCountInString(s)
+		if _, err := v.getKey(NewNum(n)); err == nil {
+			t.Errorf("expected index %d of a %d rune string to be out of range", n, n)
+		}
+		if got := runeLen(s); got != n {
+			t.Errorf("expected a length of %d, got %d", n, got)
+		}
+	}
+}
+
+func TestStringIndexDoesntAllocate(t *testing.T) {
+	long := strings.Repeat("#.█", runeCacheMin)
+	v, last := NewStr(long), NewNum(utf8.RuneCountInString(long)-1)
+	if c, err := v.getKey(last); err != nil || c.Str != "█" {
+		t.Errorf("expected █ at the last index, got %q, %v", c.Str, err)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		v.getKey(NewNum(2))
+		v.getKey(last)
+		char('#')
+	})
+	if allocs > 0 {
+		t.Errorf("expected indexing to reuse the string's bytes, got %v allocations", allocs)
+	}
+	for r := rune(0); r < utf8.RuneSelf; r++ {
+		if char(r) != string(r) {
+			t.Fatalf("expected char(%d) to be %q, got %q", r, string(r), char(r))
+		}
+	}
+}
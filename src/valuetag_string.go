@@ -13,18 +13,25 @@ func _() {
 	_ = x[ValNum-2]
 	_ = x[ValArray-3]
 	_ = x[ValMap-4]
-	_ = x[ValRange-5]
-	_ = x[ValNativeFn-6]
-	_ = x[ValFn-7]
+	_ = x[ValSet-5]
+	_ = x[ValRange-6]
+	_ = x[ValHeap-7]
+	_ = x[ValQueue-8]
+	_ = x[ValNativeFn-9]
+	_ = x[ValFn-10]
+	_ = x[ValFloat-11]
+	_ = x[ValIter-12]
+	_ = x[ValBuffer-13]
 }
 
-const _ValueTag_name = "nilstringnumberarraymaprange<nativeFn><fn>"
+const _ValueTag_name = "nilstringnumberarraymapsetrangeheapqueue<nativeFn><fn>floatiteratorbuffer"
 
-var _ValueTag_index = [...]uint8{0, 3, 9, 15, 20, 23, 28, 38, 42}
+var _ValueTag_index = [...]uint8{0, 3, 9, 15, 20, 23, 26, 31, 35, 40, 50, 54, 59, 67, 73}
 
 func (i ValueTag) String() string {
-	if i >= ValueTag(len(_ValueTag_index)-1) {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_ValueTag_index)-1 {
 		return "ValueTag(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
-	return _ValueTag_name[_ValueTag_index[i]:_ValueTag_index[i+1]]
+	return _ValueTag_name[_ValueTag_index[idx]:_ValueTag_index[idx+1]]
 }
@@ -0,0 +1,436 @@
+package lang
+
+import (
+	"fmt"
+)
+
+// vm runs bytecode from the compiler. It shares the evaluator's globals and
+// natives, so the two can call each other's functions: the vm calls into the
+// evaluator for anything it couldn't compile, and natives like memo call
+// functions with the evaluator.
+type vm struct {
+	ev       *Evaluator
+	fns      map[*ExprFunc]*chunk
+	sections map[*StmtSection]*chunk
+
+	// locals and operands for every frame
+	stack  []Value
+	frames []vmFrame
+	iters  []iterator
+}
+
+type vmFrame struct {
+	chunk *chunk
+	ip    int
+	base  int // where the frame's locals start in the stack
+	args  int // how many arguments the call passed
+	iters int // the height of the iterator stack when the frame was entered
+}
+
+// iterator is a for loop in progress
+type iterator struct {
+	tag     ValueTag
+	items   []Value
+	members []Value
+	keys    []MapKey
+	m       map[MapKey]Value
+	rng     *Range
+	next    iterNext
+	index   int
+	started bool
+}
+
+// EnableVM compiles the program's top level functions and sections to
+// bytecode and runs them on the vm from now on. Anything the compiler can't
+// handle stays on the tree-walker, the returned notes say what and why.
+func (ev *Evaluator) EnableVM() []string {
+	if ev.profileMode {
+		return []string{"the profiler doesn't support the vm, everything runs on the tree-walker"}
+	}
+	if ev.traceOut != nil {
+		return []string{"tracing doesn't support the vm, everything runs on the tree-walker"}
+	}
+	if ev.debugger != nil {
+		return []string{"the debugger doesn't support the vm, everything runs on the tree-walker"}
+	}
+
+	m := &vm{
+		ev:       ev,
+		fns:      make(map[*ExprFunc]*chunk),
+		sections: make(map[*StmtSection]*chunk),
+	}
+	notes := make([]string, 0)
+	fallback := func(what string, u *unsupported) {
+		line, _ := ev.lex.GetLineAndCol(*u.node.Token())
+		notes = append(notes, fmt.Sprintf("%s runs on the tree-walker: %s (line %d)", what, u.reason, line))
+	}
+
+	for _, stmt := range ev.prog.Stmts {
+		switch node := stmt.(type) {
+		case *StmtSection:
+			c, u := compileSection(ev.lex, node)
+			if u != nil {
+				fallback("section "+node.Label, u)
+				continue
+			}
+			m.sections[node] = c
+		case *StmtExpr:
+			fn, ok := node.Expr.(*ExprFunc)
+			if !ok {
+				continue
+			}
+			c, u := compileFn(ev.lex, fn)
+			if u != nil {
+				fallback("fn "+fn.Identifier, u)
+				continue
+			}
+			m.fns[fn] = c
+		}
+	}
+
+	ev.vm = m
+	return notes
+}
+
+func (m *vm) fail(f *vmFrame, format string, args ...interface{}) Error {
+	return m.ev.lex.errorAt(RuntimeError, f.chunk.tokens[f.ip-1], fmt.Sprintf(format, args...))
+}
+
+// trace returns the lines of the calls in progress, innermost first
+func (m *vm) trace() []int {
+	var lines []int
+	for i := len(m.frames) - 2; i >= 0; i-- {
+		f := &m.frames[i]
+		line, _ := m.ev.lex.GetLineAndCol(f.chunk.tokens[f.ip-1])
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// checkCancelled is the evaluator's checkCancelled for the vm
+func (m *vm) checkCancelled(f *vmFrame) {
+	m.ev.steps++
+	if m.ev.steps%cancelCheckInterval != 0 {
+		return
+	}
+	if err := m.ev.ctx.Err(); err != nil {
+		panic(m.fail(f, "%s", cancelMessage(err)))
+	}
+}
+
+func (m *vm) push(v Value) {
+	m.stack = append(m.stack, v)
+}
+
+func (m *vm) pop() Value {
+	v := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return v
+}
+
+// pushFrame enters c, the top n values on the stack are its arguments
+func (m *vm) pushFrame(c *chunk, n int) *vmFrame {
+	m.frames = append(m.frames, vmFrame{chunk: c, base: len(m.stack) - n, args: n, iters: len(m.iters)})
+	for i := n; i < c.locals; i++ {
+		m.stack = append(m.stack, NilValue)
+	}
+	return &m.frames[len(m.frames)-1]
+}
+
+// packRest collects the arguments on the stack past a variadic function's
+// fixed ones into an array for its last arg. Missing fixed args are left nil
+// for their defaults. It returns how many locals are now on the stack.
+func (m *vm) packRest(fn *ExprFunc, n int) int {
+	fixed := fn.fixed()
+	rest := make([]Value, 0)
+	if n > fixed {
+		top := len(m.stack)
+		rest = append(rest, m.stack[top-(n-fixed):]...)
+		m.stack = m.stack[:top-(n-fixed)]
+	}
+	for i := n; i < fixed; i++ {
+		m.push(NilValue)
+	}
+	m.push(Value{Tag: ValArray, Array: &rest})
+	return fixed + 1
+}
+
+// run evaluates a section
+func (m *vm) run(c *chunk) Value {
+	stack, frames, iters := len(m.stack), len(m.frames), len(m.iters)
+	defer func() {
+		if r := recover(); r != nil {
+			// the evaluator only knows about its own calls, add the vm's
+			if e := asError(r); e.Tag == RuntimeError {
+				e.Trace = append(e.Trace, m.trace()...)
+				r = e
+			}
+			m.stack = m.stack[:stack]
+			m.frames = m.frames[:frames]
+			m.iters = m.iters[:iters]
+			panic(r)
+		}
+	}()
+
+	f := m.pushFrame(c, 0)
+	for {
+		in := f.chunk.code[f.ip]
+		f.ip++
+
+		switch in.op {
+		case opConst:
+			m.push(f.chunk.consts[in.a])
+		case opNil:
+			m.push(NilValue)
+		case opPop:
+			m.stack = m.stack[:len(m.stack)-1]
+		case opArgPassed:
+			if in.a < f.args {
+				f.ip = in.c
+			}
+		case opLoad:
+			m.push(m.stack[f.base+in.a])
+		case opStore:
+			m.stack[f.base+in.a] = m.stack[len(m.stack)-1]
+		case opLoadGlobal:
+			name := f.chunk.consts[in.a].Str
+			v, ok := m.ev.findGlobal(name)
+			if !ok {
+				panic(m.fail(f, "%s", m.ev.unknownVariable(name, f.chunk.names)))
+			}
+			m.push(*v)
+		case opStoreGlobal:
+			v := m.stack[len(m.stack)-1]
+			m.ev.updateGlobal(f.chunk.consts[in.a].Str, &v)
+		case opBinary:
+			rhs := m.pop()
+			lhs := m.stack[len(m.stack)-1]
+			v, err := binaryOp(TokenTag(in.a), lhs, rhs)
+			if err != nil {
+				panic(m.fail(f, "%s", err))
+			}
+			m.stack[len(m.stack)-1] = v
+		case opUnary:
+			v, err := unaryOp(TokenTag(in.a), m.stack[len(m.stack)-1])
+			if err != nil {
+				panic(m.fail(f, "%s", err))
+			}
+			m.stack[len(m.stack)-1] = v
+		case opSetKey:
+			val := m.pop()
+			key := m.pop()
+			lhs := m.pop()
+			if err := lhs.setKey(key, val); err != nil {
+				panic(m.fail(f, "%s", err))
+			}
+			m.push(val)
+		case opArray:
+			top := len(m.stack)
+			items := make([]Value, in.a)
+			copy(items, m.stack[top-in.a:])
+			m.stack = m.stack[:top-in.a]
+			m.push(Value{Tag: ValArray, Array: &items})
+		case opMap:
+			keys := f.chunk.mapKeys[in.a]
+			top := len(m.stack)
+			items := make(map[MapKey]Value)
+			for i, key := range keys {
+				items[key] = m.stack[top-len(keys)+i]
+			}
+			m.stack = m.stack[:top-len(keys)]
+			m.push(Value{Tag: ValMap, Map: &items})
+		case opCall:
+			if m.ev.ctx != nil {
+				m.checkCancelled(f)
+			}
+			n := in.a
+			if in.c == 1 {
+				// the last argument is spread
+				last := m.pop()
+				if last.Tag != ValArray {
+					panic(m.fail(f, "only an array can be spread, got %s", withArticle(last.Tag.String())))
+				}
+				m.stack = append(m.stack, *last.Array...)
+				n += len(*last.Array) - 1
+			}
+			top := len(m.stack)
+			fnVal := m.stack[top-n-1]
+			args := m.stack[top-n : top : top]
+
+			switch fnVal.Tag {
+			case ValNativeFn:
+				// the evaluator uses ev.native for line numbers, as it does
+				// for its own native calls
+				prevNative := m.ev.native
+				m.ev.native = f.chunk.calls[in.b]
+				v := fnVal.NativeFn(m.ev, args)
+				m.ev.native = prevNative
+				m.stack = m.stack[:top-n]
+				m.stack[len(m.stack)-1] = v
+			case ValFn:
+				fn := fnVal.Fn.fn
+				callee, ok := m.fns[fn]
+				if !ok || fnVal.Fn.env != m.ev.globals {
+					v := m.ev.fn(f.chunk.calls[in.b], fnVal, args)
+					m.stack = m.stack[:top-n]
+					m.stack[len(m.stack)-1] = v
+					continue
+				}
+				m.ev.checkFnArity(fn, n)
+				locals := n
+				if fn.Variadic {
+					locals = m.packRest(fn, n)
+				}
+				f = m.pushFrame(callee, locals)
+				f.args = n
+			default:
+				panic(m.fail(f, "attempted to call non function"))
+			}
+		case opReturn:
+			v := m.stack[len(m.stack)-1]
+			base := f.base
+			m.iters = m.iters[:f.iters]
+			m.frames = m.frames[:len(m.frames)-1]
+			if len(m.frames) == frames {
+				m.stack = m.stack[:base]
+				return v
+			}
+			// replace the function being called with the result
+			m.stack = m.stack[:base]
+			m.stack[base-1] = v
+			f = &m.frames[len(m.frames)-1]
+		case opJump:
+			// jumping backwards is a loop going round again
+			if in.a < f.ip && m.ev.ctx != nil {
+				m.checkCancelled(f)
+			}
+			f.ip = in.a
+		case opJumpIfFalse:
+			if !m.pop().isTruthy() {
+				f.ip = in.a
+			}
+		case opIterStart:
+			val := m.pop()
+			it := iterator{tag: val.Tag}
+			switch val.Tag {
+			case ValArray:
+				it.items = *val.Array
+			case ValRange:
+				rng := *val.Range
+				it.rng = &rng
+			case ValQueue:
+				it.items = val.queue().values()
+			case ValIter:
+				it.next = val.iter().start()
+			case ValSet:
+				it.members = val.setMembers()
+			case ValMap:
+				it.m = *val.Map
+				it.keys = make([]MapKey, 0, len(it.m))
+				for key := range it.m {
+					it.keys = append(it.keys, key)
+				}
+			default:
+				panic(m.fail(f, "%s is not iterable", val.Tag.String()))
+			}
+			m.iters = append(m.iters, it)
+		case opIterNext:
+			item, index, ok := m.iters[len(m.iters)-1].step(m.ev)
+			if !ok {
+				f.ip = in.c
+				continue
+			}
+			if in.a >= 0 {
+				m.stack[f.base+in.a] = item
+			}
+			if in.b >= 0 {
+				m.stack[f.base+in.b] = index
+			}
+		case opIterEnd:
+			m.iters = m.iters[:len(m.iters)-1]
+		case opMatchIndex:
+			candidate := m.stack[f.base+in.a]
+			if candidate.Tag != ValArray || in.b >= len(*candidate.Array) {
+				f.ip = in.c
+			}
+		case opMatchItem:
+			val := m.pop()
+			candidate := m.stack[f.base+in.a]
+			eq, err := (*candidate.Array)[in.b].Compare(val)
+			if err != nil {
+				panic(err)
+			}
+			if !eq {
+				f.ip = in.c
+			}
+		case opMatchBind:
+			candidate := m.stack[f.base+in.a]
+			m.stack[f.base+in.c] = (*candidate.Array)[in.b]
+		case opMatchValue:
+			val := m.pop()
+			candidate := m.stack[f.base+in.a]
+			if candidate.Tag != val.Tag {
+				f.ip = in.c
+				continue
+			}
+			eq, err := candidate.Compare(val)
+			if err != nil {
+				panic(m.fail(f, "%s", err))
+			}
+			if !eq {
+				f.ip = in.c
+			}
+		case opError:
+			panic(m.fail(f, "%s", f.chunk.consts[in.a].Str))
+		default:
+			panic(fmt.Sprintf("unknown opcode %d", in.op))
+		}
+	}
+}
+
+// step returns the next item and index, the same ones the evaluator's for
+// loops give, or false when there are none left
+func (it *iterator) step(ev *Evaluator) (Value, Value, bool) {
+	switch it.tag {
+	case ValArray, ValQueue:
+		if it.index >= len(it.items) {
+			return NilValue, NilValue, false
+		}
+		it.index++
+		return it.items[it.index-1], Value{Tag: ValNum, Num: it.index - 1}, true
+	case ValRange:
+		if it.started {
+			it.rng.next()
+		}
+		it.started = true
+		if it.rng.done() {
+			return NilValue, NilValue, false
+		}
+		i := Value{Tag: ValNum, Num: it.rng.current}
+		return i, i, true
+	case ValIter:
+		item, ok := it.next(ev)
+		if !ok {
+			return NilValue, NilValue, false
+		}
+		it.index++
+		return item, Value{Tag: ValNum, Num: it.index - 1}, true
+	case ValSet:
+		if it.index >= len(it.members) {
+			return NilValue, NilValue, false
+		}
+		it.index++
+		return it.members[it.index-1], Value{Tag: ValNum, Num: it.index - 1}, true
+	case ValMap:
+		// skip keys deleted since the loop started, like ranging over the
+		// map would
+		for it.index < len(it.keys) {
+			key := it.keys[it.index]
+			it.index++
+			if val, present := it.m[key]; present {
+				return key.Value(), val, true
+			}
+		}
+	}
+	return NilValue, NilValue, false
+}
@@ -16,6 +16,8 @@ syn keyword aocKw var
 syn keyword aocKw continue
 syn keyword aocKw break
 syn keyword aocKw match
+syn keyword aocKw try
+syn keyword aocKw catch
 
 syn keyword aocFn print
 syn keyword aocFn push
@@ -24,6 +26,27 @@ syn keyword aocFn len
 syn keyword aocFn split
 syn keyword aocFn read
 syn keyword aocFn num
+syn keyword aocFn assert
+syn keyword aocFn error
+syn keyword aocFn copy
+syn keyword aocFn set
+syn keyword aocFn add
+syn keyword aocFn has
+syn keyword aocFn union
+syn keyword aocFn intersect
+syn keyword aocFn difference
+syn keyword aocFn parse_grid
+syn keyword aocFn neighbors4
+syn keyword aocFn neighbors8
+syn keyword aocFn in_bounds
+syn keyword aocFn heap
+syn keyword aocFn heap_push
+syn keyword aocFn heap_pop
+syn keyword aocFn queue
+syn keyword aocFn q_push
+syn keyword aocFn q_pop_front
+syn keyword aocFn q_pop_back
+syn keyword aocFn memo
 
 hi def link aocComment  Comment
 hi def link aocLabel    Label